@@ -0,0 +1,102 @@
+package dada
+
+import (
+	"context"
+	"fmt"
+	"github.com/DataDog/datadog-go/statsd"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DrainingGauge = "Draining"
+
+var ErrDraining = fmt.Errorf("the service is draining")
+
+// The drain mode for zero-downtime deploys: once the service starts draining,
+// the readiness checks start failing so the load balancer stops routing new
+// traffic, but the requests are still served.
+type DrainController struct {
+	sink statsd.ClientInterface
+
+	once     sync.Once
+	draining chan struct{}
+}
+
+// The controller used by the readiness checks by default
+var DefaultDrainController = NewDrainController(nil)
+
+func NewDrainController(sink statsd.ClientInterface) *DrainController {
+	if sink == nil {
+		sink = &statsd.NoOpClient{}
+	}
+	return &DrainController{
+		sink:     sink,
+		draining: make(chan struct{}),
+	}
+}
+
+// Switch into the drain mode, this can't be undone. Repeated calls are no-ops.
+func (d *DrainController) EnterDrain() {
+	d.once.Do(func() {
+		close(d.draining)
+		_ = d.sink.Gauge(DrainingGauge, 1, nil, 1)
+	})
+}
+
+// The channel is closed when the service starts draining
+func (d *DrainController) Draining() <-chan struct{} {
+	return d.draining
+}
+
+func (d *DrainController) IsDraining() bool {
+	select {
+	case <-d.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// The readiness check: returns ErrDraining if the service is draining
+func (d *DrainController) Ready() error {
+	if d.IsDraining() {
+		return ErrDraining
+	}
+	return nil
+}
+
+// The readiness endpoint handler, it returns 503 once the service is draining.
+// The Draining gauge is reported on each check.
+func (d *DrainController) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.IsDraining() {
+			_ = d.sink.Gauge(DrainingGauge, 1, nil, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("draining"))
+			return
+		}
+		_ = d.sink.Gauge(DrainingGauge, 0, nil, 1)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+// Drain the server and shut it down: enter the drain mode, keep serving the
+// traffic for the grace period so that the load balancer deregisters the
+// service, and then gracefully shut the server down. The context limits the
+// whole process.
+func ShutdownGracefully(ctx context.Context, server *http.Server,
+	drain *DrainController, grace time.Duration) error {
+
+	drain.EnterDrain()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	return server.Shutdown(ctx)
+}
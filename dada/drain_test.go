@@ -0,0 +1,67 @@
+package dada
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDrainController(t *testing.T) {
+	dc := NewDrainController(nil)
+	assert.NoError(t, dc.Ready())
+
+	rec := httptest.NewRecorder()
+	dc.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	dc.EnterDrain()
+	dc.EnterDrain()
+	assert.Equal(t, ErrDraining, dc.Ready())
+	<-dc.Draining()
+
+	rec = httptest.NewRecorder()
+	dc.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestShutdownGracefully(t *testing.T) {
+	dc := NewDrainController(nil)
+
+	router := mux.NewRouter()
+	router.Path("/ready").Handler(dc.ReadinessHandler())
+	router.Path("/work").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	server := ServerWithDefenseAgainstDarkArts(1000, time.Second, router)
+
+	listener, port, err := utils.GetFreeListener()
+	assert.NoError(t, err)
+	go func() { _ = server.Serve(listener) }()
+	base := "http://127.0.0.1:" + strconv.Itoa(port)
+
+	done := make(chan error)
+	go func() {
+		done <- ShutdownGracefully(context.Background(), server, dc, 300*time.Millisecond)
+	}()
+	<-dc.Draining()
+
+	// The traffic is still served during the grace period, but not the readiness
+	resp, err := http.Get(base + "/ready")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	_ = resp.Body.Close()
+	resp, err = http.Get(base + "/work")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	assert.NoError(t, <-done)
+	_, err = http.Get(base + "/work")
+	assert.Error(t, err)
+}
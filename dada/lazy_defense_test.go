@@ -76,26 +76,14 @@ func TestSlowLoris(t *testing.T) {
 	//noinspection GoUnhandledErrorResult
 	defer server.Shutdown(context.Background())
 
-	port, err := utils.GetFreeTcpPort()
+	// The listener is already bound, so the server is online right away
+	listener, port, err := utils.GetFreeListener()
 	assert.NoError(t, err)
 	addr := fmt.Sprintf("[::0]:%d", port)
-
-	// Start the server
 	go func() {
-		server.Addr = addr
-		_ = server.ListenAndServe()
+		_ = server.Serve(listener)
 	}()
 
-	// Wait for the connection to become online
-	for ;; {
-		conn, err := net.Dial("tcp", addr)
-		if err == nil {
-			_ = conn.Close()
-			break
-		}
-		time.Sleep(10 * time.Millisecond)
-	}
-
 	// A regular-speed request works fine
 	err = testReq(addr, t, 0)
 	assert.NoError(t, err)
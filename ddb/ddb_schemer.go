@@ -2,17 +2,26 @@ package ddb
 
 import (
 	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
 	. "github.com/cyberax/go-dd-service-base/visibility"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"sort"
 	"strings"
 	"time"
 )
 
+// The interval of polling for the GSI creation progress
+var gsiPollInterval = 2 * time.Second
+
 type DynamoDbSchemer struct {
 	Suffix    string
 	AwsConfig aws.Config
 	TestMode  bool
+
+	// Sample the existing items in the TTL-enabled tables and warn if their
+	// TTL values look like epoch milliseconds
+	ValidateTtl bool
 }
 
 func NewDynamoDbSchemer(suffix string, config aws.Config, testMode bool) *DynamoDbSchemer {
@@ -62,6 +71,12 @@ func (db *DynamoDbSchemer) InitSchema(ctx context.Context, tablesToCreate []Tabl
 			if err != nil {
 				return err
 			}
+			if db.ValidateTtl {
+				err = db.validateTtlValues(ctx, svc, t.Name+db.Suffix, t.TtlFieldName)
+				if err != nil {
+					return err
+				}
+			}
 			err = db.ensureGsiIsCreated(ctx, svc, t.Name+db.Suffix, t.GSI)
 			if err != nil {
 				return err
@@ -185,47 +200,54 @@ func (db *DynamoDbSchemer) ensureGsiIsCreated(ctx context.Context, client *dynam
 		existing[*i.IndexName] = 1
 	}
 
-	var updates []dynamodb.GlobalSecondaryIndexUpdate
-	var attrDefs []dynamodb.AttributeDefinition
-	for idxName, idxColumn := range gsi {
+	// DynamoDB allows only one GSI creation in progress per table, so the GSIs
+	// are created one by one (in the name order, to be predictable)
+	var missing []string
+	for idxName := range gsi {
 		if _, ok := existing[idxName]; ok {
 			CLS(ctx).Infof("GSI %s exists for %s", idxName, tableName)
 			continue
 		}
+		missing = append(missing, idxName)
+	}
+	sort.Strings(missing)
 
-		updates = append(updates, dynamodb.GlobalSecondaryIndexUpdate{
-			Create: &dynamodb.CreateGlobalSecondaryIndexAction{
-				IndexName: aws.String(idxName),
-				KeySchema: []dynamodb.KeySchemaElement{{
-					AttributeName: aws.String(idxColumn),
-					KeyType:       dynamodb.KeyTypeHash,
-				}},
-				Projection: &dynamodb.Projection{
-					ProjectionType: dynamodb.ProjectionTypeAll,
-				},
-				ProvisionedThroughput: db.getDefIops(),
-			},
-		})
-		attrDefs = append(attrDefs, dynamodb.AttributeDefinition{
-			AttributeName: aws.String(idxColumn), AttributeType: "S"})
+	// Wait for the GSIs that might be still in progress
+	err = db.waitForGsi(ctx, client, tableName)
+	if err != nil {
+		return err
 	}
 
-	if len(updates) != 0 {
-		CLS(ctx).Infof("Creating GSIs for %s", tableName)
+	for _, idxName := range missing {
+		idxColumn := gsi[idxName]
+		CLS(ctx).Infof("Creating GSI %s for %s", idxName, tableName)
 
 		_, err := client.UpdateTableRequest(&dynamodb.UpdateTableInput{
-			TableName:                   aws.String(tableName),
-			GlobalSecondaryIndexUpdates: updates,
-			AttributeDefinitions:        attrDefs,
+			TableName: aws.String(tableName),
+			GlobalSecondaryIndexUpdates: []dynamodb.GlobalSecondaryIndexUpdate{{
+				Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+					IndexName: aws.String(idxName),
+					KeySchema: []dynamodb.KeySchemaElement{{
+						AttributeName: aws.String(idxColumn),
+						KeyType:       dynamodb.KeyTypeHash,
+					}},
+					Projection: &dynamodb.Projection{
+						ProjectionType: dynamodb.ProjectionTypeAll,
+					},
+					ProvisionedThroughput: db.getDefIops(),
+				},
+			}},
+			AttributeDefinitions: []dynamodb.AttributeDefinition{{
+				AttributeName: aws.String(idxColumn), AttributeType: "S"}},
 		}).Send(ctx)
 		if err != nil {
 			return err
 		}
-	}
 
-	err = db.waitForGsi(ctx, client, tableName)
-	if err != nil {
-		return err
+		err = db.waitForGsi(ctx, client, tableName)
+		if err != nil {
+			return err
+		}
 	}
 
 	CLS(ctx).Infof("GSI are up-to-date for %s", tableName)
@@ -246,20 +268,23 @@ func (db *DynamoDbSchemer) waitForGsi(ctx context.Context,
 			return err
 		}
 
-		hasPendingChanges = false
-		for _, i := range response.DescribeTableOutput.Table.GlobalSecondaryIndexes {
+		// The table is UPDATING until the GSI backfill is done
+		table := response.DescribeTableOutput.Table
+		hasPendingChanges = table.TableStatus == dynamodb.TableStatusUpdating
+		for _, i := range table.GlobalSecondaryIndexes {
 			if i.IndexStatus == dynamodb.IndexStatusCreating {
 				hasPendingChanges = true
-
-				// Wait a bit before the retry
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				case <-time.NewTimer(2 * time.Second).C:
-				}
 				break
 			}
 		}
+
+		if hasPendingChanges {
+			// Wait a bit before the retry
+			err = utils.ClockFromContext(ctx).Sleep(ctx, gsiPollInterval)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
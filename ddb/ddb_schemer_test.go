@@ -2,12 +2,15 @@ package ddb
 
 import (
 	"context"
-	"github.com/cyberax/go-dd-service-base/visibility"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"testing"
+	"time"
 )
 
 func TestSchemer(t *testing.T) {
@@ -68,3 +71,99 @@ func TestSchemer(t *testing.T) {
 	assert.Equal(t, "world", *idxResp.Items[0]["value"].S)
 	assert.Equal(t, "hello", *idxResp.Items[0]["id"].S)
 }
+
+func TestSchemerMultipleGsi(t *testing.T) {
+	ddb := NewDdbTestContext(t, "../assets/localddb", false)
+	defer ddb.Close()
+
+	ctx := visibility.ImbueContext(context.Background(), zap.NewNop())
+
+	schemer := NewDynamoDbSchemer("_suffix", ddb.Config, true)
+	tables := []Table{{
+		Name:        "users",
+		HashKeyName: "id",
+		GSI:         map[string]string{"email-index": "email", "login-index": "login"},
+	}}
+	assert.NoError(t, schemer.InitSchema(ctx, tables))
+
+	resp, err := ddb.Conn.DescribeTableRequest(&dynamodb.DescribeTableInput{
+		TableName: aws.String("users_suffix"),
+	}).Send(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(resp.Table.GlobalSecondaryIndexes))
+	for _, idx := range resp.Table.GlobalSecondaryIndexes {
+		assert.Equal(t, dynamodb.IndexStatusActive, idx.IndexStatus)
+	}
+}
+
+// Emulates the DynamoDB limit of one GSI creation at a time
+type gsiLimitedTable struct {
+	indexes []dynamodb.GlobalSecondaryIndexDescription
+	updates int
+}
+
+// noinspection GoUnusedParameter
+func (g *gsiLimitedTable) DescribeTable(ctx context.Context,
+	input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+
+	res := &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{
+		TableName:   input.TableName,
+		TableStatus: dynamodb.TableStatusActive,
+		GlobalSecondaryIndexes: append([]dynamodb.GlobalSecondaryIndexDescription(nil),
+			g.indexes...),
+	}}
+	// The index becomes active after being seen as CREATING once
+	for i := range g.indexes {
+		if g.indexes[i].IndexStatus == dynamodb.IndexStatusCreating {
+			res.Table.TableStatus = dynamodb.TableStatusUpdating
+			g.indexes[i].IndexStatus = dynamodb.IndexStatusActive
+		}
+	}
+	return res, nil
+}
+
+// noinspection GoUnusedParameter
+func (g *gsiLimitedTable) UpdateTable(ctx context.Context,
+	input *dynamodb.UpdateTableInput) (*dynamodb.UpdateTableOutput, error) {
+
+	g.updates++
+	if len(input.GlobalSecondaryIndexUpdates) != 1 {
+		return nil, awserr.New(dynamodb.ErrCodeLimitExceededException,
+			"only one GSI can be created at a time", nil)
+	}
+	for _, idx := range g.indexes {
+		if idx.IndexStatus == dynamodb.IndexStatusCreating {
+			return nil, awserr.New(dynamodb.ErrCodeLimitExceededException,
+				"a GSI is already being created", nil)
+		}
+	}
+	g.indexes = append(g.indexes, dynamodb.GlobalSecondaryIndexDescription{
+		IndexName:   input.GlobalSecondaryIndexUpdates[0].Create.IndexName,
+		IndexStatus: dynamodb.IndexStatusCreating,
+	})
+	return &dynamodb.UpdateTableOutput{}, nil
+}
+
+func TestGsiCreatedOneByOne(t *testing.T) {
+	gsiPollInterval = time.Millisecond
+	defer func() {
+		gsiPollInterval = 2 * time.Second
+	}()
+
+	table := &gsiLimitedTable{}
+	am := utils.NewAwsMockHandler()
+	am.AddHandler(table)
+
+	ctx := visibility.ImbueContext(context.Background(), zap.NewNop())
+	schemer := NewDynamoDbSchemer("_suffix", am.AwsConfig(), true)
+	err := schemer.ensureGsiIsCreated(ctx, dynamodb.New(am.AwsConfig()), "users_suffix",
+		map[string]string{"login-index": "login", "email-index": "email"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, table.updates)
+	assert.Equal(t, "email-index", *table.indexes[0].IndexName)
+	assert.Equal(t, "login-index", *table.indexes[1].IndexName)
+	for _, idx := range table.indexes {
+		assert.Equal(t, dynamodb.IndexStatusActive, idx.IndexStatus)
+	}
+}
@@ -1,17 +1,28 @@
 package ddb
 
 import (
+	"archive/tar"
 	"bufio"
-	"github.com/cyberax/go-dd-service-base/utils"
+	"compress/gzip"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/defaults"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"testing"
 )
 
+const LocalDdbDownloadUrl = "https://s3.us-west-2.amazonaws.com/dynamodb-local/dynamodb_local_latest.tar.gz"
+
+// A test harness running the local DynamoDB, use Config or Conn to access it
+// and Close() to shut it down.
 type TestContext struct {
 	Conn   *dynamodb.Client
 	Config aws.Config
@@ -19,13 +30,55 @@ type TestContext struct {
 	Port   uint16
 }
 
-//noinspection GoUnhandledErrorResult
+// The options of the local DynamoDB test harness
+type DdbTestOptions struct {
+	// The directory with DynamoDBLocal.jar
+	JarDir string
+	// Download the local DynamoDB into JarDir if it's not there
+	Download bool
+	// The URL of the local DynamoDB distribution, LocalDdbDownloadUrl by default
+	DownloadUrl string
+	// Store the data in this directory, so it's kept between runs. The data
+	// is kept in memory if this is empty.
+	DataDir string
+	// Fail the test if the local DynamoDB can't be launched, otherwise skip it
+	FailOnErr bool
+}
+
+// noinspection GoUnhandledErrorResult
 func (ctx *TestContext) Close() {
 	ctx.Ddb.Process.Kill()
 	ctx.Ddb.Wait()
 }
 
+// Launch the local DynamoDB from the ddbDir directory, with the data kept in memory
 func NewDdbTestContext(t *testing.T, ddbDir string, failOnErr bool) *TestContext {
+	return NewDdbTestContextWithOptions(t, DdbTestOptions{
+		JarDir:    ddbDir,
+		FailOnErr: failOnErr,
+	})
+}
+
+// Launch the local DynamoDB with the given options, optionally downloading it first.
+// The test is skipped if the local DynamoDB can't be launched, unless FailOnErr is set.
+func NewDdbTestContextWithOptions(t *testing.T, opts DdbTestOptions) *TestContext {
+	failer := t.SkipNow
+	if opts.FailOnErr {
+		failer = t.FailNow
+	}
+
+	if opts.Download {
+		url := opts.DownloadUrl
+		if url == "" {
+			url = LocalDdbDownloadUrl
+		}
+		err := downloadLocalDdb(opts.JarDir, url)
+		if err != nil {
+			t.Logf("Can't download DDB local: %s", err.Error())
+			failer()
+		}
+	}
+
 	// Get a free port
 	port, e := utils.GetFreeTcpPort()
 	if e != nil {
@@ -33,20 +86,19 @@ func NewDdbTestContext(t *testing.T, ddbDir string, failOnErr bool) *TestContext
 	}
 
 	// Try to launch the Local DDB
-	cmd := exec.Command("java", "-Xmx256m",
-		"-jar", "DynamoDBLocal.jar", "-inMemory", "-port", strconv.Itoa(port))
+	args := []string{"-Xmx256m", "-jar", "DynamoDBLocal.jar", "-port", strconv.Itoa(port)}
+	if opts.DataDir != "" {
+		args = append(args, "-dbPath", opts.DataDir)
+	} else {
+		args = append(args, "-inMemory")
+	}
+	cmd := exec.Command("java", args...)
 	out, _ := cmd.StdoutPipe()
 	cmd.Stderr = os.Stderr
-	cmd.Dir = ddbDir
+	cmd.Dir = opts.JarDir
 	cmd.Stdin = os.Stdin
 
 	e = cmd.Start()
-
-	failer := t.SkipNow
-	if failOnErr {
-		failer = t.FailNow
-	}
-
 	if e != nil {
 		t.Log("Can't launch DDB local")
 		failer()
@@ -55,12 +107,7 @@ func NewDdbTestContext(t *testing.T, ddbDir string, failOnErr bool) *TestContext
 	scanner := bufio.NewScanner(out)
 	scanner.Split(bufio.ScanWords)
 	var found = false
-	for {
-		scanner.Scan()
-		if scanner.Err() != nil {
-			t.Log("Can't launch DDB local")
-			failer()
-		}
+	for scanner.Scan() {
 		if scanner.Text() == "CorsParams:" {
 			found = true
 			break
@@ -69,6 +116,8 @@ func NewDdbTestContext(t *testing.T, ddbDir string, failOnErr bool) *TestContext
 
 	if !found {
 		t.Log("Failed to initialize the DDB")
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
 		failer()
 	}
 
@@ -90,3 +139,105 @@ func NewDdbTestContext(t *testing.T, ddbDir string, failOnErr bool) *TestContext
 		Port:   uint16(port),
 	}
 }
+
+// Download and unpack the local DynamoDB distribution, if it's not yet present.
+// The archive is downloaded into a temporary file first, and DynamoDBLocal.jar is
+// renamed into place last, so an interrupted download is retried on the next run.
+func downloadLocalDdb(dir, url string) error {
+	jarPath := filepath.Join(dir, "DynamoDBLocal.jar")
+	if _, err := os.Stat(jarPath); err == nil {
+		return nil
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	archiveFile, err := ioutil.TempFile(dir, "download-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer os.Remove(archiveFile.Name())
+	//noinspection GoUnhandledErrorResult
+	defer archiveFile.Close()
+
+	err = downloadTo(url, archiveFile)
+	if err != nil {
+		return err
+	}
+	_, err = archiveFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	gz, err := gzip.NewReader(archiveFile)
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewReader(gz)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeFile(target, archive)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The jar marks the complete distribution
+	err = os.Rename(jarPath+".tmp", jarPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no DynamoDBLocal.jar in the local DDB archive")
+	}
+	return err
+}
+
+func downloadTo(url string, dst io.Writer) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download the local DDB: %s", resp.Status)
+	}
+	_, err = io.Copy(dst, resp.Body)
+	return err
+}
+
+// Write the file via a temporary file, so that no truncated files are left. The
+// jar itself stays under the temporary name until the whole archive is unpacked.
+func writeFile(target string, src io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(target+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	if filepath.Base(target) == "DynamoDBLocal.jar" {
+		return nil
+	}
+	return os.Rename(target+".tmp", target)
+}
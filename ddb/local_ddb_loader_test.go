@@ -0,0 +1,114 @@
+package ddb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func makeDdbArchive(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for name, content := range map[string]string{
+		"DynamoDBLocal.jar":          "jar",
+		"DynamoDBLocal_lib/lib.jar":  "lib",
+		"third_party_licenses/a.txt": "license",
+	} {
+		assert.NoError(t, archive.WriteHeader(&tar.Header{Name: name,
+			Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+		_, err := archive.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, archive.Close())
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestDownloadLocalDdb(t *testing.T) {
+	archive := makeDdbArchive(t)
+	truncate := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if truncate {
+			_, _ = w.Write(archive[:len(archive)/2])
+		} else {
+			_, _ = w.Write(archive)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "ddblocal")
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer os.RemoveAll(dir)
+
+	// The truncated download leaves no jar behind, so it's retried next time
+	err = downloadLocalDdb(dir, srv.URL)
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "DynamoDBLocal.jar"))
+	assert.True(t, os.IsNotExist(err))
+
+	truncate = false
+	err = downloadLocalDdb(dir, srv.URL)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "DynamoDBLocal.jar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "jar", string(data))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "DynamoDBLocal_lib/lib.jar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "lib", string(data))
+
+	// No temporary files are left
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+	files, err = filepath.Glob(filepath.Join(dir, "download-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	// The complete distribution is not downloaded again
+	srv.Close()
+	err = downloadLocalDdb(dir, srv.URL)
+	assert.NoError(t, err)
+}
+
+func TestDdbDataDir(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "ddbdata")
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer os.RemoveAll(dataDir)
+
+	opts := DdbTestOptions{JarDir: "../assets/localddb", DataDir: dataDir}
+	ddb := NewDdbTestContextWithOptions(t, opts)
+	_, err = ddb.Conn.CreateTableRequest(&dynamodb.CreateTableInput{
+		TableName: aws.String("persisted"),
+		AttributeDefinitions: []dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: dynamodb.ScalarAttributeTypeS},
+		},
+		KeySchema: []dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: dynamodb.KeyTypeHash},
+		},
+		BillingMode: dynamodb.BillingModePayPerRequest,
+	}).Send(context.Background())
+	assert.NoError(t, err)
+	ddb.Close()
+
+	// The table survives the restart
+	ddb = NewDdbTestContextWithOptions(t, opts)
+	defer ddb.Close()
+	tables, err := ddb.Conn.ListTablesRequest(
+		&dynamodb.ListTablesInput{}).Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"persisted"}, tables.TableNames)
+}
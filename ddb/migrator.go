@@ -0,0 +1,188 @@
+package ddb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/cyberax/go-dd-service-base/utils"
+	. "github.com/cyberax/go-dd-service-base/visibility"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+// The default name of the table with the applied migrations, the schemer's
+// suffix is appended to it
+const DefaultMigrationsTable = "migrations"
+
+// The operation name of the migration runs
+const MigrationOpName = "DdbMigration"
+
+const (
+	MigrationIdTag         = "migration.id"
+	migrationStatusRunning = "running"
+	migrationStatusApplied = "applied"
+)
+
+// Another instance is running the migration, or it has crashed while running
+// it (its record then has to be deleted manually)
+var ErrMigrationInProgress = errors.New("the migration is in progress")
+
+// The versioned data migration (e.g. a backfill), it's run at most once
+type Migration struct {
+	// The unique id of the migration, e.g. "2020-10-01-backfill-owners"
+	Id string
+	Fn func(ctx context.Context) error
+}
+
+// Run the migrations once, recording the applied ones in the migrations table
+type Migrator struct {
+	Schemer *DynamoDbSchemer
+	// DefaultMigrationsTable if empty
+	TableName string
+	// Recorded in the migration records to find the instance that ran them,
+	// e.g. the host name
+	Owner string
+}
+
+func NewMigrator(schemer *DynamoDbSchemer, owner string) *Migrator {
+	return &Migrator{Schemer: schemer, Owner: owner}
+}
+
+func (m *Migrator) baseTableName() string {
+	if m.TableName == "" {
+		return DefaultMigrationsTable
+	}
+	return m.TableName
+}
+
+func (m *Migrator) tableName() string {
+	return m.baseTableName() + m.Schemer.Suffix
+}
+
+// Run the pending migrations in order, creating the migrations table if needed.
+// Each migration is claimed with a conditional write of its record, so the
+// concurrent instances never run the same migration twice: the instance that
+// loses the race stops with ErrMigrationInProgress. The failed migrations are
+// unclaimed, so they are retried on the next run, and the rest of the
+// migrations are not run.
+func (m *Migrator) Migrate(ctx context.Context, migrations []Migration) error {
+	seen := make(map[string]bool)
+	for _, mig := range migrations {
+		utils.PanicIfF(mig.Id == "" || seen[mig.Id], "bad or duplicate migration id: %q", mig.Id)
+		seen[mig.Id] = true
+	}
+
+	err := m.Schemer.InitSchema(ctx, []Table{{
+		Name:        m.baseTableName(),
+		HashKeyName: "id",
+	}})
+	if err != nil {
+		return err
+	}
+
+	svc := dynamodb.New(m.Schemer.AwsConfig)
+	for _, mig := range migrations {
+		status, err := m.getStatus(ctx, svc, mig.Id)
+		if err != nil {
+			return err
+		}
+		if status == migrationStatusApplied {
+			CL(ctx).Debug("Migration is already applied", zap.String("migration", mig.Id))
+			continue
+		}
+		if status == migrationStatusRunning {
+			return fmt.Errorf("%s: %w", mig.Id, ErrMigrationInProgress)
+		}
+
+		err = m.run(ctx, svc, mig)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) run(ctx context.Context, svc *dynamodb.Client, mig Migration) error {
+	clock := utils.ClockFromContext(ctx)
+
+	_, err := svc.PutItemRequest(&dynamodb.PutItemInput{
+		TableName: aws.String(m.tableName()),
+		Item: map[string]dynamodb.AttributeValue{
+			"id":        {S: aws.String(mig.Id)},
+			"status":    {S: aws.String(migrationStatusRunning)},
+			"owner":     {S: aws.String(m.Owner)},
+			"startedAt": {N: aws.String(strconv.FormatInt(clock.Now().Unix(), 10))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}).Send(ctx)
+	if isConditionFailed(err) {
+		return fmt.Errorf("%s: %w", mig.Id, ErrMigrationInProgress)
+	}
+	if err != nil {
+		return err
+	}
+
+	CL(ctx).Info("Running the migration", zap.String("migration", mig.Id))
+	err = RunInstrumented(ctx, MigrationOpName, func(xc context.Context) error {
+		AnnotateSpan(xc, MigrationIdTag, mig.Id)
+		xc = ImbueContext(xc, CL(xc).With(zap.String("migration", mig.Id)))
+		return InstrumentWithMetrics(xc, mig.Fn)
+	})
+	if err != nil {
+		// Unclaim the migration, so that it's retried
+		_, delErr := svc.DeleteItemRequest(&dynamodb.DeleteItemInput{
+			TableName: aws.String(m.tableName()),
+			Key:       map[string]dynamodb.AttributeValue{"id": {S: aws.String(mig.Id)}},
+		}).Send(ctx)
+		if delErr != nil {
+			CL(ctx).Error("Failed to unclaim the migration",
+				zap.String("migration", mig.Id), zap.Error(delErr))
+		}
+		return fmt.Errorf("migration %s failed: %w", mig.Id, err)
+	}
+
+	_, err = svc.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(m.tableName()),
+		Key:              map[string]dynamodb.AttributeValue{"id": {S: aws.String(mig.Id)}},
+		UpdateExpression: aws.String("SET #status = :applied, appliedAt = :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":applied": {S: aws.String(migrationStatusApplied)},
+			":now":     {N: aws.String(strconv.FormatInt(clock.Now().Unix(), 10))},
+		},
+	}).Send(ctx)
+	if err != nil {
+		return err
+	}
+	CL(ctx).Info("Migration is applied", zap.String("migration", mig.Id))
+	return nil
+}
+
+func (m *Migrator) getStatus(ctx context.Context, svc *dynamodb.Client,
+	id string) (string, error) {
+
+	resp, err := svc.GetItemRequest(&dynamodb.GetItemInput{
+		TableName:      aws.String(m.tableName()),
+		ConsistentRead: aws.Bool(true),
+		Key:            map[string]dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+	}).Send(ctx)
+	if err != nil {
+		return "", err
+	}
+	status, ok := resp.Item["status"]
+	if !ok || status.S == nil {
+		return "", nil
+	}
+	return *status.S, nil
+}
+
+func isConditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) &&
+		aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,117 @@
+package ddb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"testing"
+)
+
+// The in-memory migrations table, served by the AWS mock
+type fakeMigrationsTable struct {
+	items map[string]map[string]dynamodb.AttributeValue
+}
+
+func (f *fakeMigrationsTable) ListTables(ctx context.Context,
+	arg *dynamodb.ListTablesInput) (*dynamodb.ListTablesOutput, error) {
+	return &dynamodb.ListTablesOutput{TableNames: []string{"migrations_test"}}, nil
+}
+
+func (f *fakeMigrationsTable) GetItem(ctx context.Context,
+	arg *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.items[*arg.Key["id"].S]}, nil
+}
+
+func (f *fakeMigrationsTable) PutItem(ctx context.Context,
+	arg *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	id := *arg.Item["id"].S
+	if _, ok := f.items[id]; ok {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException,
+			"exists", nil)
+	}
+	f.items[id] = arg.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeMigrationsTable) UpdateItem(ctx context.Context,
+	arg *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.items[*arg.Key["id"].S]["status"] = arg.ExpressionAttributeValues[":applied"]
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeMigrationsTable) DeleteItem(ctx context.Context,
+	arg *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	delete(f.items, *arg.Key["id"].S)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func TestMigrator(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	table := &fakeMigrationsTable{items: map[string]map[string]dynamodb.AttributeValue{}}
+	am := utils.NewAwsMockHandler()
+	am.AddHandler(table)
+
+	ctx := visibility.ImbueContext(context.Background(), zap.NewNop())
+	migrator := NewMigrator(NewDynamoDbSchemer("_test", am.AwsConfig(), true), "host1")
+
+	var ran []string
+	failing := true
+	migrations := []Migration{
+		{Id: "first", Fn: func(ctx context.Context) error {
+			ran = append(ran, "first")
+			return nil
+		}},
+		{Id: "second", Fn: func(ctx context.Context) error {
+			ran = append(ran, "second")
+			if failing {
+				return fmt.Errorf("broken")
+			}
+			return nil
+		}},
+	}
+
+	// The failed migration is unclaimed
+	err := migrator.Migrate(ctx, migrations)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"first", "second"}, ran)
+	assert.Equal(t, "applied", *table.items["first"]["status"].S)
+	assert.Equal(t, "host1", *table.items["first"]["owner"].S)
+	assert.Nil(t, table.items["second"])
+
+	// Only the pending migrations are run
+	failing = false
+	err = migrator.Migrate(ctx, migrations)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "second", "second"}, ran)
+	assert.Equal(t, "applied", *table.items["second"]["status"].S)
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, "second", spans[2].Tag(MigrationIdTag))
+
+	// The migrations claimed by another instance are not run
+	table.items["third"] = map[string]dynamodb.AttributeValue{
+		"id": {S: aws.String("third")}, "status": {S: aws.String("running")}}
+	err = migrator.Migrate(ctx, append(migrations, Migration{Id: "third",
+		Fn: func(ctx context.Context) error {
+			ran = append(ran, "third")
+			return nil
+		}}))
+	assert.True(t, errors.Is(err, ErrMigrationInProgress))
+	assert.Equal(t, 3, len(ran))
+
+	// The duplicate ids are rejected
+	assert.Panics(t, func() {
+		_ = migrator.Migrate(ctx, append(migrations, migrations[0]))
+	})
+}
@@ -0,0 +1,194 @@
+package ddb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	. "github.com/cyberax/go-dd-service-base/visibility"
+	"reflect"
+)
+
+// Returned when the iteration is stopped by the budget while there are more pages
+var ErrPageBudgetExceeded = errors.New("the page budget is exceeded")
+
+// The limits for the paginated requests, zero values mean no limit
+type PageBudget struct {
+	MaxPages int
+	MaxItems int64
+}
+
+type pageInfo struct {
+	items            []map[string]dynamodb.AttributeValue
+	lastEvaluatedKey map[string]dynamodb.AttributeValue
+	count, scanned   int64
+	consumed         *dynamodb.ConsumedCapacity
+}
+
+// Iterate over the query pages, threading the ExclusiveStartKey. The iteration
+// stops when fn returns false or an error, or when there are no more pages.
+// The page statistics are recorded in the context's MetricsContext, if it exists.
+func QueryPages(ctx context.Context, client *dynamodb.Client, input *dynamodb.QueryInput,
+	fn func(page *dynamodb.QueryOutput) (continueIterating bool, err error)) error {
+
+	return QueryPagesWithBudget(ctx, client, input, PageBudget{}, fn)
+}
+
+func QueryPagesWithBudget(ctx context.Context, client *dynamodb.Client,
+	input *dynamodb.QueryInput, budget PageBudget,
+	fn func(page *dynamodb.QueryOutput) (continueIterating bool, err error)) error {
+
+	// Don't modify the caller's input
+	in := *input
+	return iteratePages(ctx, "Query", budget, func(startKey map[string]dynamodb.AttributeValue) (
+		pageInfo, bool, error) {
+
+		in.ExclusiveStartKey = startKey
+		resp, err := client.QueryRequest(&in).Send(ctx)
+		if err != nil {
+			return pageInfo{}, false, err
+		}
+		page := resp.QueryOutput
+		cont, err := fn(page)
+		return pageInfo{
+			items:            page.Items,
+			lastEvaluatedKey: page.LastEvaluatedKey,
+			count:            aws.Int64Value(page.Count),
+			scanned:          aws.Int64Value(page.ScannedCount),
+			consumed:         page.ConsumedCapacity,
+		}, cont, err
+	})
+}
+
+// Iterate over the scan pages, see QueryPages
+func ScanPages(ctx context.Context, client *dynamodb.Client, input *dynamodb.ScanInput,
+	fn func(page *dynamodb.ScanOutput) (continueIterating bool, err error)) error {
+
+	return ScanPagesWithBudget(ctx, client, input, PageBudget{}, fn)
+}
+
+func ScanPagesWithBudget(ctx context.Context, client *dynamodb.Client,
+	input *dynamodb.ScanInput, budget PageBudget,
+	fn func(page *dynamodb.ScanOutput) (continueIterating bool, err error)) error {
+
+	in := *input
+	return iteratePages(ctx, "Scan", budget, func(startKey map[string]dynamodb.AttributeValue) (
+		pageInfo, bool, error) {
+
+		in.ExclusiveStartKey = startKey
+		resp, err := client.ScanRequest(&in).Send(ctx)
+		if err != nil {
+			return pageInfo{}, false, err
+		}
+		page := resp.ScanOutput
+		cont, err := fn(page)
+		return pageInfo{
+			items:            page.Items,
+			lastEvaluatedKey: page.LastEvaluatedKey,
+			count:            aws.Int64Value(page.Count),
+			scanned:          aws.Int64Value(page.ScannedCount),
+			consumed:         page.ConsumedCapacity,
+		}, cont, err
+	})
+}
+
+// Query all the items into the slice pointed by out (e.g. *[]MyItem), stopping
+// once maxItems are read. Zero maxItems means no limit.
+func QueryAll(ctx context.Context, client *dynamodb.Client, input *dynamodb.QueryInput,
+	out interface{}, maxItems int) error {
+
+	collector, err := newItemCollector(out, maxItems)
+	if err != nil {
+		return err
+	}
+	return QueryPages(ctx, client, input, func(page *dynamodb.QueryOutput) (bool, error) {
+		return collector.add(page.Items)
+	})
+}
+
+// Scan all the items into the slice pointed by out, see QueryAll
+func ScanAll(ctx context.Context, client *dynamodb.Client, input *dynamodb.ScanInput,
+	out interface{}, maxItems int) error {
+
+	collector, err := newItemCollector(out, maxItems)
+	if err != nil {
+		return err
+	}
+	return ScanPages(ctx, client, input, func(page *dynamodb.ScanOutput) (bool, error) {
+		return collector.add(page.Items)
+	})
+}
+
+func iteratePages(ctx context.Context, opName string, budget PageBudget,
+	fetch func(startKey map[string]dynamodb.AttributeValue) (pageInfo, bool, error)) error {
+
+	met := TryGetMetricsFromContext(ctx)
+
+	var startKey map[string]dynamodb.AttributeValue
+	var pages int
+	var items int64
+	for {
+		if pages != 0 {
+			// Honor the cancellation between the pages
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		page, cont, err := fetch(startKey)
+		pages++
+		items += page.count
+		if met != nil {
+			met.AddCount("Ddb"+opName+"Pages", 1)
+			met.AddCount("Ddb"+opName+"Items", float64(page.count))
+			met.AddCount("Ddb"+opName+"ScannedItems", float64(page.scanned))
+			if page.consumed != nil {
+				met.AddMetric("Ddb"+opName+"ConsumedCapacity",
+					aws.Float64Value(page.consumed.CapacityUnits), cloudwatch.StandardUnitCount)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if !cont || len(page.lastEvaluatedKey) == 0 {
+			return nil
+		}
+		if (budget.MaxPages > 0 && pages >= budget.MaxPages) ||
+			(budget.MaxItems > 0 && items >= budget.MaxItems) {
+			return ErrPageBudgetExceeded
+		}
+		startKey = page.lastEvaluatedKey
+	}
+}
+
+type itemCollector struct {
+	slice    reflect.Value
+	maxItems int
+}
+
+func newItemCollector(out interface{}, maxItems int) (*itemCollector, error) {
+	val := reflect.ValueOf(out)
+	if val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("expected a pointer to a slice, got %T", out)
+	}
+	return &itemCollector{slice: val.Elem(), maxItems: maxItems}, nil
+}
+
+func (c *itemCollector) add(items []map[string]dynamodb.AttributeValue) (bool, error) {
+	if c.maxItems > 0 && c.slice.Len()+len(items) > c.maxItems {
+		items = items[:c.maxItems-c.slice.Len()]
+	}
+
+	page := reflect.New(c.slice.Type())
+	err := dynamodbattribute.UnmarshalListOfMaps(items, page.Interface())
+	if err != nil {
+		return false, err
+	}
+	c.slice.Set(reflect.AppendSlice(c.slice, page.Elem()))
+
+	return c.maxItems <= 0 || c.slice.Len() < c.maxItems, nil
+}
@@ -0,0 +1,109 @@
+package ddb
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+)
+
+type pagedItem struct {
+	Id    string `dynamodbav:"id"`
+	Range string `dynamodbav:"range"`
+}
+
+func TestPagination(t *testing.T) {
+	ddb := NewDdbTestContext(t, "../assets/localddb", false)
+	defer ddb.Close()
+
+	ctx := visibility.ImbueContext(context.Background(), zap.NewNop())
+	ctx = visibility.MakeMetricContext(ctx, "Test")
+
+	schemer := NewDynamoDbSchemer("_pages", ddb.Config, true)
+	err := schemer.InitSchema(ctx, []Table{{
+		Name: "items", HashKeyName: "id", RangeKeyName: "range"}})
+	assert.NoError(t, err)
+
+	for i := 0; i < 25; i++ {
+		_, err = ddb.Conn.PutItemRequest(&dynamodb.PutItemInput{
+			TableName: aws.String("items_pages"),
+			Item: map[string]dynamodb.AttributeValue{
+				"id":    {S: aws.String("hash")},
+				"range": {S: aws.String(fmt.Sprintf("%03d", i))},
+			},
+		}).Send(ctx)
+		assert.NoError(t, err)
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String("items_pages"),
+		KeyConditionExpression: aws.String("id = :id"),
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":id": {S: aws.String("hash")}},
+		Limit: aws.Int64(10),
+	}
+
+	// All the pages
+	pages, items := 0, 0
+	err = QueryPages(ctx, ddb.Conn, input, func(page *dynamodb.QueryOutput) (bool, error) {
+		pages++
+		items += len(page.Items)
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, pages)
+	assert.Equal(t, 25, items)
+	assert.Nil(t, input.ExclusiveStartKey)
+
+	met := visibility.GetMetricsFromContext(ctx)
+	assert.Equal(t, 3.0, met.GetMetricVal("DdbQueryPages"))
+	assert.Equal(t, 25.0, met.GetMetricVal("DdbQueryItems"))
+
+	// Early stop
+	pages = 0
+	err = ScanPages(ctx, ddb.Conn, &dynamodb.ScanInput{
+		TableName: aws.String("items_pages"), Limit: aws.Int64(10)},
+		func(page *dynamodb.ScanOutput) (bool, error) {
+			pages++
+			return false, nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pages)
+
+	// Budget
+	pages = 0
+	err = QueryPagesWithBudget(ctx, ddb.Conn, input, PageBudget{MaxPages: 2},
+		func(page *dynamodb.QueryOutput) (bool, error) {
+			pages++
+			return true, nil
+		})
+	assert.Equal(t, ErrPageBudgetExceeded, err)
+	assert.Equal(t, 2, pages)
+
+	// Typed variant with a cap
+	var res []pagedItem
+	err = QueryAll(ctx, ddb.Conn, input, &res, 15)
+	assert.NoError(t, err)
+	assert.Equal(t, 15, len(res))
+	assert.Equal(t, "014", res[14].Range)
+
+	var all []pagedItem
+	err = ScanAll(ctx, ddb.Conn, &dynamodb.ScanInput{
+		TableName: aws.String("items_pages"), Limit: aws.Int64(7)}, &all, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 25, len(all))
+
+	assert.Error(t, QueryAll(ctx, ddb.Conn, input, res, 0))
+
+	// Cancellation between pages
+	cancelCtx, cancel := context.WithCancel(ctx)
+	err = QueryPages(cancelCtx, ddb.Conn, input, func(page *dynamodb.QueryOutput) (bool, error) {
+		cancel()
+		return true, nil
+	})
+	assert.Equal(t, context.Canceled, err)
+}
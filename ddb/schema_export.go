@@ -0,0 +1,226 @@
+package ddb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The attributes used as keys, sorted by name for the stable output
+type attrDef struct {
+	Name string
+	Type string
+}
+
+type gsiDef struct {
+	Name    string
+	HashKey string
+}
+
+// The table definition as it's created by InitSchema. The tables are always
+// created with the PAY_PER_REQUEST billing, the TestMode throughput is only
+// needed for the local DynamoDB.
+type tableSpec struct {
+	Name       string
+	HashKey    string
+	RangeKey   string
+	TtlField   string
+	Attributes []attrDef
+	Indexes    []gsiDef
+}
+
+func (db *DynamoDbSchemer) makeTableSpec(t Table) (tableSpec, error) {
+	if t.Name == "" || t.HashKeyName == "" {
+		return tableSpec{}, fmt.Errorf("table %q must have a name and a hash key", t.Name)
+	}
+
+	spec := tableSpec{
+		Name:     t.Name + db.Suffix,
+		HashKey:  t.HashKeyName,
+		RangeKey: t.RangeKeyName,
+		TtlField: t.TtlFieldName,
+	}
+
+	attrs := map[string]bool{t.HashKeyName: true}
+	if t.RangeKeyName != "" {
+		attrs[t.RangeKeyName] = true
+	}
+	for idxName, idxColumn := range t.GSI {
+		spec.Indexes = append(spec.Indexes, gsiDef{Name: idxName, HashKey: idxColumn})
+		attrs[idxColumn] = true
+	}
+	sort.Slice(spec.Indexes, func(i, j int) bool {
+		return spec.Indexes[i].Name < spec.Indexes[j].Name
+	})
+	for a := range attrs {
+		// All the keys are created as strings
+		spec.Attributes = append(spec.Attributes, attrDef{Name: a, Type: "S"})
+	}
+	sort.Slice(spec.Attributes, func(i, j int) bool {
+		return spec.Attributes[i].Name < spec.Attributes[j].Name
+	})
+
+	return spec, nil
+}
+
+// Make the CloudFormation logical ID or the Terraform resource name
+// from the table name: only alphanumeric characters are allowed there
+func resourceId(name string, capitalize bool) string {
+	var res strings.Builder
+	upNext := capitalize
+	for _, r := range name {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			upNext = capitalize
+			if !capitalize {
+				res.WriteRune('_')
+			}
+			continue
+		}
+		if upNext {
+			r = unicode.ToUpper(r)
+			upNext = false
+		}
+		res.WriteRune(r)
+	}
+	return res.String()
+}
+
+// Render the tables as a CloudFormation template, with the same definitions
+// that InitSchema uses. This allows to review the schema changes through IaC.
+func (db *DynamoDbSchemer) ExportCloudFormation(tables []Table) (string, error) {
+	resources := make(map[string]interface{})
+
+	for _, t := range tables {
+		spec, err := db.makeTableSpec(t)
+		if err != nil {
+			return "", err
+		}
+
+		var attrs []interface{}
+		for _, a := range spec.Attributes {
+			attrs = append(attrs, map[string]interface{}{
+				"AttributeName": a.Name, "AttributeType": a.Type})
+		}
+		keySchema := []interface{}{
+			map[string]interface{}{"AttributeName": spec.HashKey, "KeyType": "HASH"},
+		}
+		if spec.RangeKey != "" {
+			keySchema = append(keySchema, map[string]interface{}{
+				"AttributeName": spec.RangeKey, "KeyType": "RANGE"})
+		}
+
+		props := map[string]interface{}{
+			"TableName":            spec.Name,
+			"AttributeDefinitions": attrs,
+			"KeySchema":            keySchema,
+			"BillingMode":          string(dynamodb.BillingModePayPerRequest),
+		}
+
+		if len(spec.Indexes) != 0 {
+			var indexes []interface{}
+			for _, i := range spec.Indexes {
+				idx := map[string]interface{}{
+					"IndexName": i.Name,
+					"KeySchema": []interface{}{
+						map[string]interface{}{"AttributeName": i.HashKey, "KeyType": "HASH"},
+					},
+					"Projection": map[string]interface{}{"ProjectionType": "ALL"},
+				}
+				indexes = append(indexes, idx)
+			}
+			props["GlobalSecondaryIndexes"] = indexes
+		}
+
+		if spec.TtlField != "" {
+			props["TimeToLiveSpecification"] = map[string]interface{}{
+				"AttributeName": spec.TtlField,
+				"Enabled":       true,
+			}
+		}
+
+		id := resourceId(spec.Name, true) + "Table"
+		if _, ok := resources[id]; ok {
+			return "", fmt.Errorf("duplicate table resource %s", id)
+		}
+		resources[id] = map[string]interface{}{
+			"Type":       "AWS::DynamoDB::Table",
+			"Properties": props,
+		}
+	}
+
+	return marshalTemplate(map[string]interface{}{
+		"AWSTemplateFormatVersion": "2010-09-09",
+		"Resources":                resources,
+	})
+}
+
+// Render the tables as a Terraform JSON configuration (.tf.json), with the same
+// definitions that InitSchema uses.
+func (db *DynamoDbSchemer) ExportTerraformJSON(tables []Table) (string, error) {
+	resources := make(map[string]interface{})
+
+	for _, t := range tables {
+		spec, err := db.makeTableSpec(t)
+		if err != nil {
+			return "", err
+		}
+
+		var attrs []interface{}
+		for _, a := range spec.Attributes {
+			attrs = append(attrs, map[string]interface{}{"name": a.Name, "type": a.Type})
+		}
+
+		res := map[string]interface{}{
+			"name":         spec.Name,
+			"hash_key":     spec.HashKey,
+			"attribute":    attrs,
+			"billing_mode": string(dynamodb.BillingModePayPerRequest),
+		}
+		if spec.RangeKey != "" {
+			res["range_key"] = spec.RangeKey
+		}
+
+		if len(spec.Indexes) != 0 {
+			var indexes []interface{}
+			for _, i := range spec.Indexes {
+				idx := map[string]interface{}{
+					"name":            i.Name,
+					"hash_key":        i.HashKey,
+					"projection_type": "ALL",
+				}
+				indexes = append(indexes, idx)
+			}
+			res["global_secondary_index"] = indexes
+		}
+
+		if spec.TtlField != "" {
+			res["ttl"] = map[string]interface{}{
+				"attribute_name": spec.TtlField,
+				"enabled":        true,
+			}
+		}
+
+		id := resourceId(spec.Name, false)
+		if _, ok := resources[id]; ok {
+			return "", fmt.Errorf("duplicate table resource %s", id)
+		}
+		resources[id] = res
+	}
+
+	return marshalTemplate(map[string]interface{}{
+		"resource": map[string]interface{}{
+			"aws_dynamodb_table": resources,
+		},
+	})
+}
+
+func marshalTemplate(template map[string]interface{}) (string, error) {
+	res, err := json.MarshalIndent(template, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
@@ -0,0 +1,156 @@
+package ddb
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"sort"
+	"testing"
+)
+
+var exportTables = []Table{
+	{
+		Name:         "tokens",
+		HashKeyName:  "id",
+		TtlFieldName: "validUntil",
+		GSI:          map[string]string{"value-index": "value"},
+	},
+	{
+		Name:         "blobs",
+		RangeKeyName: "range",
+		HashKeyName:  "blobId",
+	},
+}
+
+type cfnTemplate struct {
+	Resources map[string]struct {
+		Type       string
+		Properties struct {
+			TableName              string
+			BillingMode            string
+			AttributeDefinitions   []struct{ AttributeName, AttributeType string }
+			KeySchema              []struct{ AttributeName, KeyType string }
+			GlobalSecondaryIndexes []struct {
+				IndexName string
+				KeySchema []struct{ AttributeName, KeyType string }
+			}
+			TimeToLiveSpecification *struct {
+				AttributeName string
+				Enabled       bool
+			}
+		}
+	}
+}
+
+func TestExportTerraform(t *testing.T) {
+	schemer := NewDynamoDbSchemer("-prod", aws.Config{}, false)
+	tf, err := schemer.ExportTerraformJSON(exportTables)
+	assert.NoError(t, err)
+
+	var parsed map[string]map[string]map[string]map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(tf), &parsed))
+	tokens := parsed["resource"]["aws_dynamodb_table"]["tokens_prod"]
+	assert.Equal(t, "tokens-prod", tokens["name"])
+	assert.Equal(t, "PAY_PER_REQUEST", tokens["billing_mode"])
+	assert.Equal(t, "id", tokens["hash_key"])
+	assert.Equal(t, map[string]interface{}{"attribute_name": "validUntil", "enabled": true},
+		tokens["ttl"])
+	assert.Equal(t, 2, len(tokens["attribute"].([]interface{})))
+
+	blobs := parsed["resource"]["aws_dynamodb_table"]["blobs_prod"]
+	assert.Equal(t, "range", blobs["range_key"])
+	assert.Nil(t, blobs["ttl"])
+
+	_, err = schemer.ExportCloudFormation([]Table{{Name: "nohash"}})
+	assert.Error(t, err)
+
+	// InitSchema creates the PAY_PER_REQUEST tables in the test mode as well
+	tf, err = NewDynamoDbSchemer("-test", aws.Config{}, true).ExportTerraformJSON(exportTables)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal([]byte(tf), &parsed))
+	tokens = parsed["resource"]["aws_dynamodb_table"]["tokens_test"]
+	assert.Equal(t, "PAY_PER_REQUEST", tokens["billing_mode"])
+	assert.Nil(t, tokens["read_capacity"])
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	ddb := NewDdbTestContext(t, "../assets/localddb", false)
+	defer ddb.Close()
+
+	ctx := visibility.ImbueContext(context.Background(), zap.NewNop())
+
+	schemer := NewDynamoDbSchemer("_export", ddb.Config, false)
+	err := schemer.InitSchema(ctx, exportTables)
+	assert.NoError(t, err)
+
+	cfn, err := schemer.ExportCloudFormation(exportTables)
+	assert.NoError(t, err)
+	var template cfnTemplate
+	assert.NoError(t, json.Unmarshal([]byte(cfn), &template))
+	assert.Equal(t, 2, len(template.Resources))
+
+	for _, res := range template.Resources {
+		assert.Equal(t, "AWS::DynamoDB::Table", res.Type)
+		props := res.Properties
+
+		desc, err := ddb.Conn.DescribeTableRequest(&dynamodb.DescribeTableInput{
+			TableName: aws.String(props.TableName)}).Send(ctx)
+		assert.NoError(t, err)
+		table := desc.Table
+
+		// The old local DynamoDB versions don't report the billing mode summary
+		billingMode := dynamodb.BillingModePayPerRequest
+		if table.BillingModeSummary != nil {
+			billingMode = table.BillingModeSummary.BillingMode
+		} else if table.ProvisionedThroughput != nil &&
+			aws.Int64Value(table.ProvisionedThroughput.ReadCapacityUnits) != 0 {
+			billingMode = dynamodb.BillingModeProvisioned
+		}
+		assert.Equal(t, string(billingMode), props.BillingMode)
+
+		var actualAttrs []string
+		for _, a := range table.AttributeDefinitions {
+			actualAttrs = append(actualAttrs, *a.AttributeName+":"+string(a.AttributeType))
+		}
+		sort.Strings(actualAttrs)
+		var exportedAttrs []string
+		for _, a := range props.AttributeDefinitions {
+			exportedAttrs = append(exportedAttrs, a.AttributeName+":"+a.AttributeType)
+		}
+		assert.Equal(t, actualAttrs, exportedAttrs)
+
+		assert.Equal(t, len(table.KeySchema), len(props.KeySchema))
+		for i, k := range table.KeySchema {
+			assert.Equal(t, *k.AttributeName, props.KeySchema[i].AttributeName)
+			assert.Equal(t, string(k.KeyType), props.KeySchema[i].KeyType)
+		}
+
+		assert.Equal(t, len(table.GlobalSecondaryIndexes), len(props.GlobalSecondaryIndexes))
+		for _, gsi := range table.GlobalSecondaryIndexes {
+			found := false
+			for _, exported := range props.GlobalSecondaryIndexes {
+				if exported.IndexName == *gsi.IndexName {
+					found = true
+					assert.Equal(t, *gsi.KeySchema[0].AttributeName,
+						exported.KeySchema[0].AttributeName)
+				}
+			}
+			assert.True(t, found)
+		}
+
+		ttl, err := ddb.Conn.DescribeTimeToLiveRequest(&dynamodb.DescribeTimeToLiveInput{
+			TableName: aws.String(props.TableName)}).Send(ctx)
+		assert.NoError(t, err)
+		if props.TimeToLiveSpecification != nil {
+			assert.Equal(t, props.TimeToLiveSpecification.AttributeName,
+				*ttl.TimeToLiveDescription.AttributeName)
+		} else {
+			assert.True(t, ttl.TimeToLiveDescription == nil ||
+				ttl.TimeToLiveDescription.TimeToLiveStatus == dynamodb.TimeToLiveStatusDisabled)
+		}
+	}
+}
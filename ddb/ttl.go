@@ -0,0 +1,90 @@
+package ddb
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	. "github.com/cyberax/go-dd-service-base/visibility"
+	"strconv"
+	"time"
+)
+
+// The epoch seconds values above this are in the year 5138, so they are
+// certainly the epoch milliseconds that DynamoDB never expires
+const maxTtlSeconds = 1e11
+
+// The number of items checked by the TTL validation in InitSchema
+const ttlSampleSize = 10
+
+// Make the TTL attribute value, always in epoch seconds
+func TTLValue(t time.Time) dynamodb.AttributeValue {
+	return dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.Unix(), 10))}
+}
+
+// Parse the TTL attribute value, the values that look like epoch milliseconds
+// are rejected
+func ParseTTL(av dynamodb.AttributeValue) (time.Time, error) {
+	if av.N == nil {
+		return time.Time{}, fmt.Errorf("TTL value is not a number")
+	}
+	secs, err := strconv.ParseFloat(*av.N, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad TTL value %s: %w", *av.N, err)
+	}
+	if secs > maxTtlSeconds {
+		return time.Time{}, fmt.Errorf("TTL value %s is not in epoch seconds", *av.N)
+	}
+	return time.Unix(int64(secs), 0), nil
+}
+
+// Check if the item is expired. DynamoDB deletes the expired items lazily, so they
+// can still be returned by reads. The items with missing or invalid TTL values
+// never expire, same as in DynamoDB.
+func IsExpired(item map[string]dynamodb.AttributeValue, ttlField string, now time.Time) bool {
+	av, ok := item[ttlField]
+	if !ok {
+		return false
+	}
+	ttl, err := ParseTTL(av)
+	if err != nil {
+		return false
+	}
+	return !ttl.After(now)
+}
+
+// Sample a few items and warn if their TTL values are not in epoch seconds
+func (db *DynamoDbSchemer) validateTtlValues(ctx context.Context, client *dynamodb.Client,
+	tableName string, ttlField string) error {
+
+	if ttlField == "" {
+		return nil
+	}
+
+	resp, err := client.ScanRequest(&dynamodb.ScanInput{
+		TableName:                aws.String(tableName),
+		Limit:                    aws.Int64(ttlSampleSize),
+		ProjectionExpression:     aws.String("#ttl"),
+		ExpressionAttributeNames: map[string]string{"#ttl": ttlField},
+	}).Send(ctx)
+	if err != nil {
+		return err
+	}
+
+	bad := 0
+	for _, item := range resp.Items {
+		av, ok := item[ttlField]
+		if !ok {
+			continue
+		}
+		if _, err := ParseTTL(av); err != nil {
+			bad++
+		}
+	}
+	if bad != 0 {
+		CLS(ctx).Warnf("Table %s has %d of %d sampled items with the TTL field %s "+
+			"not in epoch seconds, they will never expire", tableName, bad,
+			len(resp.Items), ttlField)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package ddb
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTLValues(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	av := TTLValue(now)
+	assert.Equal(t, "1600000000", *av.N)
+
+	parsed, err := ParseTTL(av)
+	assert.NoError(t, err)
+	assert.True(t, now.Equal(parsed))
+
+	// Milliseconds are rejected
+	_, err = ParseTTL(dynamodb.AttributeValue{N: aws.String("1600000000000")})
+	assert.Error(t, err)
+	_, err = ParseTTL(dynamodb.AttributeValue{S: aws.String("1600000000")})
+	assert.Error(t, err)
+
+	item := map[string]dynamodb.AttributeValue{"ttl": TTLValue(now)}
+	assert.True(t, IsExpired(item, "ttl", now))
+	assert.True(t, IsExpired(item, "ttl", now.Add(time.Second)))
+	assert.False(t, IsExpired(item, "ttl", now.Add(-time.Second)))
+	assert.False(t, IsExpired(item, "missing", now))
+	assert.False(t, IsExpired(map[string]dynamodb.AttributeValue{
+		"ttl": {N: aws.String("1600000000000")}}, "ttl", now))
+}
+
+func TestTTLValidation(t *testing.T) {
+	ddb := NewDdbTestContext(t, "../assets/localddb", false)
+	defer ddb.Close()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	ctx := visibility.ImbueContext(context.Background(), logger)
+
+	schemer := NewDynamoDbSchemer("_ttl", ddb.Config, true)
+	schemer.ValidateTtl = true
+	tables := []Table{{Name: "sessions", HashKeyName: "id", TtlFieldName: "expires"}}
+	assert.NoError(t, schemer.InitSchema(ctx, tables))
+
+	_, err := ddb.Conn.PutItemRequest(&dynamodb.PutItemInput{
+		TableName: aws.String("sessions_ttl"),
+		Item: map[string]dynamodb.AttributeValue{
+			"id":      {S: aws.String("good")},
+			"expires": TTLValue(time.Now()),
+		},
+	}).Send(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, schemer.InitSchema(ctx, tables))
+	assert.False(t, strings.Contains(sink.String(), "not in epoch seconds"))
+
+	_, err = ddb.Conn.PutItemRequest(&dynamodb.PutItemInput{
+		TableName: aws.String("sessions_ttl"),
+		Item: map[string]dynamodb.AttributeValue{
+			"id":      {S: aws.String("bad")},
+			"expires": {N: aws.String("1600000000000")},
+		},
+	}).Send(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, schemer.InitSchema(ctx, tables))
+	assert.True(t, strings.Contains(sink.String(), "1 of 2 sampled items"))
+}
@@ -0,0 +1,82 @@
+// The example service wiring the package together: the hardened HTTP server
+// with the drain controller, the echo API with the OAPI validation and the
+// tracing/metrics middleware, the traced DynamoDB and (optionally) Postgres
+// clients, and the ordered shutdown sequence.
+//
+// The service is configured with the environment variables:
+//
+//	DD_AGENT_HOST - the Datadog agent, the tracing is disabled if it's empty
+//	ENV - the environment name (default "dev")
+//	LISTEN_ADDR - the listen address (default ":8080")
+//	TABLE_SUFFIX - the suffix of the DynamoDB tables
+//	PG_CONN_STR - the Postgres connection string (optional)
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/cyberax/go-dd-service-base/visibility/zaputils"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const shutdownGrace = 10 * time.Second
+
+func envOrDefault(name, def string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return def
+}
+
+func main() {
+	logger := zaputils.ConfigureProdLogger()
+	ctx := context.Background()
+
+	client, err := visibility.SetupTracing(ctx, "fullservice",
+		envOrDefault("ENV", "dev"), logger)
+	if err != nil {
+		logger.Fatal("Failed to set up the tracing", zap.Error(err))
+	}
+
+	awsConfig, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		logger.Fatal("Failed to load the AWS config", zap.Error(err))
+	}
+
+	svc, err := NewService(ctx, Config{
+		Logger:         logger,
+		Statsd:         client,
+		AwsConfig:      awsConfig,
+		TableSuffix:    os.Getenv("TABLE_SUFFIX"),
+		PgConnStr:      os.Getenv("PG_CONN_STR"),
+		MaxRequestSize: 1024 * 1024,
+		RequestTimeout: 30 * time.Second,
+	})
+	if err != nil {
+		logger.Fatal("Failed to create the service", zap.Error(err))
+	}
+	svc.Server.Addr = envOrDefault("LISTEN_ADDR", ":8080")
+
+	go func() {
+		logger.Info("Starting the server", zap.String("addr", svc.Server.Addr))
+		err := svc.Server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logger.Fatal("Failed to serve", zap.Error(err))
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	logger.Info("Shutting down", zap.String("signal", sig.String()))
+
+	if err = svc.ShutdownSequence(shutdownGrace).Run(ctx); err != nil {
+		os.Exit(1)
+	}
+}
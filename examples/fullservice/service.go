@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/cyberax/go-dd-service-base/dada"
+	"github.com/cyberax/go-dd-service-base/ddb"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/cyberax/go-dd-service-base/visibility/oapi"
+	"github.com/cyberax/go-dd-service-base/visibility/tracedaws"
+	"github.com/cyberax/go-dd-service-base/visibility/tracedsql"
+	"github.com/gorilla/mux"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+// The API of the example service, the operation IDs are the metric prefixes
+const spec = `
+{
+  "openapi": "3.0.0",
+  "info": {"version": "1.0.0", "title": "Full service example"},
+  "paths": {
+    "/api/items/{id}": {
+      "get": {
+        "operationId": "getItem",
+        "parameters": [{
+          "name": "id", "in": "path", "required": true,
+          "schema": {"type": "string", "maxLength": 64}
+        }],
+        "responses": {
+          "200": {"description": "The item"},
+          "404": {"description": "No such item"}
+        }
+      }
+    }
+  }
+}
+`
+
+// The table with the items, the schemer's suffix is appended to it
+const ItemsTable = "items"
+
+// The count of the items found by getItem
+const ItemsFoundMetric = "ItemsFound"
+
+type Config struct {
+	Logger    *zap.Logger
+	Statsd    statsd.ClientInterface
+	AwsConfig aws.Config
+	// The suffix of the DynamoDB tables, e.g. "_prod"
+	TableSuffix string
+	// The Postgres connection string (see tracedsql.MakePgConnector), the
+	// database is not used if it's empty
+	PgConnStr string
+
+	MaxRequestSize int
+	RequestTimeout time.Duration
+}
+
+// The composition of the service: the echo API with the OAPI validation behind
+// the hardened server, the DynamoDB tables and the background processes
+type Service struct {
+	Config   Config
+	Registry *visibility.ProcessRegistry
+	Drain    *dada.DrainController
+	Echo     *echo.Echo
+	Router   *mux.Router
+	Server   *http.Server
+	Dynamo   *dynamodb.Client
+	Db       *sql.DB
+}
+
+func NewService(ctx context.Context, cfg Config) (*Service, error) {
+	ctx = visibility.ContextWithStatsd(visibility.ImbueContext(ctx, cfg.Logger), cfg.Statsd)
+
+	// Trace the AWS calls
+	tracedaws.InstrumentHandlers(&cfg.AwsConfig.Handlers)
+
+	schemer := ddb.NewDynamoDbSchemer(cfg.TableSuffix, cfg.AwsConfig, false)
+	err := schemer.InitSchema(ctx, []ddb.Table{{Name: ItemsTable, HashKeyName: "id"}})
+	if err != nil {
+		return nil, err
+	}
+
+	var db *sql.DB
+	if cfg.PgConnStr != "" {
+		connector, err := tracedsql.MakePgConnector(ctx, cfg.PgConnStr, "", cfg.AwsConfig,
+			tracedsql.WithMaxRows(10000))
+		if err != nil {
+			return nil, err
+		}
+		db = sql.OpenDB(connector)
+	}
+
+	svc := &Service{
+		Config:   cfg,
+		Registry: visibility.NewProcessRegistry(ctx),
+		Drain:    dada.NewDrainController(cfg.Statsd),
+		Echo:     echo.New(),
+		Router:   mux.NewRouter(),
+		Dynamo:   dynamodb.New(cfg.AwsConfig),
+		Db:       db,
+	}
+
+	swagger := oapi.MustLoadSpec([]byte(spec))
+	svc.Echo.HideBanner = true
+	svc.Echo.HidePort = true
+	svc.Echo.Use(oapi.TracingAndLoggingMiddlewareHook(oapi.TracingAndMetricsOptions{
+		Logger: cfg.Logger,
+		Statsd: cfg.Statsd,
+	}))
+	svc.Echo.Use(oapi.OapiRequestValidatorWithMetrics(swagger, "/", nil))
+	svc.Echo.GET("/api/items/:id", svc.getItem)
+
+	svc.Router.Handle("/ready", svc.Drain.ReadinessHandler())
+	svc.Router.PathPrefix("/api/").Handler(svc.Echo)
+	svc.Server = dada.ServerWithDefenseAgainstDarkArts(cfg.MaxRequestSize,
+		cfg.RequestTimeout, svc.Router)
+	return svc, nil
+}
+
+func (s *Service) getItem(c echo.Context) error {
+	ctx := c.Request().Context()
+	resp, err := s.Dynamo.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(ItemsTable + s.Config.TableSuffix),
+		Key: map[string]dynamodb.AttributeValue{
+			"id": {S: aws.String(c.Param("id"))},
+		},
+	}).Send(ctx)
+	if err != nil {
+		return err
+	}
+	if len(resp.Item) == 0 {
+		visibility.CL(ctx).Info("No such item", zap.String("id", c.Param("id")))
+		return echo.NewHTTPError(http.StatusNotFound, "no such item")
+	}
+
+	oapi.Metrics(c).AddCount(ItemsFoundMetric, 1)
+	return c.JSON(http.StatusOK, map[string]string{
+		"id":    aws.StringValue(resp.Item["id"].S),
+		"value": aws.StringValue(resp.Item["value"].S),
+	})
+}
+
+// Get the shutdown sequence of the service: drain it and shut the server down
+// (waiting for the grace period), then the default steps: stop the processes,
+// the tracing and the metrics, and sync the logger
+func (s *Service) ShutdownSequence(grace time.Duration) *visibility.ShutdownSequence {
+	seq := visibility.NewDefaultShutdownSequence(s.Config.Logger, s.Registry, s.Config.Statsd)
+	seq.Add("http server", visibility.ShutdownOrderProcesses-10, grace+s.Config.RequestTimeout,
+		func(ctx context.Context) error {
+			return dada.ShutdownGracefully(ctx, s.Server, s.Drain, grace)
+		})
+	if s.Db != nil {
+		seq.Add("database", visibility.ShutdownOrderProcesses+10, 0,
+			func(ctx context.Context) error {
+				return s.Db.Close()
+			})
+	}
+	return seq
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/cyberax/go-dd-service-base/ddb"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/utils/testutil"
+	"github.com/cyberax/go-dd-service-base/visibility/vistest"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The in-memory items table, served by the AWS mock
+type fakeItemsTable struct {
+	items map[string]string
+}
+
+func (f *fakeItemsTable) ListTables(ctx context.Context,
+	arg *dynamodb.ListTablesInput) (*dynamodb.ListTablesOutput, error) {
+	return &dynamodb.ListTablesOutput{TableNames: []string{"items_test"}}, nil
+}
+
+func (f *fakeItemsTable) GetItem(ctx context.Context,
+	arg *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	id := *arg.Key["id"].S
+	value, ok := f.items[id]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: map[string]dynamodb.AttributeValue{
+		"id":    {S: aws.String(id)},
+		"value": {S: aws.String(value)},
+	}}, nil
+}
+
+// Boot the service on a free port, returns its base URL
+func startService(t *testing.T, cfg Config) (*Service, string) {
+	cfg.MaxRequestSize = 1024 * 1024
+	cfg.RequestTimeout = 10 * time.Second
+
+	svc, err := NewService(context.Background(), cfg)
+	assert.NoError(t, err)
+
+	listener, port, err := utils.GetFreeListener()
+	assert.NoError(t, err)
+	go func() {
+		_ = svc.Server.Serve(listener)
+	}()
+	return svc, "http://localhost:" + strconv.Itoa(port)
+}
+
+func get(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+// Parse the JSON log lines
+func logLines(t *testing.T, sink *testutil.MemorySink) []map[string]interface{} {
+	var res []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(sink.String()), "\n") {
+		entry := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		res = append(res, entry)
+	}
+	return res
+}
+
+func findLogLine(lines []map[string]interface{}, msg string) map[string]interface{} {
+	for _, l := range lines {
+		if l["msg"] == msg {
+			return l
+		}
+	}
+	return nil
+}
+
+func TestFullService(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	am := utils.NewAwsMockHandler()
+	am.AddHandler(&fakeItemsTable{items: map[string]string{"abc": "hello"}})
+	sink, logger := testutil.NewMemorySinkLogger()
+	metrics := vistest.NewRecordingSink()
+
+	svc, url := startService(t, Config{
+		Logger:      logger,
+		Statsd:      metrics,
+		AwsConfig:   am.AwsConfig(),
+		TableSuffix: "_test",
+	})
+
+	// The ListTables of the schemer
+	assert.Equal(t, 1, len(mt.FinishedSpans()))
+	mt.Reset()
+
+	code, body := get(t, url+"/api/items/abc")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"id":"abc","value":"hello"}`, body)
+
+	// The request span is the parent of the DynamoDB span
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "dynamodb.command", spans[0].OperationName())
+	assert.Equal(t, "GetItem", spans[0].Tag("aws.operation"))
+	assert.Equal(t, spans[1].SpanID(), spans[0].ParentID())
+	assert.Equal(t, "oapi.GetItem", spans[1].Tag("resource.name"))
+
+	// The request's metrics
+	assert.Equal(t, 1.0, metrics.Distributions["GetItem."+ItemsFoundMetric])
+	assert.Equal(t, 1.0, metrics.Distributions["GetItem.Deps.dynamodb.Calls"])
+	assert.Equal(t, 1.0, metrics.Distributions["GetItem.Success"])
+	assert.Equal(t, 0.0, metrics.Distributions["GetItem.Fault"])
+	assert.Contains(t, metrics.Distributions, "GetItem.Time")
+
+	// The request's log entry is correlated with the trace
+	entry := findLogLine(logLines(t, sink), "Request finished")
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "/api/items/abc", entry["path"])
+		assert.Equal(t, "GetItem", entry["operation"])
+		assert.Equal(t, 200.0, entry["status"])
+		assert.NotEmpty(t, entry["request_id"])
+		assert.Equal(t, strconv.FormatUint(spans[1].TraceID(), 10), entry["dd.trace_id"])
+	}
+
+	// The unknown items and the invalid requests
+	code, _ = get(t, url+"/api/items/nope")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.NotNil(t, findLogLine(logLines(t, sink), "No such item"))
+	code, _ = get(t, url+"/api/items/"+strings.Repeat("a", 100))
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Shut everything down in order
+	code, _ = get(t, url+"/ready")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NoError(t, svc.ShutdownSequence(time.Millisecond).Run(context.Background()))
+	_, err := http.Get(url + "/ready")
+	assert.Error(t, err)
+}
+
+// The same over the DynamoDB Local, skipped if it's not available
+func TestFullServiceLocalDdb(t *testing.T) {
+	tc := ddb.NewDdbTestContext(t, "../../assets/localddb", false)
+	defer tc.Close()
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	_, logger := testutil.NewMemorySinkLogger()
+	metrics := vistest.NewRecordingSink()
+
+	svc, url := startService(t, Config{
+		Logger:      logger,
+		Statsd:      metrics,
+		AwsConfig:   tc.Config,
+		TableSuffix: "_test",
+	})
+	_, err := svc.Dynamo.PutItemRequest(&dynamodb.PutItemInput{
+		TableName: aws.String(ItemsTable + "_test"),
+		Item: map[string]dynamodb.AttributeValue{
+			"id":    {S: aws.String("abc")},
+			"value": {S: aws.String("hello")},
+		},
+	}).Send(context.Background())
+	assert.NoError(t, err)
+
+	code, body := get(t, url+"/api/items/abc")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"id":"abc","value":"hello"}`, body)
+	assert.Equal(t, 1.0, metrics.Distributions["GetItem."+ItemsFoundMetric])
+
+	assert.NoError(t, svc.ShutdownSequence(time.Millisecond).Run(context.Background()))
+}
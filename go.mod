@@ -6,6 +6,7 @@ require (
 	github.com/DataDog/datadog-go v3.3.1+incompatible
 	github.com/aws/aws-sdk-go-v2 v0.21.0
 	github.com/getkin/kin-openapi v0.20.0
+	github.com/ghodss/yaml v1.0.0
 	github.com/golang/protobuf v1.3.3 // indirect
 	github.com/google/uuid v1.1.1 // indirect
 	github.com/gorilla/mux v1.7.3
@@ -8,6 +8,9 @@ import (
 
 const (
 	logvalidateName = "logvalidate"
+	// Plugin option to disable imbuing the handler context with the service/method
+	// logger fields, e.g.: --twirpwrap_out=imbue_logger=false:.
+	imbueLoggerParam = "imbue_logger"
 )
 
 type Module struct {
@@ -30,12 +33,16 @@ func (m *Module) Execute(targets map[string]pgs.File, _ map[string]pgs.Package)
 
 	tpl := template.New("go")
 
+	imbueLogger, err := m.Parameters().BoolDefault(imbueLoggerParam, true)
+	m.CheckErr(err, "bad value of the imbue_logger parameter")
+
 	fns := pgsgo.InitContext(m.Parameters())
 	tpl.Funcs(map[string]interface{}{
 		"cmt":           pgs.C80,
 		"name":          fns.Name,
 		"pkg":           fns.PackageName,
 		"typ":           fns.Type,
+		"imbue":         func() bool { return imbueLogger },
 	})
 
 	template.Must(tpl.Parse(fileTpl))
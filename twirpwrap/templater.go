@@ -113,7 +113,14 @@ func (l *{{$lvName}}) {{$method.Name}}(ctx context.Context, in *{{$method.Input.
 		return nil, err
 	}
 
+{{ if imbue }}
+	// All the logs within the handler carry the method attribution
+	handlerCtx := visibility.ImbueContext(ctx, visibility.CL(ctx).With(
+		zap.String("service", "{{$service.Name}}"), zap.String("method", "{{$method.Name}}")))
+    res, err := l.Delegate.{{$method.Name}}(handlerCtx, in)
+{{ else }}
     res, err := l.Delegate.{{$method.Name}}(ctx, in)
+{{ end }}
 	if err == nil {
 		err = res.Validate()
 	}
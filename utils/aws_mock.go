@@ -4,13 +4,15 @@ import (
 	"context"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/defaults"
-	"reflect"
+	"github.com/cyberax/go-dd-service-base/utils/internal/awsdispatch"
 	"strings"
 )
 
+var ErrNoMockHandler = awsdispatch.ErrNoHandler
+
 type AwsMockHandler struct {
-	handlers []reflect.Value
-	functors []reflect.Value
+	dispatcher awsdispatch.Dispatcher
+	replayers  []*AwsReplayer
 }
 
 // Create an AWS mocker to use with the AWS services, it returns an instrumented
@@ -42,23 +44,29 @@ func (a *AwsMockHandler) AwsConfig() aws.Config {
 }
 
 func (a *AwsMockHandler) AddHandler(handlerObject interface {}) {
-	handler := reflect.ValueOf(handlerObject)
-	tp := handler.Type()
+	a.dispatcher.AddHandler(handlerObject)
+}
 
-	if handler.Kind() == reflect.Func {
-		PanicIfF(tp.NumOut() != 2 || tp.NumIn() != 2,
-			"handler must have signature of func(context.Context, <arg>)(<res>, error)")
-		a.functors = append(a.functors, handler)
-	} else {
-		PanicIfF(tp.NumMethod() == 0, "the handler must have invokable methods")
-		a.handlers = append(a.handlers, handler)
-	}
+// Serve the recorded interactions (see AwsRecorder) for the requests that are
+// not handled by the handlers
+func (a *AwsMockHandler) AddReplayer(replayer *AwsReplayer) {
+	a.replayers = append(a.replayers, replayer)
 }
 
 func (a *AwsMockHandler) requestHandler(request *aws.Request) {
 	request.Retryer = &aws.NoOpRetryer{}
 
-	res, err := a.invokeMethod(request.Context(), request.Params)
+	// The services add the per-request response handlers (e.g. the S3's
+	// CompleteMultipartUpload error check), and there is no response to handle
+	terminator := aws.NamedHandler{Name: "awsmock", Fn: func(request *aws.Request) {}}
+	for _, list := range []*aws.HandlerList{&request.Handlers.Unmarshal,
+		&request.Handlers.UnmarshalMeta, &request.Handlers.UnmarshalError,
+		&request.Handlers.ValidateResponse} {
+		list.Clear()
+		list.PushFrontNamed(terminator)
+	}
+
+	res, err := a.invokeMethod(request.Context(), request.Params, request.Data)
 	if err != nil {
 		request.Error = err
 	} else {
@@ -117,58 +125,30 @@ func vetoAfterOurHandlers(item aws.HandlerListRunItem) bool {
 }
 
 func (a *AwsMockHandler) invokeMethod(ctx context.Context,
-	params interface{}) (interface{}, error) {
+	params interface{}, output interface{}) (interface{}, error) {
 
-	for _, h := range a.handlers {
-		for i := 0; i < h.NumMethod(); i++ {
-			method := h.Method(i)
+	res, err := a.Invoke(ctx, params)
+	if err != ErrNoMockHandler {
+		return res, err
+	}
 
-			matched, res, err := tryInvoke(ctx, params, method)
+	// The replayers need the output structure to decode the recorded output
+	if output != nil {
+		for _, r := range a.replayers {
+			matched, err := r.Replay(params, output)
 			if matched {
-				return res, err
+				return output, err
 			}
 		}
 	}
-
-	for _, f := range a.functors {
-		matched, res, err := tryInvoke(ctx, params, f)
-		if matched {
-			return res, err
-		}
-	}
-
-	panic("could not find a handler")
+	panic(err.Error())
 }
 
-func tryInvoke(ctx context.Context, params interface{}, method reflect.Value) (
-	bool, interface{}, error) {
-
-	paramType := reflect.TypeOf(params)
-	errorType := reflect.TypeOf((*error)(nil)).Elem()
-	contextType := reflect.TypeOf((*context.Context)(nil)).Elem()
-
-	methodDesc := method.Type()
-	if methodDesc.NumIn() != 2 || methodDesc.NumOut() != 2 {
-		return false, nil, nil
-	}
-
-	if !contextType.ConvertibleTo(methodDesc.In(0)) {
-		return false, nil, nil
-	}
-	if !paramType.ConvertibleTo(methodDesc.In(1)) {
-		return false, nil, nil
-	}
-	if !methodDesc.Out(1).ConvertibleTo(errorType) {
-		return false, nil, nil
-	}
-
-	// It's our target!
-	res := method.Call([]reflect.Value{reflect.ValueOf(ctx),
-		reflect.ValueOf(params)})
-
-	if !res[1].IsNil() {
-		return true, nil, res[1].Interface().(error)
-	}
-
-	return true, res[0].Interface(), nil
+// Dispatch the typed operation input (e.g. *ec2.TerminateInstancesInput) to the
+// registered handlers, ErrNoMockHandler is returned if none matches. This does
+// not depend on the SDK's request pipeline, the mock for the middleware-based
+// (v1.x) SDK clients is in the utils/awsv2mock module.
+func (a *AwsMockHandler) Invoke(ctx context.Context,
+	params interface{}) (interface{}, error) {
+	return a.dispatcher.Invoke(ctx, params)
 }
@@ -53,7 +53,7 @@ func TestMockNotFound(t *testing.T) {
 
 	assert.Panics(t, func() {
 		_, _ = am.invokeMethod(context.Background(), &ec2.DescribeInstancesInput{
-			MaxResults: aws.Int64(11)})
+			MaxResults: aws.Int64(11)}, &ec2.DescribeInstancesOutput{})
 	}, "could not find a handler")
 }
 
@@ -100,3 +100,19 @@ func ExampleNewAwsMockHandler() {
 		InstanceIds: []string{"i-123"},
 	}).Send(context.Background())
 }
+
+func TestAwsMockInvoke(t *testing.T) {
+	am := NewAwsMockHandler()
+	am.AddHandler(func(ctx context.Context, arg *ec2.DescribeInstancesInput) (
+		*ec2.DescribeInstancesOutput, error) {
+		return &ec2.DescribeInstancesOutput{NextToken: arg.NextToken}, nil
+	})
+
+	res, err := am.Invoke(context.Background(), &ec2.DescribeInstancesInput{
+		NextToken: aws.String("token")})
+	assert.NoError(t, err)
+	assert.Equal(t, "token", *res.(*ec2.DescribeInstancesOutput).NextToken)
+
+	_, err = am.Invoke(context.Background(), &ec2.TerminateInstancesInput{})
+	assert.Equal(t, ErrNoMockHandler, err)
+}
@@ -0,0 +1,272 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The recorded AWS call, the Input and Output are the JSON-serialized
+// operation structures (e.g. ec2.DescribeInstancesInput)
+type AwsInteraction struct {
+	// The operation name made from the input type, e.g. "ec2.DescribeInstances"
+	Operation string
+	Input     json.RawMessage
+	Output    json.RawMessage   `json:",omitempty"`
+	Error     *RecordedAwsError `json:",omitempty"`
+}
+
+type RecordedAwsError struct {
+	Code       string `json:",omitempty"`
+	Message    string
+	StatusCode int    `json:",omitempty"`
+	RequestId  string `json:",omitempty"`
+}
+
+type AwsRecording struct {
+	Interactions []AwsInteraction
+}
+
+// Load the recording saved by the AwsRecorder
+func LoadAwsRecording(fileName string) (*AwsRecording, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	res := &AwsRecording{}
+	if err = json.Unmarshal(data, res); err != nil {
+		return nil, fmt.Errorf("failed to parse the AWS recording %s: %w", fileName, err)
+	}
+	return res, nil
+}
+
+// Get the operation name of the input structure, e.g. "ec2.DescribeInstances"
+// for *ec2.DescribeInstancesInput
+func awsOperationName(params interface{}) string {
+	tp := reflect.TypeOf(params)
+	for tp != nil && tp.Kind() == reflect.Ptr {
+		tp = tp.Elem()
+	}
+	if tp == nil {
+		return ""
+	}
+	return strings.TrimSuffix(tp.String(), "Input")
+}
+
+// Captures the AWS calls made with the real aws.Config, to be replayed later
+// through the AwsMockHandler (see AwsReplayer). E.g.:
+//
+//	recorder := NewAwsRecorder()
+//	ec := ec2.New(recorder.RecordingConfig(realConfig))
+//	... make the calls ...
+//	err := recorder.Save("testdata/ec2.json")
+type AwsRecorder struct {
+	mtx       sync.Mutex
+	recording AwsRecording
+}
+
+func NewAwsRecorder() *AwsRecorder {
+	return &AwsRecorder{}
+}
+
+// Get a copy of the config that records all the calls made with it
+func (r *AwsRecorder) RecordingConfig(config aws.Config) aws.Config {
+	res := config.Copy()
+	r.InstrumentHandlers(&res.Handlers)
+	return res
+}
+
+// Record the calls made with the handlers
+func (r *AwsRecorder) InstrumentHandlers(handlers *aws.Handlers) {
+	handlers.Complete.PushFrontNamed(aws.NamedHandler{
+		Name: "utils/aws_recorder.Complete",
+		Fn:   r.complete,
+	})
+}
+
+func (r *AwsRecorder) complete(request *aws.Request) {
+	interaction := AwsInteraction{Operation: awsOperationName(request.Params)}
+
+	var err error
+	interaction.Input, err = json.Marshal(request.Params)
+	if err != nil {
+		panic(fmt.Sprintf("failed to record the AWS input %s: %v",
+			interaction.Operation, err))
+	}
+
+	if request.Error != nil {
+		interaction.Error = recordError(request.Error)
+	} else if request.Data != nil {
+		interaction.Output, err = json.Marshal(request.Data)
+		if err != nil {
+			panic(fmt.Sprintf("failed to record the AWS output %s: %v",
+				interaction.Operation, err))
+		}
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.recording.Interactions = append(r.recording.Interactions, interaction)
+}
+
+func recordError(err error) *RecordedAwsError {
+	res := &RecordedAwsError{Message: err.Error()}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		res.Code = aerr.Code()
+		res.Message = aerr.Message()
+	}
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) {
+		res.StatusCode = failure.StatusCode()
+		res.RequestId = failure.RequestID()
+	}
+	return res
+}
+
+// Get the copy of the interactions recorded so far
+func (r *AwsRecorder) Recording() *AwsRecording {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return &AwsRecording{
+		Interactions: append([]AwsInteraction(nil), r.recording.Interactions...),
+	}
+}
+
+// Save the interactions recorded so far into the file
+func (r *AwsRecorder) Save(fileName string) error {
+	data, err := json.MarshalIndent(r.Recording(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, data, 0644)
+}
+
+// Serves the recorded interactions back, once added to the AwsMockHandler
+// (see AwsMockHandler.AddReplayer). The calls are matched by the operation
+// and the input: either the whole input, or only its key fields (see
+// SetKeyFields). The matching interactions are replayed in the recorded order,
+// with the last one repeated once all of them are used.
+type AwsReplayer struct {
+	mtx          sync.Mutex
+	interactions []AwsInteraction
+	used         []bool
+	keyFields    map[string][]string
+}
+
+func NewAwsReplayer(recording *AwsRecording) *AwsReplayer {
+	return &AwsReplayer{
+		interactions: recording.Interactions,
+		used:         make([]bool, len(recording.Interactions)),
+		keyFields:    make(map[string][]string),
+	}
+}
+
+// Match the inputs of the operation (e.g. "ec2.DescribeInstances") only by
+// these fields, e.g. "InstanceIds", ignoring the rest (e.g. the tokens)
+func (r *AwsReplayer) SetKeyFields(operation string, fields ...string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.keyFields[operation] = fields
+}
+
+// Find the recorded interaction for the input and decode its output into
+// the output structure (e.g. *ec2.DescribeInstancesOutput). The matched flag
+// is false if nothing was recorded for the input.
+func (r *AwsReplayer) Replay(params interface{}, output interface{}) (bool, error) {
+	operation := awsOperationName(params)
+	input, err := jsonFields(params)
+	if err != nil {
+		return false, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	last := -1
+	found := -1
+	for i, interaction := range r.interactions {
+		if interaction.Operation != operation {
+			continue
+		}
+		recorded, err := jsonFields(interaction.Input)
+		if err != nil {
+			return false, err
+		}
+		if !r.inputsMatch(operation, input, recorded) {
+			continue
+		}
+		last = i
+		if !r.used[i] {
+			found = i
+			break
+		}
+	}
+	if found == -1 {
+		found = last
+	}
+	if found == -1 {
+		return false, nil
+	}
+	r.used[found] = true
+
+	interaction := r.interactions[found]
+	if interaction.Error != nil {
+		return true, interaction.Error.toError()
+	}
+	if output != nil && len(interaction.Output) != 0 {
+		if err = json.Unmarshal(interaction.Output, output); err != nil {
+			return true, fmt.Errorf("failed to replay the AWS output %s: %w",
+				operation, err)
+		}
+	}
+	return true, nil
+}
+
+func (r *AwsReplayer) inputsMatch(operation string, input map[string]interface{},
+	recorded map[string]interface{}) bool {
+
+	fields, ok := r.keyFields[operation]
+	if !ok {
+		return reflect.DeepEqual(input, recorded)
+	}
+	for _, f := range fields {
+		if !reflect.DeepEqual(input[f], recorded[f]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Convert the structure (or its JSON) into the generic form for comparisons
+func jsonFields(value interface{}) (map[string]interface{}, error) {
+	data, ok := value.(json.RawMessage)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+	res := make(map[string]interface{})
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (e *RecordedAwsError) toError() error {
+	if e.Code == "" {
+		return errors.New(e.Message)
+	}
+	err := awserr.New(e.Code, e.Message, nil)
+	if e.StatusCode != 0 {
+		return awserr.NewRequestFailure(err, e.StatusCode, e.RequestId)
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func recordEc2Calls(t *testing.T, fileName string) {
+	// The mock stands in for the real AWS
+	am := NewAwsMockHandler()
+	am.AddHandler(func(ctx context.Context, arg *ec2.DescribeInstancesInput) (
+		*ec2.DescribeInstancesOutput, error) {
+		return &ec2.DescribeInstancesOutput{
+			NextToken: aws.String("next-" + arg.InstanceIds[0]),
+		}, nil
+	})
+	am.AddHandler(func(ctx context.Context, arg *ec2.TerminateInstancesInput) (
+		*ec2.TerminateInstancesOutput, error) {
+		return nil, awserr.New("InvalidInstanceID.NotFound", "no such instance", nil)
+	})
+
+	recorder := NewAwsRecorder()
+	ec := ec2.New(recorder.RecordingConfig(am.AwsConfig()))
+
+	for _, id := range []string{"i-1", "i-2"} {
+		_, err := ec.DescribeInstancesRequest(&ec2.DescribeInstancesInput{
+			InstanceIds: []string{id},
+		}).Send(context.Background())
+		assert.NoError(t, err)
+	}
+	_, err := ec.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
+		InstanceIds: []string{"i-3"},
+	}).Send(context.Background())
+	assert.Error(t, err)
+
+	assert.NoError(t, recorder.Save(fileName))
+}
+
+func TestAwsRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsrec")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "ec2.json")
+
+	recordEc2Calls(t, fileName)
+
+	recording, err := LoadAwsRecording(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(recording.Interactions))
+	assert.Equal(t, "ec2.DescribeInstances", recording.Interactions[0].Operation)
+
+	am := NewAwsMockHandler()
+	am.AddReplayer(NewAwsReplayer(recording))
+	ec := ec2.New(am.AwsConfig())
+
+	// Matched by the whole input
+	res, err := ec.DescribeInstancesRequest(&ec2.DescribeInstancesInput{
+		InstanceIds: []string{"i-2"},
+	}).Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "next-i-2", *res.NextToken)
+
+	_, err = ec.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
+		InstanceIds: []string{"i-3"},
+	}).Send(context.Background())
+	var aerr awserr.Error
+	assert.True(t, errors.As(err, &aerr))
+	assert.Equal(t, "InvalidInstanceID.NotFound", aerr.Code())
+	assert.Equal(t, "no such instance", aerr.Message())
+
+	// The handlers take precedence over the recording
+	am.AddHandler(func(ctx context.Context, arg *ec2.TerminateInstancesInput) (
+		*ec2.TerminateInstancesOutput, error) {
+		return &ec2.TerminateInstancesOutput{}, nil
+	})
+	_, err = ec.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
+		InstanceIds: []string{"i-3"},
+	}).Send(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestAwsReplayKeyFields(t *testing.T) {
+	recording := &AwsRecording{Interactions: []AwsInteraction{
+		{
+			Operation: "ec2.DescribeInstances",
+			Input:     []byte(`{"InstanceIds": ["i-1"], "NextToken": "a"}`),
+			Output:    []byte(`{"NextToken": "first"}`),
+		},
+		{
+			Operation: "ec2.DescribeInstances",
+			Input:     []byte(`{"InstanceIds": ["i-1"], "NextToken": "b"}`),
+			Output:    []byte(`{"NextToken": "second"}`),
+		},
+	}}
+	replayer := NewAwsReplayer(recording)
+	replayer.SetKeyFields("ec2.DescribeInstances", "InstanceIds")
+
+	replay := func(id string) (bool, string) {
+		out := &ec2.DescribeInstancesOutput{}
+		matched, err := replayer.Replay(&ec2.DescribeInstancesInput{
+			InstanceIds: []string{id}, NextToken: aws.String("other"),
+		}, out)
+		assert.NoError(t, err)
+		if out.NextToken == nil {
+			return matched, ""
+		}
+		return matched, *out.NextToken
+	}
+
+	// Replayed in order, the last one is repeated
+	matched, token := replay("i-1")
+	assert.True(t, matched)
+	assert.Equal(t, "first", token)
+	_, token = replay("i-1")
+	assert.Equal(t, "second", token)
+	_, token = replay("i-1")
+	assert.Equal(t, "second", token)
+
+	matched, _ = replay("i-2")
+	assert.False(t, matched)
+}
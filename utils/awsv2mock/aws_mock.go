@@ -0,0 +1,76 @@
+// The mock for the middleware-based (v1.x) aws-sdk-go-v2 clients. It's a separate
+// module, as the main one is pinned to the handler-based aws-sdk-go-v2 v0.21 that
+// shares the module path with the v1.x SDK.
+package awsv2mock
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/cyberax/go-dd-service-base/utils/internal/awsdispatch"
+)
+
+var ErrNoMockHandler = awsdispatch.ErrNoHandler
+
+type AwsMockHandler struct {
+	dispatcher awsdispatch.Dispatcher
+}
+
+// Create an AWS mocker to use with the v1.x AWS clients, the handlers are
+// registered just like with utils.AwsMockHandler:
+// func(context.Context, *ec2.TerminateInstancesInput)(*ec2.TerminateInstancesOutput, error)
+//
+// You can also use a struct as the handler, in this case the AwsMockHandler will try
+// to search for a method with a conforming signature.
+func NewAwsMockHandler() *AwsMockHandler {
+	return &AwsMockHandler{}
+}
+
+func (a *AwsMockHandler) AddHandler(handlerObject interface{}) {
+	a.dispatcher.AddHandler(handlerObject)
+}
+
+// Dispatch the typed operation input to the registered handlers,
+// ErrNoMockHandler is returned if none matches
+func (a *AwsMockHandler) Invoke(ctx context.Context,
+	params interface{}) (interface{}, error) {
+	return a.dispatcher.Invoke(ctx, params)
+}
+
+// The config for the v1.x clients (e.g. ec2.NewFromConfig), the calls never
+// leave the process
+func (a *AwsMockHandler) AwsConfig() aws.Config {
+	return aws.Config{
+		Region: "us-mars-1",
+		Credentials: aws.NewCredentialsCache(aws.CredentialsProviderFunc(
+			func(ctx context.Context) (aws.Credentials, error) {
+				return aws.Credentials{AccessKeyID: "a", SecretAccessKey: "b",
+					SessionToken: "c", Source: "awsmock"}, nil
+			})),
+		APIOptions: a.APIOptions(),
+	}
+}
+
+// The API options that serve the calls with the handlers, they can be added to
+// an existing config or passed to an individual call (e.g. as
+// func(o *ec2.Options) { o.APIOptions = append(o.APIOptions, m.APIOptions()...) })
+func (a *AwsMockHandler) APIOptions() []func(*middleware.Stack) error {
+	return []func(*middleware.Stack) error{a.addMiddleware}
+}
+
+// The mock is the last Initialize step: the input is validated and the other
+// instrumentation (e.g. tracing) still wraps the call, but nothing is serialized
+// or sent
+func (a *AwsMockHandler) addMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("awsmock",
+		func(ctx context.Context, in middleware.InitializeInput,
+			next middleware.InitializeHandler) (middleware.InitializeOutput,
+			middleware.Metadata, error) {
+
+			res, err := a.Invoke(ctx, in.Parameters)
+			if err == ErrNoMockHandler {
+				panic(err.Error())
+			}
+			return middleware.InitializeOutput{Result: res}, middleware.Metadata{}, err
+		}), middleware.After)
+}
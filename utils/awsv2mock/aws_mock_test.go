@@ -0,0 +1,63 @@
+package awsv2mock
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type tester struct {
+}
+
+//noinspection GoUnusedParameter
+func (t *tester) GetCallerIdentity(ctx context.Context,
+	input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	return &sts.GetCallerIdentityOutput{Account: aws.String("123456")}, nil
+}
+
+func TestAwsMock(t *testing.T) {
+	am := NewAwsMockHandler()
+	am.AddHandler(&tester{})
+	am.AddHandler(func(ctx context.Context, arg *sts.GetSessionTokenInput) (
+		*sts.GetSessionTokenOutput, error) {
+		return nil, errors.New("no tokens today")
+	})
+
+	client := sts.NewFromConfig(am.AwsConfig())
+
+	identity, err := client.GetCallerIdentity(context.Background(),
+		&sts.GetCallerIdentityInput{})
+	assert.NoError(t, err)
+	assert.Equal(t, "123456", *identity.Account)
+
+	// The errors are wrapped by the SDK
+	_, err = client.GetSessionToken(context.Background(), &sts.GetSessionTokenInput{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no tokens today")
+
+	// The input is still validated
+	_, err = client.AssumeRole(context.Background(), &sts.AssumeRoleInput{})
+	assert.Error(t, err)
+
+	assert.Panics(t, func() {
+		_, _ = client.GetAccessKeyInfo(context.Background(), &sts.GetAccessKeyInfoInput{
+			AccessKeyId: aws.String("AKIA1234567890123456")})
+	}, "could not find a handler")
+}
+
+func TestAwsMockPerCallOptions(t *testing.T) {
+	am := NewAwsMockHandler()
+	am.AddHandler(&tester{})
+
+	// The mock can be attached to a single call of a client
+	client := sts.New(sts.Options{Region: "us-mars-1"})
+	identity, err := client.GetCallerIdentity(context.Background(),
+		&sts.GetCallerIdentityInput{}, func(o *sts.Options) {
+			o.APIOptions = append(o.APIOptions, am.APIOptions()...)
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, "123456", *identity.Account)
+}
@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The source of time, replaced by the FakeClock in tests to make the timings
+// deterministic
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	// Sleep for the duration, or until the context is done (returning its error)
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// The timer created by the Clock, like the time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// The clock backed by the time package
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (c realClock) Sleep(ctx context.Context, d time.Duration) error {
+	return sleepWithTimer(ctx, c.NewTimer(d))
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (r realTimer) C() <-chan time.Time {
+	return r.Timer.C
+}
+
+func sleepWithTimer(ctx context.Context, timer Timer) error {
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+type clockKey struct{}
+
+var clockKeyVal = &clockKey{}
+
+// Attach the clock to the context, to be used by the code down the call chain
+// (see ClockFromContext)
+func WithClock(ctx context.Context, clock Clock) context.Context {
+	return context.WithValue(ctx, clockKeyVal, clock)
+}
+
+// Get the clock attached to the context, or the RealClock
+func ClockFromContext(ctx context.Context) Clock {
+	if clock, ok := ctx.Value(clockKeyVal).(Clock); ok && clock != nil {
+		return clock
+	}
+	return RealClock
+}
+
+// The clock that only moves when it's advanced. It's safe for concurrent use.
+type FakeClock struct {
+	mtx    sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	ch    chan time.Time
+}
+
+// Create the fake clock, starting at the given time
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) NewTimer(d time.Duration) Timer {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	timer := &fakeTimer{clock: f, when: f.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.ch <- f.now
+		return timer
+	}
+	f.timers = append(f.timers, timer)
+	return timer
+}
+
+func (f *FakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	return sleepWithTimer(ctx, f.NewTimer(d))
+}
+
+// Move the clock forward, firing the timers that are due (in the order of
+// their deadlines)
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.now = f.now.Add(d)
+	sort.Slice(f.timers, func(i, j int) bool {
+		return f.timers[i].when.Before(f.timers[j].when)
+	})
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if t.when.After(f.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- t.when
+	}
+	f.timers = pending
+}
+
+// The number of the timers that haven't fired or been stopped yet, the tests
+// can wait for the code under test to start sleeping with it
+func (f *FakeClock) PendingTimers() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return len(f.timers)
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mtx.Lock()
+	defer t.clock.mtx.Unlock()
+
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
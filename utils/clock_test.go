@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+	assert.Equal(t, start, clock.Now())
+
+	t1 := clock.NewTimer(time.Second)
+	t2 := clock.NewTimer(2 * time.Second)
+	t3 := clock.NewTimer(3 * time.Second)
+	assert.True(t, t3.Stop())
+	assert.False(t, t3.Stop())
+	assert.Equal(t, 2, clock.PendingTimers())
+
+	// Only the due timers fire
+	clock.Advance(1500 * time.Millisecond)
+	assert.Equal(t, start.Add(time.Second), <-t1.C())
+	select {
+	case <-t2.C():
+		assert.Fail(t, "the timer fired too early")
+	default:
+	}
+	assert.Equal(t, start.Add(1500*time.Millisecond), clock.Now())
+
+	// Sleep until the clock is advanced
+	done := make(chan error)
+	go func() {
+		done <- clock.Sleep(context.Background(), time.Minute)
+	}()
+	for clock.PendingTimers() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Minute)
+	assert.NoError(t, <-done)
+	assert.Equal(t, 0, clock.PendingTimers())
+
+	// The sleep is interrupted by the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, clock.Sleep(ctx, time.Minute))
+	assert.Equal(t, 0, clock.PendingTimers())
+}
+
+func TestClockFromContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, RealClock, ClockFromContext(ctx))
+
+	clock := NewFakeClock(time.Unix(1000, 0))
+	assert.Equal(t, clock, ClockFromContext(WithClock(ctx, clock)))
+	assert.NoError(t, RealClock.Sleep(ctx, time.Millisecond))
+}
@@ -0,0 +1,161 @@
+// Typed configuration loader. The configuration struct is populated from the
+// environment variables, using the struct tags:
+//
+//	env:"NAME"        - the variable name (prefixed), defaults to the SNAKE_CASE field name
+//	default:"value"   - the default value if the variable is not set
+//	required:"true"   - the variable must be set (or have a default)
+//
+// Supported field types: string, bool, ints, uints, floats, time.Duration and
+// []string (comma-separated). Values with the "secretsmanager:" prefix are
+// resolved via AWS Secrets Manager.
+package config
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SecretPrefix = "secretsmanager:"
+
+// The list of all the problems found in the configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (v *ValidationError) Error() string {
+	return "bad configuration: " + strings.Join(v.Problems, "; ")
+}
+
+// Load the configuration from the environment, without the secrets support
+func Load(prefix string, dst interface{}) error {
+	return load(context.Background(), prefix, dst, nil)
+}
+
+// Load the configuration from the environment, resolving the secrets
+// using the supplied AWS config
+func LoadWithSecrets(ctx context.Context, prefix string, dst interface{},
+	awsConfig aws.Config) error {
+	return load(ctx, prefix, dst, &awsConfig)
+}
+
+func load(ctx context.Context, prefix string, dst interface{}, awsConfig *aws.Config) error {
+	val := reflect.ValueOf(dst)
+	utils.PanicIfF(val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct,
+		"the destination must be a pointer to struct")
+	val = val.Elem()
+	tp := val.Type()
+
+	var problems []string
+	for i := 0; i < tp.NumField(); i++ {
+		field := tp.Field(i)
+		if field.PkgPath != "" {
+			continue // Unexported
+		}
+
+		name := field.Tag.Get("env")
+		if name == "" {
+			name = strings.ToUpper(utils.ToSnakeCase(field.Name, '_'))
+		}
+		name = prefix + name
+
+		str, ok := os.LookupEnv(name)
+		if !ok {
+			str, ok = field.Tag.Lookup("default")
+		}
+		if !ok {
+			if field.Tag.Get("required") == "true" {
+				problems = append(problems, fmt.Sprintf("%s is required", name))
+			}
+			continue
+		}
+
+		if strings.HasPrefix(str, SecretPrefix) {
+			if awsConfig == nil {
+				problems = append(problems,
+					fmt.Sprintf("%s is a secret, but no AWS config is supplied", name))
+				continue
+			}
+			var err error
+			str, err = utils.GetSecretString(ctx, *awsConfig,
+				strings.TrimPrefix(str, SecretPrefix))
+			if err != nil {
+				problems = append(problems,
+					fmt.Sprintf("%s can't be resolved: %s", name, err.Error()))
+				continue
+			}
+		}
+
+		err := setValue(val.Field(i), str)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s is invalid: %s", name, err.Error()))
+		}
+	}
+
+	if len(problems) != 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setValue(field reflect.Value, str string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(str)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(str, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(str, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(str, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		var res []string
+		for _, s := range strings.Split(str, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				res = append(res, s)
+			}
+		}
+		field.Set(reflect.ValueOf(res))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
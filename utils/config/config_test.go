@@ -0,0 +1,91 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	AgentHost string        `required:"true"`
+	Port      int           `default:"8125"`
+	Debug     bool          `env:"DEBUG_MODE"`
+	Timeout   time.Duration `default:"5s"`
+	Hosts     []string
+	Password  string
+}
+
+func TestLoad(t *testing.T) {
+	_ = os.Setenv("TST_AGENT_HOST", "localhost")
+	_ = os.Setenv("TST_DEBUG_MODE", "true")
+	_ = os.Setenv("TST_HOSTS", "a, b,c")
+	//noinspection GoUnhandledErrorResult
+	defer os.Unsetenv("TST_AGENT_HOST")
+	//noinspection GoUnhandledErrorResult
+	defer os.Unsetenv("TST_DEBUG_MODE")
+	//noinspection GoUnhandledErrorResult
+	defer os.Unsetenv("TST_HOSTS")
+
+	var cfg testConfig
+	err := Load("TST_", &cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "localhost", cfg.AgentHost)
+	assert.Equal(t, 8125, cfg.Port)
+	assert.True(t, cfg.Debug)
+	assert.Equal(t, 5*time.Second, cfg.Timeout)
+	assert.Equal(t, []string{"a", "b", "c"}, cfg.Hosts)
+	assert.Equal(t, "", cfg.Password)
+}
+
+func TestValidation(t *testing.T) {
+	_ = os.Setenv("BAD_PORT", "hello")
+	_ = os.Setenv("BAD_TIMEOUT", "forever")
+	//noinspection GoUnhandledErrorResult
+	defer os.Unsetenv("BAD_PORT")
+	//noinspection GoUnhandledErrorResult
+	defer os.Unsetenv("BAD_TIMEOUT")
+
+	var cfg testConfig
+	err := Load("BAD_", &cfg)
+	assert.Error(t, err)
+
+	// All the problems are reported at once
+	problems := err.(*ValidationError).Problems
+	assert.Equal(t, 3, len(problems))
+	assert.Equal(t, "BAD_AGENT_HOST is required", problems[0])
+}
+
+func TestSecrets(t *testing.T) {
+	am := utils.NewAwsMockHandler()
+	am.AddHandler(func(ctx context.Context, arg *secretsmanager.GetSecretValueInput) (
+		*secretsmanager.GetSecretValueOutput, error) {
+		if *arg.SecretId != "db/pass" {
+			return nil, fmt.Errorf("no such secret")
+		}
+		return &secretsmanager.GetSecretValueOutput{
+			SecretString: aws.String("s3cr3t"),
+		}, nil
+	})
+
+	_ = os.Setenv("SEC_AGENT_HOST", "localhost")
+	_ = os.Setenv("SEC_PASSWORD", "secretsmanager:db/pass")
+	//noinspection GoUnhandledErrorResult
+	defer os.Unsetenv("SEC_AGENT_HOST")
+	//noinspection GoUnhandledErrorResult
+	defer os.Unsetenv("SEC_PASSWORD")
+
+	var cfg testConfig
+	// No AWS config to resolve the secret
+	assert.Error(t, Load("SEC_", &cfg))
+
+	err := LoadWithSecrets(context.Background(), "SEC_", &cfg, am.AwsConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", cfg.Password)
+}
@@ -0,0 +1,96 @@
+// The SDK-independent part of the AWS mocks: dispatching the typed operation
+// inputs (e.g. *ec2.TerminateInstancesInput) to the registered handlers. It has
+// no AWS SDK imports, so that the mocks for the handler-based SDK (utils) and
+// for the middleware-based v1.x SDK (utils/awsv2mock) share it.
+package awsdispatch
+
+import (
+	"context"
+	"errors"
+	"reflect"
+)
+
+var ErrNoHandler = errors.New("could not find a handler")
+
+type Dispatcher struct {
+	handlers []reflect.Value
+	functors []reflect.Value
+}
+
+// Add a func(context.Context, <arg>)(<res>, error) handler, or a struct with
+// the methods of that signature
+func (d *Dispatcher) AddHandler(handlerObject interface{}) {
+	handler := reflect.ValueOf(handlerObject)
+	tp := handler.Type()
+
+	if handler.Kind() == reflect.Func {
+		if tp.NumOut() != 2 || tp.NumIn() != 2 {
+			panic("handler must have signature of func(context.Context, <arg>)(<res>, error)")
+		}
+		d.functors = append(d.functors, handler)
+	} else {
+		if tp.NumMethod() == 0 {
+			panic("the handler must have invokable methods")
+		}
+		d.handlers = append(d.handlers, handler)
+	}
+}
+
+// Invoke the first handler accepting the params, ErrNoHandler is returned
+// if none matches
+func (d *Dispatcher) Invoke(ctx context.Context,
+	params interface{}) (interface{}, error) {
+
+	for _, h := range d.handlers {
+		for i := 0; i < h.NumMethod(); i++ {
+			method := h.Method(i)
+
+			matched, res, err := tryInvoke(ctx, params, method)
+			if matched {
+				return res, err
+			}
+		}
+	}
+
+	for _, f := range d.functors {
+		matched, res, err := tryInvoke(ctx, params, f)
+		if matched {
+			return res, err
+		}
+	}
+
+	return nil, ErrNoHandler
+}
+
+func tryInvoke(ctx context.Context, params interface{}, method reflect.Value) (
+	bool, interface{}, error) {
+
+	paramType := reflect.TypeOf(params)
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	contextType := reflect.TypeOf((*context.Context)(nil)).Elem()
+
+	methodDesc := method.Type()
+	if methodDesc.NumIn() != 2 || methodDesc.NumOut() != 2 {
+		return false, nil, nil
+	}
+
+	if !contextType.ConvertibleTo(methodDesc.In(0)) {
+		return false, nil, nil
+	}
+	if !paramType.ConvertibleTo(methodDesc.In(1)) {
+		return false, nil, nil
+	}
+	if !methodDesc.Out(1).ConvertibleTo(errorType) {
+		return false, nil, nil
+	}
+
+	// It's our target!
+	res := method.Call([]reflect.Value{reflect.ValueOf(ctx),
+		reflect.ValueOf(params)})
+
+	if !res[1].IsNil() {
+		return true, nil, res[1].Interface().(error)
+	}
+
+	return true, res[0].Interface(), nil
+}
@@ -1,14 +1,13 @@
 package utils
 
 import (
-	"bytes"
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.com/cyberax/go-dd-service-base/utils/testutil"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 	"net"
 	"strings"
 	"time"
@@ -57,20 +56,12 @@ func PanicIfErr(err error) {
 	}
 }
 
-// MemorySink implements zap.Sink by writing all messages to a buffer.
-type MemorySink struct {
-	bytes.Buffer
-}
-func (s *MemorySink) Close() error { return nil }
-func (s *MemorySink) Sync() error  { return nil }
+// Deprecated: use testutil.MemorySink
+type MemorySink = testutil.MemorySink
 
+// Deprecated: use testutil.NewMemorySinkLogger
 func NewMemorySinkLogger() (*MemorySink, *zap.Logger) {
-	sink := &MemorySink{}
-	config := zap.NewProductionEncoderConfig()
-	config.TimeKey = ""
-	core := zapcore.NewCore(zapcore.NewJSONEncoder(config), sink, zap.DebugLevel)
-	logger := zap.New(core)
-	return sink, logger
+	return testutil.NewMemorySinkLogger()
 }
 
 
@@ -88,6 +79,34 @@ func GetFreeTcpPort() (int, error) {
 	return l.Addr().(*net.TCPAddr).Port, nil
 }
 
+// Get a listener bound to a free TCP port, and the port. Unlike with the
+// GetFreeTcpPort, the port can't be taken by someone else before the server
+// starts: pass the listener directly to http.Serve (or echo's Server.Serve).
+func GetFreeListener() (net.Listener, int, error) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, 0, err
+	}
+	return l, l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Get n listeners bound to the distinct free TCP ports (see GetFreeListener),
+// panics on failures
+func MustGetFreeListeners(n int) []net.Listener {
+	res := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, _, err := GetFreeListener()
+		if err != nil {
+			for _, prev := range res {
+				_ = prev.Close()
+			}
+			panic(err.Error())
+		}
+		res = append(res, l)
+	}
+	return res
+}
+
 func MustJsonIndent(obj interface{}, indent string) string {
 	data, err := json.MarshalIndent(obj, "", indent)
 	if err != nil {
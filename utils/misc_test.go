@@ -59,6 +59,26 @@ func TestGetFreeTcpPort(t *testing.T) {
 	assert.NotEqual(t, port, port2)
 }
 
+func TestGetFreeListener(t *testing.T) {
+	l, port, err := GetFreeListener()
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer l.Close()
+	assert.Equal(t, port, l.Addr().(*net.TCPAddr).Port)
+
+	// The port is already taken
+	_, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+	assert.Error(t, err)
+
+	listeners := MustGetFreeListeners(3)
+	ports := make(map[int]bool)
+	for _, cur := range listeners {
+		ports[cur.Addr().(*net.TCPAddr).Port] = true
+		_ = cur.Close()
+	}
+	assert.Equal(t, 3, len(ports))
+}
+
 func TestMustJson(t *testing.T) {
 	args := map[string]interface{} {
 		"Hello": "world",
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/lib/pq"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// The errors that know how long to wait before the retry, e.g. the AWS
+// throttling errors with the Retry-After header
+type BackoffSuggester interface {
+	SuggestedBackoff() time.Duration
+}
+
+// The AWS error codes that indicate throttling
+var awsThrottlingCodes = map[string]struct{}{
+	"Throttling":                             {},
+	"ThrottlingException":                    {},
+	"ThrottledException":                     {},
+	"RequestThrottledException":              {},
+	"TooManyRequestsException":               {},
+	"ProvisionedThroughputExceededException": {},
+	"RequestLimitExceeded":                   {},
+	"BandwidthLimitExceeded":                 {},
+	"LimitExceededException":                 {},
+	"RequestThrottled":                       {},
+	"SlowDown":                               {},
+	"EC2ThrottledException":                  {},
+}
+
+// The AWS error codes of the transient failures, other than throttling
+var awsTransientCodes = map[string]struct{}{
+	"RequestTimeout":                 {},
+	"RequestTimeoutException":        {},
+	"InternalError":                  {},
+	"InternalFailure":                {},
+	"InternalServerError":            {},
+	"ServiceUnavailable":             {},
+	"ServiceUnavailableException":    {},
+	"TransactionInProgressException": {},
+}
+
+// The transient Postgres errors (SQLSTATE codes), the whole connection
+// exception class ("08") is transient as well
+var pgTransientCodes = map[pq.ErrorCode]struct{}{
+	"40001": {}, // serialization_failure
+	"40P01": {}, // deadlock_detected
+	"53300": {}, // too_many_connections
+	"55P03": {}, // lock_not_available
+	"57P01": {}, // admin_shutdown
+	"57P02": {}, // crash_shutdown
+	"57P03": {}, // cannot_connect_now
+}
+
+// Check whether the AWS error code indicates throttling
+func IsAwsThrottlingCode(code string) bool {
+	_, found := awsThrottlingCodes[code]
+	return found
+}
+
+// Check whether the error is transient, so that the operation can be retried:
+// the AWS throttling and 5xx errors, the transient Postgres errors, and the
+// network timeouts and resets. The cancelled and expired contexts are not
+// retryable.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var suggester BackoffSuggester
+	if errors.As(err, &suggester) {
+		return true
+	}
+
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && (failure.StatusCode() >= http.StatusInternalServerError ||
+		failure.StatusCode() == http.StatusTooManyRequests) {
+		return true
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		if _, found := awsTransientCodes[aerr.Code()]; found || IsAwsThrottlingCode(aerr.Code()) {
+			return true
+		}
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		_, found := pgTransientCodes[pqErr.Code]
+		return found || pqErr.Code.Class() == "08"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
+
+// Get the delay before the retry suggested by the error (see BackoffSuggester),
+// or zero
+func SuggestedBackoff(err error) time.Duration {
+	var suggester BackoffSuggester
+	if errors.As(err, &suggester) {
+		return suggester.SuggestedBackoff()
+	}
+	return 0
+}
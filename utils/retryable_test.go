@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type suggestingError struct {
+	delay time.Duration
+}
+
+func (s *suggestingError) Error() string {
+	return "slow down"
+}
+
+func (s *suggestingError) SuggestedBackoff() time.Duration {
+	return s.delay
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.False(t, IsRetryable(nil))
+	assert.False(t, IsRetryable(fmt.Errorf("permanent")))
+	assert.False(t, IsRetryable(context.Canceled))
+	assert.False(t, IsRetryable(fmt.Errorf("wrapped: %w", context.DeadlineExceeded)))
+
+	// AWS
+	assert.True(t, IsAwsThrottlingCode("ThrottlingException"))
+	assert.True(t, IsRetryable(awserr.New("ThrottlingException", "slow", nil)))
+	assert.True(t, IsRetryable(awserr.New("ServiceUnavailable", "down", nil)))
+	assert.False(t, IsRetryable(awserr.New("ValidationException", "bad", nil)))
+	assert.True(t, IsRetryable(awserr.NewRequestFailure(
+		awserr.New("Whatever", "down", nil), 503, "req")))
+	assert.True(t, IsRetryable(awserr.NewRequestFailure(
+		awserr.New("Whatever", "slow", nil), 429, "req")))
+	assert.False(t, IsRetryable(awserr.NewRequestFailure(
+		awserr.New("AccessDenied", "no", nil), 403, "req")))
+
+	// Postgres
+	assert.True(t, IsRetryable(&pq.Error{Code: "40001"}))
+	assert.True(t, IsRetryable(fmt.Errorf("query: %w", &pq.Error{Code: "08006"})))
+	assert.False(t, IsRetryable(&pq.Error{Code: "23505"}))
+
+	// Network
+	assert.True(t, IsRetryable(&net.OpError{Op: "dial",
+		Err: &net.DNSError{IsTimeout: true}}))
+	assert.True(t, IsRetryable(fmt.Errorf("read: %w", syscall.ECONNRESET)))
+
+	// The errors with the suggested backoff
+	suggesting := &suggestingError{delay: time.Second}
+	assert.True(t, IsRetryable(suggesting))
+	assert.Equal(t, time.Second, SuggestedBackoff(fmt.Errorf("call: %w", suggesting)))
+	assert.Equal(t, time.Duration(0), SuggestedBackoff(fmt.Errorf("permanent")))
+}
@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// Get the current string value of the AWS Secrets Manager secret
+func GetSecretString(ctx context.Context, config aws.Config, secretId string) (string, error) {
+	sm := secretsmanager.New(config)
+
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretId),
+		// VersionStage defaults to AWSCURRENT if unspecified
+		VersionStage: aws.String("AWSCURRENT"),
+	}
+
+	result, err := sm.GetSecretValueRequest(input).Send(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if aws.StringValue(result.SecretString) == "" {
+		return "", fmt.Errorf("no string secret")
+	}
+	return *result.SecretString, nil
+}
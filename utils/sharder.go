@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// The number of the points each instance has on the hash ring, more points
+// spread the keys more evenly
+const DefaultShardReplicas = 128
+
+// The environment variables with the instance's index and the instance count
+const (
+	ShardIndexEnv = "SHARD_INDEX"
+	ShardCountEnv = "SHARD_COUNT"
+)
+
+// Sharder partitions the keys (e.g. the tenants) between the instances without
+// a coordinator: each instance knows its index and the instance count, and owns
+// the keys that the consistent hash ring assigns to it. When the instance count
+// changes, only the keys of about 1/count of the ring change their owners.
+type Sharder struct {
+	Index int
+	Count int
+
+	points []uint64
+	owners []int
+}
+
+type ringPoint struct {
+	hash  uint64
+	owner int
+}
+
+// Create the sharder for the instance with the index out of count instances
+func NewSharder(index, count int) *Sharder {
+	return NewSharderWithReplicas(index, count, DefaultShardReplicas)
+}
+
+// Create the sharder with the given number of the ring points per instance, all
+// the instances must use the same number
+func NewSharderWithReplicas(index, count, replicas int) *Sharder {
+	PanicIfF(count <= 0, "the shard count must be positive, got %d", count)
+	PanicIfF(index < 0 || index >= count, "the shard index %d is out of [0, %d)",
+		index, count)
+	PanicIfF(replicas <= 0, "the replica count must be positive, got %d", replicas)
+
+	ring := make([]ringPoint, 0, count*replicas)
+	for owner := 0; owner < count; owner++ {
+		for r := 0; r < replicas; r++ {
+			ring = append(ring, ringPoint{
+				hash:  hashKey(fmt.Sprintf("shard-%d-%d", owner, r)),
+				owner: owner,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash == ring[j].hash {
+			return ring[i].owner < ring[j].owner
+		}
+		return ring[i].hash < ring[j].hash
+	})
+
+	s := &Sharder{
+		Index:  index,
+		Count:  count,
+		points: make([]uint64, len(ring)),
+		owners: make([]int, len(ring)),
+	}
+	for i, p := range ring {
+		s.points[i] = p.hash
+		s.owners[i] = p.owner
+	}
+	return s
+}
+
+// Create the sharder from the SHARD_INDEX and SHARD_COUNT environment
+// variables, a single instance owning everything is assumed if they're not set
+func NewSharderFromEnv() (*Sharder, error) {
+	index, err := intFromEnv(ShardIndexEnv, 0)
+	if err != nil {
+		return nil, err
+	}
+	count, err := intFromEnv(ShardCountEnv, 1)
+	if err != nil {
+		return nil, err
+	}
+	if count <= 0 || index < 0 || index >= count {
+		return nil, fmt.Errorf("the shard index %d is out of [0, %d)", index, count)
+	}
+	return NewSharder(index, count), nil
+}
+
+func intFromEnv(name string, def int) (int, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return def, nil
+	}
+	res, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return res, nil
+}
+
+// The 64-bit FNV-1a hash with the final mixing (from SplitMix64), the plain
+// FNV clusters the similar short strings
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Get the index of the instance owning the key
+func (s *Sharder) Owner(key string) int {
+	hash := hashKey(key)
+	idx := sort.Search(len(s.points), func(i int) bool {
+		return s.points[i] >= hash
+	})
+	if idx == len(s.points) {
+		idx = 0
+	}
+	return s.owners[idx]
+}
+
+// Check whether the key is owned by this instance
+func (s *Sharder) Owns(key string) bool {
+	return s.Owner(key) == s.Index
+}
+
+// Get the keys owned by this instance, in their original order
+func (s *Sharder) Filter(keys []string) []string {
+	var res []string
+	for _, k := range keys {
+		if s.Owns(k) {
+			res = append(res, k)
+		}
+	}
+	return res
+}
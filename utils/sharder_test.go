@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func makeKeys(n int) []string {
+	res := make([]string, n)
+	for i := range res {
+		res[i] = "tenant-" + strconv.Itoa(i)
+	}
+	return res
+}
+
+func owners(count int, keys []string) map[string]int {
+	sharder := NewSharder(0, count)
+	res := make(map[string]int, len(keys))
+	for _, k := range keys {
+		res[k] = sharder.Owner(k)
+	}
+	return res
+}
+
+func TestSharderPartitions(t *testing.T) {
+	keys := makeKeys(10000)
+
+	// Each key is owned by exactly one instance, the shards are balanced
+	total := 0
+	for i := 0; i < 4; i++ {
+		owned := NewSharder(i, 4).Filter(keys)
+		total += len(owned)
+		assert.InDelta(t, 2500, len(owned), 500)
+	}
+	assert.Equal(t, len(keys), total)
+
+	// The ownership is deterministic
+	assert.Equal(t, owners(4, keys), owners(4, keys))
+	assert.Equal(t, keys, NewSharder(0, 1).Filter(keys))
+
+	assert.Panics(t, func() { NewSharder(3, 3) })
+	assert.Panics(t, func() { NewSharder(0, 0) })
+}
+
+func TestSharderRebalancing(t *testing.T) {
+	keys := makeKeys(10000)
+
+	for count := 1; count < 8; count++ {
+		before := owners(count, keys)
+		after := owners(count+1, keys)
+
+		// Only the keys taken over by the new instance move
+		moved := 0
+		for _, k := range keys {
+			if before[k] != after[k] {
+				assert.Equal(t, count, after[k])
+				moved++
+			}
+		}
+		expected := len(keys) / (count + 1)
+		assert.InDelta(t, expected, moved, float64(expected)/4)
+	}
+}
+
+func TestSharderFromEnv(t *testing.T) {
+	defer func() {
+		_ = os.Unsetenv(ShardIndexEnv)
+		_ = os.Unsetenv(ShardCountEnv)
+	}()
+
+	sharder, err := NewSharderFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, sharder.Index)
+	assert.Equal(t, 1, sharder.Count)
+
+	_ = os.Setenv(ShardIndexEnv, "2")
+	_ = os.Setenv(ShardCountEnv, "3")
+	sharder, err = NewSharderFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sharder.Index)
+	assert.Equal(t, 3, sharder.Count)
+
+	_ = os.Setenv(ShardIndexEnv, "3")
+	_, err = NewSharderFromEnv()
+	assert.Error(t, err)
+	_ = os.Setenv(ShardIndexEnv, "bad")
+	_, err = NewSharderFromEnv()
+	assert.Error(t, err)
+}
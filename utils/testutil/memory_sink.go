@@ -0,0 +1,30 @@
+// The test helpers that don't depend on the rest of the module. The API of the
+// package is stable: the existing functions and fields are not changed or
+// removed, only new ones are added.
+package testutil
+
+import (
+	"bytes"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// MemorySink implements zap.Sink by writing all messages to a buffer. It's not
+// thread-safe, read it once the code under test is done.
+type MemorySink struct {
+	bytes.Buffer
+}
+
+func (s *MemorySink) Close() error { return nil }
+func (s *MemorySink) Sync() error  { return nil }
+
+// Create the logger writing the JSON lines (without the timestamps) into the
+// memory sink, at the Debug level
+func NewMemorySinkLogger() (*MemorySink, *zap.Logger) {
+	sink := &MemorySink{}
+	config := zap.NewProductionEncoderConfig()
+	config.TimeKey = ""
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(config), sink, zap.DebugLevel)
+	logger := zap.New(core)
+	return sink, logger
+}
@@ -0,0 +1,13 @@
+package testutil
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMemorySinkLogger(t *testing.T) {
+	sink, logger := NewMemorySinkLogger()
+	logger.Debug("hello")
+	assert.Equal(t, "{\"level\":\"debug\",\"msg\":\"hello\"}\n", sink.String())
+	assert.NoError(t, sink.Sync())
+}
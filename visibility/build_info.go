@@ -0,0 +1,97 @@
+package visibility
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+const VersionHeader = "X-Service-Version"
+
+// The build information can be set with the linker flags, e.g.:
+// -ldflags "-X github.com/cyberax/go-dd-service-base/visibility.buildVersion=1.2.3"
+var (
+	buildVersion string
+	buildCommit  string
+	buildTime    string
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+}
+
+var buildInfoMtx sync.Mutex
+var buildInfoOverride *BuildInfo
+
+// Set the build information, overriding the linker-supplied values. This must be
+// called before the logging and tracing are set up.
+func SetBuildInfo(version, commit, buildTime string) {
+	buildInfoMtx.Lock()
+	defer buildInfoMtx.Unlock()
+	buildInfoOverride = &BuildInfo{Version: version, Commit: commit, BuildTime: buildTime}
+}
+
+// Get the build information: either set by SetBuildInfo, or set via the linker
+// flags, or the main module version from the binary.
+func GetBuildInfo() BuildInfo {
+	buildInfoMtx.Lock()
+	defer buildInfoMtx.Unlock()
+	if buildInfoOverride != nil {
+		return *buildInfoOverride
+	}
+
+	res := BuildInfo{Version: buildVersion, Commit: buildCommit, BuildTime: buildTime}
+	if res.Version == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			res.Version = info.Main.Version
+		}
+	}
+	return res
+}
+
+// Get the non-empty build information as logger fields
+func (b BuildInfo) Fields() []zap.Field {
+	var res []zap.Field
+	if b.Version != "" {
+		res = append(res, zap.String("version", b.Version))
+	}
+	if b.Commit != "" {
+		res = append(res, zap.String("commit", b.Commit))
+	}
+	if b.BuildTime != "" {
+		res = append(res, zap.String("build_time", b.BuildTime))
+	}
+	return res
+}
+
+// Get the non-empty build information as a map
+func (b BuildInfo) Map() map[string]interface{} {
+	res := make(map[string]interface{})
+	if b.Version != "" {
+		res["version"] = b.Version
+	}
+	if b.Commit != "" {
+		res["commit"] = b.Commit
+	}
+	if b.BuildTime != "" {
+		res["build_time"] = b.BuildTime
+	}
+	return res
+}
+
+// The handler returning the build information as JSON, e.g. for the /version endpoint
+func BuildInfoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.Marshal(GetBuildInfo())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	})
+}
@@ -0,0 +1,23 @@
+package visibility
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBuildInfo(t *testing.T) {
+	SetBuildInfo("1.2.3", "abcdef", "2020-10-10")
+	defer func() {
+		buildInfoOverride = nil
+	}()
+
+	info := GetBuildInfo()
+	assert.Equal(t, "1.2.3", info.Version)
+	assert.Equal(t, 3, len(info.Fields()))
+
+	rec := httptest.NewRecorder()
+	BuildInfoHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	assert.Equal(t, `{"version":"1.2.3","commit":"abcdef","build_time":"2020-10-10"}`,
+		rec.Body.String())
+}
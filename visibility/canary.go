@@ -0,0 +1,69 @@
+package visibility
+
+import (
+	"context"
+	"go.uber.org/zap"
+)
+
+const (
+	CanarySkippedMetric = "CanarySkipped"
+	ShadowedMetric      = "Shadowed"
+)
+
+// Check whether the request is made by a canary client
+func IsCanary(ctx context.Context) bool {
+	return GetClientTypeFromContext(ctx) == ClientTypeCanary
+}
+
+// Run the function with a side effect (sending emails, charging cards) only for
+// the non-canary requests. The skipped calls are counted in the CanarySkipped
+// metric of the context's MetricsContext (if it exists).
+func RunUnlessCanary(ctx context.Context, fn func(ctx context.Context) error) error {
+	return RunUnlessRing(ctx, ClientTypeCanary, fn)
+}
+
+// Run the function like RunUnlessCanary, skipping it for the requests with the
+// client type at least as risky as the ring (see SetClientRings)
+func RunUnlessRing(ctx context.Context, ring string,
+	fn func(ctx context.Context) error) error {
+
+	if !IsAtLeastAsRiskyAs(ctx, ring) {
+		return fn(ctx)
+	}
+
+	if logger := TryCL(ctx); logger != nil {
+		logger.Debug("Skipping the side effect for a risky client",
+			zap.String("client_type", GetClientTypeFromContext(ctx)))
+	}
+	if met := TryGetMetricsFromContext(ctx); met != nil {
+		met.AddCount(CanarySkippedMetric, 1)
+	}
+	return nil
+}
+
+// Run the realFn for the normal requests and the shadowFn (that simulates the
+// side effect) for the canary requests. The shadowed calls are counted in the
+// Shadowed metric of the context's MetricsContext (if it exists).
+func ShadowOnCanary(ctx context.Context, realFn func(ctx context.Context) error,
+	shadowFn func(ctx context.Context) error) error {
+	return ShadowOnRing(ctx, ClientTypeCanary, realFn, shadowFn)
+}
+
+// Run the functions like ShadowOnCanary, shadowing the side effect for the
+// requests with the client type at least as risky as the ring
+func ShadowOnRing(ctx context.Context, ring string, realFn func(ctx context.Context) error,
+	shadowFn func(ctx context.Context) error) error {
+
+	if !IsAtLeastAsRiskyAs(ctx, ring) {
+		return realFn(ctx)
+	}
+
+	if logger := TryCL(ctx); logger != nil {
+		logger.Debug("Shadowing the side effect for a risky client",
+			zap.String("client_type", GetClientTypeFromContext(ctx)))
+	}
+	if met := TryGetMetricsFromContext(ctx); met != nil {
+		met.AddCount(ShadowedMetric, 1)
+	}
+	return shadowFn(ctx)
+}
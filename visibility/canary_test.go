@@ -0,0 +1,65 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func canaryTestCtx(clientType string) context.Context {
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	ctx = ContextWithClientType(ctx, clientType)
+	return MakeMetricContext(ctx, "Op")
+}
+
+func TestRunUnlessCanary(t *testing.T) {
+	ctx := canaryTestCtx(ClientTypeNormal)
+	ran := false
+	err := RunUnlessCanary(ctx, func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, ran)
+	assert.Nil(t, GetMetricsFromContext(ctx).Metrics[CanarySkippedMetric])
+
+	ctx = canaryTestCtx(ClientTypeCanary)
+	ran = false
+	err = RunUnlessCanary(ctx, func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.False(t, ran)
+	assert.Equal(t, 1.0, GetMetricsFromContext(ctx).Metrics[CanarySkippedMetric].Val)
+
+	// No logger and no metrics context are needed
+	assert.NoError(t, RunUnlessCanary(
+		ContextWithClientType(context.Background(), ClientTypeCanary),
+		func(ctx context.Context) error {
+			panic("should not be called")
+		}))
+}
+
+func TestShadowOnCanary(t *testing.T) {
+	var called string
+	realFn := func(ctx context.Context) error {
+		called = "real"
+		return nil
+	}
+	shadowFn := func(ctx context.Context) error {
+		called = "shadow"
+		return nil
+	}
+
+	ctx := canaryTestCtx(ClientTypeNormal)
+	assert.NoError(t, ShadowOnCanary(ctx, realFn, shadowFn))
+	assert.Equal(t, "real", called)
+	assert.Nil(t, GetMetricsFromContext(ctx).Metrics[ShadowedMetric])
+
+	ctx = canaryTestCtx(ClientTypeCanary)
+	assert.NoError(t, ShadowOnCanary(ctx, realFn, shadowFn))
+	assert.Equal(t, "shadow", called)
+	assert.Equal(t, 1.0, GetMetricsFromContext(ctx).Metrics[ShadowedMetric].Val)
+}
@@ -0,0 +1,117 @@
+package visibility
+
+import (
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+)
+
+const DefaultCardinalityLimit = 500
+const OverflowTagValue = "overflow"
+
+// The guard against the accidental high-cardinality metric tags. It tracks the
+// distinct values of each tag per metric, and once the limit is reached, the new
+// values of that tag are replaced with "overflow".
+type CardinalityGuard struct {
+	mtx    sync.Mutex
+	limit  int
+	logger *zap.Logger
+	// metric name -> tag key -> seen values
+	seen map[string]map[string]map[string]struct{}
+}
+
+func NewCardinalityGuard(limit int, logger *zap.Logger) *CardinalityGuard {
+	if limit <= 0 {
+		limit = DefaultCardinalityLimit
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &CardinalityGuard{
+		limit:  limit,
+		logger: logger,
+		seen:   make(map[string]map[string]map[string]struct{}),
+	}
+}
+
+var cardinalityGuardMtx sync.RWMutex
+var cardinalityGuard *CardinalityGuard
+
+// Install the cardinality guard used by CopyToStatsd, nil disables it
+func SetCardinalityGuard(guard *CardinalityGuard) {
+	cardinalityGuardMtx.Lock()
+	defer cardinalityGuardMtx.Unlock()
+	cardinalityGuard = guard
+}
+
+func getCardinalityGuard() *CardinalityGuard {
+	cardinalityGuardMtx.RLock()
+	defer cardinalityGuardMtx.RUnlock()
+	return cardinalityGuard
+}
+
+// Guards the tags that are always guarded (e.g. the tenant), if there's no
+// guard installed with SetCardinalityGuard
+var defaultTagGuard = NewCardinalityGuard(DefaultCardinalityLimit, nil)
+
+// Filter the tags of a metric sent directly to statsd, whose values come from
+// the requests. The installed guard is used, or the default one if there's none.
+func GuardTags(name string, tags []string) []string {
+	guard := getCardinalityGuard()
+	if guard == nil {
+		guard = defaultTagGuard
+	}
+	return guard.Filter(name, tags)
+}
+
+// Check the tags of a metric, replacing the values of the tags that are over the limit
+func (g *CardinalityGuard) Filter(name string, tags []string) []string {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	perMetric := g.seen[name]
+	if perMetric == nil {
+		perMetric = make(map[string]map[string]struct{})
+		g.seen[name] = perMetric
+	}
+
+	var res []string
+	for i, t := range tags {
+		key, value := t, ""
+		if idx := strings.IndexByte(t, ':'); idx >= 0 {
+			key, value = t[:idx], t[idx+1:]
+		}
+
+		values := perMetric[key]
+		if values == nil {
+			values = make(map[string]struct{})
+			perMetric[key] = values
+		}
+		if _, ok := values[value]; ok {
+			continue
+		}
+		if len(values) < g.limit {
+			values[value] = struct{}{}
+			continue
+		}
+
+		// Copy on the first write, the tags slice might be shared
+		if res == nil {
+			res = make([]string, len(tags))
+			copy(res, tags)
+		}
+		res[i] = key + ":" + OverflowTagValue
+		if len(values) == g.limit {
+			// Log only once per tag
+			values[OverflowTagValue] = struct{}{}
+			g.logger.Warn("Metric tag cardinality is over the limit",
+				zap.String("metric", name), zap.String("tag", key),
+				zap.Int("limit", g.limit))
+		}
+	}
+
+	if res == nil {
+		return tags
+	}
+	return res
+}
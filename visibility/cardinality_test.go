@@ -0,0 +1,42 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestCardinalityGuard(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	guard := NewCardinalityGuard(2, logger)
+
+	assert.Equal(t, []string{"unit:count", "id:1"}, guard.Filter("m", []string{"unit:count", "id:1"}))
+	assert.Equal(t, []string{"unit:count", "id:2"}, guard.Filter("m", []string{"unit:count", "id:2"}))
+	// Over the limit
+	assert.Equal(t, []string{"unit:count", "id:overflow"},
+		guard.Filter("m", []string{"unit:count", "id:3"}))
+	assert.Equal(t, []string{"unit:count", "id:overflow"},
+		guard.Filter("m", []string{"unit:count", "id:4"}))
+	// Known values still pass
+	assert.Equal(t, []string{"unit:count", "id:1"}, guard.Filter("m", []string{"unit:count", "id:1"}))
+	// Other metrics are tracked separately
+	assert.Equal(t, []string{"id:3"}, guard.Filter("m2", []string{"id:3"}))
+
+	assert.Equal(t, 1, strings.Count(sink.String(), "cardinality is over the limit"))
+}
+
+func TestCardinalityGuardInStatsd(t *testing.T) {
+	SetCardinalityGuard(NewCardinalityGuard(1, nil))
+	defer SetCardinalityGuard(nil)
+
+	rs := NewRecordingSink()
+	for i := 0; i < 3; i++ {
+		ctx := MakeMetricContext(context.Background(), "Op")
+		GetMetricsFromContext(ctx).AddCount("Count", 1)
+		GetMetricsFromContext(ctx).CopyToStatsd(rs, fmt.Sprintf("client%d", i))
+	}
+	assert.Equal(t, "client-type:overflow", rs.Tags["Op.Count"][1])
+}
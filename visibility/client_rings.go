@@ -0,0 +1,86 @@
+package visibility
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"sync"
+)
+
+// The client types (the deployment rings) ordered from the riskiest to the
+// safest, e.g. "canary", "early", "stable". The client type itself is passed
+// through the spans, the metrics and the middlewares unchanged, the order only
+// matters for the precedence checks.
+var clientRingsMtx sync.RWMutex
+var clientRings = defaultClientRings()
+
+func defaultClientRings() []string {
+	return []string{ClientTypeCanary, ClientTypeNormal}
+}
+
+// Set the deployment rings ordered from the riskiest to the safest, no rings
+// restore the default of canary and normal
+func SetClientRings(rings ...string) {
+	clientRingsMtx.Lock()
+	defer clientRingsMtx.Unlock()
+	if len(rings) == 0 {
+		clientRings = defaultClientRings()
+		return
+	}
+	clientRings = append([]string(nil), rings...)
+}
+
+// Get the deployment rings ordered from the riskiest to the safest
+func ClientRings() []string {
+	clientRingsMtx.RLock()
+	defer clientRingsMtx.RUnlock()
+	return append([]string(nil), clientRings...)
+}
+
+// The unknown rings that were already logged by IsAtLeastAsRiskyAs
+var unknownRingsLogged sync.Map
+
+// Get the position of the ring, 0 being the riskiest. The unknown rings are
+// ranked as the safest ones.
+func ClientRingRank(ring string) int {
+	rank, _ := clientRingRank(ring)
+	return rank
+}
+
+func clientRingRank(ring string) (int, bool) {
+	clientRingsMtx.RLock()
+	defer clientRingsMtx.RUnlock()
+	for i, r := range clientRings {
+		if r == ring {
+			return i, true
+		}
+	}
+	return len(clientRings), false
+}
+
+// Check whether the ring is at least as risky as the other one, e.g. whether
+// "canary" is at least as risky as "early". No ring is as risky as the other
+// one that is not registered (e.g. misspelled), except for itself.
+func IsRingAtLeastAsRisky(ring string, other string) bool {
+	if ring == other {
+		return true
+	}
+	otherRank, known := clientRingRank(other)
+	if !known {
+		return false
+	}
+	return ClientRingRank(ring) <= otherRank
+}
+
+// Check whether the request's client type is at least as risky as the ring.
+// The unregistered ring is logged (once) with the context's logger.
+func IsAtLeastAsRiskyAs(ctx context.Context, ring string) bool {
+	if _, known := clientRingRank(ring); !known {
+		if _, logged := unknownRingsLogged.LoadOrStore(ring, true); !logged {
+			if logger := TryCL(ctx); logger != nil {
+				logger.Warn("The client ring is not registered, see SetClientRings",
+					zap.String("ring", ring), zap.Strings("rings", ClientRings()))
+			}
+		}
+	}
+	return IsRingAtLeastAsRisky(GetClientTypeFromContext(ctx), ring)
+}
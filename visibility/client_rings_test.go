@@ -0,0 +1,109 @@
+package visibility
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestClientRings(t *testing.T) {
+	assert.Equal(t, []string{ClientTypeCanary, ClientTypeNormal}, ClientRings())
+	assert.True(t, IsRingAtLeastAsRisky(ClientTypeCanary, ClientTypeNormal))
+	assert.False(t, IsRingAtLeastAsRisky(ClientTypeNormal, ClientTypeCanary))
+	// The unknown rings are the safest
+	assert.False(t, IsRingAtLeastAsRisky("Vasja", ClientTypeNormal))
+	assert.True(t, IsRingAtLeastAsRisky("Vasja", "Vasja"))
+
+	SetClientRings(ClientTypeCanary, "early", "stable")
+	defer SetClientRings()
+
+	assert.Equal(t, 1, ClientRingRank("early"))
+	assert.Equal(t, 3, ClientRingRank(ClientTypeNormal))
+	assert.True(t, IsRingAtLeastAsRisky("early", "stable"))
+	assert.True(t, IsRingAtLeastAsRisky(ClientTypeCanary, "early"))
+	assert.False(t, IsRingAtLeastAsRisky("early", ClientTypeCanary))
+
+	ctx := ContextWithClientType(context.Background(), "early")
+	assert.True(t, IsAtLeastAsRiskyAs(ctx, "early"))
+	assert.False(t, IsAtLeastAsRiskyAs(ctx, ClientTypeCanary))
+	assert.False(t, IsCanary(ctx))
+}
+
+func TestUnknownClientRing(t *testing.T) {
+	// The canary is not registered
+	SetClientRings("early", "stable")
+	defer SetClientRings()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	run := func(clientType string, ring string) bool {
+		ctx := ContextWithClientType(ImbueContext(context.Background(), logger), clientType)
+		ran := false
+		assert.NoError(t, RunUnlessRing(ctx, ring, func(ctx context.Context) error {
+			ran = true
+			return nil
+		}))
+		return ran
+	}
+
+	// The misspelled ring skips nothing, and it's logged once
+	assert.True(t, run("early", "eraly"))
+	assert.True(t, run("stable", "eraly"))
+	assert.Equal(t, 1, strings.Count(sink.String(), "The client ring is not registered"))
+	assert.True(t, strings.Contains(sink.String(), `"ring":"eraly"`))
+
+	assert.True(t, run("stable", ClientTypeCanary))
+	assert.True(t, run("early", ClientTypeCanary))
+	// The exact match is still skipped
+	assert.False(t, run(ClientTypeCanary, ClientTypeCanary))
+}
+
+func TestRunUnlessRing(t *testing.T) {
+	SetClientRings(ClientTypeCanary, "early", "stable")
+	defer SetClientRings()
+
+	run := func(clientType string, ring string) (bool, context.Context) {
+		ctx := canaryTestCtx(clientType)
+		ran := false
+		err := RunUnlessRing(ctx, ring, func(ctx context.Context) error {
+			ran = true
+			return nil
+		})
+		assert.NoError(t, err)
+		return ran, ctx
+	}
+
+	ran, ctx := run("early", "early")
+	assert.False(t, ran)
+	assert.Equal(t, 1.0, GetMetricsFromContext(ctx).Metrics[CanarySkippedMetric].Val)
+	ran, _ = run(ClientTypeCanary, "early")
+	assert.False(t, ran)
+	ran, _ = run("stable", "early")
+	assert.True(t, ran)
+
+	// The canary-only helpers are not affected by the other rings
+	ctx = canaryTestCtx("early")
+	ran = false
+	assert.NoError(t, RunUnlessCanary(ctx, func(ctx context.Context) error {
+		ran = true
+		return nil
+	}))
+	assert.True(t, ran)
+
+	var called string
+	realFn := func(ctx context.Context) error {
+		called = "real"
+		return nil
+	}
+	shadowFn := func(ctx context.Context) error {
+		called = "shadow"
+		return nil
+	}
+	ctx = canaryTestCtx("early")
+	assert.NoError(t, ShadowOnRing(ctx, "early", realFn, shadowFn))
+	assert.Equal(t, "shadow", called)
+	assert.Equal(t, 1.0, GetMetricsFromContext(ctx).Metrics[ShadowedMetric].Val)
+	assert.NoError(t, ShadowOnCanary(ctx, realFn, shadowFn))
+	assert.Equal(t, "real", called)
+}
@@ -5,10 +5,12 @@
 package visibility
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"net/http"
 	"strconv"
+	"time"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
@@ -85,9 +87,15 @@ func (wc *wrappedClient) Do(req *http.Request) (*http.Response, error) {
 	if err != nil {
 		panic(fmt.Sprintf("twirp: failed to inject http headers: %v\n", err))
 	}
+	// The downstream logs can be found by the originating request ID
+	propagateRequestId(span, req.Header)
 
 	req = req.WithContext(ctx)
+	start := time.Now()
 	res, err := wc.c.Do(req)
+	if met := TryGetMetricsFromContext(ctx); met != nil {
+		recordClientMetrics(ctx, met, svc+"."+method, res, err, time.Now().Sub(start))
+	}
 	if err != nil {
 		span.SetTag(ext.Error, err)
 	} else {
@@ -100,3 +108,31 @@ func (wc *wrappedClient) Do(req *http.Request) (*http.Response, error) {
 	}
 	return res, err
 }
+
+// Record the client-side metrics of the call into the calling operation's
+// metrics: "<service>.<method>.ClientTime", "ClientSuccess" and "ClientError".
+// The responses are also counted in "<op>.<service>.<method>.ClientStatus"
+// tagged with their status code, sent to the context's statsd right away.
+func recordClientMetrics(ctx context.Context, met *MetricsContext, prefix string,
+	res *http.Response, err error, duration time.Duration) {
+
+	met.AddDuration(prefix+".ClientTime", duration)
+	met.AddCount(prefix+".ClientSuccess", 0)
+	met.AddCount(prefix+".ClientError", 0)
+
+	if err != nil {
+		met.AddCount(prefix+".ClientError", 1)
+		return
+	}
+	met.Lock.Lock()
+	opName := met.OpName
+	met.Lock.Unlock()
+	_ = GetStatsdFromContext(ctx).Distribution(opName+"."+prefix+".ClientStatus", 1,
+		[]string{"unit:count", "status:" + strconv.Itoa(res.StatusCode),
+			ClientTypeTag + ":" + GetClientTypeFromContext(ctx)}, 1)
+	if res.StatusCode >= 400 {
+		met.AddCount(prefix+".ClientError", 1)
+	} else {
+		met.AddCount(prefix+".ClientSuccess", 1)
+	}
+}
@@ -0,0 +1,62 @@
+package visibility
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/twitchtv/twirp/ctxsetters"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"testing"
+)
+
+type fakeTwirpClient struct {
+	status int
+	err    error
+}
+
+func (f *fakeTwirpClient) Do(req *http.Request) (*http.Response, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &http.Response{StatusCode: f.status, Request: req}, nil
+}
+
+func TestTwirpClientMetrics(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	fake := &fakeTwirpClient{status: http.StatusOK}
+	client := WrapTwirpClientDef(fake, "example")
+
+	statuses := NewRecordingSink()
+	ctx := MakeMetricContext(ContextWithStatsd(context.Background(), statuses), "Op")
+	ctx = ctxsetters.WithServiceName(ctx, "Example")
+	ctx = ctxsetters.WithMethodName(ctx, "MakeHat")
+
+	call := func() {
+		req, err := http.NewRequest("POST", "http://localhost/twirp/MakeHat", nil)
+		assert.NoError(t, err)
+		_, _ = client.Do(req.WithContext(ctx))
+	}
+	call()
+	fake.status = http.StatusServiceUnavailable
+	call()
+	fake.err = errors.New("connection refused")
+	call()
+
+	sink := NewRecordingSink()
+	GetMetricsFromContext(ctx).CopyToStatsd(sink, ClientTypeNormal)
+
+	assert.Equal(t, 1.0, sink.Distributions["Op.Example.MakeHat.ClientSuccess"])
+	assert.Equal(t, 2.0, sink.Distributions["Op.Example.MakeHat.ClientError"])
+	// The status is the tag of the last response
+	assert.Equal(t, 1.0, statuses.Distributions["Op.Example.MakeHat.ClientStatus"])
+	assert.Equal(t, []string{"unit:count", "status:503", "client-type:normal"},
+		statuses.Tags["Op.Example.MakeHat.ClientStatus"])
+	assert.NotContains(t, sink.Distributions, "Op.Example.MakeHat.ClientStatus5xx")
+	_, hasTime := sink.Distributions["Op.Example.MakeHat.ClientTime"]
+	assert.True(t, hasTime)
+	assert.Equal(t, []string{"unit:microseconds", "client-type:normal"},
+		sink.Tags["Op.Example.MakeHat.ClientTime"])
+}
@@ -0,0 +1,109 @@
+package visibility
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net"
+	"net/http"
+)
+
+// The header the callers without a tracer (e.g. curl or the browsers) can set
+// their client type with
+const DefaultClientTypeHeader = "X-Client-Type"
+
+// The header with the shared secret, if ClientTypeHeaderOptions.Secret is set
+const DefaultClientTypeSecretHeader = "X-Client-Type-Secret"
+
+// Honor the client type header of the requests that don't have the client type
+// in their span baggage. The header is ignored unless its value is one of the
+// ClientRings, and unless the request passes the spoofing checks.
+type ClientTypeHeaderOptions struct {
+	// DefaultClientTypeHeader if empty
+	Header string
+
+	// Honor the header only from these networks (see ParseCIDRs), if set
+	TrustedNets []*net.IPNet
+
+	// Honor the header only if the SecretHeader has this value, if set
+	Secret string
+	// DefaultClientTypeSecretHeader if empty
+	SecretHeader string
+}
+
+// Parse the CIDRs (e.g. "10.0.0.0/8") for the ClientTypeHeaderOptions.TrustedNets
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted network %q: %w", c, err)
+		}
+		res = append(res, ipNet)
+	}
+	return res, nil
+}
+
+// Get the client type of the inbound request: from the span baggage, or from
+// the client type header if it's enabled (opts are not nil). The client type
+// from the header is written into the baggage, so it propagates downstream.
+func ClientTypeFromRequest(span tracer.Span, r *http.Request,
+	opts *ClientTypeHeaderOptions) string {
+
+	if item := span.BaggageItem(ClientTypeTag); item != "" || opts == nil {
+		return ClientTypeFromSpan(span)
+	}
+
+	header := opts.Header
+	if header == "" {
+		header = DefaultClientTypeHeader
+	}
+	clientType := r.Header.Get(header)
+	if clientType == "" || !isKnownClientRing(clientType) || !opts.isTrusted(r) {
+		return ClientTypeNormal
+	}
+
+	span.SetBaggageItem(ClientTypeTag, clientType)
+	return clientType
+}
+
+func isKnownClientRing(clientType string) bool {
+	for _, ring := range ClientRings() {
+		if ring == clientType {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *ClientTypeHeaderOptions) isTrusted(r *http.Request) bool {
+	if len(o.TrustedNets) != 0 && !o.fromTrustedNet(r) {
+		return false
+	}
+	if o.Secret != "" {
+		secretHeader := o.SecretHeader
+		if secretHeader == "" {
+			secretHeader = DefaultClientTypeSecretHeader
+		}
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get(secretHeader)),
+			[]byte(o.Secret)) == 1
+	}
+	return true
+}
+
+func (o *ClientTypeHeaderOptions) fromTrustedNet(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range o.TrustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package visibility
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientTypeFromRequest(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	nets, err := ParseCIDRs("10.0.0.0/8")
+	assert.NoError(t, err)
+	_, err = ParseCIDRs("garbage")
+	assert.Error(t, err)
+
+	check := func(opts *ClientTypeHeaderOptions, remoteAddr string,
+		headers map[string]string) (string, string) {
+
+		span := tracer.StartSpan("test")
+		defer span.Finish()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return ClientTypeFromRequest(span, r, opts), span.BaggageItem(ClientTypeTag)
+	}
+	canary := map[string]string{DefaultClientTypeHeader: ClientTypeCanary}
+
+	// The header is disabled by default
+	ct, _ := check(nil, "10.1.1.1:1234", canary)
+	assert.Equal(t, ClientTypeNormal, ct)
+
+	// The client type is written into the baggage
+	ct, baggage := check(&ClientTypeHeaderOptions{}, "10.1.1.1:1234", canary)
+	assert.Equal(t, ClientTypeCanary, ct)
+	assert.Equal(t, ClientTypeCanary, baggage)
+
+	// The unknown client types are ignored
+	ct, baggage = check(&ClientTypeHeaderOptions{}, "10.1.1.1:1234",
+		map[string]string{DefaultClientTypeHeader: "whatever"})
+	assert.Equal(t, ClientTypeNormal, ct)
+	assert.Equal(t, "", baggage)
+
+	// Only the trusted networks are honored
+	trusted := &ClientTypeHeaderOptions{TrustedNets: nets}
+	ct, _ = check(trusted, "10.1.1.1:1234", canary)
+	assert.Equal(t, ClientTypeCanary, ct)
+	ct, _ = check(trusted, "192.168.1.1:1234", canary)
+	assert.Equal(t, ClientTypeNormal, ct)
+
+	// The shared secret must match
+	secret := &ClientTypeHeaderOptions{Header: "X-Ring", Secret: "s3cr3t"}
+	ct, _ = check(secret, "192.168.1.1:1234", map[string]string{
+		"X-Ring": ClientTypeCanary, DefaultClientTypeSecretHeader: "s3cr3t"})
+	assert.Equal(t, ClientTypeCanary, ct)
+	ct, _ = check(secret, "192.168.1.1:1234", map[string]string{
+		"X-Ring": ClientTypeCanary, DefaultClientTypeSecretHeader: "wrong"})
+	assert.Equal(t, ClientTypeNormal, ct)
+}
+
+func TestGorillaClientTypeHeader(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	rs := NewRecordingSink()
+	gorilla := NewTracedGorilla(&panickyTwirpServer{succeed: true}, zap.NewNop(),
+		rs, nil, nil)
+	gorilla.SetClientTypeHeader(&ClientTypeHeaderOptions{})
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	req := httptest.NewRequest(http.MethodPost, "/twirp/twirp.test.Example/MakeHat", nil)
+	req.Header.Set(DefaultClientTypeHeader, ClientTypeCanary)
+	muxer.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, []string{"unit:bytes", "client-type:canary"},
+		rs.Tags["Example.MakeHat.BytesOut"])
+
+	// The client type propagates downstream in the baggage
+	baggage := map[string]string{}
+	mt.FinishedSpans()[0].Context().ForeachBaggageItem(func(k, v string) bool {
+		baggage[k] = v
+		return true
+	})
+	assert.Equal(t, ClientTypeCanary, baggage[ClientTypeTag])
+}
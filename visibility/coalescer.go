@@ -0,0 +1,110 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"sync"
+)
+
+const CoalescedMetric = "Coalesced"
+const CoalesceKeyTag = "coalesce.key"
+const CoalesceLeaderTraceTag = "coalesce.leader_trace_id"
+const CoalesceLeaderSpanTag = "coalesce.leader_span_id"
+
+type coalescedCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+
+	leaderTraceId, leaderSpanId uint64
+}
+
+// Coalescer collapses the concurrent calls with the same key into one call
+// (the "singleflight" pattern), e.g. to avoid the backend stampede on a cache miss.
+type Coalescer struct {
+	name  string
+	mtx   sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// Create a coalescer, the name is used for the spans and metrics of the calls
+func NewCoalescer(name string) *Coalescer {
+	return &Coalescer{name: name, calls: make(map[string]*coalescedCall)}
+}
+
+// Run fn once for all the concurrent callers with the same key. The first caller
+// (the leader) runs fn under RunInstrumented with its own context, so its
+// cancellation affects all the callers. The other callers wait for the result,
+// each within its own span tagged with the leader's span ID, and their metrics
+// get the Coalesced count. The shared flag is true for the callers that got
+// the result of someone else's call.
+func (c *Coalescer) Do(ctx context.Context, key string,
+	fn func(ctx context.Context) (interface{}, error)) (val interface{}, err error, shared bool) {
+
+	c.mtx.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mtx.Unlock()
+		val, err = c.wait(ctx, key, call)
+		return val, err, true
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mtx.Unlock()
+
+	c.lead(ctx, key, call, fn)
+	return call.val, call.err, false
+}
+
+func (c *Coalescer) lead(ctx context.Context, key string, call *coalescedCall,
+	fn func(ctx context.Context) (interface{}, error)) {
+
+	defer func() {
+		if p := recover(); p != nil {
+			// Don't leave the followers hanging
+			call.err = fmt.Errorf("coalesced call panicked: %v", p)
+			c.finish(key, call)
+			panic(p)
+		}
+		c.finish(key, call)
+	}()
+
+	_ = RunInstrumented(ctx, c.name, func(ctx context.Context) error {
+		span := SpanFromContextOrNoop(ctx)
+		span.SetTag(CoalesceKeyTag, key)
+		call.leaderTraceId = span.Context().TraceID()
+		call.leaderSpanId = span.Context().SpanID()
+		call.val, call.err = fn(ctx)
+		return call.err
+	})
+}
+
+func (c *Coalescer) finish(key string, call *coalescedCall) {
+	c.mtx.Lock()
+	delete(c.calls, key)
+	c.mtx.Unlock()
+	close(call.done)
+}
+
+func (c *Coalescer) wait(ctx context.Context, key string,
+	call *coalescedCall) (interface{}, error) {
+
+	if met := TryGetMetricsFromContext(ctx); met != nil {
+		met.AddCount(CoalescedMetric, 1)
+	}
+
+	span, ctx := tracer.StartSpanFromContext(ctx, c.name+".coalesced",
+		tracer.ResourceName(c.name), tracer.Tag(CoalesceKeyTag, key))
+
+	select {
+	case <-ctx.Done():
+		span.Finish(tracer.WithError(ctx.Err()))
+		return nil, ctx.Err()
+	case <-call.done:
+	}
+
+	span.SetTag(CoalesceLeaderTraceTag, fmt.Sprintf("%d", call.leaderTraceId))
+	span.SetTag(CoalesceLeaderSpanTag, fmt.Sprintf("%d", call.leaderSpanId))
+	span.Finish(tracer.WithError(call.err))
+	return call.val, call.err
+}
@@ -0,0 +1,100 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCoalescer(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	co := NewCoalescer("FetchThing")
+
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return "result", nil
+	}
+
+	// Start the leader
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		val, err, shared := co.Do(ctx, "key", fn)
+		assert.NoError(t, err)
+		assert.Equal(t, "result", val)
+		assert.False(t, shared)
+	}()
+	<-started
+
+	// Followers piggyback on the leader's call
+	wg := sync.WaitGroup{}
+	var metrics []*MetricsContext
+	for i := 0; i < 3; i++ {
+		mctx := MakeMetricContext(ctx, fmt.Sprintf("Follower%d", i))
+		metrics = append(metrics, GetMetricsFromContext(mctx))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err, shared := co.Do(mctx, "key", func(ctx context.Context) (interface{}, error) {
+				panic("must not be called")
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "result", val)
+			assert.True(t, shared)
+		}()
+	}
+
+	// Wait until all the followers have joined
+	for {
+		joined := 0
+		for _, m := range metrics {
+			joined += int(m.GetMetricVal(CoalescedMetric))
+		}
+		if joined == 3 {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+	<-leaderDone
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	var leaderSpanId uint64
+	followers := 0
+	for _, s := range mt.FinishedSpans() {
+		if s.OperationName() == "FetchThing" {
+			leaderSpanId = s.SpanID()
+		}
+	}
+	for _, s := range mt.FinishedSpans() {
+		if s.OperationName() == "FetchThing.coalesced" {
+			followers++
+			assert.Equal(t, fmt.Sprintf("%d", leaderSpanId), s.Tag(CoalesceLeaderSpanTag))
+		}
+	}
+	assert.Equal(t, 3, followers)
+
+	// The key is released after the call
+	val, err, shared := co.Do(ctx, "key", func(ctx context.Context) (interface{}, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	assert.Nil(t, val)
+	assert.Error(t, err)
+	assert.False(t, shared)
+}
@@ -0,0 +1,190 @@
+package visibility
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The responses smaller than this are not worth compressing
+const DefaultCompressionThreshold = 1024
+
+const CompressionRatioMetric = "CompressionRatio"
+
+// Check whether the client accepts the gzip-encoded responses
+func AcceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// The writer that gzips the response on top of the underlying writer, counting
+// both the uncompressed and the sent bytes. The data is buffered until the
+// threshold is reached, the shorter responses are sent as-is. Close must be
+// called once the response is written.
+type CompressingWriter struct {
+	dst       http.ResponseWriter
+	threshold int
+
+	statusCode int
+	buf        []byte
+	bytesIn    int64
+	bytesOut   int64
+	decided    bool
+	gz         *gzip.Writer
+}
+
+func NewCompressingWriter(dst http.ResponseWriter, threshold int) *CompressingWriter {
+	return &CompressingWriter{dst: dst, threshold: threshold}
+}
+
+func (c *CompressingWriter) Header() http.Header {
+	return c.dst.Header()
+}
+
+func (c *CompressingWriter) WriteHeader(code int) {
+	if c.decided {
+		// The header is already sent
+		return
+	}
+	c.statusCode = code
+}
+
+func (c *CompressingWriter) Write(data []byte) (int, error) {
+	c.bytesIn += int64(len(data))
+	if !c.decided {
+		c.buf = append(c.buf, data...)
+		if len(c.buf) < c.threshold {
+			return len(data), nil
+		}
+		if err := c.decide(true); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	if c.gz != nil {
+		return c.gz.Write(data)
+	}
+	return c.writeOut(data)
+}
+
+func (c *CompressingWriter) writeOut(data []byte) (int, error) {
+	n, err := c.dst.Write(data)
+	c.bytesOut += int64(n)
+	return n, err
+}
+
+// Send the header and the buffered data, compressing them if requested
+func (c *CompressingWriter) decide(compress bool) error {
+	c.decided = true
+
+	header := c.dst.Header()
+	if compress && header.Get("Content-Encoding") == "" {
+		// The length set by the handler is the uncompressed one
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", "gzip")
+		header.Add("Vary", "Accept-Encoding")
+		c.gz = gzip.NewWriter(writerFunc(c.writeOut))
+	}
+	if c.statusCode != 0 {
+		c.dst.WriteHeader(c.statusCode)
+	}
+
+	buf := c.buf
+	c.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if c.gz != nil {
+		_, err = c.gz.Write(buf)
+	} else {
+		_, err = c.writeOut(buf)
+	}
+	return err
+}
+
+// The flushed responses are streamed, so they are compressed regardless of
+// their size
+func (c *CompressingWriter) Flush() {
+	if !c.decided {
+		if err := c.decide(true); err != nil {
+			return
+		}
+	}
+	if c.gz != nil {
+		if err := c.gz.Flush(); err != nil {
+			return
+		}
+	}
+	if flusher, ok := c.dst.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// The connection can be hijacked (e.g. for websockets) only before anything
+// is written
+func (c *CompressingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := c.dst.(http.Hijacker)
+	if !ok || c.decided || len(c.buf) != 0 {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	c.decided = true
+	return hijacker.Hijack()
+}
+
+// Flush the remaining data
+func (c *CompressingWriter) Close() error {
+	if !c.decided {
+		if err := c.decide(false); err != nil {
+			return err
+		}
+	}
+	if c.gz == nil {
+		return nil
+	}
+	return c.gz.Close()
+}
+
+// The number of bytes written by the handler
+func (c *CompressingWriter) BytesIn() int64 {
+	return c.bytesIn
+}
+
+// The number of bytes sent to the underlying writer, compressed or not
+func (c *CompressingWriter) BytesOut() int64 {
+	return c.bytesOut
+}
+
+// The ratio of the uncompressed and compressed sizes, if the response was compressed
+func (c *CompressingWriter) CompressionRatio() (float64, bool) {
+	if c.gz == nil || c.bytesIn == 0 || c.bytesOut == 0 {
+		return 0, false
+	}
+	return float64(c.bytesIn) / float64(c.bytesOut), true
+}
+
+type writerFunc func(data []byte) (int, error)
+
+func (f writerFunc) Write(data []byte) (int, error) {
+	return f(data)
+}
@@ -0,0 +1,100 @@
+package visibility
+
+import (
+	"compress/gzip"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/twitchtv/twirp/ctxsetters"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The fake twirp server that returns a response of the given size
+type sizedTwirpServer struct {
+	panickyTwirpServer
+	size int
+}
+
+func (s *sizedTwirpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := ctxsetters.WithPackageName(r.Context(), "twirp.test")
+	ctx = ctxsetters.WithServiceName(ctx, "Example")
+	ctx = ctxsetters.WithMethodName(ctx, "MakeHat")
+	hooks := MakeTraceHooks("test")
+	ctx, _ = hooks.RequestRouted(ctx)
+
+	w.Header().Set("Content-Length", strconv.Itoa(s.size))
+	w.WriteHeader(http.StatusTeapot)
+	_, _ = w.Write([]byte(strings.Repeat("a", s.size)))
+	hooks.ResponseSent(ctx)
+}
+
+func serveSized(size int, acceptEncoding string) (*httptest.ResponseRecorder,
+	*RecordingSink, string) {
+
+	rs := NewRecordingSink()
+	sink, logger := utils.NewMemorySinkLogger()
+	gorilla := NewTracedGorilla(&sizedTwirpServer{size: size}, logger, rs, nil, nil)
+	gorilla.SetResponseCompression(100)
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	req := httptest.NewRequest(http.MethodPost, "/twirp/twirp.test.Example/MakeHat", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	muxer.ServeHTTP(rec, req)
+	return rec, rs, sink.String()
+}
+
+func TestResponseCompression(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	rec, rs, logs := serveSized(10000, "deflate, gzip")
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "", rec.Header().Get("Content-Length"))
+
+	reader, err := gzip.NewReader(rec.Body)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 10000), string(data))
+
+	// The compressed size is accounted
+	bytesOut := rs.Distributions["Example.MakeHat.BytesOut"]
+	assert.True(t, bytesOut > 0 && bytesOut < 1000)
+	assert.Equal(t, 10000/bytesOut, rs.Distributions["Example.MakeHat.CompressionRatio"])
+	assert.Contains(t, logs, `"compression_ratio"`)
+}
+
+func TestResponseCompressionSkipped(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	// Below the threshold
+	rec, rs, logs := serveSized(99, "gzip")
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "99", rec.Header().Get("Content-Length"))
+	assert.Equal(t, 99, rec.Body.Len())
+	assert.Equal(t, 99.0, rs.Distributions["Example.MakeHat.BytesOut"])
+	_, ok := rs.Distributions["Example.MakeHat.CompressionRatio"]
+	assert.False(t, ok)
+	assert.NotContains(t, logs, "compression_ratio")
+
+	// The client doesn't support gzip
+	for _, enc := range []string{"", "deflate", "gzip;q=0"} {
+		rec, rs, _ = serveSized(10000, enc)
+		assert.Equal(t, "", rec.Header().Get("Content-Encoding"))
+		assert.Equal(t, 10000, rec.Body.Len())
+		assert.Equal(t, 10000.0, rs.Distributions["Example.MakeHat.BytesOut"])
+	}
+}
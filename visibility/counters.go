@@ -0,0 +1,115 @@
+package visibility
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"math"
+	"sync/atomic"
+)
+
+// The lock-free count metric of a MetricsContext, for the hot loops of the
+// batch jobs where the AddCount's lock is contended
+type Counter struct {
+	bits uint64
+}
+
+// Add to the counter without taking the context's lock. The unit is always
+// Count, the value is merged (added) into the context's metric of the same
+// name when the metrics are read or copied out (GetMetric, String, CopyToSpan,
+// CopyToStatsd, FlushDeltaToStatsd), so the Metrics map itself lags behind
+// until then.
+func (c *Counter) Add(val float64) {
+	for {
+		old := atomic.LoadUint64(&c.bits)
+		upd := math.Float64bits(math.Float64frombits(old) + val)
+		if atomic.CompareAndSwapUint64(&c.bits, old, upd) {
+			return
+		}
+	}
+}
+
+// Get the value accumulated since the last merge and zero it
+func (c *Counter) take() float64 {
+	return math.Float64frombits(atomic.SwapUint64(&c.bits, 0))
+}
+
+// Pad the shards to their own cache lines, so the writers don't contend
+type paddedCounter struct {
+	Counter
+	_ [56]byte
+}
+
+// The Counter split into shards, for many goroutines writing the same metric:
+// each writer takes its own shard once with Shard() and adds to it, the shards
+// are summed at merge time
+type ShardedCounter struct {
+	shards []paddedCounter
+	next   uint32
+}
+
+// Get the next shard in the round-robin order, the handle should be kept by
+// the writer goroutine instead of being re-fetched for every Add
+func (s *ShardedCounter) Shard() *Counter {
+	idx := atomic.AddUint32(&s.next, 1) - 1
+	return &s.shards[idx%uint32(len(s.shards))].Counter
+}
+
+func (s *ShardedCounter) take() float64 {
+	sum := 0.0
+	for i := range s.shards {
+		sum += s.shards[i].take()
+	}
+	return sum
+}
+
+// Get the lock-free counter for the metric, it's created on the first call and
+// the later calls return the same handle. The unit of the metric is Count, the
+// added values are merged into the metric on its reads and flushes (see
+// Counter.Add), so it can be mixed with AddCount. Reset zeroes the counters but
+// keeps the handles valid.
+func (m *MetricsContext) Counter(name string) *Counter {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	c := m.counters[name]
+	if c == nil {
+		if m.counters == nil {
+			m.counters = make(map[string]*Counter)
+		}
+		c = &Counter{}
+		m.counters[name] = c
+	}
+	return c
+}
+
+// Get the sharded counter for the metric, for the multi-goroutine writers. The
+// number of shards is set on the first call (with the minimum of 1), it should
+// be about the number of the writers. The semantics are the same as for
+// Counter: the unit is Count, the shards' sum is merged on the reads and flushes.
+func (m *MetricsContext) ShardedCounter(name string, shards int) *ShardedCounter {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	s := m.shardedCounters[name]
+	if s == nil {
+		if shards < 1 {
+			shards = 1
+		}
+		if m.shardedCounters == nil {
+			m.shardedCounters = make(map[string]*ShardedCounter)
+		}
+		s = &ShardedCounter{shards: make([]paddedCounter, shards)}
+		m.shardedCounters[name] = s
+	}
+	return s
+}
+
+// Merge the counters into the Metrics map. The metrics of the counters are
+// created even if nothing was added, like with AddCount(name, 0).
+func (m *MetricsContext) foldCountersLocked() {
+	for name, c := range m.counters {
+		m.addMetricLocked(name, c.take(), cloudwatch.StandardUnitCount)
+	}
+	for name, s := range m.shardedCounters {
+		m.addMetricLocked(name, s.take(), cloudwatch.StandardUnitCount)
+	}
+}
@@ -0,0 +1,114 @@
+package visibility
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	mctx := GetMetricsFromContext(MakeMetricContext(context.Background(), "TestOp"))
+
+	counter := mctx.Counter("items")
+	assert.True(t, counter == mctx.Counter("items"))
+	sharded := mctx.ShardedCounter("rows", 4)
+	assert.True(t, sharded == mctx.ShardedCounter("rows", 8))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shard := sharded.Shard()
+			for j := 0; j < 1000; j++ {
+				counter.Add(1)
+				shard.Add(0.5)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The counters are merged with the regular metrics
+	mctx.AddCount("items", 2)
+	val, unit := mctx.GetMetric("items")
+	assert.Equal(t, 8002.0, val)
+	assert.Equal(t, cloudwatch.StandardUnitCount, unit)
+	assert.Equal(t, 4000.0, mctx.GetMetricVal("rows"))
+
+	// The merge is done once
+	counter.Add(3)
+	sink := NewRecordingSink()
+	mctx.CopyToStatsd(sink, "batch")
+	assert.Equal(t, 8005.0, sink.Distributions["TestOp.items"])
+	assert.Equal(t, 4000.0, sink.Distributions["TestOp.rows"])
+	assert.Equal(t, "unit:count", sink.Tags["TestOp.items"][0])
+
+	// The handles survive the reset
+	mctx.Reset()
+	counter.Add(1)
+	assert.Equal(t, 1.0, mctx.GetMetricVal("items"))
+	assert.Equal(t, 0.0, mctx.GetMetricVal("rows"))
+}
+
+func TestCounterFlushDelta(t *testing.T) {
+	mctx := GetMetricsFromContext(MakeMetricContext(context.Background(), "TestOp"))
+	counter := mctx.Counter("items")
+
+	counter.Add(5)
+	sink := NewRecordingSink()
+	mctx.FlushDeltaToStatsd(sink, "batch")
+	assert.Equal(t, 5.0, sink.Distributions["TestOp.items"])
+
+	counter.Add(2)
+	sink.Clear()
+	mctx.CopyToStatsd(sink, "batch")
+	assert.Equal(t, 2.0, sink.Distributions["TestOp.items"])
+}
+
+const benchGoroutines = 8
+
+// Split the b.N operations among benchGoroutines goroutines
+func runConcurrently(b *testing.B, fn func(worker, n int)) {
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for w := 0; w < benchGoroutines; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			fn(worker, b.N/benchGoroutines)
+		}(w)
+	}
+	wg.Wait()
+}
+
+func BenchmarkAddCount(b *testing.B) {
+	mctx := GetMetricsFromContext(MakeMetricContext(context.Background(), "BenchOp"))
+	runConcurrently(b, func(worker, n int) {
+		for i := 0; i < n; i++ {
+			mctx.AddCount("items", 1)
+		}
+	})
+}
+
+func BenchmarkCounter(b *testing.B) {
+	mctx := GetMetricsFromContext(MakeMetricContext(context.Background(), "BenchOp"))
+	counter := mctx.Counter("items")
+	runConcurrently(b, func(worker, n int) {
+		for i := 0; i < n; i++ {
+			counter.Add(1)
+		}
+	})
+}
+
+func BenchmarkShardedCounter(b *testing.B) {
+	mctx := GetMetricsFromContext(MakeMetricContext(context.Background(), "BenchOp"))
+	sharded := mctx.ShardedCounter("items", benchGoroutines)
+	runConcurrently(b, func(worker, n int) {
+		shard := sharded.Shard()
+		for i := 0; i < n; i++ {
+			shard.Add(1)
+		}
+	})
+}
@@ -7,7 +7,10 @@ import (
 	"go.uber.org/zap"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 	"gopkg.in/DataDog/dd-trace-go.v1/profiler"
+	"net/http"
 	"os"
+	"strconv"
+	"sync"
 )
 
 func SetupTracing(ctx context.Context, appName, envName string, logger *zap.Logger) (
@@ -20,6 +23,7 @@ func SetupTracing(ctx context.Context, appName, envName string, logger *zap.Logg
 	agentHost := os.Getenv("DD_AGENT_HOST")
 	if agentHost == "" {
 		logger.Info("No DD_AGENT_HOST set, tracing and metrics are disabled")
+		startDebugSpanRecorder(logger)
 		return &statsd.NoOpClient{}, nil
 	}
 
@@ -29,18 +33,30 @@ func SetupTracing(ctx context.Context, appName, envName string, logger *zap.Logg
 		statsd.WithTags([]string{"env:"+envName}),
 	}
 
-	var cli statsd.ClientInterface
-	cli, err := statsd.New("", statsTags...)
-	if err != nil {
-		cli = &statsd.NoOpClient{}
-		logger.Error("Failed to initialize the stats daemon", zap.Error(err))
-	}
+	// The agent might not be up yet, the client is re-created until it is
+	cli := NewLazyStatsd(func() (statsd.ClientInterface, error) {
+		return statsd.New("", statsTags...)
+	}, logger)
 
 	// Start the tracer
 	options := []tracer.StartOption{
 		tracer.WithAnalytics(true),
 		tracer.WithServiceName(utils.ToSnakeCase(appName, '-')),
 		tracer.WithGlobalTag("env", envName),
+		// Log the tracer's errors (e.g. the dropped traces) with our logger
+		tracer.WithLogger(NewTracerLogger(logger)),
+		// The runtime metrics are billed as the custom ones, so they are
+		// opt-in: the tracer enables them if DD_RUNTIME_METRICS_ENABLED is set
+	}
+	buildInfo := GetBuildInfo()
+	if buildInfo.Version != "" {
+		options = append(options, tracer.WithServiceVersion(buildInfo.Version))
+	}
+	if buildInfo.Commit != "" {
+		options = append(options, tracer.WithGlobalTag("commit", buildInfo.Commit))
+	}
+	if buildInfo.BuildTime != "" {
+		options = append(options, tracer.WithGlobalTag("build_time", buildInfo.BuildTime))
 	}
 	profilerOptions := []profiler.Option{
 		profiler.WithService(utils.ToSnakeCase(appName, '-')),
@@ -52,6 +68,10 @@ func SetupTracing(ctx context.Context, appName, envName string, logger *zap.Logg
 		profiler.WithAPIKey(""), // Clear the API key to enable the local agent use
 	}
 
+	if buildInfo.Version != "" {
+		profilerOptions = append(profilerOptions, profiler.WithTags("version:"+buildInfo.Version))
+	}
+
 	// Hostname is not always pulled automatically
 	ddHost := os.Getenv("DD_HOSTNAME")
 	if ddHost != "" {
@@ -61,7 +81,7 @@ func SetupTracing(ctx context.Context, appName, envName string, logger *zap.Logg
 	tracer.Start(options...)
 
 	// Start the profiler
-	err = profiler.Start(profilerOptions...)
+	err := profiler.Start(profilerOptions...)
 	if err != nil {
 		logger.Error("Failed to initialize the profiler", zap.Error(err))
 	}
@@ -69,9 +89,59 @@ func SetupTracing(ctx context.Context, appName, envName string, logger *zap.Logg
 	return cli, nil
 }
 
-func TearDownTracing(ctx context.Context, client statsd.ClientInterface) {
+// The span recorder installed by SetupTracing if DD_DEBUG_SPANS is set to the
+// number of spans to keep, and there's no agent
+var debugSpanRecorderMtx sync.Mutex
+var debugSpanRecorder *SpanRecorder
+
+func startDebugSpanRecorder(logger *zap.Logger) {
+	maxSpans, _ := strconv.Atoi(os.Getenv("DD_DEBUG_SPANS"))
+	if maxSpans <= 0 {
+		return
+	}
+	logger.Info("Recording the spans locally", zap.Int("max_spans", maxSpans))
+
+	debugSpanRecorderMtx.Lock()
+	defer debugSpanRecorderMtx.Unlock()
+	debugSpanRecorder = StartSpanRecorder(maxSpans)
+}
+
+// The handler serving the locally recorded spans (see DD_DEBUG_SPANS), to be
+// mounted at /debug/spans
+func DebugSpansHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		debugSpanRecorderMtx.Lock()
+		rec := debugSpanRecorder
+		debugSpanRecorderMtx.Unlock()
+
+		if rec == nil {
+			http.Error(w, "span recording is not enabled", http.StatusNotFound)
+			return
+		}
+		rec.Handler().ServeHTTP(w, r)
+	})
+}
+
+// Stop the tracer, the profiler and the debug span recorder, this is the
+// tracing step of the ShutdownSequence
+func StopTracing(ctx context.Context) error {
+	debugSpanRecorderMtx.Lock()
+	rec := debugSpanRecorder
+	debugSpanRecorder = nil
+	debugSpanRecorderMtx.Unlock()
+
+	if rec != nil {
+		rec.Stop()
+	}
 	tracer.Stop()
 	profiler.Stop()
-	_ = client.Flush()
-	_ = client.Close()
+	return nil
+}
+
+// Stop the tracing and close the statsd client. The ShutdownSequence (see
+// NewDefaultShutdownSequence) runs the same steps with the timeouts, ordered
+// with the logger sync and the process registry close.
+func TearDownTracing(ctx context.Context, client statsd.ClientInterface) {
+	_ = StopTracing(ctx)
+	_ = CloseStatsdStep(client)(ctx)
 }
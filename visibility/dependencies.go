@@ -0,0 +1,27 @@
+package visibility
+
+import (
+	"context"
+	"time"
+)
+
+// The prefix of the per-dependency metrics, e.g. "Deps.dynamodb.Calls"
+const DependencyMetricPrefix = "Deps."
+
+const (
+	DependencyCallsMetric = "Calls"
+	DependencyTimeMetric  = "Time"
+)
+
+// Count the call of the dependency (e.g. "dynamodb" or "postgres") in the
+// "Deps.<dependency>.Calls" and "Deps.<dependency>.Time" metrics of the
+// context's MetricsContext. Nothing is recorded if there's no metrics context.
+func RecordDependencyCall(ctx context.Context, dependency string, duration time.Duration) {
+	met := TryGetMetricsFromContext(ctx)
+	if met == nil {
+		return
+	}
+	prefix := DependencyMetricPrefix + dependency + "."
+	met.AddCount(prefix+DependencyCallsMetric, 1)
+	met.AddDuration(prefix+DependencyTimeMetric, duration)
+}
@@ -0,0 +1,90 @@
+package visibility
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// The error that records the stack trace of the place where it was wrapped.
+// The wrapped errors can carry their own stacks, the whole chain can be logged
+// with ErrorChainField.
+type StackErr struct {
+	stack *ShortenedStackTrace
+	cause error
+}
+
+// Wrap the error, recording the caller's stack trace
+func WithStackErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StackErr{stack: NewShortenedStackTrace(3, false, err), cause: err}
+}
+
+func (s *StackErr) Error() string {
+	return s.cause.Error()
+}
+
+func (s *StackErr) Unwrap() error {
+	return s.cause
+}
+
+func (s *StackErr) StackTrace() []uintptr {
+	return s.stack.StackTrace()
+}
+
+// One error in the chain, along with its stack trace
+type ErrorChainLink struct {
+	Msg   string
+	Stack []StackElement
+}
+
+// Get all the errors in the chain that carry a stack trace (anything with
+// the StackTrace() []uintptr method), starting with the outermost one
+func GetErrorChain(err error) []ErrorChainLink {
+	var res []ErrorChainLink
+	for ; err != nil; err = errors.Unwrap(err) {
+		tracer, ok := err.(interface{ StackTrace() []uintptr })
+		if !ok {
+			continue
+		}
+		stack := &ShortenedStackTrace{stack: tracer.StackTrace()}
+		res = append(res, ErrorChainLink{Msg: err.Error(), Stack: stack.JSONStack()})
+	}
+	return res
+}
+
+// Get the chain of the stack traces of the error as a zap field. The pretty
+// console encoder renders each of the stacks separately.
+func ErrorChainField(err error) zap.Field {
+	return zap.Array("errorchain", errorChain{err})
+}
+
+type errorChain struct {
+	err error
+}
+
+func (e errorChain) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, l := range GetErrorChain(e.err) {
+		err := enc.AppendObject(l)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l ErrorChainLink) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("Msg", l.Msg)
+	return enc.AddArray("Stack", zapcore.ArrayMarshalerFunc(
+		func(arr zapcore.ArrayEncoder) error {
+			for _, e := range l.Stack {
+				err := arr.AppendObject(e)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+}
@@ -0,0 +1,204 @@
+package visibility
+
+import (
+	"context"
+	"encoding/json"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// The prefix of the span tags and the exposure metrics of the gates
+const GateTagPrefix = "experiment."
+
+// A feature gate: enabled for the canary clients and for the percentage of the
+// other requests. The rollout decision is made from the trace ID, so all the
+// services see the same decision for the same request. The gates are registered
+// centrally and can be changed at runtime (see GatesHandler).
+type Gate struct {
+	name    string
+	percent int32 // atomic
+	canary  int32 // atomic
+}
+
+var gatesMtx sync.RWMutex
+var gates = make(map[string]*Gate)
+
+// Create the gate, enabled only for the canary clients. The gates are
+// registered by name, the gate with the same name is shared.
+func NewGate(name string) *Gate {
+	gatesMtx.Lock()
+	defer gatesMtx.Unlock()
+	if g, ok := gates[name]; ok {
+		return g
+	}
+	g := &Gate{name: name, canary: 1}
+	gates[name] = g
+	return g
+}
+
+// Get the registered gate, or nil
+func GetGate(name string) *Gate {
+	gatesMtx.RLock()
+	defer gatesMtx.RUnlock()
+	return gates[name]
+}
+
+// Get all the registered gates, ordered by name
+func Gates() []*Gate {
+	gatesMtx.RLock()
+	defer gatesMtx.RUnlock()
+	res := make([]*Gate, 0, len(gates))
+	for _, g := range gates {
+		res = append(res, g)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+	return res
+}
+
+func (g *Gate) Name() string {
+	return g.name
+}
+
+// Get the percentage of the non-canary requests the gate is enabled for
+func (g *Gate) Rollout() int {
+	return int(atomic.LoadInt32(&g.percent))
+}
+
+// Set the percentage of the non-canary requests the gate is enabled for, the
+// values are clamped to 0..100
+func (g *Gate) SetRollout(percent int) {
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+	atomic.StoreInt32(&g.percent, int32(percent))
+}
+
+func (g *Gate) CanaryEnabled() bool {
+	return atomic.LoadInt32(&g.canary) != 0
+}
+
+// Enable or disable the gate for the canary clients
+func (g *Gate) SetCanaryEnabled(enabled bool) {
+	var val int32
+	if enabled {
+		val = 1
+	}
+	atomic.StoreInt32(&g.canary, val)
+}
+
+// Check whether the gate is enabled for the request. The decision is recorded
+// in the "experiment.<name>" span tag, and the exposure is counted in the
+// "experiment.<name>.Exposures" metric of the context's MetricsContext.
+func (g *Gate) Enabled(ctx context.Context) bool {
+	span, hasSpan := tracer.SpanFromContext(ctx)
+
+	enabled := g.CanaryEnabled() && IsAtLeastAsRiskyAs(ctx, ClientTypeCanary)
+	if !enabled {
+		if percent := g.Rollout(); percent >= 100 {
+			enabled = true
+		} else if percent > 0 {
+			var traceId uint64
+			if hasSpan {
+				traceId = span.Context().TraceID()
+			} else {
+				traceId = rand.Uint64()
+			}
+			enabled = g.bucket(traceId) < uint64(percent)
+		}
+	}
+
+	if hasSpan {
+		span.SetTag(GateTagPrefix+g.name, enabled)
+	}
+	if met := TryGetMetricsFromContext(ctx); met != nil {
+		met.AddCount(GateTagPrefix+g.name+".Exposures", 1)
+	}
+	return enabled
+}
+
+// Get the rollout bucket (0..99) of the trace, the gate name is mixed in so
+// that the different gates are enabled for the different requests
+func (g *Gate) bucket(traceId uint64) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(g.name))
+	_, _ = h.Write([]byte(strconv.FormatUint(traceId, 10)))
+	return h.Sum64() % 100
+}
+
+type gateState struct {
+	Name    string `json:"name"`
+	Rollout int    `json:"rollout"`
+	Canary  bool   `json:"canary"`
+}
+
+// The handler listing the gates as JSON (GET), and changing them (POST with the
+// "name" and the optional "rollout" and "canary" form values), e.g. for
+// /debug/gates
+func GatesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if !updateGate(w, r) {
+				return
+			}
+		} else if r.Method != http.MethodGet {
+			http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var res []gateState
+		for _, g := range Gates() {
+			res = append(res, gateState{Name: g.name, Rollout: g.Rollout(),
+				Canary: g.CanaryEnabled()})
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	})
+}
+
+func updateGate(w http.ResponseWriter, r *http.Request) bool {
+	gate := GetGate(r.FormValue("name"))
+	if gate == nil {
+		http.Error(w, "unknown gate", http.StatusNotFound)
+		return false
+	}
+
+	var rollout int
+	var canary bool
+	var err error
+	rolloutStr, canaryStr := r.FormValue("rollout"), r.FormValue("canary")
+	if rolloutStr != "" {
+		if rollout, err = strconv.Atoi(rolloutStr); err != nil {
+			http.Error(w, "bad rollout: "+err.Error(), http.StatusBadRequest)
+			return false
+		}
+	}
+	if canaryStr != "" {
+		if canary, err = strconv.ParseBool(canaryStr); err != nil {
+			http.Error(w, "bad canary flag: "+err.Error(), http.StatusBadRequest)
+			return false
+		}
+	}
+
+	if rolloutStr != "" {
+		gate.SetRollout(rollout)
+	}
+	if canaryStr != "" {
+		gate.SetCanaryEnabled(canary)
+	}
+	return true
+}
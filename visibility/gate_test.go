@@ -0,0 +1,98 @@
+package visibility
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGateCanary(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	gate := NewGate("test.canary")
+	assert.Equal(t, gate, NewGate("test.canary"))
+	assert.Equal(t, gate, GetGate("test.canary"))
+
+	span, ctx := tracer.StartSpanFromContext(
+		MakeMetricContext(context.Background(), "Op"), "op")
+	assert.False(t, gate.Enabled(ContextWithClientType(ctx, ClientTypeNormal)))
+	assert.False(t, gate.Enabled(ContextWithClientType(ctx, "Vasja")))
+	assert.True(t, gate.Enabled(ContextWithClientType(ctx, ClientTypeCanary)))
+	span.Finish()
+
+	assert.Equal(t, true, mt.FinishedSpans()[0].Tag("experiment.test.canary"))
+	assert.Equal(t, 3.0, GetMetricsFromContext(ctx).GetMetricVal(
+		"experiment.test.canary.Exposures"))
+
+	gate.SetCanaryEnabled(false)
+	assert.False(t, gate.Enabled(ContextWithClientType(ctx, ClientTypeCanary)))
+
+	// No span and no metrics are fine
+	gate.SetRollout(100)
+	assert.True(t, gate.Enabled(context.Background()))
+}
+
+func TestGateRollout(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	gate := NewGate("test.rollout")
+	gate.SetRollout(30)
+	assert.Equal(t, 30, gate.Rollout())
+
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		span, ctx := tracer.StartSpanFromContext(context.Background(), "op")
+		decision := gate.Enabled(ctx)
+		// The decision is the same for the same trace
+		assert.Equal(t, decision, gate.Enabled(ctx))
+		if decision {
+			enabled++
+		}
+		span.Finish()
+	}
+	assert.True(t, enabled > 200 && enabled < 400, "enabled %d", enabled)
+
+	gate.SetRollout(150)
+	assert.Equal(t, 100, gate.Rollout())
+	gate.SetRollout(-1)
+	assert.Equal(t, 0, gate.Rollout())
+}
+
+func TestGatesHandler(t *testing.T) {
+	gate := NewGate("test.handler")
+	handler := GatesHandler()
+
+	rec := httptest.NewRecorder()
+	form := url.Values{"name": {"test.handler"}, "rollout": {"25"}, "canary": {"false"}}
+	req := httptest.NewRequest(http.MethodPost, "/debug/gates",
+		strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 25, gate.Rollout())
+	assert.False(t, gate.CanaryEnabled())
+
+	var states []gateState
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &states))
+	assert.Contains(t, states, gateState{Name: "test.handler", Rollout: 25})
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost,
+		"/debug/gates?name=unknown&rollout=1", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost,
+		"/debug/gates?name=test.handler&rollout=lots", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, 25, gate.Rollout())
+}
@@ -0,0 +1,87 @@
+package visibility
+
+import (
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+// The value logged instead of the redacted headers
+const RedactedHeaderValue = "<redacted>"
+
+// The headers redacted by default, their values are the credentials
+var DefaultRedactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// The headers written into the access logs, as the "request_headers" and
+// "response_headers" fields
+type HeaderLogging struct {
+	RequestHeaders  []string
+	ResponseHeaders []string
+
+	// The headers whose values are replaced with RedactedHeaderValue,
+	// DefaultRedactedHeaders if nil
+	Redacted []string
+}
+
+// Copy the header, replacing the values of the redacted headers (matched
+// case-insensitively) with RedactedHeaderValue. The handlers should log the
+// headers from GetHttpRequestHeader only through it.
+func RedactHeader(header http.Header, redacted []string) http.Header {
+	res := make(http.Header, len(header))
+	for name, values := range header {
+		if isRedactedHeader(name, redacted) {
+			res[name] = []string{RedactedHeaderValue}
+			continue
+		}
+		res[name] = append([]string(nil), values...)
+	}
+	return res
+}
+
+func isRedactedHeader(name string, redacted []string) bool {
+	for _, r := range redacted {
+		if strings.EqualFold(name, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HeaderLogging) redacted() []string {
+	if h.Redacted == nil {
+		return DefaultRedactedHeaders
+	}
+	return h.Redacted
+}
+
+// Get the access log fields with the configured headers, the absent headers
+// are skipped. Nothing is logged for the nil HeaderLogging.
+func (h *HeaderLogging) Fields(req, resp http.Header) []zap.Field {
+	if h == nil {
+		return nil
+	}
+	var res []zap.Field
+	if vals := h.selectHeaders(req, h.RequestHeaders); len(vals) != 0 {
+		res = append(res, zap.Any("request_headers", vals))
+	}
+	if vals := h.selectHeaders(resp, h.ResponseHeaders); len(vals) != 0 {
+		res = append(res, zap.Any("response_headers", vals))
+	}
+	return res
+}
+
+func (h *HeaderLogging) selectHeaders(header http.Header, names []string) map[string]string {
+	res := make(map[string]string)
+	for _, name := range names {
+		values := header[http.CanonicalHeaderKey(name)]
+		if len(values) == 0 {
+			continue
+		}
+		if isRedactedHeader(name, h.redacted()) {
+			res[name] = RedactedHeaderValue
+		} else {
+			res[name] = strings.Join(values, ", ")
+		}
+	}
+	return res
+}
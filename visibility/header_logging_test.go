@@ -0,0 +1,51 @@
+package visibility
+
+import (
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedactHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	header.Add("Cookie", "a=secret")
+	header.Set("Accept", "text/plain")
+
+	redacted := RedactHeader(header, DefaultRedactedHeaders)
+	assert.Equal(t, RedactedHeaderValue, redacted.Get("Authorization"))
+	assert.Equal(t, RedactedHeaderValue, redacted.Get("Cookie"))
+	assert.Equal(t, "text/plain", redacted.Get("Accept"))
+	// The original is not modified
+	assert.Equal(t, "Bearer secret", header.Get("Authorization"))
+}
+
+func TestGorillaHeaderLogging(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	gorilla := NewTracedGorilla(&panickyTwirpServer{succeed: true}, logger,
+		NewRecordingSink(), nil, nil)
+	gorilla.SetHeaderLogging(&HeaderLogging{
+		RequestHeaders: []string{"authorization", "X-Debug", "X-Absent"},
+	})
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	req := httptest.NewRequest(http.MethodPost, "/twirp/twirp.test.Example/MakeHat", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("X-Debug", "yes")
+	muxer.ServeHTTP(httptest.NewRecorder(), req)
+
+	logs := sink.String()
+	assert.False(t, strings.Contains(logs, "secret-token"))
+	assert.True(t, strings.Contains(logs,
+		`"request_headers":{"X-Debug":"yes","authorization":"<redacted>"}`))
+	assert.False(t, strings.Contains(logs, "X-Absent"))
+}
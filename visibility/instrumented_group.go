@@ -0,0 +1,96 @@
+package visibility
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// The group of concurrently running sub-tasks, with the errgroup semantics: the
+// first failed sub-task cancels the group's context, and Wait returns its error.
+// Each sub-task is traced with RunInstrumented, and its Success/Error/Fault
+// counts are aggregated in the parent's MetricsContext (if it exists) as
+// "<name>.Success", "<name>.Error" and "<name>.Fault".
+type InstrumentedGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	met    *MetricsContext
+
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
+}
+
+// Create a new group, the returned context is cancelled when any of the
+// sub-tasks fails or when Wait returns
+func NewInstrumentedGroup(ctx context.Context) (*InstrumentedGroup, context.Context) {
+	groupCtx, cancel := context.WithCancel(ctx)
+	return &InstrumentedGroup{
+		ctx:    groupCtx,
+		cancel: cancel,
+		met:    TryGetMetricsFromContext(ctx),
+	}, groupCtx
+}
+
+// Run the sub-task in a new goroutine. A panic in the sub-task is recovered
+// and is treated as its error, and counted as a Fault. With the global
+// PanicCrash policy (see SetPanicPolicy) the process is crashed once it's
+// counted.
+func (g *InstrumentedGroup) Go(name string, fn func(ctx context.Context) error) {
+	g.wg.Add(1)
+
+	go func() {
+		defer g.wg.Done()
+
+		var err error
+		panicked := true
+		defer func() {
+			p := recover()
+			if p != nil {
+				err = fmt.Errorf("sub-task %s panicked: %v", name, p)
+			}
+			g.finish(name, err, panicked)
+			if p != nil && ResolvePanicPolicy(PanicPolicyDefault, PanicContain) == PanicCrash {
+				CrashProcess(p)
+			}
+		}()
+
+		err = RunInstrumented(g.ctx, name, func(ctx context.Context) error {
+			return InstrumentWithMetrics(ctx, fn)
+		})
+		panicked = false
+	}()
+}
+
+func (g *InstrumentedGroup) finish(name string, err error, panicked bool) {
+	if g.met != nil {
+		g.met.AddCount(name+".Success", 0)
+		g.met.AddCount(name+".Error", 0)
+		g.met.AddCount(name+".Fault", 0)
+		// The panics contained by RunInstrumented (PanicContain) are returned
+		// as errors, but they are still faults
+		var panicErr *PanicError
+		if panicked || errors.As(err, &panicErr) {
+			g.met.AddCount(name+".Fault", 1)
+		} else if err != nil {
+			g.met.AddCount(name+".Error", 1)
+		} else {
+			g.met.AddCount(name+".Success", 1)
+		}
+	}
+
+	if err != nil {
+		g.errOnce.Do(func() {
+			g.err = err
+			g.cancel()
+		})
+	}
+}
+
+// Wait for all the sub-tasks to finish, and return the first error (if any)
+func (g *InstrumentedGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
@@ -0,0 +1,116 @@
+package visibility
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"testing"
+)
+
+func TestInstrumentedGroup(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	ctx = MakeMetricContext(ctx, "Parent")
+	root, ctx := tracer.StartSpanFromContext(ctx, "root")
+
+	group, groupCtx := NewInstrumentedGroup(ctx)
+	failure := errors.New("failed")
+	group.Go("Waiter", func(ctx context.Context) error {
+		// Cancelled by the failure of the other sub-task
+		<-ctx.Done()
+		return nil
+	})
+	group.Go("Failer", func(ctx context.Context) error {
+		return failure
+	})
+
+	assert.Equal(t, failure, group.Wait())
+	assert.Error(t, groupCtx.Err())
+	root.Finish()
+
+	met := GetMetricsFromContext(ctx)
+	assert.Equal(t, 1.0, met.GetMetricVal("Waiter.Success"))
+	assert.Equal(t, 0.0, met.GetMetricVal("Waiter.Error"))
+	assert.Equal(t, 1.0, met.GetMetricVal("Failer.Error"))
+
+	// Each sub-task gets a child span
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 3, len(spans))
+	for _, s := range spans {
+		if s.OperationName() != "root" {
+			assert.Equal(t, root.Context().SpanID(), s.ParentID())
+		}
+	}
+}
+
+func TestInstrumentedGroupPanic(t *testing.T) {
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	ctx = MakeMetricContext(ctx, "Parent")
+
+	group, _ := NewInstrumentedGroup(ctx)
+	group.Go("Panicker", func(ctx context.Context) error {
+		panic("oops")
+	})
+	group.Go("Worker", func(ctx context.Context) error {
+		return nil
+	})
+
+	err := group.Wait()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Panicker panicked: oops")
+
+	met := GetMetricsFromContext(ctx)
+	assert.Equal(t, 1.0, met.GetMetricVal("Panicker.Fault"))
+	assert.Equal(t, 0.0, met.GetMetricVal("Panicker.Error"))
+	assert.Equal(t, 1.0, met.GetMetricVal("Worker.Success"))
+}
+
+func TestInstrumentedGroupContainedPanic(t *testing.T) {
+	SetPanicPolicy(PanicContain)
+	defer SetPanicPolicy(PanicPolicyDefault)
+
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	ctx = MakeMetricContext(ctx, "Parent")
+
+	group, _ := NewInstrumentedGroup(ctx)
+	group.Go("Panicker", func(ctx context.Context) error {
+		panic("oops")
+	})
+
+	err := group.Wait()
+	var panicErr *PanicError
+	assert.True(t, errors.As(err, &panicErr))
+
+	met := GetMetricsFromContext(ctx)
+	assert.Equal(t, 1.0, met.GetMetricVal("Panicker.Fault"))
+	assert.Equal(t, 0.0, met.GetMetricVal("Panicker.Error"))
+}
+
+func TestInstrumentedGroupPanicCrash(t *testing.T) {
+	SetPanicPolicy(PanicCrash)
+	defer SetPanicPolicy(PanicPolicyDefault)
+	var crashed interface{}
+	oldCrash := CrashProcess
+	CrashProcess = func(p interface{}) {
+		crashed = p
+	}
+	defer func() { CrashProcess = oldCrash }()
+
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	ctx = MakeMetricContext(ctx, "Parent")
+
+	group, _ := NewInstrumentedGroup(ctx)
+	group.Go("Panicker", func(ctx context.Context) error {
+		panic("oops")
+	})
+	assert.Error(t, group.Wait())
+
+	// The fault is counted before the crash
+	assert.Equal(t, "oops", crashed)
+	assert.Equal(t, 1.0, GetMetricsFromContext(ctx).GetMetricVal("Panicker.Fault"))
+}
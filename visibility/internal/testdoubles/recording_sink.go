@@ -0,0 +1,112 @@
+// The test doubles shared by the visibility package (for the compatibility
+// aliases) and the vistest package, which is their public home
+package testdoubles
+
+import (
+	"github.com/DataDog/datadog-go/statsd"
+	"time"
+)
+
+// The statsd client recording the last value and the tags of each metric. It's
+// not thread-safe, read it once the code under test is done.
+type RecordingSink struct {
+	Distributions map[string]float64
+	Counts        map[string]int64
+	Gauges        map[string]float64
+	// The timings in milliseconds
+	Timings map[string]float64
+	// The tags of the last value of each metric
+	Tags   map[string][]string
+	Events []*statsd.Event
+}
+
+var _ statsd.ClientInterface = &RecordingSink{}
+
+func NewRecordingSink() *RecordingSink {
+	r := &RecordingSink{}
+	r.Clear()
+	return r
+}
+
+// Forget everything recorded so far
+func (r *RecordingSink) Clear() {
+	r.Distributions = make(map[string]float64)
+	r.Counts = make(map[string]int64)
+	r.Gauges = make(map[string]float64)
+	r.Timings = make(map[string]float64)
+	r.Tags = make(map[string][]string)
+	r.Events = nil
+}
+
+func (r *RecordingSink) Gauge(name string, value float64, tags []string, _ float64) error {
+	r.Gauges[name] = value
+	r.Tags[name] = tags
+	return nil
+}
+
+func (r *RecordingSink) Count(name string, value int64, tags []string, _ float64) error {
+	r.Counts[name] = value
+	r.Tags[name] = tags
+	return nil
+}
+
+func (r *RecordingSink) Histogram(_ string, _ float64, _ []string, _ float64) error {
+	return nil
+}
+
+func (r *RecordingSink) Distribution(name string, value float64, tags []string, _ float64) error {
+	r.Distributions[name] = value
+	r.Tags[name] = tags
+	return nil
+}
+
+func (r *RecordingSink) Decr(_ string, _ []string, _ float64) error {
+	return nil
+}
+
+func (r *RecordingSink) Incr(_ string, _ []string, _ float64) error {
+	return nil
+}
+
+func (r *RecordingSink) Set(_ string, _ string, _ []string, _ float64) error {
+	return nil
+}
+
+func (r *RecordingSink) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return r.TimeInMilliseconds(name, float64(value)/float64(time.Millisecond), tags, rate)
+}
+
+func (r *RecordingSink) TimeInMilliseconds(name string, value float64, tags []string, _ float64) error {
+	r.Timings[name] = value
+	r.Tags[name] = tags
+	return nil
+}
+
+func (r *RecordingSink) Event(e *statsd.Event) error {
+	r.Events = append(r.Events, e)
+	return nil
+}
+
+func (r *RecordingSink) SimpleEvent(_, _ string) error {
+	return nil
+}
+
+func (r *RecordingSink) ServiceCheck(_ *statsd.ServiceCheck) error {
+	return nil
+}
+
+func (r *RecordingSink) SimpleServiceCheck(_ string, _ statsd.ServiceCheckStatus) error {
+	return nil
+}
+
+func (r *RecordingSink) Close() error {
+	return nil
+}
+
+func (r *RecordingSink) Flush() error {
+	return nil
+}
+
+func (r *RecordingSink) SetWriteTimeout(_ time.Duration) error {
+	return nil
+}
@@ -0,0 +1,239 @@
+package visibility
+
+import (
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The number of the calls buffered while the client can't be created, the
+	// calls beyond it are dropped
+	LazyStatsdMaxPending = 1000
+
+	lazyStatsdMinBackoff = time.Second
+	lazyStatsdMaxBackoff = time.Minute
+)
+
+// The statsd client that is created on the first use, and re-created with the
+// backoff while its creation fails (e.g. the agent's socket is not up yet
+// during the pod start). The calls made while there's no client are buffered
+// (up to LazyStatsdMaxPending) and sent once it's created.
+type LazyStatsd struct {
+	factory func() (statsd.ClientInterface, error)
+	logger  *zap.Logger
+	clock   utils.Clock
+
+	mtx          sync.Mutex
+	client       statsd.ClientInterface
+	failing      bool
+	nextAttempt  time.Time
+	backoff      time.Duration
+	pending      []func(c statsd.ClientInterface) error
+	writeTimeout time.Duration
+	closed       bool
+
+	dropped uint64
+}
+
+var _ statsd.ClientInterface = &LazyStatsd{}
+
+// Create the client with the factory (e.g. wrapping statsd.New) on the first
+// use. The state transitions are logged with the logger.
+func NewLazyStatsd(factory func() (statsd.ClientInterface, error),
+	logger *zap.Logger) *LazyStatsd {
+
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &LazyStatsd{factory: factory, logger: logger, clock: utils.RealClock}
+}
+
+// Use the clock for the creation backoff, useful for tests
+func (l *LazyStatsd) SetClock(clock utils.Clock) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.clock = clock
+}
+
+// The number of the calls dropped since the start because the buffer was full
+// or the client was closed
+func (l *LazyStatsd) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+func (l *LazyStatsd) getClientLocked() statsd.ClientInterface {
+	if l.client != nil || l.closed || l.clock.Now().Before(l.nextAttempt) {
+		return l.client
+	}
+
+	client, err := l.factory()
+	if err != nil {
+		if l.backoff == 0 {
+			l.backoff = lazyStatsdMinBackoff
+		} else if l.backoff *= 2; l.backoff > lazyStatsdMaxBackoff {
+			l.backoff = lazyStatsdMaxBackoff
+		}
+		l.nextAttempt = l.clock.Now().Add(l.backoff)
+		if !l.failing {
+			l.failing = true
+			l.logger.Error("Failed to create the statsd client, retrying",
+				zap.Error(err), zap.Duration("backoff", l.backoff))
+		}
+		return nil
+	}
+
+	if l.writeTimeout != 0 {
+		_ = client.SetWriteTimeout(l.writeTimeout)
+	}
+	if l.failing {
+		l.logger.Info("Statsd client is created", zap.Int("pending", len(l.pending)),
+			zap.Uint64("dropped", atomic.LoadUint64(&l.dropped)))
+	}
+	l.client = client
+	l.failing = false
+	l.backoff = 0
+	return client
+}
+
+func (l *LazyStatsd) send(call func(c statsd.ClientInterface) error) error {
+	l.mtx.Lock()
+	client := l.getClientLocked()
+	if client == nil || l.closed {
+		if l.closed || len(l.pending) >= LazyStatsdMaxPending {
+			atomic.AddUint64(&l.dropped, 1)
+		} else {
+			l.pending = append(l.pending, call)
+		}
+		l.mtx.Unlock()
+		return nil
+	}
+	pending := l.pending
+	l.pending = nil
+	l.mtx.Unlock()
+
+	for _, p := range pending {
+		_ = p(client)
+	}
+	return call(client)
+}
+
+func (l *LazyStatsd) Gauge(name string, value float64, tags []string, rate float64) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.Gauge(name, value, tags, rate)
+	})
+}
+
+func (l *LazyStatsd) Count(name string, value int64, tags []string, rate float64) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.Count(name, value, tags, rate)
+	})
+}
+
+func (l *LazyStatsd) Histogram(name string, value float64, tags []string, rate float64) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.Histogram(name, value, tags, rate)
+	})
+}
+
+func (l *LazyStatsd) Distribution(name string, value float64, tags []string, rate float64) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.Distribution(name, value, tags, rate)
+	})
+}
+
+func (l *LazyStatsd) Decr(name string, tags []string, rate float64) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.Decr(name, tags, rate)
+	})
+}
+
+func (l *LazyStatsd) Incr(name string, tags []string, rate float64) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.Incr(name, tags, rate)
+	})
+}
+
+func (l *LazyStatsd) Set(name string, value string, tags []string, rate float64) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.Set(name, value, tags, rate)
+	})
+}
+
+func (l *LazyStatsd) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.Timing(name, value, tags, rate)
+	})
+}
+
+func (l *LazyStatsd) TimeInMilliseconds(name string, value float64, tags []string,
+	rate float64) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.TimeInMilliseconds(name, value, tags, rate)
+	})
+}
+
+func (l *LazyStatsd) Event(e *statsd.Event) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.Event(e)
+	})
+}
+
+func (l *LazyStatsd) SimpleEvent(title, text string) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.SimpleEvent(title, text)
+	})
+}
+
+func (l *LazyStatsd) ServiceCheck(sc *statsd.ServiceCheck) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.ServiceCheck(sc)
+	})
+}
+
+func (l *LazyStatsd) SimpleServiceCheck(name string, status statsd.ServiceCheckStatus) error {
+	return l.send(func(c statsd.ClientInterface) error {
+		return c.SimpleServiceCheck(name, status)
+	})
+}
+
+// Close the client, the pending and the subsequent calls are dropped
+func (l *LazyStatsd) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.closed = true
+	atomic.AddUint64(&l.dropped, uint64(len(l.pending)))
+	l.pending = nil
+	if l.client == nil {
+		return nil
+	}
+	return l.client.Close()
+}
+
+func (l *LazyStatsd) Flush() error {
+	l.mtx.Lock()
+	client := l.client
+	l.mtx.Unlock()
+
+	if client == nil {
+		return nil
+	}
+	return client.Flush()
+}
+
+// Set the write timeout, it's applied to the client once it's created
+func (l *LazyStatsd) SetWriteTimeout(d time.Duration) error {
+	l.mtx.Lock()
+	l.writeTimeout = d
+	client := l.client
+	l.mtx.Unlock()
+
+	if client == nil {
+		return nil
+	}
+	return client.SetWriteTimeout(d)
+}
@@ -0,0 +1,65 @@
+package visibility
+
+import (
+	"fmt"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLazyStatsd(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	clock := utils.NewFakeClock(time.Unix(1000, 0))
+	rs := NewRecordingSink()
+
+	attempts := 0
+	lazy := NewLazyStatsd(func() (statsd.ClientInterface, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, fmt.Errorf("no agent")
+		}
+		return rs, nil
+	}, logger)
+	lazy.SetClock(clock)
+
+	// The calls are buffered while the client can't be created, the creation
+	// is retried only after the backoff
+	assert.NoError(t, lazy.Count("first", 1, nil, 1))
+	assert.NoError(t, lazy.Count("second", 2, nil, 1))
+	assert.Equal(t, 1, attempts)
+	clock.Advance(time.Second)
+	assert.NoError(t, lazy.Count("third", 3, nil, 1))
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 0, len(rs.Counts))
+
+	// The buffered calls are sent once the client is created
+	clock.Advance(2 * time.Second)
+	assert.NoError(t, lazy.Distribution("fourth", 4, nil, 1))
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, int64(1), rs.Counts["first"])
+	assert.Equal(t, int64(3), rs.Counts["third"])
+	assert.Equal(t, 4.0, rs.Distributions["fourth"])
+	assert.Equal(t, uint64(0), lazy.Dropped())
+
+	// Only the transitions are logged
+	logs := sink.String()
+	assert.Equal(t, 1, strings.Count(logs, "Failed to create the statsd client"))
+	assert.Equal(t, 1, strings.Count(logs, "Statsd client is created"))
+
+	assert.NoError(t, lazy.Close())
+	assert.NoError(t, lazy.Count("closed", 1, nil, 1))
+	assert.Equal(t, uint64(1), lazy.Dropped())
+}
+
+func TestLazyStatsdOverflow(t *testing.T) {
+	lazy := NewLazyStatsd(func() (statsd.ClientInterface, error) {
+		return nil, fmt.Errorf("no agent")
+	}, nil)
+	for i := 0; i < LazyStatsdMaxPending+5; i++ {
+		assert.NoError(t, lazy.Incr("calls", nil, 1))
+	}
+	assert.Equal(t, uint64(5), lazy.Dropped())
+}
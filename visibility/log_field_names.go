@@ -0,0 +1,37 @@
+package visibility
+
+import (
+	"go.uber.org/zap"
+)
+
+// The key names of the access log fields, mapping the default keys (e.g.
+// "method") to the ones expected by the log pipeline (e.g.
+// "http.request.method"). The unmapped fields keep their default keys.
+type LogFieldNames map[string]string
+
+// The Elastic Common Schema names of the access log fields
+var ECSLogFieldNames = LogFieldNames{
+	"path":       "url.path",
+	"remote_ip":  "source.ip",
+	"host":       "url.domain",
+	"method":     "http.request.method",
+	"uri":        "url.original",
+	"referer":    "http.request.referrer",
+	"user_agent": "user_agent.original",
+	"status":     "http.response.status_code",
+	"bytes_in":   "http.request.body.bytes",
+	"bytes_out":  "http.response.body.bytes",
+}
+
+// Rename the fields (in place) according to the mapping
+func (n LogFieldNames) Apply(fields []zap.Field) []zap.Field {
+	if len(n) == 0 {
+		return fields
+	}
+	for i := range fields {
+		if key, ok := n[fields[i].Key]; ok {
+			fields[i].Key = key
+		}
+	}
+	return fields
+}
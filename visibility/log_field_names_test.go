@@ -0,0 +1,34 @@
+package visibility
+
+import (
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGorillaLogFieldNames(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	gorilla := NewTracedGorilla(&panickyTwirpServer{succeed: true}, logger,
+		NewRecordingSink(), nil, nil)
+	gorilla.SetLogFieldNames(ECSLogFieldNames)
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	req := httptest.NewRequest(http.MethodPost, "/twirp/twirp.test.Example/MakeHat", nil)
+	muxer.ServeHTTP(httptest.NewRecorder(), req)
+
+	logs := sink.String()
+	assert.True(t, strings.Contains(logs, `"http.request.method":"POST"`))
+	assert.True(t, strings.Contains(logs, `"url.path":"/twirp/twirp.test.Example/MakeHat"`))
+	assert.False(t, strings.Contains(logs, `"method":`))
+	// The unmapped fields keep their keys
+	assert.True(t, strings.Contains(logs, `"latency_human":`))
+}
@@ -2,12 +2,15 @@ package visibility
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type loggerKey struct {
@@ -28,6 +31,12 @@ func CL(ctx context.Context, opts ...zap.Option) *zap.Logger {
 	}
 }
 
+// Get the logger from the context, or nil if the context has not been imbued
+func TryCL(ctx context.Context) *zap.Logger {
+	logger, _ := ctx.Value(loggerKeyVal).(*zap.Logger)
+	return logger
+}
+
 func CLS(ctx context.Context, opts ...zap.Option) *zap.SugaredLogger {
 	logger := CL(ctx, opts...)
 	return logger.Sugar()
@@ -37,6 +46,34 @@ func ImbueContext(ctx context.Context, logger *zap.Logger) context.Context {
 	return context.WithValue(ctx, loggerKeyVal, logger)
 }
 
+// Add fields to the context's logger (or to a no-op logger if the context is not
+// imbued) and re-imbue the context with it
+func ImbueContextWith(ctx context.Context, fields ...zap.Field) context.Context {
+	return ImbueContext(ctx, loggerOrNop(ctx).With(fields...))
+}
+
+// Add a name segment to the context's logger and re-imbue the context with it
+func WithLoggerName(ctx context.Context, name string) context.Context {
+	return ImbueContext(ctx, loggerOrNop(ctx).Named(name))
+}
+
+func loggerOrNop(ctx context.Context) *zap.Logger {
+	logger := TryCL(ctx)
+	if logger == nil {
+		return zap.NewNop()
+	}
+	return logger
+}
+
+// The request-scoped buffer of the verbose log entries, these entries are only
+// written out if the request fails. Implemented by zaputils.RequestLogBuffer.
+type RequestLogBuffer interface {
+	// Wrap the logger so that its Debug and Info entries are buffered
+	Wrap(logger *zap.Logger) *zap.Logger
+	// Flush the buffered entries if failed is true, drop them otherwise
+	Finish(failed bool)
+}
+
 type ShortenedStackTrace struct {
 	skipToFirstPanic bool
 	stack            []uintptr
@@ -87,29 +124,10 @@ type StackElement struct {
 func (s *ShortenedStackTrace) JSONStack() []StackElement {
 	// Create the stack trace
 	stackElements := make([]StackElement, 0, 20)
-	panicsToSkip := 0
-	if s.skipToFirstPanic {
-		panicsToSkip = s.countPanics()
-	}
-
-	// Note: On the last iteration, frames.Next() returns false, with a valid
-	// frame, but we ignore this frame. The last frame is a a runtime frame which
-	// adds noise, since it's only either runtime.main or runtime.goexit.
-	frames := runtime.CallersFrames(s.stack)
-	for frame, more := frames.Next(); more; frame, more = frames.Next() {
-		path, line, label := s.parseFrame(frame)
-
-		if panicsToSkip >0 && strings.HasPrefix(path, "runtime/panic") && label == "gopanic" {
-			panicsToSkip -= 1
-			continue
-		}
-		if panicsToSkip > 0 {
-			continue
-		}
-
+	for _, f := range s.visibleFrames() {
 		stackElements = append(stackElements, StackElement{
-			Fl: path + ":" + strconv.Itoa(line),
-			Fn: label,
+			Fl: f.path + ":" + strconv.Itoa(f.line),
+			Fn: f.label,
 		})
 	}
 	return stackElements
@@ -117,32 +135,122 @@ func (s *ShortenedStackTrace) JSONStack() []StackElement {
 
 // Create a nice stack trace, skipping all the deferred frames after the first panic() call.
 func (s *ShortenedStackTrace) StringStack() string {
-	// Create the stack trace
-	frames := runtime.CallersFrames(s.stack)
+	var res strings.Builder
+	for _, f := range s.visibleFrames() {
+		res.WriteString(f.path + ":" + strconv.Itoa(f.line) + " " + f.label + "\n")
+	}
+	return res.String()
+}
 
-	panicsToSkip := 0
-	if s.skipToFirstPanic {
-		panicsToSkip = s.countPanics()
+type parsedFrame struct {
+	path  string
+	line  int
+	label string
+}
+
+// Symbolization is expensive, so the parsed frames are cached by PC. A single PC
+// can expand into several frames if the functions were inlined. The frame right
+// after runtime.sigpanic has the faulting PC rather than the return address, so
+// it's symbolized differently and is cached under its own key.
+var frameCache sync.Map // frameKey -> []parsedFrame
+
+type frameKey struct {
+	pc            uintptr
+	afterSigpanic bool
+}
+
+type cachedFrames struct {
+	frames   []parsedFrame
+	sigpanic bool
+}
+
+func (s *ShortenedStackTrace) parsedFrames() []parsedFrame {
+	res, ok := s.framesFromCache()
+	if !ok {
+		res = s.symbolizeFrames()
 	}
 
-	var res string
-	// Note: On the last iteration, frames.Next() returns false, with a valid
-	// frame, but we ignore this frame. The last frame is a a runtime frame which
-	// adds noise, since it's only either runtime.main or runtime.goexit.
-	for frame, more := frames.Next(); more; frame, more = frames.Next() {
+	// The last frame is a a runtime frame which adds noise, since it's only
+	// either runtime.main or runtime.goexit.
+	if len(res) > 0 {
+		res = res[:len(res)-1]
+	}
+	return res
+}
+
+func (s *ShortenedStackTrace) framesFromCache() ([]parsedFrame, bool) {
+	res := make([]parsedFrame, 0, len(s.stack))
+	afterSigpanic := false
+	for _, pc := range s.stack {
+		cached, ok := frameCache.Load(frameKey{pc: pc, afterSigpanic: afterSigpanic})
+		if !ok {
+			return nil, false
+		}
+		res = append(res, cached.(cachedFrames).frames...)
+		afterSigpanic = cached.(cachedFrames).sigpanic
+	}
+	return res, true
+}
+
+// Symbolize the whole stack at once, the runtime needs to see the sigpanic frame
+// to correctly symbolize the faulting frame after it. The frames are then split
+// back into the per-PC groups to fill the cache: the inlined frames have no Func,
+// and each group ends with the frame of the physical function.
+func (s *ShortenedStackTrace) symbolizeFrames() []parsedFrame {
+	var res []parsedFrame
+	var groups []cachedFrames
+	var cur cachedFrames
+
+	frames := runtime.CallersFrames(s.stack)
+	for {
+		frame, more := frames.Next()
 		path, line, label := s.parseFrame(frame)
+		parsed := parsedFrame{path: path, line: line, label: label}
+		res = append(res, parsed)
+
+		cur.frames = append(cur.frames, parsed)
+		if frame.Func != nil {
+			cur.sigpanic = frame.Function == "runtime.sigpanic"
+			groups = append(groups, cur)
+			cur = cachedFrames{}
+		}
+		if !more {
+			break
+		}
+	}
+
+	// Don't cache anything if the frames can't be matched to the PCs (e.g. for the
+	// non-Go frames)
+	if len(cur.frames) != 0 || len(groups) != len(s.stack) {
+		return res
+	}
+	afterSigpanic := false
+	for i, pc := range s.stack {
+		frameCache.LoadOrStore(frameKey{pc: pc, afterSigpanic: afterSigpanic}, groups[i])
+		afterSigpanic = groups[i].sigpanic
+	}
+	return res
+}
 
-		if panicsToSkip >0 && strings.HasPrefix(path, "runtime/panic") && label == "gopanic" {
+// Get the frames, optionally skipping all the deferred frames after the first panic() call.
+func (s *ShortenedStackTrace) visibleFrames() []parsedFrame {
+	frames := s.parsedFrames()
+	if !s.skipToFirstPanic {
+		return frames
+	}
+
+	panicsToSkip := countPanics(frames)
+	res := make([]parsedFrame, 0, len(frames))
+	for _, f := range frames {
+		if panicsToSkip > 0 && isPanicFrame(f) {
 			panicsToSkip -= 1
 			continue
 		}
 		if panicsToSkip > 0 {
 			continue
 		}
-
-		res += path + ":" + strconv.Itoa(line) + " " + label + "\n"
+		res = append(res, f)
 	}
-
 	return res
 }
 
@@ -178,17 +286,45 @@ func (s *ShortenedStackTrace) parseFrame(frame runtime.Frame) (string, int, stri
 	return path, line, label
 }
 
+// Get the stack trace as a zap field. The stack is symbolized lazily, only if the
+// log entry is actually written.
 func (s *ShortenedStackTrace) Field() zap.Field {
-	return zap.Reflect("stacktrace", s.JSONStack())
+	return zap.Array("stacktrace", lazyStack{s})
+}
+
+type lazyStack struct {
+	trace *ShortenedStackTrace
+}
+
+func (l lazyStack) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, e := range l.trace.JSONStack() {
+		err := enc.AppendObject(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l lazyStack) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.trace.JSONStack())
+}
+
+func (e StackElement) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("Fl", e.Fl)
+	enc.AddString("Fn", e.Fn)
+	return nil
+}
+
+func isPanicFrame(f parsedFrame) bool {
+	return strings.HasPrefix(f.path, "runtime/panic") && f.label == "gopanic"
 }
 
 // Count the number of go panic() calls in the stack trace
-func (s *ShortenedStackTrace) countPanics() int {
-	frames := runtime.CallersFrames(s.stack)
+func countPanics(frames []parsedFrame) int {
 	panics := 0
-	for frame, more := frames.Next(); more; frame, more = frames.Next() {
-		path, _, label := s.parseFrame(frame)
-		if strings.HasPrefix(path, "runtime/panic") && label == "gopanic" {
+	for _, f := range frames {
+		if isPanicFrame(f) {
 			panics += 1
 		}
 	}
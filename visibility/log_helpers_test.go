@@ -97,3 +97,18 @@ func TestPanicSearch(t *testing.T) {
 
 	panic("Hello")
 }
+
+func TestImbueContextWith(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+
+	ctx := ImbueContext(context.Background(), logger)
+	ctx = ImbueContextWith(ctx, zap.String("field1", "hello"))
+	ctx = WithLoggerName(ctx, "Sub")
+	CL(ctx).Info("Test")
+	assert.Equal(t, `{"level":"info","logger":"Sub","msg":"Test","field1":"hello"}`+"\n",
+		sink.String())
+
+	// Un-imbued contexts get a no-op logger
+	CL(ImbueContextWith(context.Background(), zap.Int("a", 1))).Info("Nothing")
+	CL(WithLoggerName(context.Background(), "Nop")).Info("Nothing")
+}
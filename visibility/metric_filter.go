@@ -0,0 +1,66 @@
+package visibility
+
+import (
+	"strings"
+	"sync"
+)
+
+// The number of the metrics dropped by the MetricFilter, sent under this fixed
+// name (not prefixed with the operation) to notice an overly aggressive filter
+const SuppressedMetricsMetric = "MetricsSuppressed"
+
+// Decides which metrics are sent to statsd by CopyToStatsd. Each distinct
+// "<opName>.<metricName>" is a billable custom metric in DataDog. The filtered
+// out metrics are still attached to the spans.
+type MetricFilter interface {
+	Allow(opName, metricName string) bool
+}
+
+type allowAllMetrics struct{}
+
+func (allowAllMetrics) Allow(opName, metricName string) bool {
+	return true
+}
+
+// Allow only the operations that start with one of the prefixes
+type PrefixAllowlist []string
+
+func (p PrefixAllowlist) Allow(opName, metricName string) bool {
+	for _, prefix := range p {
+		if strings.HasPrefix(opName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Deny the metrics whose names end with one of the suffixes
+type DenySuffixes []string
+
+func (d DenySuffixes) Allow(opName, metricName string) bool {
+	for _, suffix := range d {
+		if strings.HasSuffix(metricName, suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+var metricFilterMtx sync.RWMutex
+var metricFilter MetricFilter = allowAllMetrics{}
+
+// Install the filter used by CopyToStatsd, nil allows all the metrics
+func SetMetricFilter(filter MetricFilter) {
+	metricFilterMtx.Lock()
+	defer metricFilterMtx.Unlock()
+	if filter == nil {
+		filter = allowAllMetrics{}
+	}
+	metricFilter = filter
+}
+
+func getMetricFilter() MetricFilter {
+	metricFilterMtx.RLock()
+	defer metricFilterMtx.RUnlock()
+	return metricFilter
+}
@@ -0,0 +1,59 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"testing"
+)
+
+func TestMetricFilters(t *testing.T) {
+	allow := PrefixAllowlist{"Billing.", "Auth."}
+	assert.True(t, allow.Allow("Billing.Charge", "Time"))
+	assert.True(t, allow.Allow("Auth.Login", "Success"))
+	assert.False(t, allow.Allow("Search.Query", "Time"))
+	assert.False(t, PrefixAllowlist{}.Allow("Billing.Charge", "Time"))
+
+	deny := DenySuffixes{"_bytes", ".Debug"}
+	assert.False(t, deny.Allow("Op", "read_bytes"))
+	assert.False(t, deny.Allow("Op", "cache.Debug"))
+	assert.True(t, deny.Allow("Op", "Time"))
+}
+
+func TestCopyToStatsdWithFilter(t *testing.T) {
+	SetMetricFilter(DenySuffixes{"Debug"})
+	defer SetMetricFilter(nil)
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx := MakeMetricContext(context.Background(), "Op")
+	met := GetMetricsFromContext(ctx)
+	met.SetCount("Success", 1)
+	met.SetCount("CacheDebug", 2)
+	met.SetCount("QueueDebug", 3)
+
+	sink := NewRecordingSink()
+	met.CopyToStatsd(sink, "normal")
+	assert.Equal(t, 1.0, sink.Distributions["Op.Success"])
+	_, ok := sink.Distributions["Op.CacheDebug"]
+	assert.False(t, ok)
+	assert.Equal(t, int64(2), sink.Counts[SuppressedMetricsMetric])
+	assert.Equal(t, []string{"unit:count", "client-type:normal"},
+		sink.Tags[SuppressedMetricsMetric])
+
+	// The spans still get everything
+	span := tracer.StartSpan("test")
+	met.CopyToSpan(span)
+	span.Finish()
+	assert.Equal(t, 2.0, mt.FinishedSpans()[0].Tag("CacheDebug"))
+
+	// Nothing is reported if nothing is suppressed
+	SetMetricFilter(nil)
+	sink.Clear()
+	met.CopyToStatsd(sink, "normal")
+	assert.Equal(t, 2.0, sink.Distributions["Op.CacheDebug"])
+	_, ok = sink.Counts[SuppressedMetricsMetric]
+	assert.False(t, ok)
+}
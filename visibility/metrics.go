@@ -5,21 +5,111 @@ import (
 	"github.com/DataDog/datadog-go/statsd"
 	. "github.com/cyberax/go-dd-service-base/utils"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Deprecated: the metrics context is now stored under an unexported key, this
+// key is only read as a fallback for the contexts created with it directly.
 const MetricsContextKey = "MetricContext"
 
+type metricsContextKey struct{}
+
+var metricsContextKeyVal = &metricsContextKey{}
+
+var warnOnShadowing int32
+
+// Log a warning when MakeMetricContext shadows an existing metrics context, to
+// find the places where an operation is instrumented twice
+func SetWarnOnMetricsShadowing(enabled bool) {
+	var val int32
+	if enabled {
+		val = 1
+	}
+	atomic.StoreInt32(&warnOnShadowing, val)
+}
+
+var debugLateMetrics int32
+
+// Log the name and the stack of the metrics recorded after the context was sealed
+func SetDebugLateMetrics(enabled bool) {
+	var val int32
+	if enabled {
+		val = 1
+	}
+	atomic.StoreInt32(&debugLateMetrics, val)
+}
+
+var spanMetricsSampledOnly int32
+
+// Attach the metrics to the spans only if they are sampled (kept by the
+// priority sampler), statsd still gets all the metrics. Span tags are expensive
+// on the high-QPS paths, and the unsampled spans are dropped anyway.
+func SetSpanMetricsSampledOnly(enabled bool) {
+	var val int32
+	if enabled {
+		val = 1
+	}
+	atomic.StoreInt32(&spanMetricsSampledOnly, val)
+}
+
+const PartialFailureMetric = "PartialFailure"
+const WarningsTag = "warnings"
+
+// The suffixes of the metrics recorded by RecordBoolRate
+const (
+	BoolRateTotalSuffix = ".Total"
+	BoolRateTrueSuffix  = ".True"
+	BoolRateSuffix      = ".Rate"
+)
+
+const UnitConflictMetric = "MetricUnitConflicts"
+const UnitConflictSuffix = ".unit_conflict"
+
+// Log the unit conflicts at most once in this interval
+const unitConflictLogInterval = 10 * time.Second
+
+var lastUnitConflictLog int64
+
 type MetricsContext struct {
 	Lock    sync.Mutex
 	OpName  string
 	Metrics map[string]*MetricEntry
 
+	warnings []string
+
+	lenientUnits bool
+	logger       *zap.Logger
+
+	sealed      bool
+	lateMetrics int
+
+	// The names recorded with RecordBoolRate
+	boolRates map[string]bool
+	// The values already sent by FlushDeltaToStatsd
+	flushed map[string]float64
+	// The names recorded with SetMetric, they're not monotonic
+	nonMonotonic map[string]bool
+	// The lock-free counters, merged into Metrics on the reads
+	counters        map[string]*Counter
+	shardedCounters map[string]*ShardedCounter
+	// The statsd namespaces of the metrics that are not prefixed with OpName
+	namespaces map[string]string
+	// Sent as the tenant tag to statsd
+	tenant string
+
 	sink statsd.ClientInterface
 	span tracer.Span
+
+	// The source of the timestamps and the benchmark durations
+	clock Clock
 }
 
 type MetricEntry struct {
@@ -90,39 +180,189 @@ func (e MetricEntry) Normalize() (float64, cloudwatch.StandardUnit) {
 }
 
 func MakeMetricContext(ctx context.Context, opName string) context.Context {
-	return context.WithValue(ctx, MetricsContextKey,
+	if atomic.LoadInt32(&warnOnShadowing) != 0 {
+		existing := TryGetMetricsFromContext(ctx)
+		logger := TryCL(ctx)
+		if existing != nil && logger != nil {
+			logger.Warn("Metrics context is shadowed",
+				zap.String("existing_op", existing.OpName), zap.String("new_op", opName),
+				zap.Stack("stack"))
+		}
+	}
+
+	return context.WithValue(ctx, metricsContextKeyVal,
 		&MetricsContext{
 			OpName:  opName,
 			Metrics: map[string]*MetricEntry{},
+			logger:  TryCL(ctx),
+			clock:   ClockFromContext(ctx),
+			tenant:  TenantFromContext(ctx),
 		})
 }
 
+// Create a metrics context, unless the context already has one
+func MakeMetricContextIfAbsent(ctx context.Context, opName string) context.Context {
+	if TryGetMetricsFromContext(ctx) != nil {
+		return ctx
+	}
+	return MakeMetricContext(ctx, opName)
+}
+
 func GetMetricsFromContext(ctx context.Context) *MetricsContext {
-	res, ok := ctx.Value(MetricsContextKey).(*MetricsContext)
-	PanicIfF(!ok, "No metrics context attached")
+	res := TryGetMetricsFromContext(ctx)
+	PanicIfF(res == nil, "No metrics context attached")
 
 	return res
 }
 
 func TryGetMetricsFromContext(ctx context.Context) *MetricsContext {
-	res, ok := ctx.Value(MetricsContextKey).(*MetricsContext)
+	res, ok := ctx.Value(metricsContextKeyVal).(*MetricsContext)
+	if ok {
+		return res
+	}
+	// Fall back to the deprecated key
+	res, ok = ctx.Value(MetricsContextKey).(*MetricsContext)
 	if !ok {
 		return nil
 	}
 	return res
 }
 
+// Set the clock for the metric timestamps and the benchmarks, useful for tests.
+// The clock attached to the context (see WithClock) is used by default.
+func (m *MetricsContext) SetClock(clock Clock) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.clock = clock
+}
+
+func (m *MetricsContext) lockedNow() time.Time {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	return m.now()
+}
+
+// Must be called under the lock
+func (m *MetricsContext) now() time.Time {
+	if m.clock == nil {
+		return time.Now()
+	}
+	return m.clock.Now()
+}
+
+// Set the tenant sent as the tenant tag of the metrics, the metrics contexts
+// pick up the tenant from the context (see ContextWithTenant) by default
+func (m *MetricsContext) SetTenant(tenant string) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.tenant = tenant
+}
+
 // Remove all metrics for the context, useful for tests
 func (m *MetricsContext) Reset() {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 
 	m.Metrics = make(map[string]*MetricEntry)
+	m.warnings = nil
+	m.sealed = false
+	m.lateMetrics = 0
+	m.boolRates = nil
+	m.flushed = nil
+	m.nonMonotonic = nil
+	for _, c := range m.counters {
+		c.take()
+	}
+	for _, s := range m.shardedCounters {
+		s.take()
+	}
+}
+
+// Mark the context as sealed, this is called by the middlewares right before
+// the metrics are copied out. The metrics recorded after that are still stored,
+// but they are counted as late since they likely won't be reported.
+func (m *MetricsContext) Seal() {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.sealed = true
+}
+
+func (m *MetricsContext) WasSealed() bool {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	return m.sealed
+}
+
+// The number of metrics recorded after the context was sealed
+func (m *MetricsContext) LateMetrics() int {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	return m.lateMetrics
+}
+
+func (m *MetricsContext) noteLateWriteLocked(name string) {
+	if !m.sealed {
+		return
+	}
+	m.lateMetrics++
+
+	if atomic.LoadInt32(&debugLateMetrics) == 0 || m.logger == nil {
+		return
+	}
+	// Skip runtime.Callers, NewShortenedStackTrace, this function and AddMetric/SetMetric
+	stack := NewShortenedStackTrace(4, false, "late metric")
+	m.logger.Warn("Metric is recorded after the metrics context was sealed",
+		zap.String("op", m.OpName), zap.String("metric", name),
+		zap.String("stack", stack.StringStack()))
+}
+
+// Record a warning for a degraded-but-successful operation. Warnings don't fail
+// the operation, but they are surfaced as the span tag and the PartialFailure count.
+func (m *MetricsContext) AddWarning(warning string) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	m.noteLateWriteLocked(PartialFailureMetric)
+	if len(m.warnings) == 0 {
+		// The operation is counted once, however many warnings it has
+		m.addMetricLocked(PartialFailureMetric, 1, cloudwatch.StandardUnitCount)
+	}
+	m.warnings = append(m.warnings, warning)
+}
+
+// Get the recorded warnings, e.g. to include them into the response
+func (m *MetricsContext) GetWarnings() []string {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	res := make([]string, len(m.warnings))
+	copy(res, m.warnings)
+	return res
+}
+
+// By default, adding a metric with a unit that differs from the already recorded
+// one is a programming error and panics. In the lenient mode the value is converted
+// if both units share the same base (e.g. seconds and milliseconds), otherwise
+// it's recorded as "name.unit_conflict" and the MetricUnitConflicts count is
+// incremented. Use the lenient mode in production to avoid taking down handlers.
+func (m *MetricsContext) SetLenientUnits(lenient bool) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.lenientUnits = lenient
+}
+
+// Set the logger used to report the unit conflicts in the lenient mode, by default
+// the logger from the context passed to MakeMetricContext is used
+func (m *MetricsContext) SetLogger(logger *zap.Logger) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.logger = logger
 }
 
 func (m *MetricsContext) GetMetric(name string) (val float64, unit cloudwatch.StandardUnit) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
+	m.foldCountersLocked()
 
 	curVal := m.Metrics[name]
 	if curVal == nil {
@@ -137,31 +377,143 @@ func (m *MetricsContext) GetMetricVal(name string) float64 {
 	return v
 }
 
+// Log at most this many metrics in MarshalLogObject and String
+const maxLoggedMetrics = 50
+
+// The key of the number of the metrics omitted from the log
+const MetricsTruncatedKey = "_truncated"
+
+// Get the first maxLoggedMetrics names in the alphabetical order, and the
+// number of the omitted ones
+func (m *MetricsContext) loggedNamesLocked() ([]string, int) {
+	names := make([]string, 0, len(m.Metrics))
+	for name := range m.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > maxLoggedMetrics {
+		return names[:maxLoggedMetrics], len(names) - maxLoggedMetrics
+	}
+	return names, 0
+}
+
+// Log the metrics as name -> {value, unit} objects, e.g. with
+// zap.Object("metrics", met)
+func (m *MetricsContext) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.foldCountersLocked()
+
+	names, truncated := m.loggedNamesLocked()
+	for _, name := range names {
+		if err := enc.AddObject(name, m.Metrics[name]); err != nil {
+			return err
+		}
+	}
+	if truncated != 0 {
+		enc.AddInt(MetricsTruncatedKey, truncated)
+	}
+	return nil
+}
+
+func (e *MetricEntry) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddFloat64("value", e.Val)
+	enc.AddString("unit", string(e.Unit))
+	return nil
+}
+
+// The compact form of the metrics ordered by name, e.g.
+// "Op{Count=2 Count, Time=1.5 Seconds}"
+func (m *MetricsContext) String() string {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.foldCountersLocked()
+
+	names, truncated := m.loggedNamesLocked()
+	parts := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		e := m.Metrics[name]
+		parts = append(parts, name+"="+
+			strconv.FormatFloat(e.Val, 'g', -1, 64)+" "+string(e.Unit))
+	}
+	if truncated != 0 {
+		parts = append(parts, "..."+strconv.Itoa(truncated)+" more")
+	}
+	return m.OpName + "{" + strings.Join(parts, ", ") + "}"
+}
+
 func (m *MetricsContext) AddMetric(name string, val float64, unit cloudwatch.StandardUnit) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 
+	m.noteLateWriteLocked(name)
+	m.addMetricLocked(name, val, unit)
+}
+
+func (m *MetricsContext) addMetricLocked(name string, val float64, unit cloudwatch.StandardUnit) {
 	curVal := m.Metrics[name]
 	if curVal == nil {
 		m.Metrics[name] = &MetricEntry{
 			Val:       val,
 			Unit:      unit,
-			Timestamp: time.Now(),
+			Timestamp: m.now(),
 		}
 		return
 	}
 
-	PanicIfF(curVal.Unit != unit, "inconsistent unit assignment, was %s want %s",
+	if curVal.Unit == unit {
+		curVal.Val += val
+		return
+	}
+
+	PanicIfF(!m.lenientUnits, "inconsistent unit assignment, was %s want %s",
 		curVal.Unit, unit)
-	curVal.Val += val
+
+	// Try to convert the value into the existing unit
+	newNorm, newBase := MetricEntry{Val: val, Unit: unit}.Normalize()
+	curFactor, curBase := MetricEntry{Val: 1, Unit: curVal.Unit}.Normalize()
+	if newBase == curBase && newBase != cloudwatch.StandardUnitNone {
+		curVal.Val += newNorm / curFactor
+		return
+	}
+
+	m.logUnitConflict(name, curVal.Unit, unit)
+	m.addMetricLocked(UnitConflictMetric, 1, cloudwatch.StandardUnitCount)
+	if strings.HasSuffix(name, UnitConflictSuffix) {
+		// Don't create an endless chain of suffixes, just drop the value
+		return
+	}
+	m.addMetricLocked(name+UnitConflictSuffix, val, unit)
+}
+
+func (m *MetricsContext) logUnitConflict(name string,
+	was, want cloudwatch.StandardUnit) {
+
+	if m.logger == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&lastUnitConflictLog)
+	if now-last < int64(unitConflictLogInterval) ||
+		!atomic.CompareAndSwapInt64(&lastUnitConflictLog, last, now) {
+		return
+	}
+	m.logger.Error("Inconsistent metric unit assignment",
+		zap.String("op", m.OpName), zap.String("metric", name),
+		zap.String("was", string(was)), zap.String("want", string(want)))
 }
 
 func (m *MetricsContext) SetMetric(name string, val float64, unit cloudwatch.StandardUnit) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 
-	ent := &MetricEntry{Val: val, Unit: unit, Timestamp: time.Now()}
+	m.noteLateWriteLocked(name)
+	ent := &MetricEntry{Val: val, Unit: unit, Timestamp: m.now()}
 	m.Metrics[name] = ent
+	if m.nonMonotonic == nil {
+		m.nonMonotonic = make(map[string]bool)
+	}
+	m.nonMonotonic[name] = true
 }
 
 func (m *MetricsContext) AddCount(name string, val float64) {
@@ -172,6 +524,35 @@ func (m *MetricsContext) SetCount(name string, val float64) {
 	m.SetMetric(name, val, cloudwatch.StandardUnitCount)
 }
 
+// Record the flag (e.g. a cache hit) as the 1 or 0 count
+func (m *MetricsContext) RecordBool(name string, value bool) {
+	m.AddCount(name, boolToCount(value))
+}
+
+// Record the occurrence of the flag in the "<name>.Total" count, and the true
+// values in the "<name>.True" count. CopyToStatsd also sends their ratio as the
+// "<name>.Rate" metric.
+func (m *MetricsContext) RecordBoolRate(name string, value bool) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	m.noteLateWriteLocked(name)
+	m.addMetricLocked(name+BoolRateTotalSuffix, 1, cloudwatch.StandardUnitCount)
+	m.addMetricLocked(name+BoolRateTrueSuffix, boolToCount(value),
+		cloudwatch.StandardUnitCount)
+	if m.boolRates == nil {
+		m.boolRates = make(map[string]bool)
+	}
+	m.boolRates[name] = true
+}
+
+func boolToCount(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
 func (m *MetricsContext) AddDuration(name string, duration time.Duration) {
 	m.AddMetric(name, duration.Seconds(), cloudwatch.StandardUnitSeconds)
 }
@@ -184,43 +565,234 @@ type TimeMeasurement struct {
 	parent *MetricsContext
 	name   string
 	start  time.Time
+	span   tracer.Span
+}
+
+type BenchmarkOption func(t *TimeMeasurement)
+
+// Also set the measured duration as the span tag when Done() is called, so the
+// partial timings are visible on the span before the operation completes (the
+// tag is overwritten with the total when the metrics are copied to the span).
+func BenchmarkToSpan(span tracer.Span) BenchmarkOption {
+	return func(t *TimeMeasurement) {
+		t.span = span
+	}
 }
 
-func (m *MetricsContext) Benchmark(name string) *TimeMeasurement {
-	return &TimeMeasurement{
+func (m *MetricsContext) Benchmark(name string, opts ...BenchmarkOption) *TimeMeasurement {
+	res := &TimeMeasurement{
 		parent: m,
 		name:   name,
-		start:  time.Now(),
+		start:  m.lockedNow(),
 	}
+	for _, o := range opts {
+		o(res)
+	}
+	return res
+}
+
+// The time since the start of the measurement
+func (t *TimeMeasurement) Elapsed() time.Duration {
+	return t.parent.lockedNow().Sub(t.start)
 }
 
 func (t *TimeMeasurement) Done() {
-	t.parent.AddDuration(t.name, time.Now().Sub(t.start))
+	duration := t.parent.lockedNow().Sub(t.start)
+	t.parent.AddDuration(t.name, duration)
+
+	if t.span != nil {
+		entry := MetricEntry{Val: duration.Seconds(), Unit: cloudwatch.StandardUnitSeconds}
+		normVal, normUnit := entry.Normalize()
+		t.span.SetTag(t.name, normVal)
+		t.span.SetTag(t.name+"_unit", t.parent.normalizeUnitName(normUnit))
+	}
 }
 
 func (m *MetricsContext) CopyToSpan(span tracer.Span) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
+	m.foldCountersLocked()
 
 	for name, val := range m.Metrics {
 		normVal, normUnit := val.Normalize()
-		span.SetTag(name, normVal)
+		SetSpanTagSafe(span, name, normVal)
 		if normUnit != cloudwatch.StandardUnitCount {
 			span.SetTag(name+"_unit", m.normalizeUnitName(normUnit))
 		}
 	}
+	if len(m.warnings) != 0 {
+		SetSpanTagSafe(span, WarningsTag, strings.Join(m.warnings, "\n"))
+	}
+}
+
+// Copy the metrics to the span, unless SetSpanMetricsSampledOnly is enabled and the
+// span is not sampled. This is what RunInstrumented and the middlewares use.
+func (m *MetricsContext) CopyToSampledSpan(span tracer.Span) {
+	if atomic.LoadInt32(&spanMetricsSampledOnly) != 0 && !IsSpanSampled(span) {
+		return
+	}
+	m.CopyToSpan(span)
+}
+
+// Check the span's sampling decision, the spans without the decision are
+// considered to be sampled. The sampling priority is not exposed directly by
+// the tracer, so it's read from the propagation headers.
+func IsSpanSampled(span tracer.Span) bool {
+	carrier := tracer.TextMapCarrier{}
+	if err := tracer.Inject(span.Context(), carrier); err != nil {
+		return true
+	}
+	priority, ok := carrier[tracer.DefaultPriorityHeader]
+	if !ok {
+		return true
+	}
+	val, err := strconv.Atoi(priority)
+	return err != nil || val > 0
 }
 
 func (m *MetricsContext) CopyToStatsd(client statsd.ClientInterface, clientType string) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
+	m.foldCountersLocked()
 
+	guard := getTagGuard(m.tenant)
+	filter := getMetricFilter()
+	suppressed := 0
 	for name, val := range m.Metrics {
-		normVal, normUnit := val.Normalize()
-		normUnitName := m.normalizeUnitName(normUnit)
+		if !filter.Allow(m.OpName, name) {
+			suppressed++
+			continue
+		}
+		entry := *val
+		if prev, ok := m.flushed[name]; ok {
+			// Only the remainder of the already flushed counts is sent
+			entry.Val -= prev
+			if entry.Val == 0 {
+				continue
+			}
+		}
+		m.sendLocked(client, clientType, guard, name, entry)
+	}
+
+	for name := range m.boolRates {
+		total, trues := m.Metrics[name+BoolRateTotalSuffix], m.Metrics[name+BoolRateTrueSuffix]
+		if total == nil || trues == nil || total.Val == 0 {
+			continue
+		}
+		if !filter.Allow(m.OpName, name+BoolRateSuffix) {
+			suppressed++
+			continue
+		}
+		statsdName, tags := m.statsdNameLocked(name + BoolRateSuffix)
+		tags = appendTenantTag(append(tags, "unit:none", ClientTypeTag+":"+clientType), m.tenant)
+		if guard != nil {
+			tags = guard.Filter(statsdName, tags)
+		}
+		_ = client.Distribution(statsdName, trues.Val/total.Val, tags, 1)
+	}
+
+	if suppressed != 0 {
+		_ = client.Count(SuppressedMetricsMetric, int64(suppressed),
+			[]string{"unit:count", ClientTypeTag + ":" + clientType}, 1)
+	}
+}
+
+func (m *MetricsContext) sendLocked(client statsd.ClientInterface, clientType string,
+	guard *CardinalityGuard, name string, entry MetricEntry) {
+
+	normVal, normUnit := entry.Normalize()
+	statsdName, tags := m.statsdTagsLocked(clientType, guard, name, normUnit)
+	_ = client.Distribution(statsdName, normVal, tags, 1)
+}
+
+func (m *MetricsContext) statsdTagsLocked(clientType string, guard *CardinalityGuard,
+	name string, unit cloudwatch.StandardUnit) (string, []string) {
 
-		_ = client.Distribution(m.OpName+"."+name, normVal,
-			[]string{"unit:" + normUnitName, "client-type:" + clientType}, 1)
+	statsdName, tags := m.statsdNameLocked(name)
+	tags = appendTenantTag(append(tags, "unit:"+m.normalizeUnitName(unit),
+		ClientTypeTag+":"+clientType), m.tenant)
+	if guard != nil {
+		tags = guard.Filter(statsdName, tags)
+	}
+	return statsdName, tags
+}
+
+// Send the metric to statsd under the namespace instead of the OpName, so it
+// can be aggregated across the operations, e.g. SetMetricNamespace("query.time",
+// "db") sends it as "db.query.time" (and its bool rate as "db.query.time.Rate").
+// The empty namespace sends it without any prefix. The OpName is then sent as
+// the "operation" tag. The metric's name in the context (and in the span) is
+// not changed.
+func (m *MetricsContext) SetMetricNamespace(name, namespace string) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if m.namespaces == nil {
+		m.namespaces = make(map[string]string)
+	}
+	m.namespaces[name] = namespace
+}
+
+// Get the statsd name of the metric and the tags identifying the operation, if
+// it's not in the name. The bool rate metrics use the namespace of their base.
+func (m *MetricsContext) statsdNameLocked(name string) (string, []string) {
+	namespace, ok := m.namespaces[name]
+	for _, suffix := range []string{BoolRateSuffix, BoolRateTotalSuffix, BoolRateTrueSuffix} {
+		base := strings.TrimSuffix(name, suffix)
+		if !ok && base != name && m.boolRates[base] {
+			namespace, ok = m.namespaces[base]
+		}
+	}
+	if !ok {
+		return m.OpName + "." + name, make([]string, 0, 3)
+	}
+	tags := []string{"operation:" + m.OpName}
+	if namespace == "" {
+		return name, tags
+	}
+	return namespace + "." + name, tags
+}
+
+// The metrics set by the middlewares (and InstrumentWithMetrics) that are
+// final only once the request is finished, e.g. the Fault is 1 until the
+// handler returns
+var RequestStatusMetrics = []string{"Success", "Error", "Fault", "Time", CancelledMetric}
+
+// Send the changes of the monotonic counts since the previous flush, e.g.
+// periodically for the long-lived requests. The deltas are the distributions,
+// like all the other metrics, and the CopyToStatsd at the end sends only the
+// remainders, so the sums of the sent values stay correct. The other metrics
+// (durations, bytes, the metrics set with SetMetric) are sent only by
+// CopyToStatsd. The counts that are not final until the end (e.g.
+// RequestStatusMetrics) should be skipped.
+func (m *MetricsContext) FlushDeltaToStatsd(client statsd.ClientInterface, clientType string,
+	skip ...string) {
+
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.foldCountersLocked()
+
+	guard := getTagGuard(m.tenant)
+	filter := getMetricFilter()
+outer:
+	for name, val := range m.Metrics {
+		for _, s := range skip {
+			if s == name {
+				continue outer
+			}
+		}
+		if val.Unit != cloudwatch.StandardUnitCount || m.nonMonotonic[name] {
+			continue
+		}
+		entry := *val
+		entry.Val -= m.flushed[name]
+		if entry.Val == 0 || !filter.Allow(m.OpName, name) {
+			continue
+		}
+		m.sendLocked(client, clientType, guard, name, entry)
+		if m.flushed == nil {
+			m.flushed = make(map[string]float64)
+		}
+		m.flushed[name] = val.Val
 	}
 }
 
@@ -4,7 +4,12 @@ import (
 	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/cyberax/go-dd-service-base/utils"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,8 +31,10 @@ func TestMetricsContext(t *testing.T) {
 	mctx.SetDuration("duration", time.Millisecond*500)
 	mctx.AddDuration("duration", time.Second*2)
 
+	clock := utils.NewFakeClock(time.Unix(1000, 0))
+	mctx.SetClock(clock)
 	bench := mctx.Benchmark("delay")
-	time.Sleep(500 * time.Millisecond)
+	clock.Advance(500 * time.Millisecond)
 	bench.Done()
 
 	fakeSink := NewRecordingSink()
@@ -38,7 +45,7 @@ func TestMetricsContext(t *testing.T) {
 
 	assert.Equal(t, float64(14), fakeSink.Distributions["TestOp.count1"])
 
-	assert.True(t, fakeSink.Distributions["TestOp.delay"] > 0.5*1000000)
+	assert.Equal(t, 0.5*1000000, fakeSink.Distributions["TestOp.delay"])
 	assert.Equal(t, "unit:microseconds", fakeSink.Tags["TestOp.delay"][0])
 
 	assert.Equal(t, 2.5*1e6, fakeSink.Distributions["TestOp.duration"])
@@ -89,3 +96,250 @@ func TestMetricsSubmission(t *testing.T) {
 		assert.Equal(t, "bytes", fc.tags[fmt.Sprintf("met%d_unit", i)])
 	}
 }
+
+func TestWarnings(t *testing.T) {
+	ctx := MakeMetricContext(context.Background(), "TestOp")
+	mctx := GetMetricsFromContext(ctx)
+	assert.Equal(t, 0, len(mctx.GetWarnings()))
+	mctx.SetClock(utils.NewFakeClock(time.Unix(1000, 0)))
+
+	mctx.AddWarning("item 1 failed")
+	mctx.AddWarning("item 2 failed")
+	assert.Equal(t, []string{"item 1 failed", "item 2 failed"}, mctx.GetWarnings())
+	assert.Equal(t, 1.0, mctx.GetMetricVal(PartialFailureMetric))
+	assert.Equal(t, time.Unix(1000, 0), mctx.Metrics[PartialFailureMetric].Timestamp)
+
+	// The unit of the metric is checked
+	conflicting := GetMetricsFromContext(MakeMetricContext(context.Background(), "TestOp"))
+	conflicting.SetMetric(PartialFailureMetric, 1, cloudwatch.StandardUnitSeconds)
+	assert.Panics(t, func() { conflicting.AddWarning("item 3 failed") })
+
+	fc := &FakeSpan{tags: map[string]interface{}{}}
+	mctx.CopyToSpan(fc)
+	assert.Equal(t, "item 1 failed\nitem 2 failed", fc.tags[WarningsTag])
+	assert.Nil(t, fc.tags["error"])
+
+	mctx.Reset()
+	assert.Equal(t, 0, len(mctx.GetWarnings()))
+}
+
+func TestMetricsShadowing(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	ctx := ImbueContext(context.Background(), logger)
+	ctx = MakeMetricContext(ctx, "Outer")
+
+	// The existing context is reused
+	same := MakeMetricContextIfAbsent(ctx, "Inner")
+	assert.Equal(t, "Outer", GetMetricsFromContext(same).OpName)
+
+	SetWarnOnMetricsShadowing(true)
+	defer SetWarnOnMetricsShadowing(false)
+	shadowed := MakeMetricContext(ctx, "Inner")
+	assert.Equal(t, "Inner", GetMetricsFromContext(shadowed).OpName)
+	assert.True(t, strings.Contains(sink.String(), "Metrics context is shadowed"))
+
+	// The deprecated key is still readable
+	//noinspection GoDeprecation
+	legacy := context.WithValue(context.Background(), MetricsContextKey,
+		&MetricsContext{OpName: "Legacy"})
+	assert.Equal(t, "Legacy", GetMetricsFromContext(legacy).OpName)
+}
+
+func TestLenientUnits(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	ctx := ImbueContext(context.Background(), logger)
+	mctx := GetMetricsFromContext(MakeMetricContext(ctx, "Op"))
+
+	mctx.AddDuration("Time", time.Second)
+	// Strict mode by default
+	assert.Panics(t, func() {
+		mctx.AddMetric("Time", 500, cloudwatch.StandardUnitMilliseconds)
+	})
+
+	mctx.SetLenientUnits(true)
+	// Same base unit is converted
+	mctx.AddMetric("Time", 500, cloudwatch.StandardUnitMilliseconds)
+	val, unit := mctx.GetMetric("Time")
+	assert.Equal(t, 1.5, val)
+	assert.Equal(t, cloudwatch.StandardUnitSeconds, unit)
+
+	// Incompatible units are recorded separately
+	mctx.AddMetric("Time", 10, cloudwatch.StandardUnitBytes)
+	mctx.AddMetric("Time", 10, cloudwatch.StandardUnitBytes)
+	assert.Equal(t, 1.5, mctx.GetMetricVal("Time"))
+	assert.Equal(t, 20.0, mctx.GetMetricVal("Time"+UnitConflictSuffix))
+	assert.Equal(t, 2.0, mctx.GetMetricVal(UnitConflictMetric))
+	// The log is rate-limited
+	assert.Equal(t, 1, strings.Count(sink.String(), "Inconsistent metric unit"))
+}
+
+func TestLateMetrics(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	ctx := ImbueContext(context.Background(), logger)
+
+	var mctx *MetricsContext
+	err := RunInstrumented(ctx, "Op", func(c context.Context) error {
+		mctx = GetMetricsFromContext(c)
+		mctx.AddCount("InTime", 1)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, mctx.WasSealed())
+	assert.Equal(t, 0, mctx.LateMetrics())
+
+	// Late writes are still recorded
+	mctx.AddCount("Late", 1)
+	assert.Equal(t, 1, mctx.LateMetrics())
+	assert.Equal(t, 1.0, mctx.GetMetricVal("Late"))
+	assert.Equal(t, "", sink.String())
+
+	SetDebugLateMetrics(true)
+	defer SetDebugLateMetrics(false)
+	mctx.SetCount("Late2", 1)
+	assert.Equal(t, 2, mctx.LateMetrics())
+	assert.True(t, strings.Contains(sink.String(), `"metric":"Late2"`))
+	assert.True(t, strings.Contains(sink.String(), "TestLateMetrics"))
+}
+
+func TestBenchmarkToSpan(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "op")
+	ctx = MakeMetricContext(ctx, "Op")
+	met := GetMetricsFromContext(ctx)
+
+	bench := met.Benchmark("Step", BenchmarkToSpan(span))
+	time.Sleep(2 * time.Millisecond)
+	bench.Done()
+	met.Benchmark("Untraced").Done()
+
+	// The partial timing is visible while the span is still open
+	step, ok := span.(mocktracer.Span).Tag("Step").(float64)
+	assert.True(t, ok)
+	assert.True(t, step >= 2000)
+	assert.Equal(t, "microseconds", span.(mocktracer.Span).Tag("Step_unit"))
+	assert.Nil(t, span.(mocktracer.Span).Tag("Untraced"))
+	span.Finish()
+}
+
+func TestBoolMetrics(t *testing.T) {
+	mctx := GetMetricsFromContext(MakeMetricContext(context.Background(), "TestOp"))
+
+	mctx.RecordBool("CacheHit", true)
+	mctx.RecordBool("CacheHit", false)
+	mctx.RecordBool("CacheHit", true)
+	mctx.RecordBool("Retried", false)
+	assert.Equal(t, 2.0, mctx.GetMetricVal("CacheHit"))
+
+	mctx.RecordBoolRate("Throttled", true)
+	mctx.RecordBoolRate("Throttled", false)
+	mctx.RecordBoolRate("Throttled", false)
+	mctx.RecordBoolRate("Throttled", false)
+
+	fakeSink := NewRecordingSink()
+	mctx.CopyToStatsd(fakeSink, "ThisClientType")
+
+	assert.Equal(t, 2.0, fakeSink.Distributions["TestOp.CacheHit"])
+	assert.Equal(t, "unit:count", fakeSink.Tags["TestOp.CacheHit"][0])
+	assert.Equal(t, 0.0, fakeSink.Distributions["TestOp.Retried"])
+	assert.Equal(t, 4.0, fakeSink.Distributions["TestOp.Throttled.Total"])
+	assert.Equal(t, 1.0, fakeSink.Distributions["TestOp.Throttled.True"])
+	assert.Equal(t, 0.25, fakeSink.Distributions["TestOp.Throttled.Rate"])
+	assert.Equal(t, []string{"unit:none", "client-type:ThisClientType"},
+		fakeSink.Tags["TestOp.Throttled.Rate"])
+
+	// The rates are forgotten on reset
+	mctx.Reset()
+	mctx.RecordBool("Throttled", true)
+	fakeSink = NewRecordingSink()
+	mctx.CopyToStatsd(fakeSink, "ThisClientType")
+	_, hasRate := fakeSink.Distributions["TestOp.Throttled.Rate"]
+	assert.False(t, hasRate)
+}
+
+func TestMetricsLogging(t *testing.T) {
+	mctx := GetMetricsFromContext(MakeMetricContext(context.Background(), "TestOp"))
+	mctx.SetCount("b", 2)
+	mctx.SetMetric("a", 1.5, cloudwatch.StandardUnitSeconds)
+	assert.Equal(t, "TestOp{a=1.5 Seconds, b=2 Count}", mctx.String())
+
+	sink, logger := utils.NewMemorySinkLogger()
+	logger.Info("Failed", zap.Object("metrics", mctx))
+	assert.True(t, strings.Contains(sink.String(),
+		`"metrics":{"a":{"value":1.5,"unit":"Seconds"},"b":{"value":2,"unit":"Count"}}`))
+
+	// Only the first names are logged
+	for i := 0; i < maxLoggedMetrics+2; i++ {
+		mctx.SetCount(fmt.Sprintf("m%03d", i), 1)
+	}
+	str := mctx.String()
+	assert.True(t, strings.HasSuffix(str, ", m047=1 Count, ...4 more}"))
+
+	sink.Reset()
+	logger.Info("Failed", zap.Object("metrics", mctx))
+	assert.True(t, strings.Contains(sink.String(), `"m047":{"value":1,"unit":"Count"},"_truncated":4}`))
+	assert.False(t, strings.Contains(sink.String(), `"m048"`))
+}
+
+func TestFlushDelta(t *testing.T) {
+	mctx := GetMetricsFromContext(MakeMetricContext(context.Background(), "TestOp"))
+	mctx.SetCount("Fault", 1)
+	mctx.AddCount("Frames", 3)
+	mctx.AddDuration("Wait", time.Second)
+	mctx.SetCount("Queued", 4)
+
+	// Only the monotonic counts are flushed
+	sink := NewRecordingSink()
+	mctx.FlushDeltaToStatsd(sink, "normal", RequestStatusMetrics...)
+	assert.Equal(t, map[string]float64{"TestOp.Frames": 3}, sink.Distributions)
+	assert.Empty(t, sink.Counts)
+
+	// Only the changed counts are sent
+	mctx.AddCount("Frames", 2)
+	mctx.SetCount("Queued", 2)
+	sink = NewRecordingSink()
+	mctx.FlushDeltaToStatsd(sink, "normal", RequestStatusMetrics...)
+	assert.Equal(t, map[string]float64{"TestOp.Frames": 2}, sink.Distributions)
+
+	// The final copy sends the remainders and the other metrics
+	mctx.AddCount("Frames", 1)
+	mctx.SetCount("Fault", 0)
+	sink = NewRecordingSink()
+	mctx.CopyToStatsd(sink, "normal")
+	// The same metric type as for the requests that are never flushed
+	assert.Equal(t, map[string]float64{"TestOp.Frames": 1, "TestOp.Wait": 1e6,
+		"TestOp.Queued": 2, "TestOp.Fault": 0}, sink.Distributions)
+	assert.Empty(t, sink.Counts)
+	assert.Equal(t, 6.0, mctx.GetMetricVal("Frames"))
+}
+
+func TestMetricNamespace(t *testing.T) {
+	mctx := GetMetricsFromContext(MakeMetricContext(context.Background(), "TestOp"))
+	mctx.SetMetricNamespace("query.time", "db")
+	mctx.SetMetricNamespace("Requests", "")
+	mctx.SetMetricNamespace("Throttled", "aws")
+	mctx.AddDuration("query.time", time.Second)
+	mctx.AddCount("Requests", 1)
+	mctx.AddCount("Local", 1)
+	mctx.RecordBoolRate("Throttled", true)
+	mctx.RecordBoolRate("Throttled", false)
+
+	sink := NewRecordingSink()
+	mctx.CopyToStatsd(sink, "normal")
+	assert.Equal(t, map[string]float64{
+		"db.query.time":       1e6,
+		"Requests":            1,
+		"TestOp.Local":        1,
+		"aws.Throttled.Total": 2,
+		"aws.Throttled.True":  1,
+		"aws.Throttled.Rate":  0.5,
+	}, sink.Distributions)
+	assert.Equal(t, []string{"operation:TestOp", "unit:microseconds",
+		"client-type:normal"}, sink.Tags["db.query.time"])
+	assert.Equal(t, []string{"unit:count", "client-type:normal"},
+		sink.Tags["TestOp.Local"])
+
+	// The name in the context is not changed
+	assert.Equal(t, 1.0, mctx.GetMetricVal("Requests"))
+}
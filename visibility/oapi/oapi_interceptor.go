@@ -7,23 +7,61 @@ import (
 	"fmt"
 	. "github.com/cyberax/go-dd-service-base/utils"
 	"github.com/cyberax/go-dd-service-base/visibility"
+	"go.uber.org/zap"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
-	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/getkin/kin-openapi/openapi3filter"
 	"github.com/labstack/echo/v4"
 )
 
+// The requests rejected before reaching an operation are counted in these
+// metrics, tagged by the method and the status (never by the path, to keep
+// the cardinality bounded) and traced under the BadRequestSpanName
+const (
+	UnmatchedPathMetric     = "oapi.UnmatchedPath"
+	ValidationFailureMetric = "oapi.ValidationFailure"
+	BadRequestSpanName      = "oapi.bad_request"
+)
+
+// The rejected paths are truncated to this length in the logs
+const maxLoggedPathLength = 256
+
 type AuthValidatorFunc func(e echo.Context, input *openapi3filter.AuthenticationInput) error
 
 type requestValidationAndMetrics struct {
-	router  *openapi3filter.Router
-	apiPath string
-	next    echo.HandlerFunc
-	auth    AuthValidatorFunc
+	router   *openapi3filter.Router
+	apiPath  string
+	basePath string
+	next     echo.HandlerFunc
+	auth     AuthValidatorFunc
+
+	// The misconfigured mount point, logged once on the legacy path
+	mountErr       error
+	mountErrLogged *sync.Once
+}
+
+type RequestValidatorOptions struct {
+	// The common prefix of the API requests (including the mount point), the
+	// other requests are passed through without the validation
+	ApiPath string
+
+	// The path where the API is mounted, e.g. the prefix of the echo Group. It's
+	// stripped from the request path before looking up the operation, unless
+	// the spec paths already include it.
+	BasePath string
+
+	// Use the path of the spec's first server URL (see SpecBasePath) as the
+	// BasePath, if the latter is empty
+	UseSpecBasePath bool
+
+	Auth AuthValidatorFunc
 }
 
 // Create middleware to validate requests against OAPI3 specification. Additionally
@@ -36,17 +74,189 @@ type requestValidationAndMetrics struct {
 // Time: request duration (time)
 func OapiRequestValidatorWithMetrics(swagger *openapi3.Swagger, apiPath string,
 	validator AuthValidatorFunc) echo.MiddlewareFunc {
+
 	PanicIfF(apiPath == "", "API methods must have a common prefix")
+	// The mount problems are only logged here, to keep the existing services
+	// starting up
+	mw, _ := newRequestValidator(swagger, RequestValidatorOptions{
+		ApiPath: apiPath,
+		Auth:    validator,
+	}, true)
+	return mw
+}
+
+// Create the validation middleware (see OapiRequestValidatorWithMetrics) for
+// the API mounted under a base path. Fails if none of the spec paths can
+// ever match the requests under the ApiPath.
+func OapiRequestValidatorWithOptions(swagger *openapi3.Swagger,
+	opts RequestValidatorOptions) (echo.MiddlewareFunc, error) {
+
+	if opts.ApiPath == "" {
+		return nil, fmt.Errorf("API methods must have a common prefix")
+	}
+	return newRequestValidator(swagger, opts, false)
+}
+
+// Create the validation middleware, the mount error is either returned or
+// logged once (on the first API request) if logMountErr is set
+func newRequestValidator(swagger *openapi3.Swagger, opts RequestValidatorOptions,
+	logMountErr bool) (echo.MiddlewareFunc, error) {
+
+	basePath := strings.TrimRight(opts.BasePath, "/")
+	if basePath == "" && opts.UseSpecBasePath {
+		basePath = SpecBasePath(swagger)
+	}
+	if basePath != "" {
+		// The base path is handled here instead of the servers, which are
+		// matched against the full URLs with the hosts
+		specCopy := *swagger
+		specCopy.Servers = nil
+		swagger = &specCopy
+		if specIncludesPrefix(swagger, basePath) {
+			basePath = ""
+		}
+	}
+
+	var mountErr error
+	if len(swagger.Servers) == 0 && !specCanMatch(swagger, basePath, opts.ApiPath) {
+		mountErr = fmt.Errorf(
+			"none of the spec paths can match the requests under %q (base path %q)",
+			opts.ApiPath, basePath)
+		if !logMountErr {
+			return nil, mountErr
+		}
+	}
+
 	router := openapi3filter.NewRouter().WithSwagger(swagger)
+	mountErrLogged := &sync.Once{}
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		val := requestValidationAndMetrics{
-			router: router,
-			next: next,
-			apiPath: apiPath,
-			auth: validator,
+			router:         router,
+			next:           next,
+			apiPath:        opts.ApiPath,
+			basePath:       basePath,
+			auth:           opts.Auth,
+			mountErr:       mountErr,
+			mountErrLogged: mountErrLogged,
 		}
 		return val.validateAndRunWithMetrics
+	}, nil
+}
+
+// Get the path of the spec's first server URL (e.g. "/v2" for
+// "https://example.com/v2"), the templated paths are ignored
+func SpecBasePath(swagger *openapi3.Swagger) string {
+	if len(swagger.Servers) == 0 || swagger.Servers[0] == nil {
+		return ""
+	}
+	serverUrl, err := url.Parse(swagger.Servers[0].URL)
+	if err != nil || strings.Contains(serverUrl.Path, "{") {
+		return ""
+	}
+	return strings.TrimRight(serverUrl.Path, "/")
+}
+
+// Check whether all the spec paths start with the prefix
+func specIncludesPrefix(swagger *openapi3.Swagger, prefix string) bool {
+	if len(swagger.Paths) == 0 {
+		return false
+	}
+	for path := range swagger.Paths {
+		if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// Check whether any of the spec paths, mounted under the base path, can match
+// a request under the API path
+func specCanMatch(swagger *openapi3.Swagger, basePath string, apiPath string) bool {
+	for path := range swagger.Paths {
+		full := basePath + path
+		// The path parameters can match anything
+		if i := strings.IndexByte(full, '{'); i >= 0 {
+			full = full[:i]
+		}
+		if strings.HasPrefix(full, apiPath) || strings.HasPrefix(apiPath, full) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the URL to look up the operation, relative to the base path. Only the
+// whole path segments match it, e.g. "/v2" is not stripped from "/v20/items".
+func (r *requestValidationAndMetrics) routeURL(reqUrl *url.URL) *url.URL {
+	if r.basePath == "" || (reqUrl.Path != r.basePath &&
+		!strings.HasPrefix(reqUrl.Path, r.basePath+"/")) {
+		return reqUrl
+	}
+	res := *reqUrl
+	res.Path = strings.TrimPrefix(reqUrl.Path, r.basePath)
+	if res.Path == "" {
+		res.Path = "/"
 	}
+	res.RawPath = ""
+	return &res
+}
+
+// Count, trace and log the request rejected by the validator
+func (r *requestValidationAndMetrics) rejectRequest(ctx echo.Context, metric string,
+	httpErr *echo.HTTPError) error {
+
+	req := ctx.Request()
+	reqCtx := req.Context()
+
+	span := visibility.SpanFromContextOrNoop(reqCtx)
+	span.SetOperationName(BadRequestSpanName)
+	span.SetTag(ext.ResourceName, BadRequestSpanName)
+
+	_ = visibility.GetStatsdFromContext(reqCtx).Count(metric, 1, []string{
+		"unit:count",
+		"method:" + req.Method,
+		"status:" + strconv.Itoa(httpErr.Code),
+		visibility.ClientTypeTag + ":" + visibility.GetClientTypeFromContext(reqCtx),
+	}, 1)
+
+	if logger := visibility.TryCL(reqCtx); logger != nil {
+		logger.Warn("Rejected the request", zap.String("reason", metric),
+			zap.String("method", req.Method),
+			zap.String("path", truncatePath(req.URL.Path)),
+			zap.Int("status", httpErr.Code),
+			zap.Reflect("error", httpErr.Message))
+	}
+	return httpErr
+}
+
+// Count the schema violation by its category and field, and tag the span
+func (r *requestValidationAndMetrics) recordViolation(ctx echo.Context,
+	err *openapi3filter.RequestError) {
+
+	reqCtx := ctx.Request().Context()
+	category, field := classifyValidationError(err)
+	visibility.SpanFromContextOrNoop(reqCtx).SetTag(ValidationErrorTag,
+		category+":"+field)
+
+	tags := visibility.GuardTags(ValidationErrorMetric, []string{
+		"unit:count",
+		"category:" + category,
+		"field:" + field,
+		visibility.ClientTypeTag + ":" + visibility.GetClientTypeFromContext(reqCtx),
+	})
+	_ = visibility.GetStatsdFromContext(reqCtx).Count(ValidationErrorMetric, 1, tags, 1)
+}
+
+// Cut the path on the rune boundary, the rejected paths can be arbitrarily long
+func truncatePath(path string) string {
+	if len(path) <= maxLoggedPathLength {
+		return path
+	}
+	cut := maxLoggedPathLength
+	for cut > 0 && !utf8.RuneStart(path[cut]) {
+		cut--
+	}
+	return path[:cut] + "..."
 }
 
 func (r *requestValidationAndMetrics) validateAndRunWithMetrics(ctx echo.Context) error {
@@ -55,7 +265,15 @@ func (r *requestValidationAndMetrics) validateAndRunWithMetrics(ctx echo.Context
 	if !strings.HasPrefix(req.URL.Path, r.apiPath) {
 		return r.next(ctx)
 	}
-	route, pathParams, err := r.router.FindRoute(req.Method, req.URL)
+	if r.mountErr != nil {
+		r.mountErrLogged.Do(func() {
+			if logger := visibility.TryCL(req.Context()); logger != nil {
+				logger.Error("The API is mounted incorrectly, its requests are rejected",
+					zap.Error(r.mountErr))
+			}
+		})
+	}
+	route, pathParams, err := r.router.FindRoute(req.Method, r.routeURL(req.URL))
 
 	// We failed to find a matching route for the request.
 	if err != nil {
@@ -63,12 +281,14 @@ func (r *requestValidationAndMetrics) validateAndRunWithMetrics(ctx echo.Context
 		case *openapi3filter.RouteError:
 			// We've got a bad request, the path requested doesn't match
 			// either server, or path, or something.
-			return echo.NewHTTPError(http.StatusBadRequest, e.Reason)
+			return r.rejectRequest(ctx, UnmatchedPathMetric,
+				echo.NewHTTPError(http.StatusBadRequest, e.Reason))
 		default:
 			// This should never happen today, but if our upstream code changes,
 			// we don't want to crash the server, so handle the unexpected error.
-			return echo.NewHTTPError(http.StatusInternalServerError,
-				fmt.Sprintf("error validating route: %s", err.Error()))
+			return r.rejectRequest(ctx, UnmatchedPathMetric,
+				echo.NewHTTPError(http.StatusInternalServerError,
+					fmt.Sprintf("error validating route: %s", err.Error())))
 		}
 	}
 
@@ -92,14 +312,18 @@ func (r *requestValidationAndMetrics) validateAndRunWithMetrics(ctx echo.Context
 			// Split up the verbose error by lines and return the first one
 			// openapi errors seem to be multi-line with a decent message on the first
 			errorLines := strings.Split(e.Error(), "\n")
-			return echo.NewHTTPError(http.StatusBadRequest, errorLines[0])
+			r.recordViolation(ctx, e)
+			return r.rejectRequest(ctx, ValidationFailureMetric,
+				echo.NewHTTPError(http.StatusBadRequest, errorLines[0]))
 		case *openapi3filter.SecurityRequirementsError:
-			return echo.NewHTTPError(http.StatusForbidden, e.Error())
+			return r.rejectRequest(ctx, ValidationFailureMetric,
+				echo.NewHTTPError(http.StatusForbidden, e.Error()))
 		default:
 			// This should never happen today, but if our upstream code changes,
 			// we don't want to crash the server, so handle the unexpected error.
-			return echo.NewHTTPError(http.StatusInternalServerError,
-				fmt.Sprintf("error validating request: %s", err))
+			return r.rejectRequest(ctx, ValidationFailureMetric,
+				echo.NewHTTPError(http.StatusInternalServerError,
+					fmt.Sprintf("error validating request: %s", err)))
 		}
 	}
 
@@ -110,32 +334,47 @@ func (r *requestValidationAndMetrics) validateAndRunWithMetrics(ctx echo.Context
 	}
 	// CapitalizeTheOperationName
 	opId = strings.ToUpper(opId[0:1]) + opId[1:]
+	ctx.Set(EchoOperationKey, opId)
+	// The code without the echo.Context (e.g. the clients) gets it from the context
+	req = req.WithContext(context.WithValue(req.Context(), operationKeyVal, opId))
+	ctx.SetRequest(req)
 
-	span, ok := tracer.SpanFromContext(req.Context())
-	if ok {
-		span.SetOperationName(opId)
-		span.SetTag(ext.ResourceName, "oapi."+opId)
-	}
+	span := visibility.SpanFromContextOrNoop(req.Context())
+	span.SetOperationName(opId)
+	span.SetTag(ext.ResourceName, "oapi."+opId)
+	visibility.ExpectOperation(req.Context(), opId)
 
+	// The metrics context reused from the enclosing request (see
+	// TracingAndMetricsOptions.Standalone) keeps its owner's name and status
 	met := visibility.GetMetricsFromContext(req.Context())
-	met.OpName = opId
+	nested, _ := ctx.Get(echoNestedMetricsKey).(bool)
+	if !nested {
+		// The metrics can be flushed concurrently (see MetricsFlushInterval)
+		met.Lock.Lock()
+		met.OpName = opId
+		met.Lock.Unlock()
 
-	// We set the service fault counter immediately to 1
-	// so if the next() function panics, we still record the fault.
-	met.SetCount("Fault", 1)
-	met.SetCount("Error", 1)
-	met.SetCount("Success", 0)
-	bench := met.Benchmark("Time")
-	defer bench.Done()
+		// We set the service fault counter immediately to 1
+		// so if the next() function panics, we still record the fault.
+		met.SetCount("Fault", 1)
+		met.SetCount("Error", 1)
+		met.SetCount("Success", 0)
+		defer met.Benchmark("Time").Done()
+	}
 
 	// Run the next handler in the chain
 	err = r.next(ctx)
 
-	met.SetCount("Fault", 0) // Defuse the fault count
-	if err == nil {
-		met.SetCount("Success", 1)
-		met.SetCount("Error", 0) // Defuse the error count
+	if !nested {
+		met.SetCount("Fault", 0) // Defuse the fault count
+		if err == nil {
+			met.SetCount("Success", 1)
+			met.SetCount("Error", 0) // Defuse the error count
+		} else if visibility.IsCancellation(req.Context(), err) {
+			// The client went away, it's not an error of the service
+			met.SetCount("Error", 0)
+			met.SetCount(visibility.CancelledMetric, 1)
+		}
 	}
-
 	return err
 }
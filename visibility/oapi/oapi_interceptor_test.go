@@ -0,0 +1,206 @@
+package oapi
+
+import (
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const itemsSchema = `
+{
+  "openapi": "3.0.0",
+  "info": {"version": "1.0.0", "title": "Items API"},
+  %SERVERS%
+  "paths": {
+    "%PREFIX%/items/{id}": {
+      "get": {
+        "operationId": "getItem",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "integer"}}
+        ],
+        "responses": {"200": {"description": "OK"}}
+      }
+    }
+  }
+}
+`
+
+func loadItemsSpec(t *testing.T, prefix string, server string) *openapi3.Swagger {
+	servers := ""
+	if server != "" {
+		servers = `"servers": [{"url": "` + server + `"}],`
+	}
+	data := strings.ReplaceAll(itemsSchema, "%SERVERS%", servers)
+	data = strings.ReplaceAll(data, "%PREFIX%", prefix)
+	swagger, err := openapi3.NewSwaggerLoader().LoadSwaggerFromData([]byte(data))
+	assert.NoError(t, err)
+	return swagger
+}
+
+func newItemsEcho() *echo.Echo {
+	e := echo.New()
+	e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+		Statsd: visibility.NewRecordingSink(),
+		Logger: zap.NewNop(),
+	}))
+	return e
+}
+
+func getItem(c echo.Context) error {
+	if OperationFromContext(c.Request().Context()) != Operation(c) {
+		panic("Inconsistent operation")
+	}
+	return c.String(http.StatusOK, Operation(c))
+}
+
+func requestItem(e *echo.Echo, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func mustValidator(t *testing.T, spec *openapi3.Swagger,
+	opts RequestValidatorOptions) echo.MiddlewareFunc {
+	mw, err := OapiRequestValidatorWithOptions(spec, opts)
+	assert.NoError(t, err)
+	return mw
+}
+
+func TestValidatorMountPoints(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	// Mounted at the root
+	e := newItemsEcho()
+	e.Use(OapiRequestValidatorWithMetrics(loadItemsSpec(t, "", ""), "/", nil))
+	e.GET("/items/:id", getItem)
+	rec := requestItem(e, "/items/12")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "GetItem", rec.Body.String())
+	assert.Equal(t, http.StatusBadRequest, requestItem(e, "/items/abc").Code)
+
+	// Mounted under "/api", the spec paths don't include it
+	e = newItemsEcho()
+	e.Use(mustValidator(t, loadItemsSpec(t, "", ""),
+		RequestValidatorOptions{ApiPath: "/api", BasePath: "/api/"}))
+	e.GET("/api/items/:id", getItem)
+	assert.Equal(t, http.StatusOK, requestItem(e, "/api/items/12").Code)
+	assert.Equal(t, http.StatusBadRequest, requestItem(e, "/api/items/abc").Code)
+
+	// Mounted under "/api", the spec paths include it
+	e = newItemsEcho()
+	e.Use(mustValidator(t, loadItemsSpec(t, "/api", ""),
+		RequestValidatorOptions{ApiPath: "/api", BasePath: "/api"}))
+	e.GET("/api/items/:id", getItem)
+	assert.Equal(t, http.StatusOK, requestItem(e, "/api/items/12").Code)
+
+	// Mounted under a Group, with the base path from the spec's server
+	e = newItemsEcho()
+	group := e.Group("/v2")
+	group.Use(mustValidator(t,
+		loadItemsSpec(t, "", "https://example.com/v2"),
+		RequestValidatorOptions{ApiPath: "/v2", UseSpecBasePath: true}))
+	group.GET("/items/:id", getItem)
+	rec = requestItem(e, "/v2/items/12")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "GetItem", rec.Body.String())
+	assert.Equal(t, http.StatusBadRequest, requestItem(e, "/v2/items/abc").Code)
+}
+
+func TestValidatorRouteURL(t *testing.T) {
+	r := requestValidationAndMetrics{basePath: "/v2"}
+	for path, expected := range map[string]string{
+		"/v2":        "/",
+		"/v2/":       "/",
+		"/v2/items":  "/items",
+		"/v20/items": "/v20/items",
+		"/v2items":   "/v2items",
+		"/items":     "/items",
+	} {
+		assert.Equal(t, expected, r.routeURL(&url.URL{Path: path}).Path, path)
+	}
+}
+
+func TestValidatorUnmatchableMount(t *testing.T) {
+	spec := loadItemsSpec(t, "", "")
+	_, err := OapiRequestValidatorWithOptions(spec, RequestValidatorOptions{ApiPath: "/api"})
+	assert.EqualError(t, err,
+		`none of the spec paths can match the requests under "/api" (base path "")`)
+	_, err = OapiRequestValidatorWithOptions(spec, RequestValidatorOptions{})
+	assert.Error(t, err)
+
+	// The legacy constructor only logs the error, once
+	sink, logger := utils.NewMemorySinkLogger()
+	e := echo.New()
+	e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+		Statsd: visibility.NewRecordingSink(),
+		Logger: logger,
+	}))
+	e.Use(OapiRequestValidatorWithMetrics(spec, "/api", nil))
+	e.GET("/api/items/:id", getItem)
+	assert.Equal(t, http.StatusBadRequest, requestItem(e, "/api/items/12").Code)
+	assert.Equal(t, http.StatusBadRequest, requestItem(e, "/api/items/13").Code)
+	assert.Equal(t, 1, strings.Count(sink.String(), "The API is mounted incorrectly"))
+
+	assert.Equal(t, "/v2", SpecBasePath(loadItemsSpec(t, "", "https://example.com/v2/")))
+	assert.Equal(t, "", SpecBasePath(loadItemsSpec(t, "", "https://example.com/{ver}")))
+}
+
+func TestValidatorBadRequests(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	rs := visibility.NewRecordingSink()
+	sink, logger := utils.NewMemorySinkLogger()
+	e := echo.New()
+	e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+		Statsd: rs,
+		Logger: logger,
+	}))
+	e.Use(OapiRequestValidatorWithMetrics(loadItemsSpec(t, "", ""), "/items", nil))
+	e.GET("/items/:id", getItem)
+
+	// The path doesn't match any operation
+	longPath := "/items/12/" + strings.Repeat("x", 1000)
+	assert.Equal(t, http.StatusBadRequest, requestItem(e, longPath).Code)
+	assert.Equal(t, int64(1), rs.Counts[UnmatchedPathMetric])
+	assert.Equal(t, []string{"unit:count", "method:GET", "status:400",
+		"client-type:" + visibility.ClientTypeNormal}, rs.Tags[UnmatchedPathMetric])
+	spans := mt.FinishedSpans()
+	assert.Equal(t, BadRequestSpanName, spans[len(spans)-1].OperationName())
+	assert.Equal(t, BadRequestSpanName, spans[len(spans)-1].Tag(ext.ResourceName))
+
+	var warning string
+	for _, line := range strings.Split(sink.String(), "\n") {
+		if strings.Contains(line, "Rejected the request") {
+			warning = line
+		}
+	}
+	assert.Contains(t, warning, `"level":"warn"`)
+	assert.Contains(t, warning, `"path":"`+longPath[:maxLoggedPathLength]+`..."`)
+	assert.NotContains(t, warning, longPath)
+
+	// The operation matches, but the parameter is invalid
+	assert.Equal(t, http.StatusBadRequest, requestItem(e, "/items/abc").Code)
+	assert.Equal(t, int64(1), rs.Counts[ValidationFailureMetric])
+	assert.Equal(t, []string{"unit:count", "method:GET", "status:400",
+		"client-type:" + visibility.ClientTypeNormal}, rs.Tags[ValidationFailureMetric])
+
+	// None of the metrics are per-path
+	for name := range rs.Counts {
+		assert.NotContains(t, name, "items")
+	}
+	for name := range rs.Distributions {
+		assert.NotContains(t, name, "items")
+	}
+}
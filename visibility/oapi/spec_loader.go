@@ -0,0 +1,148 @@
+package oapi
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/getkin/kin-openapi/openapi3"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Counted in the context's statsd when a spec fails to load or validate
+const SpecLoadFailureMetric = "OapiSpec.LoadFailure"
+
+// Load the spec and validate it, panicking with the error that points to the
+// failing path, operation or component. Meant for the specs embedded into the
+// binary, which must always be valid.
+func MustLoadSpec(data []byte) *openapi3.Swagger {
+	swagger, err := LoadSpec(context.Background(), data)
+	if err != nil {
+		panic(err.Error())
+	}
+	return swagger
+}
+
+// Load the spec and validate it. The failures are logged (if the context has a
+// logger) and counted in the SpecLoadFailureMetric.
+func LoadSpec(ctx context.Context, data []byte) (*openapi3.Swagger, error) {
+	swagger, err := openapi3.NewSwaggerLoader().LoadSwaggerFromData(data)
+	return checkLoadedSpec(ctx, "<data>", swagger, err)
+}
+
+// Load the spec from the file, resolving the relative $refs to other files
+func LoadSpecFromFile(ctx context.Context, fileName string) (*openapi3.Swagger, error) {
+	loader := openapi3.NewSwaggerLoader()
+	loader.IsExternalRefsAllowed = true
+	swagger, err := loader.LoadSwaggerFromFile(fileName)
+	return checkLoadedSpec(ctx, fileName, swagger, err)
+}
+
+// Load the spec split across multiple files from the file system (e.g. the one
+// with the embedded static files), resolving the $refs relative to the
+// referring file. The refs must point into the documents ("common.yaml#/...").
+func LoadSpecFromFS(ctx context.Context, fs http.FileSystem,
+	fileName string) (*openapi3.Swagger, error) {
+
+	loader := openapi3.NewSwaggerLoader()
+	loader.IsExternalRefsAllowed = true
+	loader.LoadSwaggerFromURIFunc = func(loader *openapi3.SwaggerLoader,
+		location *url.URL) (*openapi3.Swagger, error) {
+
+		if location.Scheme != "" || location.Host != "" {
+			return nil, fmt.Errorf("unsupported spec location: '%s'", location)
+		}
+		data, err := readFromFS(fs, location.Path)
+		if err != nil {
+			return nil, err
+		}
+		return loader.LoadSwaggerFromDataWithPath(data, location)
+	}
+
+	swagger, err := loader.LoadSwaggerFromURI(&url.URL{Path: path.Clean("/" + fileName)})
+	return checkLoadedSpec(ctx, fileName, swagger, err)
+}
+
+func readFromFS(fs http.FileSystem, fileName string) ([]byte, error) {
+	file, err := fs.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+func checkLoadedSpec(ctx context.Context, source string, swagger *openapi3.Swagger,
+	err error) (*openapi3.Swagger, error) {
+
+	if err != nil {
+		err = fmt.Errorf("failed to load the OpenAPI spec %s: %w", source, err)
+	} else if err = ValidateSpec(ctx, swagger); err != nil {
+		err = fmt.Errorf("invalid OpenAPI spec %s: %w", source, err)
+	}
+	if err == nil {
+		return swagger, nil
+	}
+
+	if logger := visibility.TryCL(ctx); logger != nil {
+		logger.Error("Failed to load the OpenAPI spec", zap.String("source", source),
+			zap.Error(err))
+	}
+	_ = visibility.GetStatsdFromContext(ctx).Count(SpecLoadFailureMetric, 1,
+		[]string{"unit:count"}, 1)
+	return nil, err
+}
+
+// Validate the spec, pointing to the failing operation or component. The
+// openapi3 validation alone only says which section is invalid.
+func ValidateSpec(ctx context.Context, swagger *openapi3.Swagger) error {
+	var paths []string
+	for p := range swagger.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		pathItem := swagger.Paths[p]
+		if pathItem == nil {
+			return fmt.Errorf("path %s is empty", p)
+		}
+		if err := pathItem.Parameters.Validate(ctx); err != nil {
+			return fmt.Errorf("invalid parameters of path %s: %w", p, err)
+		}
+
+		operations := pathItem.Operations()
+		var methods []string
+		for m := range operations {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		for _, m := range methods {
+			op := operations[m]
+			if err := op.Validate(ctx); err != nil {
+				return fmt.Errorf("invalid operation %s %s (operationId %q): %w",
+					strings.ToUpper(m), p, op.OperationID, err)
+			}
+		}
+	}
+
+	var schemas []string
+	for name := range swagger.Components.Schemas {
+		schemas = append(schemas, name)
+	}
+	sort.Strings(schemas)
+	for _, name := range schemas {
+		if err := swagger.Components.Schemas[name].Validate(ctx); err != nil {
+			return fmt.Errorf("invalid schema %s: %w", name, err)
+		}
+	}
+
+	// Everything else
+	return swagger.Validate(ctx)
+}
@@ -0,0 +1,112 @@
+package oapi
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const mainSpec = `
+openapi: 3.0.0
+info:
+  version: 1.0.0
+  title: Split API
+paths:
+  /items/{id}:
+    get:
+      operationId: getItem
+      parameters:
+        - $ref: "common/params.yaml#/components/parameters/ItemId"
+      responses:
+        "200":
+          description: OK
+`
+
+const paramsSpec = `
+openapi: 3.0.0
+info:
+  version: 1.0.0
+  title: Common
+paths: {}
+components:
+  parameters:
+    ItemId:
+      name: id
+      in: path
+      required: true
+      schema:
+        type: integer
+`
+
+func writeSplitSpec(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spec")
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "common"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "api.yaml"),
+		[]byte(mainSpec), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "common", "params.yaml"),
+		[]byte(paramsSpec), 0644))
+	return dir
+}
+
+func TestLoadSplitSpec(t *testing.T) {
+	dir := writeSplitSpec(t)
+	defer os.RemoveAll(dir)
+
+	swagger, err := LoadSpecFromFile(context.Background(), filepath.Join(dir, "api.yaml"))
+	assert.NoError(t, err)
+	param := swagger.Paths["/items/{id}"].Get.Parameters[0].Value
+	assert.Equal(t, "id", param.Name)
+	assert.Equal(t, "integer", param.Schema.Value.Type)
+
+	swagger, err = LoadSpecFromFS(context.Background(), http.Dir(dir), "api.yaml")
+	assert.NoError(t, err)
+	param = swagger.Paths["/items/{id}"].Get.Parameters[0].Value
+	assert.Equal(t, "id", param.Name)
+}
+
+func TestLoadBrokenSpec(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	rs := visibility.NewRecordingSink()
+	ctx := visibility.ImbueContext(context.Background(), logger)
+	ctx = visibility.ContextWithStatsd(ctx, rs)
+
+	// A dangling $ref
+	broken := strings.ReplaceAll(mainSpec,
+		"common/params.yaml#/components/parameters/ItemId",
+		"#/components/parameters/Missing")
+	_, err := LoadSpec(ctx, []byte(broken))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to load the OpenAPI spec")
+	assert.Contains(t, sink.String(), "Failed to load the OpenAPI spec")
+	assert.Equal(t, int64(1), rs.Counts[SpecLoadFailureMetric])
+
+	// An operation without the responses
+	invalid := strings.ReplaceAll(mainSpec, `
+      responses:
+        "200":
+          description: OK
+`, "\n")
+	invalid = strings.ReplaceAll(invalid, `
+      parameters:
+        - $ref: "common/params.yaml#/components/parameters/ItemId"`, "")
+	_, err = LoadSpec(ctx, []byte(invalid))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid operation GET /items/{id} (operationId "getItem")`)
+
+	assert.Panics(t, func() {
+		MustLoadSpec([]byte(broken))
+	})
+}
+
+func TestMustLoadSpec(t *testing.T) {
+	swagger := MustLoadSpec([]byte(schema))
+	assert.NotNil(t, swagger.Paths["/api/run/{res}"])
+}
@@ -0,0 +1,104 @@
+package oapi
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/utils/testutil"
+	"github.com/cyberax/go-dd-service-base/visibility/vistest"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/labstack/echo/v4"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net/http"
+	"testing"
+)
+
+// The echo server for the handler tests, with the tracing middleware and the
+// request validator installed (see NewTestServer)
+type TestServer struct {
+	Echo *echo.Echo
+	// The URL of the server, e.g. "http://127.0.0.1:12345"
+	BaseUrl string
+
+	// The logs and the metrics of the requests. The sinks are not thread-safe,
+	// read them only once the requests are finished (e.g. after the Close).
+	Logs    *testutil.MemorySink
+	Metrics *vistest.RecordingSink
+}
+
+// Start the echo server on an ephemeral port, with the tracing middleware and
+// the validator of the spec's paths (under the spec's base path), and the
+// routes added by the register function. The options' Logger and Statsd are
+// replaced by the recording ones. The caller must Close the server.
+func NewTestServer(t *testing.T, spec *openapi3.Swagger, opts TracingAndMetricsOptions,
+	register func(e *echo.Echo)) *TestServer {
+
+	logs, logger := testutil.NewMemorySinkLogger()
+	metrics := vistest.NewRecordingSink()
+	opts.Logger = logger
+	opts.Statsd = metrics
+
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Use(TracingAndLoggingMiddlewareHook(opts))
+
+	apiPath := SpecBasePath(spec)
+	if apiPath == "" {
+		apiPath = "/"
+	}
+	validator, err := OapiRequestValidatorWithOptions(spec, RequestValidatorOptions{
+		ApiPath:         apiPath,
+		UseSpecBasePath: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create the validator: %v", err)
+	}
+	e.Use(validator)
+	if register != nil {
+		register(e)
+	}
+
+	listener, port, err := utils.GetFreeListener()
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		_ = e.Server.Serve(listener)
+	}()
+	res := &TestServer{
+		Echo:    e,
+		BaseUrl: fmt.Sprintf("http://127.0.0.1:%d", port),
+		Logs:    logs,
+		Metrics: metrics,
+	}
+	return res
+}
+
+// Shut the server down, waiting for the running requests to finish
+func (s *TestServer) Close() {
+	_ = s.Echo.Shutdown(context.Background())
+}
+
+// Get the HTTP client that sends the trace of the request's context (and its
+// baggage, e.g. the client type) to the server
+func (s *TestServer) Client() *http.Client {
+	return &http.Client{Transport: &traceInjectingTransport{next: http.DefaultTransport}}
+}
+
+type traceInjectingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *traceInjectingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span, ok := tracer.SpanFromContext(req.Context())
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	// The RoundTrippers must not modify the original request
+	req = req.Clone(req.Context())
+	if err := tracer.Inject(span.Context(), tracer.HTTPHeadersCarrier(req.Header)); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
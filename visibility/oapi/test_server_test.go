@@ -0,0 +1,370 @@
+package oapi
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"github.com/cyberax/go-dd-service-base/utils"
+	. "github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTestServer(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	var clientType string
+	srv := NewTestServer(t, MustLoadSpec([]byte(schema)), TracingAndMetricsOptions{},
+		func(e *echo.Echo) {
+			e.GET("/api/run/:res", func(c echo.Context) error {
+				clientType = ClientType(c)
+				return c.String(http.StatusOK, "ok")
+			})
+		})
+	defer srv.Close()
+
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "clientSide")
+	span.SetBaggageItem(ClientTypeTag, ClientTypeCanary)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		srv.BaseUrl+"/api/run/test", nil)
+	assert.NoError(t, err)
+
+	resp, err := srv.Client().Do(req)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	span.Finish()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	srv.Close()
+
+	// The trace and its baggage are passed to the server
+	assert.Equal(t, ClientTypeCanary, clientType)
+	var serverSpan mocktracer.Span
+	for _, s := range mt.FinishedSpans() {
+		if s.OperationName() == "RunSomething" {
+			serverSpan = s
+		}
+	}
+	assert.NotNil(t, serverSpan)
+	assert.Equal(t, span.Context().TraceID(), serverSpan.TraceID())
+
+	assert.Equal(t, 1.0, srv.Metrics.Distributions["RunSomething.Success"])
+	assert.True(t, strings.Contains(srv.Logs.String(), `"msg":"Request finished"`))
+}
+
+func TestEchoLogFieldNames(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	srv := NewTestServer(t, MustLoadSpec([]byte(schema)), TracingAndMetricsOptions{
+		LogFieldNames: LogFieldNames{"method": "http.request.method", "remote_ip": "source.ip"},
+	}, func(e *echo.Echo) {
+		e.GET("/api/run/:res", func(c echo.Context) error {
+			return c.String(http.StatusOK, "ok")
+		})
+	})
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.BaseUrl + "/api/run/test")
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	srv.Close()
+
+	logs := srv.Logs.String()
+	assert.True(t, strings.Contains(logs, `"http.request.method":"GET"`))
+	assert.True(t, strings.Contains(logs, `"source.ip":"127.0.0.1"`))
+	assert.False(t, strings.Contains(logs, `"method":`))
+	assert.True(t, strings.Contains(logs, `"path":"/api/run/test"`))
+}
+
+func TestEchoSLO(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	registry := NewSLORegistry()
+	registry.Register("RunSomething", time.Nanosecond, 0.99)
+	SetSLORegistry(registry)
+	defer SetSLORegistry(nil)
+
+	srv := NewTestServer(t, MustLoadSpec([]byte(schema)), TracingAndMetricsOptions{},
+		func(e *echo.Echo) {
+			e.GET("/api/run/:res", func(c echo.Context) error {
+				time.Sleep(time.Millisecond)
+				return c.String(http.StatusOK, "ok")
+			})
+		})
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.BaseUrl + "/api/run/test")
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	srv.Close()
+
+	assert.Equal(t, 1.0, srv.Metrics.Distributions[SLOBreachMetric])
+	assert.Equal(t, []string{"operation:RunSomething", "client-type:normal"},
+		srv.Metrics.Tags[SLOBreachMetric])
+	assert.Equal(t, true, mt.FinishedSpans()[0].Tag(SLOBreachedTag))
+}
+
+func TestEchoSLOWithoutValidator(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	registry := NewSLORegistry()
+	registry.Register("Custom", time.Hour, 0.99)
+	SetSLORegistry(registry)
+	defer SetSLORegistry(nil)
+
+	sink := NewRecordingSink()
+	e := echo.New()
+	e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+		Statsd: sink,
+		Logger: zap.NewNop(),
+	}))
+	e.GET("/custom", func(c echo.Context) error {
+		// The SLO is looked up by the final operation name
+		Metrics(c).OpName = "Custom"
+		return c.String(http.StatusOK, "ok")
+	})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/custom", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Equal(t, 0.0, sink.Distributions[SLOBreachMetric])
+	assert.Equal(t, []string{"operation:Custom", "client-type:normal"},
+		sink.Tags[SLOBreachMetric])
+	assert.Equal(t, false, mt.FinishedSpans()[0].Tag(SLOBreachedTag))
+}
+
+func TestEchoHeaderLogging(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	srv := NewTestServer(t, MustLoadSpec([]byte(schema)), TracingAndMetricsOptions{
+		HeaderLogging: &HeaderLogging{
+			RequestHeaders:  []string{"Cookie", "Accept"},
+			ResponseHeaders: []string{"Set-Cookie"},
+		},
+	}, func(e *echo.Echo) {
+		e.GET("/api/run/:res", func(c echo.Context) error {
+			c.Response().Header().Set("Set-Cookie", "session=secret-session")
+			return c.String(http.StatusOK, "ok")
+		})
+	})
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.BaseUrl+"/api/run/test", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Cookie", "session=secret-cookie")
+	req.Header.Set("Accept", "text/plain")
+	resp, err := srv.Client().Do(req)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	srv.Close()
+
+	logs := srv.Logs.String()
+	assert.False(t, strings.Contains(logs, "secret-cookie"))
+	assert.False(t, strings.Contains(logs, "secret-session"))
+	assert.True(t, strings.Contains(logs,
+		`"request_headers":{"Accept":"text/plain","Cookie":"<redacted>"}`))
+	assert.True(t, strings.Contains(logs, `"response_headers":{"Set-Cookie":"<redacted>"}`))
+}
+
+func TestEchoTenant(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	var handlerTenant string
+	srv := NewTestServer(t, MustLoadSpec([]byte(schema)), TracingAndMetricsOptions{
+		TenantResolver: TenantFromHeader("X-Tenant"),
+	}, func(e *echo.Echo) {
+		e.GET("/api/run/:res", func(c echo.Context) error {
+			handlerTenant = TenantFromContext(c.Request().Context())
+			return c.String(http.StatusOK, "ok")
+		})
+	})
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.BaseUrl+"/api/run/test", nil)
+	assert.NoError(t, err)
+	req.Header.Set("X-Tenant", "acme")
+	resp, err := srv.Client().Do(req)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	srv.Close()
+
+	assert.Equal(t, "acme", handlerTenant)
+	assert.True(t, strings.Contains(srv.Logs.String(), `"tenant":"acme"`))
+	assert.Equal(t, "acme", mt.FinishedSpans()[0].Tag(TenantTag))
+	assert.Equal(t, []string{"unit:microseconds", "client-type:normal", "tenant:acme"},
+		srv.Metrics.Tags["RunSomething.Time"])
+}
+
+func TestEchoNested(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	register := func(e *echo.Echo) {
+		e.GET("/api/run/:res", func(c echo.Context) error {
+			Metrics(c).AddCount("Frob", 1)
+			Log(c).Info("Inside")
+			return c.String(http.StatusOK, "ok")
+		})
+	}
+	nested := NewTestServer(t, MustLoadSpec([]byte(schema)),
+		TracingAndMetricsOptions{}, register)
+	defer nested.Close()
+	standalone := NewTestServer(t, MustLoadSpec([]byte(schema)),
+		TracingAndMetricsOptions{Standalone: true}, register)
+	defer standalone.Close()
+
+	// Dispatch the requests in-process from the enclosing "gateway" request
+	gatewayLogs, gatewayLogger := utils.NewMemorySinkLogger()
+	dispatch := func(srv *TestServer) (tracer.Span, *MetricsContext) {
+		span, ctx := tracer.StartSpanFromContext(context.Background(), "gateway")
+		ctx = ImbueContext(ctx, gatewayLogger.With(zap.String("gateway", "gw")))
+		ctx = MakeMetricContext(ctx, "Gateway")
+		gwMet := GetMetricsFromContext(ctx)
+		gwMet.SetCount("Fault", 1)
+		gwMet.SetCount("Success", 0)
+		req := httptest.NewRequest(http.MethodGet, "/api/run/test", nil).WithContext(ctx)
+		resp, err := NewEchoTargetedHttpClient(srv.Echo).Transport.RoundTrip(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		span.Finish()
+		return span, gwMet
+	}
+
+	// The nested request is the child of the gateway one, it logs with the
+	// gateway's logger and counts into its metrics
+	gwSpan, gwMet := dispatch(nested)
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, gwSpan.Context().SpanID(), spans[0].ParentID())
+	assert.Equal(t, "RunSomething", spans[0].OperationName())
+	assert.Equal(t, 1.0, gwMet.GetMetricVal("Frob"))
+	// The gateway's operation and its (still in-flight) status are not
+	// overwritten by the nested one
+	assert.Equal(t, "Gateway", gwMet.OpName)
+	assert.Equal(t, 1.0, gwMet.GetMetricVal("Fault"))
+	assert.Equal(t, 0.0, gwMet.GetMetricVal("Success"))
+	assert.Equal(t, 0.0, gwMet.GetMetricVal("Error"))
+	assert.Equal(t, 0.0, gwMet.GetMetricVal("Time"))
+	assert.True(t, strings.Contains(gatewayLogs.String(),
+		`"logger":"HTTP","msg":"Inside","gateway":"gw"`))
+	assert.Equal(t, 0, len(nested.Metrics.Distributions))
+	assert.Equal(t, "", nested.Logs.String())
+
+	// The standalone server starts afresh
+	mt.Reset()
+	gatewayLogs.Reset()
+	_, gwMet = dispatch(standalone)
+	spans = mt.FinishedSpans()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, uint64(0), spans[0].ParentID())
+	assert.Equal(t, 0.0, gwMet.GetMetricVal("Frob"))
+	assert.Equal(t, "", gatewayLogs.String())
+	assert.True(t, strings.Contains(standalone.Logs.String(), `"msg":"Inside"`))
+	standalone.Close()
+	assert.Equal(t, 1.0, standalone.Metrics.Distributions["RunSomething.Frob"])
+}
+
+func TestEchoMaxResponseSize(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	var writeErr error
+	srv := NewTestServer(t, MustLoadSpec([]byte(schema)), TracingAndMetricsOptions{
+		MaxResponseSize: 100,
+	}, func(e *echo.Echo) {
+		e.GET("/api/run/:res", func(c echo.Context) error {
+			writeErr = c.String(http.StatusOK, strings.Repeat("a", 200))
+			return nil
+		})
+	})
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.BaseUrl + "/api/run/test")
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	srv.Close()
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "Internal Server Error\n", string(body))
+	assert.Equal(t, ErrResponseTooLarge, writeErr)
+	assert.Equal(t, 1.0, srv.Metrics.Distributions["RunSomething."+ResponseTooLargeMetric])
+	assert.Equal(t, ErrResponseTooLarge, mt.FinishedSpans()[0].Tag(ext.Error))
+	logs := srv.Logs.String()
+	assert.True(t, strings.Contains(logs, `"msg":"Response too large"`))
+	assert.True(t, strings.Contains(logs, `"status":500`))
+}
+
+func TestEchoResponseCompression(t *testing.T) {
+	srv := NewTestServer(t, MustLoadSpec([]byte(schema)), TracingAndMetricsOptions{
+		CompressionThreshold: DefaultCompressionThreshold,
+	}, func(e *echo.Echo) {
+		e.GET("/api/run/:res", func(c echo.Context) error {
+			return c.String(http.StatusOK, strings.Repeat("a", 10000))
+		})
+	})
+	defer srv.Close()
+
+	get := func(acceptEncoding string) map[string]interface{} {
+		req, err := http.NewRequest(http.MethodGet, srv.BaseUrl+"/api/run/test", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := srv.Client().Do(req)
+		assert.NoError(t, err)
+		//noinspection GoUnhandledErrorResult
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var body io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			body, err = gzip.NewReader(resp.Body)
+			assert.NoError(t, err)
+		}
+		data, err := ioutil.ReadAll(body)
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Repeat("a", 10000), string(data))
+
+		// The fields of the last access log line
+		var fields map[string]interface{}
+		for _, line := range strings.Split(srv.Logs.String(), "\n") {
+			if strings.Contains(line, `"msg":"Request finished"`) {
+				fields = nil
+				assert.NoError(t, json.Unmarshal([]byte(line), &fields))
+			}
+		}
+		return fields
+	}
+
+	// The compressed size is logged
+	fields := get("gzip")
+	bytesOut := fields["bytes_out"].(float64)
+	assert.True(t, bytesOut > 0 && bytesOut < 1000)
+	assert.Equal(t, 10000/bytesOut, fields["compression_ratio"])
+
+	// The clients that don't support gzip get the plain response
+	fields = get("identity")
+	assert.Equal(t, 10000.0, fields["bytes_out"])
+	_, ok := fields["compression_ratio"]
+	assert.False(t, ok)
+
+	srv.Close()
+	assert.Equal(t, 10000/bytesOut,
+		srv.Metrics.Distributions["RunSomething."+CompressionRatioMetric])
+}
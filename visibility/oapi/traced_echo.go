@@ -8,26 +8,112 @@
 package oapi
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"github.com/DataDog/datadog-go/statsd"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	. "github.com/cyberax/go-dd-service-base/utils"
 	"github.com/cyberax/go-dd-service-base/visibility"
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net"
 	"net/http"
 	"runtime/pprof"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// Keys under which the middleware stores the request-scoped state in the echo.Context,
+// in addition to the request's context.Context
+const (
+	EchoLoggerKey     = "oapi.Logger"
+	EchoMetricsKey    = "oapi.Metrics"
+	EchoClientTypeKey = "oapi.ClientType"
+	EchoOperationKey  = "oapi.Operation"
+
+	// Set if the metrics context is reused from the enclosing request
+	echoNestedMetricsKey = "oapi.NestedMetrics"
+)
+
 type TracingAndMetricsOptions struct {
 	DebugMode  bool
 	SampleRate *float64
 	Statsd     statsd.ClientInterface
 
+	// Report the requests that are still running after this threshold, zero
+	// disables the watchdog
+	LongRunningThreshold time.Duration
+
+	// Also report the requests that are still running after this multiple of
+	// their operation's SLO target (see visibility.SetSLORegistry and
+	// visibility.SetExpectedDuration), zero disables it
+	LongRunningMultiple float64
+
+	// Log the progress of the streaming (SSE or flushed) responses with this
+	// interval, zero disables the streaming detection
+	StreamHeartbeatInterval time.Duration
+
+	// Periodically send the counts accumulated so far by the long requests
+	// (e.g. SSE or websockets), instead of only once they finish. Zero disables
+	// the flushing (see visibility.MetricsContext.FlushDeltaToStatsd).
+	MetricsFlushInterval time.Duration
+
+	// Return the service version in the visibility.VersionHeader response header
+	VersionHeader bool
+
+	// Buffer the Debug and Info logs of each request, and write them out only
+	// if the request fails with a 5xx status or a panic (see zaputils.RequestLogBufferFactory)
+	RequestLogBuffer func() visibility.RequestLogBuffer
+
+	// Ignore the trace headers of the matching requests, starting fresh traces
+	// for them instead. Nil trusts all the requests.
+	UntrustedRequest visibility.UntrustedRequestPredicate
+
+	// Read the client type from the request header if it's not in the span
+	// baggage (see visibility.ClientTypeFromRequest), nil disables the header
+	ClientTypeHeader *visibility.ClientTypeHeaderOptions
+
+	// Rename the access log fields (e.g. to visibility.ECSLogFieldNames), nil
+	// keeps the default keys
+	LogFieldNames visibility.LogFieldNames
+
+	// Log the request and response headers, with the sensitive ones redacted.
+	// Nil disables the header logging.
+	HeaderLogging *visibility.HeaderLogging
+
+	// Resolve the tenant of the requests, it's added to their contexts (see
+	// visibility.TenantFromContext), log fields, spans and metrics
+	TenantResolver visibility.TenantResolver
+
+	// What to do with the panics, by default they are converted into 500
+	// responses (see visibility.PanicPolicy)
+	PanicPolicy visibility.PanicPolicy
+
+	// Stop the responses that are larger than this limit, zero disables the
+	// limit. The uncommitted responses are replaced with the 500 error, the
+	// committed ones can only be cut short (see visibility.SizeCappedWriter).
+	MaxResponseSize int64
+
+	// Gzip the responses of at least this size (see
+	// visibility.DefaultCompressionThreshold) for the clients that accept it,
+	// zero disables the compression. The bytes_out is the compressed size, and
+	// the compression ratio is logged and recorded in the request's metrics.
+	CompressionThreshold int
+
+	// Ignore the span, the logger and the metrics context already in the
+	// request context. By default the requests dispatched in-process by another
+	// instrumented server (e.g. with the DirectEchoTransport) get a child span,
+	// the "HTTP" logger is based on the existing one and the existing metrics
+	// context is reused (and reported by its owner, the validator keeps its
+	// operation name and its Success/Error/Fault/Time status).
+	Standalone bool
+
 	Logger *zap.Logger
 }
 
@@ -38,13 +124,22 @@ func (t *TracingAndMetricsOptions) Validate() {
 type traceAndLogMiddleware struct {
 	next echo.HandlerFunc
 	opts TracingAndMetricsOptions
+
+	// tracer.StartSpanFromContext, overridden in tests
+	startSpan func(ctx context.Context, operationName string,
+		opts ...tracer.StartSpanOption) (tracer.Span, context.Context)
 }
 
 func (z *traceAndLogMiddleware) prepareCommonLogFields(c echo.Context,
-	reqDuration time.Duration) []zap.Field {
+	compressor *visibility.CompressingWriter, reqDuration time.Duration) []zap.Field {
 
 	req := c.Request()
 	res := c.Response()
+	if req == nil || res == nil {
+		// Custom harnesses might not have them
+		return z.opts.LogFieldNames.Apply([]zap.Field{zap.Duration("latency", reqDuration),
+			zap.String("latency_human", reqDuration.String())})
+	}
 
 	// Now log whatever happened
 	bytesIn, err := strconv.ParseInt(req.Header.Get(echo.HeaderContentLength),
@@ -56,8 +151,13 @@ func (z *traceAndLogMiddleware) prepareCommonLogFields(c echo.Context,
 	if p == "" {
 		p = "/"
 	}
+	// The response size counts the bytes written by the handler
+	bytesOut := res.Size
+	if compressor != nil {
+		bytesOut = compressor.BytesOut()
+	}
 
-	return []zap.Field{
+	fields := []zap.Field{
 		zap.String("path", p),
 		zap.String("remote_ip", c.RealIP()),
 		zap.String("host", req.Host),
@@ -69,8 +169,21 @@ func (z *traceAndLogMiddleware) prepareCommonLogFields(c echo.Context,
 		zap.Duration("latency", reqDuration),
 		zap.String("latency_human", reqDuration.String()),
 		zap.Int64("bytes_in", bytesIn),
-		zap.Int64("bytes_out", res.Size),
+		zap.Int64("bytes_out", bytesOut),
+	}
+	if compressor != nil {
+		if ratio, ok := compressor.CompressionRatio(); ok {
+			fields = append(fields, zap.Float64("compression_ratio", ratio))
+		}
+	}
+	if op := Operation(c); op != "" {
+		fields = append(fields, zap.String("operation", op))
 	}
+	if sw, ok := res.Writer.(*streamingWriter); ok && sw.isStreaming() {
+		fields = append(fields, zap.Bool("streamed", true))
+	}
+	fields = append(fields, z.opts.HeaderLogging.Fields(req.Header, res.Header())...)
+	return z.opts.LogFieldNames.Apply(fields)
 }
 
 func (z *traceAndLogMiddleware) instrumentRequest(c echo.Context) error {
@@ -80,6 +193,10 @@ func (z *traceAndLogMiddleware) instrumentRequest(c echo.Context) error {
 	//}
 
 	req := c.Request()
+	if req == nil {
+		// Nothing to instrument
+		return z.next(c)
+	}
 	opts := []tracer.StartSpanOption{
 		tracer.SpanType(ext.SpanTypeWeb),
 		tracer.Tag(ext.HTTPMethod, req.Method),
@@ -88,38 +205,63 @@ func (z *traceAndLogMiddleware) instrumentRequest(c echo.Context) error {
 	if z.opts.SampleRate != nil {
 		opts = append(opts, tracer.Tag(ext.EventSampleRate, *z.opts.SampleRate))
 	}
-	if spanctx, err := tracer.Extract(tracer.HTTPHeadersCarrier(req.Header)); err == nil {
-		opts = append(opts, tracer.ChildOf(spanctx))
+	// The span of the enclosing server is the parent, the headers would only
+	// repeat it (or be missing)
+	spanCtx := visibility.ContextWithRequestStart(req.Context(), time.Now())
+	if z.opts.Standalone {
+		spanCtx = tracer.ContextWithSpan(spanCtx, nil)
+	}
+	if _, nested := tracer.SpanFromContext(spanCtx); !nested {
+		opts = append(opts, visibility.InboundTraceOptions(req, z.opts.UntrustedRequest)...)
 	}
 
 	// We start with an 'unknown' method, it will be overridden in the OAPI handler
 	// once the method name is known.
-	span, ctx := tracer.StartSpanFromContext(req.Context(),
-		"oapi.unknown", opts...)
-	defer span.Finish()
+	startSpan := z.startSpan
+	if startSpan == nil {
+		startSpan = tracer.StartSpanFromContext
+	}
+	span, ctx := startSpan(spanCtx, "oapi.unknown", opts...)
+
+	// The span is finished exactly once, after the metrics are copied into it,
+	// with the panic error if there was one
+	var panicErr error
+	var crashWith interface{}
+	defer func() {
+		if panicErr != nil {
+			span.Finish(tracer.WithError(panicErr), tracer.NoDebugStack())
+		} else {
+			span.Finish()
+		}
+		if crashWith != nil {
+			visibility.CrashProcess(crashWith)
+		}
+	}()
 
 	// Copy the 'baggage' from other tracers
-	reqId := req.Header.Get("Request-Id")
-	if reqId == "" {
-		reqId = req.Header.Get("X-Request-Id")
-	}
-	if reqId != "" {
-		span.SetTag("request-id", reqId)
-		span.SetBaggageItem("request-id", reqId)
-	}
+	reqId := visibility.InboundRequestId(req, span)
+	span.SetTag(visibility.RequestIdBaggage, reqId)
+	span.SetBaggageItem(visibility.RequestIdBaggage, reqId)
 
 	// Contextualize the logger
 	traceId := fmt.Sprintf("%d", span.Context().TraceID())
 	spanId := fmt.Sprintf("%d", span.Context().SpanID())
 
 	// Return the tracing headers back to the caller
-	if traceId != "0" && spanId != "0" {
-		c.Response().Header().Add(tracer.DefaultTraceIDHeader, traceId)
-		c.Response().Header().Add(tracer.DefaultParentIDHeader, spanId)
+	if resp := c.Response(); resp != nil {
+		if traceId != "0" && spanId != "0" {
+			resp.Header().Add(tracer.DefaultTraceIDHeader, traceId)
+			resp.Header().Add(tracer.DefaultParentIDHeader, spanId)
+		}
+		if z.opts.VersionHeader {
+			if version := visibility.GetBuildInfo().Version; version != "" {
+				resp.Header().Set(visibility.VersionHeader, version)
+			}
+		}
 	}
 
 	ctx = visibility.ContextWithStatsd(ctx, z.opts.Statsd)
-	clientType := visibility.ClientTypeFromSpan(span)
+	clientType := visibility.ClientTypeFromRequest(span, req, z.opts.ClientTypeHeader)
 	ctx = visibility.ContextWithClientType(ctx, clientType)
 
 	// Set the pprof labels for the thread
@@ -133,27 +275,100 @@ func (z *traceAndLogMiddleware) instrumentRequest(c echo.Context) error {
 		zap.String("dd.span_id", spanId),
 		zap.String("log.trace_id", traceId),
 		zap.String("log.span_id", spanId),
+		zap.String("request_id", reqId),
 	}
-	if reqId != "" {
-		fields = append(fields, zap.String("request_id", reqId))
+	if z.opts.TenantResolver != nil {
+		if tenant := z.opts.TenantResolver(req); tenant != "" {
+			ctx = visibility.ContextWithTenant(ctx, tenant)
+			span.SetTag(visibility.TenantTag, tenant)
+			fields = append(fields, zap.String(visibility.TenantTag, tenant))
+		}
 	}
 
-	logger := z.opts.Logger.Named("HTTP").With(fields...)
-	ctx = visibility.ImbueContext(ctx, logger) // Add the logger
+	baseLogger := z.opts.Logger
+	if outer := visibility.TryCL(req.Context()); outer != nil && !z.opts.Standalone {
+		baseLogger = outer
+	}
+	logger := baseLogger.Named("HTTP").With(fields...)
+	reqLogger := logger
+	var logBuffer visibility.RequestLogBuffer
+	if z.opts.RequestLogBuffer != nil {
+		logBuffer = z.opts.RequestLogBuffer()
+		reqLogger = logBuffer.Wrap(logger)
+	}
+	finishLogBuffer := func(failed bool) {
+		if logBuffer != nil {
+			logBuffer.Finish(failed)
+		}
+	}
+	ctx = visibility.ImbueContext(ctx, reqLogger) // Add the logger
+
+	// Watch for the stuck requests
+	ctx, stopWatchdog := visibility.StartWatchdogWithMultiple(ctx, span,
+		z.opts.LongRunningThreshold, z.opts.LongRunningMultiple, traceId)
+	defer stopWatchdog()
 
-	// Set up the metrics
-	ctx = visibility.MakeMetricContext(ctx, "unknown")
+	// Set up the metrics, the reused ones are sent by their owner
+	ownMetrics := z.opts.Standalone || visibility.TryGetMetricsFromContext(ctx) == nil
+	if ownMetrics {
+		ctx = visibility.MakeMetricContext(ctx, "unknown")
+	}
 	met := visibility.GetMetricsFromContext(ctx)
-	defer met.CopyToStatsd(z.opts.Statsd, clientType)
-	defer met.CopyToSpan(span)
+	if ownMetrics {
+		defer met.CopyToStatsd(z.opts.Statsd, clientType)
+		defer met.CopyToSampledSpan(span)
+		defer met.Seal()
+		if z.opts.MetricsFlushInterval > 0 {
+			// Stopped before the final copy
+			stopFlusher := z.startMetricsFlusher(met, clientType)
+			defer stopFlusher()
+		}
+	}
 
 	// Remember the context in the Echo request
 	req = req.WithContext(ctx)
 	c.SetRequest(req)
+	c.Set(EchoLoggerKey, reqLogger)
+	c.Set(EchoMetricsKey, met)
+	c.Set(echoNestedMetricsKey, !ownMetrics)
+	c.Set(EchoClientTypeKey, clientType)
 
 	logger.Info("Starting request")
 
 	start := time.Now()
+	// Only measures the SLO duration, with the metrics clock
+	sloTiming := met.Benchmark("Time")
+	var compressor *visibility.CompressingWriter
+	if z.opts.CompressionThreshold > 0 && c.Response() != nil && visibility.AcceptsGzip(req) {
+		compressor = visibility.NewCompressingWriter(c.Response().Writer,
+			z.opts.CompressionThreshold)
+		c.Response().Writer = compressor
+	}
+	// Send out the rest of the compressed response, once it's complete
+	finishCompression := func() {
+		if compressor == nil {
+			return
+		}
+		if err := compressor.Close(); err != nil {
+			logger.Warn("Failed to finish the compressed response", zap.Error(err))
+		}
+		if ratio, ok := compressor.CompressionRatio(); ok {
+			met.SetMetric(visibility.CompressionRatioMetric, ratio,
+				cloudwatch.StandardUnitNone)
+		}
+	}
+	var capper *visibility.SizeCappedWriter
+	if z.opts.MaxResponseSize > 0 && c.Response() != nil {
+		capper = visibility.NewSizeCappedWriter(c.Response().Writer, z.opts.MaxResponseSize)
+		c.Response().Writer = capper
+	}
+	if z.opts.StreamHeartbeatInterval > 0 && c.Response() != nil {
+		sw := &streamingWriter{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = sw
+		stopHeartbeat := z.startStreamHeartbeat(ctx, sw, start)
+		defer stopHeartbeat()
+	}
+
 	// Protect against panics
 	defer func() {
 		report := recover()
@@ -161,13 +376,25 @@ func (z *traceAndLogMiddleware) instrumentRequest(c echo.Context) error {
 			return
 		}
 
+		// A secondary panic here would mask the original one
+		defer func() {
+			if secondary := recover(); secondary != nil {
+				z.opts.Logger.Error("Panic while handling a request fault",
+					zap.String("fault", fmt.Sprintf("%v", report)),
+					zap.String("secondary", fmt.Sprintf("%v", secondary)))
+			}
+		}()
+
+		finishLogBuffer(true)
+
 		err := fmt.Errorf("%v", report)
 		stack := visibility.NewShortenedStackTrace(0, true, err.Error())
-		span.SetTag(ext.ErrorStack, stack.StringStack())
-		span.Finish(tracer.WithError(err), tracer.NoDebugStack())
+		visibility.TagSpanWithPanic(span, report, stack)
+		panicErr = err
+		visibility.EmitPanicEvent(z.opts.Statsd, met.OpName, err.Error(), stack)
 
 		// Send the 500 error along the way...
-		if !c.Response().Committed {
+		if c.Response() != nil && !c.Response().Committed {
 			if z.opts.DebugMode {
 				// Send the stack trace along with the error in dev mode
 				errMsg := make(map[string]interface{})
@@ -179,18 +406,50 @@ func (z *traceAndLogMiddleware) instrumentRequest(c echo.Context) error {
 			}
 		}
 
-		ch := z.prepareCommonLogFields(c, time.Now().Sub(start))
-		logger.Info("Request fault", append(ch, zap.Error(stack),
+		finishCompression()
+		ch := z.prepareCommonLogFields(c, compressor, time.Now().Sub(start))
+		if z.opts.DebugMode {
+			ch = append(ch, zap.Object("metrics", met))
+		}
+		logger.Error("Request fault", append(ch, zap.Error(stack),
 			stack.Field())...)
+
+		if visibility.ResolvePanicPolicy(z.opts.PanicPolicy,
+			visibility.PanicContain) == visibility.PanicCrash {
+			// Crash once the span is finished
+			crashWith = report
+		}
 	}()
 
 	// Actually process the request
-	if err := z.next(c); err != nil {
+	err := z.next(c)
+	if capper != nil {
+		capper.Finish()
+		if capper.TooLarge() {
+			z.reportTooLarge(c, capper, met, span, logger)
+		}
+	}
+	if ownMetrics && !visibility.IsCancellation(ctx, err) {
+		// The handlers (e.g. the validator) might have renamed the operation
+		met.Lock.Lock()
+		opName := met.OpName
+		met.Lock.Unlock()
+		visibility.RecordSLO(ctx, opName, sloTiming.Elapsed())
+	}
+	if err != nil {
 		// We have an error, process it
 		c.Error(err)
-		ch := z.prepareCommonLogFields(c, time.Now().Sub(start))
+		finishCompression()
+		finishLogBuffer(isServerFault(c))
+		ch := z.prepareCommonLogFields(c, compressor, time.Now().Sub(start))
+		if z.opts.DebugMode {
+			ch = append(ch, zap.Object("metrics", met))
+		}
 		httpErr, ok := err.(*echo.HTTPError)
-		if ok {
+		if visibility.IsCancellation(ctx, err) {
+			logger.Info("Request cancelled", append(ch, zap.Error(err))...)
+			span.SetTag(visibility.CancelledTag, true)
+		} else if ok {
 			// HTTP errors contain a redundant code field
 			logger.Info("Request error",
 				append(ch, zap.Reflect("error", httpErr.Message))...)
@@ -201,13 +460,182 @@ func (z *traceAndLogMiddleware) instrumentRequest(c echo.Context) error {
 		}
 		return nil // Error is not propagated further
 	}
+	finishCompression()
+	finishLogBuffer(isServerFault(c))
 
 	logger.Info("Request finished",
-		z.prepareCommonLogFields(c, time.Now().Sub(start))...)
+		z.prepareCommonLogFields(c, compressor, time.Now().Sub(start))...)
 
 	return nil
 }
 
+func (z *traceAndLogMiddleware) reportTooLarge(c echo.Context,
+	capper *visibility.SizeCappedWriter, met *visibility.MetricsContext,
+	span ddtrace.Span, logger *zap.Logger) {
+
+	if capper.Rejected() {
+		// The handler doesn't know that the 500 error was sent instead
+		c.Response().Status = http.StatusInternalServerError
+	}
+	met.AddCount(visibility.ResponseTooLargeMetric, 1)
+	span.SetTag(ext.Error, visibility.ErrResponseTooLarge)
+	logger.Warn("Response too large", zap.Int64("limit", z.opts.MaxResponseSize),
+		zap.Bool("rejected", capper.Rejected()))
+}
+
+func isServerFault(c echo.Context) bool {
+	return c.Response() != nil && c.Response().Status >= http.StatusInternalServerError
+}
+
+// Periodically log the progress of the streaming responses, their final
+// numbers are known only once the stream ends.
+func (z *traceAndLogMiddleware) startStreamHeartbeat(ctx context.Context,
+	sw *streamingWriter, start time.Time) func() {
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(z.opts.StreamHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if !sw.isStreaming() {
+				continue
+			}
+
+			bytesOut := atomic.LoadInt64(&sw.bytesOut)
+			elapsed := time.Now().Sub(start)
+			visibility.CL(ctx).Info("Request in progress",
+				zap.Duration("latency", elapsed),
+				zap.String("latency_human", elapsed.String()),
+				zap.Int64("bytes_out", bytesOut))
+			_ = z.opts.Statsd.Distribution("StreamBytesOut", float64(bytesOut),
+				[]string{"unit:bytes",
+					visibility.ClientTypeTag + ":" + visibility.GetClientTypeFromContext(ctx)}, 1)
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// Periodically flush the changes of the request's metrics
+func (z *traceAndLogMiddleware) startMetricsFlusher(met *visibility.MetricsContext,
+	clientType string) func() {
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(z.opts.MetricsFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			met.FlushDeltaToStatsd(z.opts.Statsd, clientType,
+				visibility.RequestStatusMetrics...)
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// The response writer that detects the streaming responses: either flushed by
+// the handler or having the text/event-stream content type.
+type streamingWriter struct {
+	http.ResponseWriter
+	bytesOut  int64 // atomic
+	streaming int32 // atomic
+}
+
+func (w *streamingWriter) isStreaming() bool {
+	return atomic.LoadInt32(&w.streaming) != 0
+}
+
+func (w *streamingWriter) WriteHeader(code int) {
+	if strings.HasPrefix(w.Header().Get(echo.HeaderContentType), "text/event-stream") {
+		atomic.StoreInt32(&w.streaming, 1)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamingWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	atomic.AddInt64(&w.bytesOut, int64(n))
+	return n, err
+}
+
+func (w *streamingWriter) Flush() {
+	atomic.StoreInt32(&w.streaming, 1)
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *streamingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// The handler returning the build information as JSON, e.g. for the /version endpoint
+func EchoBuildInfoHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, visibility.GetBuildInfo())
+}
+
+// Get the OpenAPI operationId matched by the OAPI validator, or an empty string
+func Operation(c echo.Context) string {
+	op, _ := c.Get(EchoOperationKey).(string)
+	return op
+}
+
+type operationKey struct{}
+
+var operationKeyVal = &operationKey{}
+
+// Get the OpenAPI operationId matched by the OAPI validator from the request
+// context, or an empty string
+func OperationFromContext(ctx context.Context) string {
+	op, _ := ctx.Value(operationKeyVal).(string)
+	return op
+}
+
+// Get the request logger from the echo.Context, falling back to the request context
+func Log(c echo.Context) *zap.Logger {
+	if logger, ok := c.Get(EchoLoggerKey).(*zap.Logger); ok {
+		return logger
+	}
+	return visibility.CL(c.Request().Context())
+}
+
+// Get the request metrics from the echo.Context, falling back to the request context
+func Metrics(c echo.Context) *visibility.MetricsContext {
+	if met, ok := c.Get(EchoMetricsKey).(*visibility.MetricsContext); ok {
+		return met
+	}
+	return visibility.GetMetricsFromContext(c.Request().Context())
+}
+
+// Get the client type from the echo.Context, falling back to the request context
+func ClientType(c echo.Context) string {
+	if ct, ok := c.Get(EchoClientTypeKey).(string); ok {
+		return ct
+	}
+	return visibility.GetClientTypeFromContext(c.Request().Context())
+}
+
 // Insert middleware responsible for logging, metrics and tracing
 func TracingAndLoggingMiddlewareHook(opts TracingAndMetricsOptions) echo.MiddlewareFunc {
 	opts.Validate()
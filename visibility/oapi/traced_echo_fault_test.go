@@ -0,0 +1,147 @@
+package oapi
+
+import (
+	"context"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The span wrapper that counts the Finish calls
+type countingSpan struct {
+	tracer.Span
+	finishes int
+}
+
+func (c *countingSpan) Finish(opts ...tracer.FinishOption) {
+	c.finishes++
+	c.Span.Finish(opts...)
+}
+
+func makeFaultyMiddleware(logger *zap.Logger,
+	next echo.HandlerFunc) (*traceAndLogMiddleware, *countingSpan) {
+
+	counter := &countingSpan{}
+	return &traceAndLogMiddleware{
+		next: next,
+		opts: TracingAndMetricsOptions{Statsd: &statsd.NoOpClient{}, Logger: logger},
+		startSpan: func(ctx context.Context, operationName string,
+			opts ...tracer.StartSpanOption) (tracer.Span, context.Context) {
+			span, ctx := tracer.StartSpanFromContext(ctx, operationName, opts...)
+			counter.Span = span
+			return counter, ctx
+		},
+	}, counter
+}
+
+func TestPanicFinishesSpanOnce(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	z, counter := makeFaultyMiddleware(zap.NewNop(), func(c echo.Context) error {
+		panic("boom")
+	})
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/run", nil), rec)
+	assert.NoError(t, z.instrumentRequest(c))
+
+	assert.Equal(t, 1, counter.finishes)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "boom", spans[0].Tag(ext.Error).(error).Error())
+
+	// The successful requests also finish the span once
+	z, counter = makeFaultyMiddleware(zap.NewNop(), func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	c = echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/run", nil),
+		httptest.NewRecorder())
+	assert.NoError(t, z.instrumentRequest(c))
+	assert.Equal(t, 1, counter.finishes)
+}
+
+func TestPanicWithNilResponse(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	z, counter := makeFaultyMiddleware(logger, func(c echo.Context) error {
+		panic("boom")
+	})
+
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/run", nil),
+		httptest.NewRecorder())
+	c.SetResponse(nil)
+	assert.NotPanics(t, func() {
+		assert.NoError(t, z.instrumentRequest(c))
+	})
+
+	assert.Equal(t, 1, counter.finishes)
+	// The original fault is logged, not masked by a secondary panic
+	assert.True(t, strings.Contains(sink.String(),
+		`"level":"error","logger":"HTTP","msg":"Request fault"`))
+	assert.True(t, strings.Contains(sink.String(), "boom"))
+	assert.False(t, strings.Contains(sink.String(), "Panic while handling"))
+}
+
+func TestSecondaryPanicIsContained(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	z, counter := makeFaultyMiddleware(logger, func(c echo.Context) error {
+		panic("boom")
+	})
+
+	e := echo.New()
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		panic("error handler is broken")
+	}
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/run", nil),
+		httptest.NewRecorder())
+	assert.NotPanics(t, func() {
+		assert.NoError(t, z.instrumentRequest(c))
+	})
+
+	assert.Equal(t, 1, counter.finishes)
+	assert.True(t, strings.Contains(sink.String(), "Panic while handling a request fault"))
+	assert.True(t, strings.Contains(sink.String(), "\"fault\":\"boom\""))
+	assert.True(t, strings.Contains(sink.String(), "error handler is broken"))
+}
+
+func TestPanicPolicyCrash(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	var crashed interface{}
+	oldCrash := visibility.CrashProcess
+	visibility.CrashProcess = func(p interface{}) {
+		crashed = p
+	}
+	defer func() { visibility.CrashProcess = oldCrash }()
+
+	z, counter := makeFaultyMiddleware(zap.NewNop(), func(c echo.Context) error {
+		panic("boom")
+	})
+	z.opts.PanicPolicy = visibility.PanicCrash
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/run", nil), rec)
+	assert.NoError(t, z.instrumentRequest(c))
+
+	assert.Equal(t, "boom", crashed)
+	assert.Equal(t, 1, counter.finishes)
+	assert.Equal(t, "boom", mt.FinishedSpans()[0].Tag("panic"))
+}
@@ -9,10 +9,8 @@ import (
 	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
-	"go.uber.org/zap"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
-	"net"
 	"net/http"
 	"strings"
 	"testing"
@@ -56,34 +54,30 @@ const schema = `
 }
 `
 
-func setupServer(t *testing.T, logger *zap.Logger,
-	metrics *RecordingSink, listener net.Listener) *echo.Echo {
-	// First, set up a minimal Echo server
-	e := echo.New()
-	e.HideBanner = true
+func setupServer(t *testing.T) *TestServer {
+	swagger, err := openapi3.NewSwaggerLoader().LoadSwaggerFromData([]byte(schema))
+	assert.NoError(t, err)
 
-	// Insert the logging/tracing middleware
 	tmo := TracingAndMetricsOptions{
 		DebugMode:  true,
 		SampleRate: aws.Float64(1.0),
-		Statsd:     metrics,
-		Logger:     logger,
 	}
-	e.Use(TracingAndLoggingMiddlewareHook(tmo))
-
-	swagger, err := openapi3.NewSwaggerLoader().LoadSwaggerFromData([]byte(schema))
-	assert.NoError(t, err)
-
-	e.Use(OapiRequestValidatorWithMetrics(swagger, "/api", nil))
+	return NewTestServer(t, swagger, tmo, registerHandler)
+}
 
+func registerHandler(e *echo.Echo) {
 	e.GET("/api/run/*", func(ctx echo.Context) error {
 		c := ctx.Request().Context()
 		path := ctx.Request().URL.Path
 		CLS(c).Infof("From inside handler %s", path)
 		ct := GetClientTypeFromContext(c)
+		if ClientType(ctx) != ct || Metrics(ctx) != GetMetricsFromContext(c) ||
+			Log(ctx) != CL(c) {
+			panic("Inconsistent echo context")
+		}
 
 		if strings.HasSuffix(path, "ok") {
-			GetMetricsFromContext(c).AddCount("Frob", 1)
+			Metrics(ctx).AddCount("Frob", 1)
 			if ct != "Vasja" {
 				panic("Bad Client Type")
 			}
@@ -101,55 +95,45 @@ func setupServer(t *testing.T, logger *zap.Logger,
 			}
 			return fmt.Errorf("logic error")
 		}
+		if strings.HasSuffix(path, "cancelled") {
+			return fmt.Errorf("client is gone: %w", context.Canceled)
+		}
 
 		time.Sleep(200 * time.Millisecond)
 		panic("unknown parameter")
 	})
-
-	go func() {
-		_ = e.Server.Serve(listener)
-	}()
-
-	return e
 }
 
 func TestEchoTracing(t *testing.T) {
 	mt := mocktracer.Start()
 	defer mt.Stop()
 
-	sink, logger := utils.NewMemorySinkLogger()
-	metricsSink := NewRecordingSink()
-
-	lstn, err := net.Listen("tcp", "[::]:9123")
-	assert.NoError(t, err)
-	//noinspection GoUnhandledErrorResult
-	defer lstn.Close()
+	srv := setupServer(t)
+	defer srv.Close()
+	base, sink, metricsSink := srv.BaseUrl, srv.Logs, srv.Metrics
 
-	e := setupServer(t, logger, metricsSink, lstn)
-	//noinspection GoUnhandledErrorResult
-	defer e.Shutdown(context.Background())
+	testOkCall(t, base, sink, mt, metricsSink)
+	testRegularError(t, base, sink, mt, metricsSink)
+	testLogicError(t, base, sink, mt, metricsSink)
+	testPanic(t, base, sink, mt, metricsSink)
+	testCancelled(t, base, sink, mt, metricsSink)
 
-	testOkCall(t, sink, mt, metricsSink)
-	testRegularError(t, sink, mt, metricsSink)
-	testLogicError(t, sink, mt, metricsSink)
-	testPanic(t, sink, mt, metricsSink)
-
-	resp, err := http.Get("http://[::]:9123/api/unknown")
+	resp, err := http.Get(base + "/api/unknown")
 	assert.NoError(t, err)
 	assert.Equal(t, 400, resp.StatusCode)
 
-	resp, err = http.Get("http://[::]:9123/api/run?param=123")
+	resp, err = http.Get(base + "/api/run?param=123")
 	assert.NoError(t, err)
 	assert.Equal(t, 400, resp.StatusCode)
 }
 
-func testOkCall(t *testing.T, logSink *utils.MemorySink, segSink mocktracer.Tracer,
-	metSink *RecordingSink) {
+func testOkCall(t *testing.T, base string, logSink *utils.MemorySink,
+	segSink mocktracer.Tracer, metSink *RecordingSink) {
 	defer segSink.Reset()
 	defer metSink.Clear()
 	defer logSink.Reset()
 
-	req, err := http.NewRequest("GET", "http://[::]:9123/api/run/ok", nil)
+	req, err := http.NewRequest("GET", base + "/api/run/ok", nil)
 	assert.NoError(t, err)
 
 	// Add client type header
@@ -182,15 +166,16 @@ func testOkCall(t *testing.T, logSink *utils.MemorySink, segSink mocktracer.Trac
 	assert.Equal(t, float64(1), metSink.Distributions["RunSomething.Frob"])
 
 	assert.True(t, strings.Contains(logSink.String(), `"msg":"Request finished"`))
+	assert.True(t, strings.Contains(logSink.String(), `"operation":"RunSomething"`))
 }
 
-func testRegularError(t *testing.T, logSink *utils.MemorySink,
+func testRegularError(t *testing.T, base string, logSink *utils.MemorySink,
 	segSink mocktracer.Tracer, metSink *RecordingSink) {
 	defer segSink.Reset()
 	defer metSink.Clear()
 	defer logSink.Reset()
 
-	req, err := http.NewRequest("GET", "http://[::]:9123/api/run/error", nil)
+	req, err := http.NewRequest("GET", base + "/api/run/error", nil)
 	assert.NoError(t, err)
 
 	// Add client type header
@@ -216,15 +201,16 @@ func testRegularError(t *testing.T, logSink *utils.MemorySink,
 	assert.Equal(t, float64(1), metSink.Distributions["RunSomething.Error"])
 
 	assert.True(t, strings.Contains(logSink.String(), `"msg":"Request error"`))
+	assert.True(t, strings.Contains(logSink.String(), `"operation":"RunSomething"`))
 }
 
-func testPanic(t *testing.T, logSink *utils.MemorySink,
+func testPanic(t *testing.T, base string, logSink *utils.MemorySink,
 	segSink mocktracer.Tracer, sink *RecordingSink) {
 	defer segSink.Reset()
 	defer sink.Clear()
 	defer logSink.Reset()
 
-	resp, err := http.Get("http://[::]:9123/api/run/panic")
+	resp, err := http.Get(base + "/api/run/panic")
 	assert.NoError(t, err)
 	assert.Equal(t, 500, resp.StatusCode)
 
@@ -238,13 +224,13 @@ func testPanic(t *testing.T, logSink *utils.MemorySink,
 	assert.True(t, strings.Contains(logSink.String(), "stacktrace"))
 }
 
-func testLogicError(t *testing.T, logSink *utils.MemorySink,
+func testLogicError(t *testing.T, base string, logSink *utils.MemorySink,
 	segSink mocktracer.Tracer, sink *RecordingSink) {
 	defer segSink.Reset()
 	defer sink.Clear()
 	defer logSink.Reset()
 
-	resp, err := http.Get("http://[::]:9123/api/run/bad")
+	resp, err := http.Get(base + "/api/run/bad")
 	assert.NoError(t, err)
 	assert.Equal(t, 500, resp.StatusCode)
 
@@ -255,4 +241,83 @@ func testLogicError(t *testing.T, logSink *utils.MemorySink,
 	assert.True(t, sink.Distributions["RunSomething.Time"] >= 0)
 
 	assert.True(t, strings.Contains(logSink.String(), `"error":"logic error"`))
+	// The metrics are attached in the debug mode
+	assert.True(t, strings.Contains(logSink.String(), `"metrics":{`))
+}
+
+func TestStreamingResponse(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	e := echo.New()
+	e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+		Statsd:                  NewRecordingSink(),
+		Logger:                  logger,
+		StreamHeartbeatInterval: 20 * time.Millisecond,
+	}))
+	e.GET("/stream", func(ctx echo.Context) error {
+		ctx.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+		ctx.Response().WriteHeader(http.StatusOK)
+		for i := 0; i < 5; i++ {
+			_, _ = ctx.Response().Write([]byte("data: hello\n\n"))
+			ctx.Response().Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+		return nil
+	})
+
+	client := NewEchoTargetedHttpClient(e)
+	resp, err := client.Get("http://localhost/stream")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	assert.True(t, strings.Contains(sink.String(), `"msg":"Request in progress"`))
+	assert.True(t, strings.Contains(sink.String(), `"streamed":true`))
+}
+
+func testCancelled(t *testing.T, base string, logSink *utils.MemorySink,
+	segSink mocktracer.Tracer, sink *RecordingSink) {
+	defer segSink.Reset()
+	defer sink.Clear()
+	defer logSink.Reset()
+
+	resp, err := http.Get(base + "/api/run/cancelled")
+	assert.NoError(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+
+	assert.Equal(t, 5, len(sink.Distributions))
+	assert.Equal(t, float64(0), sink.Distributions["RunSomething.Fault"])
+	assert.Equal(t, float64(0), sink.Distributions["RunSomething.Success"])
+	assert.Equal(t, float64(0), sink.Distributions["RunSomething.Error"])
+	assert.Equal(t, float64(1), sink.Distributions["RunSomething.Cancelled"])
+
+	assert.Equal(t, 1, len(segSink.FinishedSpans()))
+	seg := segSink.FinishedSpans()[0]
+	assert.Equal(t, true, seg.Tag(CancelledTag))
+	assert.Nil(t, seg.Tag("error"))
+
+	assert.True(t, strings.Contains(logSink.String(), `"msg":"Request cancelled"`))
+}
+
+func TestMetricsFlushInterval(t *testing.T) {
+	srv := NewTestServer(t, MustLoadSpec([]byte(schema)),
+		TracingAndMetricsOptions{MetricsFlushInterval: 10 * time.Millisecond},
+		func(e *echo.Echo) {
+			e.GET("/api/run/:res", func(c echo.Context) error {
+				Metrics(c).AddCount("Frames", 3)
+				time.Sleep(100 * time.Millisecond)
+				Metrics(c).AddCount("Frames", 2)
+				return c.String(http.StatusOK, "done")
+			})
+		})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.BaseUrl + "/api/run/stream")
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	srv.Close()
+
+	// The first frames were flushed while the request was running, so the
+	// last sent value is the remainder
+	assert.Equal(t, 2.0, srv.Metrics.Distributions["RunSomething.Frames"])
+	assert.Equal(t, 1.0, srv.Metrics.Distributions["RunSomething.Success"])
+	assert.Equal(t, 0.0, srv.Metrics.Distributions["RunSomething.Fault"])
 }
@@ -0,0 +1,103 @@
+package oapi
+
+import (
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"strconv"
+	"strings"
+)
+
+// The schema violations of the rejected requests are counted in this metric,
+// tagged by the category and the field (the parameter name or the JSON pointer
+// into the body). The first violation is also set on the span.
+const (
+	ValidationErrorMetric = "oapi.ValidationError"
+	ValidationErrorTag    = "oapi.violation"
+)
+
+// The categories of the schema violations
+const (
+	ViolationMissingRequired = "missing_required"
+	ViolationTypeMismatch    = "type_mismatch"
+	ViolationEnum            = "enum"
+	ViolationFormat          = "format"
+	ViolationRange           = "range"
+	ViolationUnknownField    = "unknown_field"
+	ViolationContentType     = "content_type"
+	ViolationMalformedBody   = "malformed_body"
+	ViolationOther           = "other"
+)
+
+// The field of the body violations without the path, e.g. the wrong body type
+const bodyField = "body"
+
+// Get the category and the field of the request's schema violation
+func classifyValidationError(err *openapi3filter.RequestError) (string, string) {
+	field := bodyField
+	if err.Parameter != nil {
+		field = err.Parameter.Name
+	}
+
+	if err.Err == openapi3filter.ErrInvalidRequired {
+		return ViolationMissingRequired, field
+	}
+	if err.RequestBody != nil && err.Err == nil &&
+		strings.HasPrefix(err.Reason, "header 'Content-Type'") {
+		return ViolationContentType, field
+	}
+
+	switch cause := err.Err.(type) {
+	case *openapi3.SchemaError:
+		if err.Parameter == nil {
+			field = schemaErrorField(cause)
+		}
+		return schemaViolation(cause.SchemaField), field
+	case *openapi3filter.ParseError:
+		if err.Parameter == nil {
+			return ViolationMalformedBody, field
+		}
+		// E.g. a non-integer value of an integer parameter
+		return ViolationTypeMismatch, field
+	}
+
+	if err.RequestBody != nil && err.Err != nil {
+		return ViolationMalformedBody, field
+	}
+	return ViolationOther, field
+}
+
+func schemaViolation(schemaField string) string {
+	switch schemaField {
+	case "required":
+		return ViolationMissingRequired
+	case "type", "nullable":
+		return ViolationTypeMismatch
+	case "enum":
+		return ViolationEnum
+	case "pattern", "format":
+		return ViolationFormat
+	case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf",
+		"minLength", "maxLength", "minItems", "maxItems", "uniqueItems",
+		"minProperties", "maxProperties":
+		return ViolationRange
+	case "properties":
+		return ViolationUnknownField
+	default:
+		return ViolationOther
+	}
+}
+
+// Get the JSON pointer of the violation in the body, the array indices are
+// replaced with "*" to keep the cardinality bounded
+func schemaErrorField(err *openapi3.SchemaError) string {
+	path := err.JSONPointer()
+	if len(path) == 0 {
+		return bodyField
+	}
+	for i, p := range path {
+		if _, convErr := strconv.Atoi(p); convErr == nil {
+			path[i] = "*"
+		}
+	}
+	return "/" + strings.Join(path, "/")
+}
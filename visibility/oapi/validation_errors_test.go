@@ -0,0 +1,109 @@
+package oapi
+
+import (
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const ordersSchema = `
+{
+  "openapi": "3.0.0",
+  "info": {"version": "1.0.0", "title": "Orders API"},
+  "paths": {
+    "/orders": {
+      "post": {
+        "operationId": "createOrder",
+        "parameters": [
+          {"name": "limit", "in": "query", "required": true, "schema": {"type": "integer"}}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {
+            "type": "object",
+            "required": ["name"],
+            "additionalProperties": false,
+            "properties": {
+              "name": {"type": "string"},
+              "kind": {"type": "string", "enum": ["retail", "wholesale"]},
+              "count": {"type": "integer", "minimum": 1},
+              "email": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+              "lines": {"type": "array", "items": {
+                "type": "object",
+                "properties": {"sku": {"type": "string"}}
+              }}
+            }
+          }}}
+        },
+        "responses": {"200": {"description": "OK"}}
+      }
+    }
+  }
+}
+`
+
+func TestValidationErrorCategories(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	rs := visibility.NewRecordingSink()
+	e := echo.New()
+	e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+		Statsd: rs,
+		Logger: zap.NewNop(),
+	}))
+	e.Use(OapiRequestValidatorWithMetrics(MustLoadSpec([]byte(ordersSchema)), "/orders", nil))
+	e.POST("/orders", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	cases := []struct {
+		query, contentType, body string
+		category, field          string
+	}{
+		{"", "application/json", `{"name": "a"}`, ViolationMissingRequired, "limit"},
+		{"?limit=x", "application/json", `{"name": "a"}`, ViolationTypeMismatch, "limit"},
+		{"?limit=1", "application/json", `{}`, ViolationMissingRequired, "/name"},
+		{"?limit=1", "application/json", `{"name": 1}`, ViolationTypeMismatch, "/name"},
+		{"?limit=1", "application/json", `{"name": "a", "kind": "x"}`, ViolationEnum, "/kind"},
+		{"?limit=1", "application/json", `{"name": "a", "count": 0}`, ViolationRange, "/count"},
+		{"?limit=1", "application/json", `{"name": "a", "email": "x"}`, ViolationFormat, "/email"},
+		{"?limit=1", "application/json", `{"name": "a", "lines": [{"sku": 1}]}`,
+			ViolationTypeMismatch, "/lines/*/sku"},
+		{"?limit=1", "application/json", `{"name": "a", "extra": 1}`, ViolationUnknownField, "body"},
+		{"?limit=1", "application/json", `{"name": `, ViolationMalformedBody, "body"},
+		{"?limit=1", "text/plain", `hello`, ViolationContentType, "body"},
+	}
+	for _, c := range cases {
+		rs.Clear()
+		mt.Reset()
+
+		req := httptest.NewRequest(http.MethodPost, "/orders"+c.query, strings.NewReader(c.body))
+		req.Header.Set(echo.HeaderContentType, c.contentType)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, c.body)
+		assert.Equal(t, int64(1), rs.Counts[ValidationErrorMetric], c.body)
+		assert.Equal(t, []string{"unit:count", "category:" + c.category, "field:" + c.field,
+			"client-type:" + visibility.ClientTypeNormal}, rs.Tags[ValidationErrorMetric], c.body)
+		assert.Equal(t, c.category+":"+c.field,
+			mt.FinishedSpans()[0].Tag(ValidationErrorTag), c.body)
+	}
+
+	// The valid requests are not counted
+	rs.Clear()
+	req := httptest.NewRequest(http.MethodPost, "/orders?limit=1",
+		strings.NewReader(`{"name": "a", "kind": "retail"}`))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rs.Counts, ValidationErrorMetric)
+}
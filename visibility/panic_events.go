@@ -0,0 +1,44 @@
+package visibility
+
+import (
+	"fmt"
+	"github.com/DataDog/datadog-go/statsd"
+	"sync/atomic"
+)
+
+var panicEvents int32
+
+// Send a DataDog event for each panic recovered by RunInstrumented and the
+// middlewares, so that the panics show up in the event stream and can trigger
+// monitors. Disabled by default to avoid the event spam.
+func SetPanicEvents(enabled bool) {
+	var val int32
+	if enabled {
+		val = 1
+	}
+	atomic.StoreInt32(&panicEvents, val)
+}
+
+// Send the panic event (if enabled) with the operation name, the panic message
+// and the first frame of the stack trace. The events of the same operation are
+// aggregated together.
+func EmitPanicEvent(sink statsd.ClientInterface, opName string, panicMsg string,
+	stack *ShortenedStackTrace) {
+
+	if atomic.LoadInt32(&panicEvents) == 0 || sink == nil {
+		return
+	}
+
+	text := panicMsg
+	if stack != nil {
+		if frames := stack.JSONStack(); len(frames) > 0 {
+			text += fmt.Sprintf("\nat %s %s", frames[0].Fl, frames[0].Fn)
+		}
+	}
+
+	event := statsd.NewEvent("Panic in "+opName, text)
+	event.AlertType = statsd.Error
+	event.AggregationKey = "panic:" + opName
+	event.Tags = []string{"operation:" + opName}
+	_ = sink.Event(event)
+}
@@ -0,0 +1,44 @@
+package visibility
+
+import (
+	"context"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"strings"
+	"testing"
+)
+
+func panicInOp(rs *RecordingSink) {
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	ctx = ContextWithStatsd(ctx, rs)
+	_ = RunInstrumented(ctx, "Op", func(ctx context.Context) error {
+		panic("boom")
+	})
+}
+
+func TestPanicEvents(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	// Disabled by default
+	rs := NewRecordingSink()
+	assert.Panics(t, func() { panicInOp(rs) })
+	assert.Equal(t, 0, len(rs.Events))
+
+	SetPanicEvents(true)
+	defer SetPanicEvents(false)
+
+	assert.Panics(t, func() { panicInOp(rs) })
+	assert.Equal(t, 1, len(rs.Events))
+
+	event := rs.Events[0]
+	assert.Equal(t, "Panic in Op", event.Title)
+	assert.Equal(t, statsd.Error, event.AlertType)
+	assert.Equal(t, []string{"operation:Op"}, event.Tags)
+	// The first frame is the panic() call site
+	assert.True(t, strings.HasPrefix(event.Text, "boom\nat "))
+	assert.True(t, strings.Contains(event.Text,
+		"visibility/panic_events_test.go:17 panicInOp.func1"), event.Text)
+}
@@ -0,0 +1,74 @@
+package visibility
+
+import (
+	"fmt"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"sync/atomic"
+)
+
+// What to do with a recovered panic, once it's logged and recorded in the span.
+// The components keep their historic behavior by default:
+//   - RunInstrumented: crash (re-raise the panic to the caller)
+//   - ProcessRegistry: crash (the panic is re-raised by RunInstrumented, killing
+//     the process)
+//   - TracedGorilla: contain (respond with 500, or abort the already committed
+//     response)
+//   - the echo middleware: contain (respond with 500)
+//   - TaskPool and InstrumentedGroup: contain (the task fails with the error)
+type PanicPolicy int32
+
+const (
+	// Use the global policy (see SetPanicPolicy), or the component's default
+	PanicPolicyDefault PanicPolicy = iota
+	// Convert the panic into an error (or a 500 response)
+	PanicContain
+	// Crash the process, to be restarted by the orchestrator
+	PanicCrash
+)
+
+var globalPanicPolicy int32
+
+// Set the panic policy of all the components that are not overridden
+// individually, PanicPolicyDefault restores their defaults
+func SetPanicPolicy(policy PanicPolicy) {
+	atomic.StoreInt32(&globalPanicPolicy, int32(policy))
+}
+
+// Pick the policy of a component: its own override, then the global policy,
+// then the component's default
+func ResolvePanicPolicy(override PanicPolicy, componentDefault PanicPolicy) PanicPolicy {
+	if override != PanicPolicyDefault {
+		return override
+	}
+	if global := PanicPolicy(atomic.LoadInt32(&globalPanicPolicy)); global != PanicPolicyDefault {
+		return global
+	}
+	return componentDefault
+}
+
+// The error returned instead of the contained panic
+type PanicError struct {
+	Value interface{}
+	Stack *ShortenedStackTrace
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("gopanic: %v", p.Value)
+}
+
+// Record the recovered panic in the span, in the same way for all the components
+func TagSpanWithPanic(span tracer.Span, p interface{}, stack *ShortenedStackTrace) {
+	SetSpanTagSafe(span, ext.ErrorStack, stack.StringStack())
+	SetSpanTagSafe(span, "panic", fmt.Sprintf("%v", p))
+}
+
+// Terminate the process with the panic. The http.Server recovers the panics of
+// the handlers, so the panic is raised in a new goroutine instead of the
+// current one. Replaceable in tests.
+var CrashProcess = func(p interface{}) {
+	go func() {
+		panic(p)
+	}()
+	select {}
+}
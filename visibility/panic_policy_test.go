@@ -0,0 +1,99 @@
+package visibility
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolvePanicPolicy(t *testing.T) {
+	defer SetPanicPolicy(PanicPolicyDefault)
+
+	assert.Equal(t, PanicCrash, ResolvePanicPolicy(PanicPolicyDefault, PanicCrash))
+	assert.Equal(t, PanicContain, ResolvePanicPolicy(PanicContain, PanicCrash))
+
+	SetPanicPolicy(PanicContain)
+	assert.Equal(t, PanicContain, ResolvePanicPolicy(PanicPolicyDefault, PanicCrash))
+	// The component overrides take precedence
+	assert.Equal(t, PanicCrash, ResolvePanicPolicy(PanicCrash, PanicContain))
+}
+
+func TestRunInstrumentedContained(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	panicky := func(ctx context.Context) error {
+		panic("contained")
+	}
+
+	err := RunInstrumentedWithPolicy(ctx, "test1", PanicContain, panicky)
+	panicErr, ok := err.(*PanicError)
+	assert.True(t, ok)
+	assert.Equal(t, "contained", panicErr.Value)
+	assert.Equal(t, "gopanic: contained", err.Error())
+	assert.NotNil(t, panicErr.Stack)
+
+	// The span is tagged in the same way as for the crash
+	span0 := mt.FinishedSpans()[0]
+	assert.Equal(t, "contained", span0.Tag("panic"))
+	assert.Equal(t, "gopanic: contained", span0.Tag("error").(error).Error())
+
+	// The global policy applies to RunInstrumented
+	SetPanicPolicy(PanicContain)
+	defer SetPanicPolicy(PanicPolicyDefault)
+	assert.Error(t, RunInstrumented(ctx, "test1", panicky))
+	assert.Panics(t, func() {
+		_ = RunInstrumentedWithPolicy(ctx, "test1", PanicCrash, panicky)
+	})
+}
+
+func TestProcessRegistryContained(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	registry := NewProcessRegistry(ImbueContext(context.Background(), logger))
+	registry.SetPanicPolicy(PanicContain)
+
+	pc := registry.CreateProcessContext("panicky")
+	pc.Run(func(ctx context.Context) error {
+		panic("contained")
+	})
+	pc.Wait()
+	registry.Close()
+
+	assert.Contains(t, sink.String(), "Operation panicked")
+}
+
+func TestGorillaPanicCrash(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	var crashed interface{}
+	var spansAtCrash int
+	oldCrash := CrashProcess
+	CrashProcess = func(p interface{}) {
+		crashed = p
+		spansAtCrash = len(mt.FinishedSpans())
+	}
+	defer func() { CrashProcess = oldCrash }()
+
+	rs := NewRecordingSink()
+	gorilla := NewTracedGorilla(&panickyTwirpServer{}, zap.NewNop(), rs, nil, nil)
+	gorilla.SetPanicPolicy(PanicCrash)
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	muxer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost,
+		"/twirp/twirp.test.Example/MakeHat", nil))
+
+	assert.Equal(t, "A very bad idea", crashed)
+	// The span is finished and the fault is counted before the crash
+	assert.Equal(t, 1, spansAtCrash)
+	assert.Equal(t, "A very bad idea", mt.FinishedSpans()[0].Tag("panic"))
+	assert.Equal(t, int64(1), rs.Counts["Example.MakeHat.Fault"])
+}
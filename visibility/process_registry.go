@@ -3,6 +3,7 @@ package visibility
 import (
 	"context"
 	"go.uber.org/zap"
+	"runtime/pprof"
 	"sort"
 	"strings"
 	"sync"
@@ -19,12 +20,29 @@ type ProcessRegistry struct {
 
 	processes     map[string]*ProcessContext
 	runningGroups sync.WaitGroup
+
+	nameNormalizer func(name string) string
+	diagnostics    bool
+	panicPolicy    PanicPolicy
 }
 
+// The pprof label used to find the goroutines of the running processes
+const ProcessLabel = "process"
+
+// The counts of the successful and the failed iterations of the periodic
+// processes, tagged with "process:<name>". A monitor on the heartbeat catches
+// the processes that stopped ticking.
+const (
+	PeriodicHeartbeatMetric = "Periodic.Heartbeat"
+	PeriodicFailureMetric   = "Periodic.Failure"
+)
+
 type ProcessContext struct {
 	Parent *ProcessRegistry
 	Name   string
 	Done   chan struct{}
+
+	creationStack *ShortenedStackTrace
 }
 
 func NewProcessRegistry(parentCtx context.Context) *ProcessRegistry {
@@ -37,6 +55,33 @@ func NewProcessRegistry(parentCtx context.Context) *ProcessRegistry {
 	return p
 }
 
+// Create a process registry that maps the unique process names onto stable
+// operation names used for tracing (e.g. "sync-tenant-abc123" -> "sync-tenant"),
+// to keep the trace cardinality bounded. The unique names are still used for the
+// registry itself and in logs.
+func NewProcessRegistryWithNormalizer(parentCtx context.Context,
+	nameNormalizer func(name string) string) *ProcessRegistry {
+	p := NewProcessRegistry(parentCtx)
+	p.nameNormalizer = nameNormalizer
+	return p
+}
+
+// Enable the diagnostic mode: each process records the stack where it was
+// started, so that the stuck processes can be found by DumpStuck
+func (p *ProcessRegistry) SetDiagnosticMode(enabled bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.diagnostics = enabled
+}
+
+// Override the panic policy of the processes. By default a panicking process
+// crashes the service, PanicContain makes it just finish.
+func (p *ProcessRegistry) SetPanicPolicy(policy PanicPolicy) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.panicPolicy = policy
+}
+
 func (p *ProcessRegistry) Close() {
 	CL(p.rootCtx).Sugar().Infof(
 		"Closing the process registry with %d processes running: %s",
@@ -46,6 +91,94 @@ func (p *ProcessRegistry) Close() {
 	CL(p.rootCtx).Info("Finished waiting for processes to finish")
 }
 
+// Close the registry, waiting for at most the specified timeout. If the processes
+// don't finish in time, their stacks are logged and false is returned.
+func (p *ProcessRegistry) CloseWithTimeout(timeout time.Duration) bool {
+	CL(p.rootCtx).Sugar().Infof(
+		"Closing the process registry with %d processes running: %s",
+		atomic.LoadUint64(&p.numRunning), p.LogRunning())
+	p.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		p.runningGroups.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		CL(p.rootCtx).Info("Finished waiting for processes to finish")
+		return true
+	case <-time.After(timeout):
+		CL(p.rootCtx).Warn("Timed out waiting for processes to finish")
+		p.DumpStuck(p.rootCtx)
+		return false
+	}
+}
+
+// Log the current stacks of all the still-running processes, along with
+// their creation stacks if the diagnostic mode is enabled.
+func (p *ProcessRegistry) DumpStuck(ctx context.Context) {
+	p.mtx.Lock()
+	running := make([]*ProcessContext, 0, len(p.processes))
+	for _, pc := range p.processes {
+		running = append(running, pc)
+	}
+	p.mtx.Unlock()
+
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].Name < running[j].Name
+	})
+
+	for _, pc := range running {
+		fields := []zap.Field{
+			zap.String("process", pc.Name),
+			zap.String("stacktrace", FindLabeledGoroutines(ProcessLabel, pc.Name)),
+		}
+		if pc.creationStack != nil {
+			fields = append(fields,
+				zap.String("creation_stack", pc.creationStack.StringStack()))
+		}
+		CL(ctx).Warn("Process is still running", fields...)
+	}
+}
+
+// Wait for the currently running processes to finish on their own, without
+// cancelling them (unlike Close), for at most the timeout. The names of the
+// processes that are still running are returned, nil if all of them finished.
+// The processes started during the wait are not waited for.
+func (p *ProcessRegistry) WaitAll(timeout time.Duration) []string {
+	p.mtx.Lock()
+	running := make([]*ProcessContext, 0, len(p.processes))
+	for _, pc := range p.processes {
+		running = append(running, pc)
+	}
+	p.mtx.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var stillRunning []string
+	for _, pc := range running {
+		select {
+		case <-pc.Done:
+			continue
+		case <-timer.C:
+		}
+		// Timed out, collect all the unfinished processes
+		for _, pc := range running {
+			select {
+			case <-pc.Done:
+			default:
+				stillRunning = append(stillRunning, pc.Name)
+			}
+		}
+		break
+	}
+	sort.Strings(stillRunning)
+	return stillRunning
+}
+
 func (p *ProcessRegistry) LogRunning() string {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
@@ -85,6 +218,9 @@ func (pc *ProcessContext) prepareRun() bool {
 		return false
 	}
 
+	if p.diagnostics {
+		pc.creationStack = NewShortenedStackTrace(4, false, "")
+	}
 	p.processes[pc.Name] = pc
 	atomic.AddUint64(&p.numRunning, 1)
 	p.runningGroups.Add(1)
@@ -110,18 +246,44 @@ func (pc *ProcessContext) TryRun(proc func(ctx context.Context) error) bool {
 		defer pc.Parent.markDone(pc.Name)
 
 		// Run the process with XRay instrumentation
-		_ = RunInstrumented(pc.Parent.rootCtx, pc.Name, func(xc context.Context) error {
-				err := proc(xc)
-				if err != nil {
-					CL(xc).Error("Async process returned an error", zap.Error(err))
-				}
-				return err
-			})
+		_ = pc.runInstrumented(proc)
 	}()
 
 	return true
 }
 
+// Get the operation name of the process, used for tracing and metrics
+func (pc *ProcessContext) opName() string {
+	if pc.Parent.nameNormalizer != nil {
+		return pc.Parent.nameNormalizer(pc.Name)
+	}
+	return pc.Name
+}
+
+func (pc *ProcessContext) runInstrumented(proc func(ctx context.Context) error) error {
+	opName := pc.opName()
+
+	// Label the goroutine, so it can be found by DumpStuck
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(),
+		pprof.Labels(ProcessLabel, pc.Name)))
+
+	pc.Parent.mtx.Lock()
+	policy := pc.Parent.panicPolicy
+	pc.Parent.mtx.Unlock()
+
+	return RunInstrumentedWithPolicy(pc.Parent.rootCtx, opName, policy, func(xc context.Context) error {
+		if opName != pc.Name {
+			// Keep the unique process name in the logs
+			xc = ImbueContext(xc, CL(xc).With(zap.String("process", pc.Name)))
+		}
+		err := proc(xc)
+		if err != nil {
+			CL(xc).Error("Async process returned an error", zap.Error(err))
+		}
+		return err
+	})
+}
+
 func (p *ProcessRegistry) markDone(s string) {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
@@ -143,16 +305,17 @@ func (pc *ProcessContext) RunPeriodicProcess(period time.Duration,
 		ticker := time.NewTicker(period)
 		defer ticker.Stop()
 
+		sink := GetStatsdFromContext(pc.Parent.rootCtx)
+		tags := []string{"unit:count", "process:" + pc.opName()}
+
 	loop:
 		for {
 			// Run the process with tracing instrumentation
-			_ = RunInstrumented(pc.Parent.rootCtx, pc.Name, func(xc context.Context) error {
-					err := proc(xc)
-					if err != nil {
-						CL(xc).Error("Async process returned an error", zap.Error(err))
-					}
-					return err
-				})
+			if err := pc.runInstrumented(proc); err != nil {
+				_ = sink.Count(PeriodicFailureMetric, 1, tags, 1)
+			} else {
+				_ = sink.Count(PeriodicHeartbeatMetric, 1, tags, 1)
+			}
 
 			select {
 			case <-ticker.C:
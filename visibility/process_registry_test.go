@@ -2,9 +2,14 @@ package visibility
 
 import (
 	"context"
+	"fmt"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/cyberax/go-dd-service-base/utils"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -122,3 +127,126 @@ func TestProcessRegistryInstrumentation(t *testing.T) {
 	reg.Close()
 	assert.True(t, good)
 }
+
+func TestNameNormalization(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx := context.Background()
+	ctx = ImbueContext(ctx, zap.NewNop())
+	reg := NewProcessRegistryWithNormalizer(ctx, func(name string) string {
+		return strings.TrimSuffix(name, "-abc123")
+	})
+
+	p := reg.CreateProcessContext("sync-tenant-abc123")
+	p.Run(func(ctx context.Context) error { return nil })
+	p.Wait()
+	reg.Close()
+
+	spans := mt.FinishedSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "sync-tenant", spans[0].OperationName())
+}
+
+func TestDumpStuck(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	ctx := ImbueContext(context.Background(), logger)
+	reg := NewProcessRegistry(ctx)
+	reg.SetDiagnosticMode(true)
+
+	release := make(chan bool)
+	p := reg.CreateProcessContext("stuck")
+	p.Run(func(ctx context.Context) error {
+		// Ignore the context cancellation
+		<-release
+		return nil
+	})
+
+	assert.False(t, reg.CloseWithTimeout(50*time.Millisecond))
+	assert.True(t, strings.Contains(sink.String(), "Process is still running"))
+	// The current stack and the creation stack
+	assert.True(t, strings.Contains(sink.String(), "TestDumpStuck.func1"))
+	assert.True(t, strings.Contains(sink.String(), "creation_stack"))
+
+	close(release)
+	p.Wait()
+	assert.True(t, reg.CloseWithTimeout(time.Second))
+}
+
+// Sums up the counts, unlike the RecordingSink
+type summingSink struct {
+	statsd.NoOpClient
+	mtx    sync.Mutex
+	counts map[string]int64
+}
+
+func (s *summingSink) Count(name string, value int64, tags []string, _ float64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.counts[name+"|"+strings.Join(tags, ",")] += value
+	return nil
+}
+
+func (s *summingSink) get(name string) int64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.counts[name]
+}
+
+func TestPeriodicHeartbeat(t *testing.T) {
+	sink := &summingSink{counts: make(map[string]int64)}
+	ctx := ContextWithStatsd(ImbueContext(context.Background(), zap.NewNop()), sink)
+	reg := NewProcessRegistry(ctx)
+
+	progressChan := make(chan int)
+	iteration := 0
+	pc := reg.CreateProcessContext("proc1")
+	pc.RunPeriodicProcess(time.Millisecond, func(ctx context.Context) error {
+		iteration++
+		select {
+		case <-ctx.Done():
+		case progressChan <- iteration:
+		}
+		if iteration == 2 {
+			return fmt.Errorf("the second iteration fails")
+		}
+		return nil
+	})
+
+	for i := 0; i < 4; i++ {
+		<-progressChan
+	}
+	reg.Close()
+	pc.Wait()
+
+	// Each iteration is counted, only the second one has failed
+	assert.True(t, iteration >= 4)
+	assert.Equal(t, int64(iteration-1), sink.get("Periodic.Heartbeat|unit:count,process:proc1"))
+	assert.Equal(t, int64(1), sink.get("Periodic.Failure|unit:count,process:proc1"))
+}
+
+func TestWaitAll(t *testing.T) {
+	reg := NewProcessRegistry(ImbueContext(context.Background(), zap.NewNop()))
+	assert.Nil(t, reg.WaitAll(time.Millisecond))
+
+	release := make(chan struct{})
+	fast := reg.CreateProcessContext("fast")
+	fast.Run(func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	stuck := reg.CreateProcessContext("stuck")
+	stuck.Run(func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	// The processes are not cancelled
+	release <- struct{}{}
+	assert.Equal(t, []string{"stuck"}, reg.WaitAll(50*time.Millisecond))
+	assert.False(t, reg.HasProcess("fast"))
+	assert.True(t, reg.HasProcess("stuck"))
+
+	reg.Close()
+	assert.Nil(t, reg.WaitAll(time.Second))
+}
@@ -1,105 +1,28 @@
 package visibility
 
 import (
-	"github.com/DataDog/datadog-go/statsd"
+	"github.com/cyberax/go-dd-service-base/visibility/internal/testdoubles"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
-	"time"
 )
 
-type RecordingSink struct {
-	Distributions map[string]float64
-	Counts        map[string]int64
-	Tags          map[string][]string
-}
+// Deprecated: use vistest.RecordingSink
+type RecordingSink = testdoubles.RecordingSink
 
+// Deprecated: use vistest.NewRecordingSink
 func NewRecordingSink() *RecordingSink {
-	return &RecordingSink{
-		Distributions: make(map[string]float64),
-		Counts:        make(map[string]int64),
-		Tags:          make(map[string][]string),
-	}
-}
-
-func(r *RecordingSink) Clear() {
-	r.Distributions = make(map[string]float64)
-	r.Counts = make(map[string]int64)
-	r.Tags = make(map[string][]string)
-}
-
-func (r *RecordingSink) Gauge(_ string, _ float64, _ []string, _ float64) error {
-	return nil
-}
-
-func (r *RecordingSink) Count(name string, value int64, tags []string, _ float64) error {
-	r.Counts[name] = value
-	r.Tags[name] = tags
-	return nil
-}
-
-func (r *RecordingSink) Histogram(_ string, _ float64, _ []string, _ float64) error {
-	return nil
-}
-
-func (r *RecordingSink) Distribution(name string, value float64, tags []string, _ float64) error {
-	r.Distributions[name] = value
-	r.Tags[name] = tags
-	return nil
-}
-
-func (r *RecordingSink) Decr(_ string, _ []string, _ float64) error {
-	return nil
-}
-
-func (r *RecordingSink) Incr(_ string, _ []string, _ float64) error {
-	return nil
-}
-
-func (r *RecordingSink) Set(_ string, _ string, _ []string, _ float64) error {
-	return nil
-}
-
-func (r *RecordingSink) Timing(_ string, _ time.Duration, _ []string, _ float64) error {
-	return nil
-}
-
-func (r *RecordingSink) TimeInMilliseconds(_ string, _ float64, _ []string, _ float64) error {
-	return nil
-}
-
-func (r *RecordingSink) Event(_ *statsd.Event) error {
-	return nil
-}
-
-func (r *RecordingSink) SimpleEvent(_, _ string) error {
-	return nil
-}
-
-func (r *RecordingSink) ServiceCheck(_ *statsd.ServiceCheck) error {
-	return nil
-}
-
-func (r *RecordingSink) SimpleServiceCheck(_ string, _ statsd.ServiceCheckStatus) error {
-	return nil
-}
-
-func (r *RecordingSink) Close() error {
-	return nil
-}
-
-func (r *RecordingSink) Flush() error {
-	return nil
-}
-
-func (r *RecordingSink) SetWriteTimeout(_ time.Duration) error {
-	return nil
+	return testdoubles.NewRecordingSink()
 }
 
+// The span that records its tags (if created with the tags map), also used as
+// the no-op span by SpanFromContextOrNoop
 type FakeSpan struct {
 	tags map[string]interface{}
 }
 
 func (f *FakeSpan) SetTag(key string, value interface{}) {
-	f.tags[key] = value
+	if f.tags != nil {
+		f.tags[key] = value
+	}
 }
 
 func (f *FakeSpan) SetOperationName(operationName string) {
@@ -116,5 +39,19 @@ func (f *FakeSpan) Finish(opts ...ddtrace.FinishOption) {
 }
 
 func (f *FakeSpan) Context() ddtrace.SpanContext {
-	return nil
+	return fakeSpanContext{}
+}
+
+// The context of the FakeSpan, with zero IDs and no baggage
+type fakeSpanContext struct{}
+
+func (fakeSpanContext) SpanID() uint64 {
+	return 0
+}
+
+func (fakeSpanContext) TraceID() uint64 {
+	return 0
+}
+
+func (fakeSpanContext) ForeachBaggageItem(_ func(k, v string) bool) {
 }
@@ -0,0 +1,43 @@
+package visibility
+
+import (
+	"context"
+	"time"
+)
+
+type requestStartKey struct{}
+
+var requestStartKeyVal = &requestStartKey{}
+
+// Store the time when the request processing started, done by the middlewares
+func ContextWithRequestStart(ctx context.Context, start time.Time) context.Context {
+	return context.WithValue(ctx, requestStartKeyVal, start)
+}
+
+// Get the time when the middleware started processing the request, the handlers
+// can use it to find out how long the request has been running so far
+func RequestStart(ctx context.Context) (time.Time, bool) {
+	start, ok := ctx.Value(requestStartKeyVal).(time.Time)
+	return start, ok
+}
+
+// Get the time elapsed since the start of the request
+func RequestElapsed(ctx context.Context) (time.Duration, bool) {
+	start, ok := RequestStart(ctx)
+	if !ok {
+		return 0, false
+	}
+	return time.Now().Sub(start), true
+}
+
+// Get the time left until the context's deadline, so that the handlers can
+// skip the optional work when the request is about to time out. Returns false
+// if the context has no deadline. The budget can be negative if the deadline
+// has already passed.
+func RemainingBudget(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return deadline.Sub(time.Now()), true
+}
@@ -0,0 +1,61 @@
+package visibility
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestBudget(t *testing.T) {
+	ctx := context.Background()
+	_, ok := RequestStart(ctx)
+	assert.False(t, ok)
+	_, ok = RemainingBudget(ctx)
+	assert.False(t, ok)
+
+	start := time.Now().Add(-time.Second)
+	ctx = ContextWithRequestStart(ctx, start)
+	stored, ok := RequestStart(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, start, stored)
+	elapsed, ok := RequestElapsed(ctx)
+	assert.True(t, ok)
+	assert.True(t, elapsed >= time.Second)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	remaining, ok := RemainingBudget(ctx)
+	assert.True(t, ok)
+	assert.True(t, remaining > 59*time.Second && remaining <= time.Minute)
+}
+
+type startCapturingServer struct {
+	panickyTwirpServer
+	start time.Time
+}
+
+func (s *startCapturingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.start, _ = RequestStart(r.Context())
+}
+
+func TestGorillaRequestStart(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	server := &startCapturingServer{}
+	gorilla := NewTracedGorilla(server, zap.NewNop(), NewRecordingSink(), nil, nil)
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	before := time.Now()
+	muxer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost,
+		"/twirp/twirp.test.Example/MakeHat", nil))
+	assert.False(t, server.start.Before(before))
+	assert.False(t, server.start.After(time.Now()))
+}
@@ -0,0 +1,84 @@
+package visibility
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Deprecated: the request header is now stored under an unexported key, this
+// key is only read as a fallback for the contexts created with it directly.
+const RequestHeaderKey = 11
+
+type requestHeaderKey struct{}
+
+var requestHeaderKeyVal = &requestHeaderKey{}
+
+const DefaultApiKeyHeader = "X-Api-Key"
+
+var apiKeyHeaderMtx sync.RWMutex
+var apiKeyHeader = DefaultApiKeyHeader
+
+// Set the name of the header with the API key, read by GetApiKey
+func SetApiKeyHeader(name string) {
+	apiKeyHeaderMtx.Lock()
+	defer apiKeyHeaderMtx.Unlock()
+	apiKeyHeader = name
+}
+
+func getApiKeyHeader() string {
+	apiKeyHeaderMtx.RLock()
+	defer apiKeyHeaderMtx.RUnlock()
+	return apiKeyHeader
+}
+
+func ContextWithHttpRequestHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, requestHeaderKeyVal, header)
+}
+
+// Get the header of the HTTP request, it's available only if the request came
+// through the TracedGorilla
+func GetHttpRequestHeader(ctx context.Context) (http.Header, bool) {
+	val, ok := ctx.Value(requestHeaderKeyVal).(http.Header)
+	if ok {
+		return val, true
+	}
+	// Fall back to the deprecated key
+	val, ok = ctx.Value(RequestHeaderKey).(http.Header)
+	return val, ok
+}
+
+// Get the value of the request header, false is returned if the header is
+// absent or empty, or if the request header is not available
+func GetHttpRequestHeaderValue(ctx context.Context, name string) (string, bool) {
+	header, ok := GetHttpRequestHeader(ctx)
+	if !ok {
+		return "", false
+	}
+	val := header.Get(name)
+	return val, val != ""
+}
+
+// Get the Authorization header of the request
+func GetAuthorization(ctx context.Context) (string, bool) {
+	return GetHttpRequestHeaderValue(ctx, "Authorization")
+}
+
+// Get the token from the "Authorization: Bearer <token>" header
+func GetBearerToken(ctx context.Context) (string, bool) {
+	auth, ok := GetAuthorization(ctx)
+	if !ok {
+		return "", false
+	}
+	const prefix = "bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+// Get the API key from the header set by SetApiKeyHeader ("X-Api-Key" by default)
+func GetApiKey(ctx context.Context) (string, bool) {
+	return GetHttpRequestHeaderValue(ctx, getApiKeyHeader())
+}
@@ -0,0 +1,61 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestRequestHeaderAccessors(t *testing.T) {
+	_, ok := GetHttpRequestHeader(context.Background())
+	assert.False(t, ok)
+	_, ok = GetAuthorization(context.Background())
+	assert.False(t, ok)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer  tok123")
+	header.Set("X-Api-Key", "key1")
+	header.Set("X-Custom-Key", "key2")
+	ctx := ContextWithHttpRequestHeader(context.Background(), header)
+
+	auth, ok := GetAuthorization(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "Bearer  tok123", auth)
+	token, ok := GetBearerToken(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "tok123", token)
+
+	key, ok := GetApiKey(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "key1", key)
+
+	SetApiKeyHeader("X-Custom-Key")
+	defer SetApiKeyHeader(DefaultApiKeyHeader)
+	key, ok = GetApiKey(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "key2", key)
+
+	_, ok = GetHttpRequestHeaderValue(ctx, "X-Missing")
+	assert.False(t, ok)
+
+	// Not a bearer token
+	header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	_, ok = GetBearerToken(ctx)
+	assert.False(t, ok)
+}
+
+func TestRequestHeaderKeyCollision(t *testing.T) {
+	// The foreign values under the plain int key are ignored
+	ctx := context.WithValue(context.Background(), 11, "something else")
+	_, ok := GetHttpRequestHeader(ctx)
+	assert.False(t, ok)
+
+	// The legacy key is still read
+	header := http.Header{}
+	header.Set("Authorization", "Basic x")
+	ctx = context.WithValue(context.Background(), RequestHeaderKey, header)
+	auth, ok := GetAuthorization(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "Basic x", auth)
+}
@@ -0,0 +1,49 @@
+package visibility
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net/http"
+)
+
+const (
+	// The baggage item (and the span tag) with the ID of the originating request
+	RequestIdBaggage = "request-id"
+	// The header with the request ID, set on the outgoing requests
+	RequestIdHeader = "X-Request-Id"
+)
+
+// Get the ID of the incoming request: the one propagated in the trace baggage
+// by the upstream service, then the one from the Request-Id or X-Request-Id
+// headers. A new ID is generated if there are none.
+func InboundRequestId(req *http.Request, span tracer.Span) string {
+	if reqId := span.BaggageItem(RequestIdBaggage); reqId != "" {
+		return reqId
+	}
+	if reqId := req.Header.Get("Request-Id"); reqId != "" {
+		return reqId
+	}
+	if reqId := req.Header.Get(RequestIdHeader); reqId != "" {
+		return reqId
+	}
+	return utils.MakeRandomStr(16)
+}
+
+// Get the request ID from the span in the context, or an empty string
+func GetRequestId(ctx context.Context) string {
+	span, ok := tracer.SpanFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return span.BaggageItem(RequestIdBaggage)
+}
+
+// Set the X-Request-Id header of the outgoing request from the span's baggage,
+// unless the header is already set
+func propagateRequestId(span tracer.Span, header http.Header) {
+	reqId := span.BaggageItem(RequestIdBaggage)
+	if reqId != "" && header.Get(RequestIdHeader) == "" {
+		header.Set(RequestIdHeader, reqId)
+	}
+}
@@ -0,0 +1,117 @@
+package visibility
+
+import (
+	"bytes"
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/twitchtv/twirp/example"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+// Relays the calls to the downstream haberdasher
+type relayHaberdasher struct {
+	downstream example.Haberdasher
+}
+
+func (r *relayHaberdasher) MakeHat(ctx context.Context,
+	size *example.Size) (*example.Hat, error) {
+	return r.downstream.MakeHat(ctx, size)
+}
+
+func startHaberdasher(svc example.Haberdasher) (*httptest.Server, *utils.MemorySink) {
+	sink, logger := utils.NewMemorySinkLogger()
+	server := example.NewHaberdasherServer(svc, MakeTraceHooks("twirp-test"))
+	gorilla := NewTracedGorilla(server, logger, NewRecordingSink(), nil, nil)
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+	return httptest.NewServer(muxer), sink
+}
+
+func TestRequestIdPropagation(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	downstream, downstreamSink := startHaberdasher(haberdasher(6))
+	defer downstream.Close()
+	upstream, upstreamSink := startHaberdasher(&relayHaberdasher{
+		downstream: example.NewHaberdasherJSONClient(downstream.URL,
+			WrapTwirpClientDef(&http.Client{}, "relay")),
+	})
+	defer upstream.Close()
+
+	client := example.NewHaberdasherJSONClient(upstream.URL,
+		WrapTwirpClient(&http.Client{}, "tester", DefAnalyticsRate, "myClient"))
+
+	// The upstream generates the ID
+	_, err := client.MakeHat(context.Background(), &example.Size{Inches: 6})
+	assert.NoError(t, err)
+
+	// The ID set by the caller is kept
+	req, err := http.NewRequest(http.MethodPost,
+		upstream.URL+"/twirp/twitch.twirp.example.Haberdasher/MakeHat",
+		bytes.NewReader([]byte(`{"inches": 6}`)))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Request-Id", "req-123")
+	span := tracer.StartSpan("caller")
+	span.SetBaggageItem(ClientTypeTag, "myClient")
+	assert.NoError(t, tracer.Inject(span.Context(), tracer.HTTPHeadersCarrier(req.Header)))
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Wait for the requests to be logged
+	upstream.Close()
+	downstream.Close()
+
+	idRe := regexp.MustCompile(`"request_id":"([^"]+)"`)
+	var upstreamIds, downstreamIds []string
+	for _, m := range idRe.FindAllStringSubmatch(upstreamSink.String(), -1) {
+		upstreamIds = append(upstreamIds, m[1])
+	}
+	for _, m := range idRe.FindAllStringSubmatch(downstreamSink.String(), -1) {
+		downstreamIds = append(downstreamIds, m[1])
+	}
+	assert.NotEmpty(t, upstreamIds)
+	assert.Len(t, upstreamIds[0], 32)
+	assert.Equal(t, upstreamIds, downstreamIds)
+	assert.Equal(t, "req-123", upstreamIds[len(upstreamIds)-1])
+}
+
+func TestInboundRequestId(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	span := tracer.StartSpan("test")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-Id", "header-id")
+	assert.Equal(t, "header-id", InboundRequestId(req, span))
+
+	// The baggage wins over the header
+	span.SetBaggageItem(RequestIdBaggage, "baggage-id")
+	assert.Equal(t, "baggage-id", InboundRequestId(req, span))
+	ctx := tracer.ContextWithSpan(context.Background(), span)
+	assert.Equal(t, "baggage-id", GetRequestId(ctx))
+
+	// The header set explicitly is not overridden
+	header := http.Header{}
+	propagateRequestId(span, header)
+	assert.Equal(t, "baggage-id", header.Get(RequestIdHeader))
+	header.Set(RequestIdHeader, "explicit")
+	propagateRequestId(span, header)
+	assert.Equal(t, "explicit", header.Get(RequestIdHeader))
+
+	assert.NotEqual(t, InboundRequestId(httptest.NewRequest(http.MethodGet, "/", nil),
+		tracer.StartSpan("a")), InboundRequestId(httptest.NewRequest(http.MethodGet, "/", nil),
+		tracer.StartSpan("b")))
+	assert.Equal(t, "", GetRequestId(context.Background()))
+}
@@ -0,0 +1,126 @@
+package visibility
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// The count of the responses over the size limit, in the namespace of the
+// operation (see TracedGorilla.SetMaxResponseSize and the echo middleware's
+// MaxResponseSize)
+const ResponseTooLargeMetric = "ResponseTooLarge"
+
+// Returned by the writes of the responses over the size limit, the handler
+// should stop writing
+var ErrResponseTooLarge = errors.New("the response is over the size limit")
+
+// The writer that stops the responses once they're over the size limit. If the
+// response is not committed yet (or its Content-Length is over the limit), it's
+// replaced with a 500 error, otherwise it's cut short. The writes over the
+// limit return ErrResponseTooLarge.
+//
+// The status is held back until the first write or flush, so the oversized
+// responses written at once are still rejected. Finish must be called once
+// the handler returns to send the status of the empty responses.
+type SizeCappedWriter struct {
+	http.ResponseWriter
+	maxBytes int64
+
+	bytesOut    int64
+	pendingCode int
+	committed   bool
+	tooLarge    bool
+	rejected    bool
+}
+
+func NewSizeCappedWriter(w http.ResponseWriter, maxBytes int64) *SizeCappedWriter {
+	return &SizeCappedWriter{ResponseWriter: w, maxBytes: maxBytes}
+}
+
+// Check whether the handler tried to send more than the limit
+func (s *SizeCappedWriter) TooLarge() bool {
+	return s.tooLarge
+}
+
+// Check whether the response was replaced with a 500 error, rather than cut short
+func (s *SizeCappedWriter) Rejected() bool {
+	return s.rejected
+}
+
+func (s *SizeCappedWriter) WriteHeader(code int) {
+	if s.committed || s.pendingCode != 0 {
+		return
+	}
+	declared, err := strconv.ParseInt(s.Header().Get("Content-Length"), 10, 64)
+	if err == nil && declared > s.maxBytes {
+		s.reject()
+		return
+	}
+	s.pendingCode = code
+}
+
+func (s *SizeCappedWriter) Write(data []byte) (int, error) {
+	if s.tooLarge {
+		return 0, ErrResponseTooLarge
+	}
+	if s.bytesOut+int64(len(data)) > s.maxBytes {
+		if !s.committed {
+			s.reject()
+		}
+		s.tooLarge = true
+		return 0, ErrResponseTooLarge
+	}
+	s.commit()
+	n, err := s.ResponseWriter.Write(data)
+	s.bytesOut += int64(n)
+	return n, err
+}
+
+// Send the held back status, if there's one
+func (s *SizeCappedWriter) Finish() {
+	s.commit()
+}
+
+func (s *SizeCappedWriter) commit() {
+	if s.committed {
+		return
+	}
+	s.committed = true
+	if s.pendingCode != 0 {
+		s.ResponseWriter.WriteHeader(s.pendingCode)
+	}
+}
+
+// Send the 500 error instead of the response
+func (s *SizeCappedWriter) reject() {
+	s.tooLarge = true
+	s.rejected = true
+	s.committed = true
+
+	header := s.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("X-Content-Type-Options", "nosniff")
+	s.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+	_, _ = fmt.Fprintln(s.ResponseWriter, http.StatusText(http.StatusInternalServerError))
+}
+
+func (s *SizeCappedWriter) Flush() {
+	s.commit()
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *SizeCappedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
@@ -0,0 +1,121 @@
+package visibility
+
+import (
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/twitchtv/twirp/ctxsetters"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The fake twirp server that streams the response in chunks
+type streamingTwirpServer struct {
+	panickyTwirpServer
+	chunks []int
+	errs   []error
+}
+
+func (s *streamingTwirpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := ctxsetters.WithPackageName(r.Context(), "twirp.test")
+	ctx = ctxsetters.WithServiceName(ctx, "Example")
+	ctx = ctxsetters.WithMethodName(ctx, "MakeHat")
+	hooks := MakeTraceHooks("test")
+	ctx, _ = hooks.RequestRouted(ctx)
+
+	s.errs = nil
+	for _, c := range s.chunks {
+		_, err := w.Write([]byte(strings.Repeat("a", c)))
+		s.errs = append(s.errs, err)
+	}
+	hooks.ResponseSent(ctx)
+}
+
+func serveCapped(server GenericTwirpServer) (*httptest.ResponseRecorder, *RecordingSink,
+	string) {
+
+	rs := NewRecordingSink()
+	sink, logger := utils.NewMemorySinkLogger()
+	gorilla := NewTracedGorilla(server, logger, rs, nil, nil)
+	gorilla.SetMaxResponseSize(100)
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	rec := httptest.NewRecorder()
+	muxer.ServeHTTP(rec, httptest.NewRequest(http.MethodPost,
+		"/twirp/twirp.test.Example/MakeHat", nil))
+	return rec, rs, sink.String()
+}
+
+func TestResponseSizeCap(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	// Under the limit
+	rec, rs, logs := serveCapped(&sizedTwirpServer{size: 100})
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Equal(t, 100, rec.Body.Len())
+	assert.NotContains(t, rs.Distributions, "Example.MakeHat.ResponseTooLarge")
+	assert.Equal(t, 1.0, rs.Distributions["Example.MakeHat.Success"])
+	assert.NotContains(t, logs, "Response too large")
+
+	// The declared Content-Length is over the limit
+	mt.Reset()
+	rec, rs, logs = serveCapped(&sizedTwirpServer{size: 101})
+	spans := mt.FinishedSpans()
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "Internal Server Error\n", rec.Body.String())
+	assert.Equal(t, 1.0, rs.Distributions["Example.MakeHat.ResponseTooLarge"])
+	// The handler succeeded, but the client got the 500 error
+	assert.Equal(t, 0.0, rs.Distributions["Example.MakeHat.Success"])
+	assert.Equal(t, 1.0, rs.Distributions["Example.MakeHat.Fault"])
+	assert.Equal(t, ErrResponseTooLarge, spans[0].Tag(ext.Error))
+	assert.Equal(t, http.StatusInternalServerError, spans[0].Tag(ext.HTTPCode))
+	assert.Contains(t, logs, `"msg":"Response too large"`)
+	assert.Contains(t, logs, `"rejected":true`)
+}
+
+func TestResponseSizeCapStreaming(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	// The first write is over the limit, so the response is not committed yet
+	server := &streamingTwirpServer{chunks: []int{150, 10}}
+	rec, rs, logs := serveCapped(server)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, []error{ErrResponseTooLarge, ErrResponseTooLarge}, server.errs)
+	assert.Equal(t, 1.0, rs.Distributions["Example.MakeHat.ResponseTooLarge"])
+	assert.Equal(t, 1.0, rs.Distributions["Example.MakeHat.Fault"])
+	assert.Contains(t, logs, `"rejected":true`)
+
+	// The response is already committed, so it's cut short
+	server = &streamingTwirpServer{chunks: []int{60, 30, 20, 5}}
+	mt.Reset()
+	rec, rs, logs = serveCapped(server)
+	spans := mt.FinishedSpans()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 90, rec.Body.Len())
+	assert.Equal(t, []error{nil, nil, ErrResponseTooLarge, ErrResponseTooLarge}, server.errs)
+	assert.Equal(t, 1.0, rs.Distributions["Example.MakeHat.ResponseTooLarge"])
+	// The cut response is still a success of the handler
+	assert.Equal(t, 1.0, rs.Distributions["Example.MakeHat.Success"])
+	assert.Equal(t, float64(90), rs.Distributions["Example.MakeHat.BytesOut"])
+	assert.Equal(t, ErrResponseTooLarge, spans[0].Tag(ext.Error))
+	assert.Contains(t, logs, `"rejected":false`)
+	assert.Contains(t, logs, `"limit":100`)
+}
+
+func TestSizeCappedWriterEmptyResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	capper := NewSizeCappedWriter(rec, 100)
+	capper.WriteHeader(http.StatusNoContent)
+	// The status is held back until the handler is done
+	assert.Equal(t, http.StatusOK, rec.Code)
+	capper.Finish()
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.False(t, capper.TooLarge())
+}
@@ -0,0 +1,84 @@
+package visibility
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"go.uber.org/zap"
+	"time"
+)
+
+const RetriesMetric = "Retries"
+const AttemptTag = "attempt"
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// The backoff multiplier, 2 is used if not set
+	Multiplier float64
+	// Check if the error is retryable, all errors are retried if not set
+	Retryable func(err error) bool
+}
+
+// The policy retrying the transient errors (see utils.IsRetryable)
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+		Retryable:      utils.IsRetryable,
+	}
+}
+
+// Run the function with RunInstrumented, retrying it with the exponential backoff
+// according to the policy. Each attempt gets its own span tagged with the attempt
+// number, and the number of retries is recorded as the Retries count in the
+// caller's metrics context (if there's one). Panics are not retried.
+func RetryInstrumented(ctx context.Context, name string, policy RetryPolicy,
+	fn func(context.Context) error) error {
+
+	multiplier := policy.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	met := TryGetMetricsFromContext(ctx)
+
+	backoff := policy.InitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = RunInstrumented(ctx, name, func(c context.Context) error {
+			SpanFromContextOrNoop(c).SetTag(AttemptTag, attempt)
+			return fn(c)
+		})
+
+		if err == nil || attempt >= policy.MaxAttempts {
+			return err
+		}
+		if policy.Retryable != nil && !policy.Retryable(err) {
+			return err
+		}
+
+		// Wait longer if the error asks for it (e.g. the AWS throttling)
+		delay := backoff
+		if suggested := utils.SuggestedBackoff(err); suggested > delay {
+			delay = suggested
+		}
+
+		CL(ctx).Info("Retrying the operation", zap.String("operation", name),
+			zap.Int(AttemptTag, attempt), zap.Duration("backoff", delay),
+			zap.Error(err))
+		if met != nil {
+			met.AddCount(RetriesMetric, 1)
+		}
+
+		if err := utils.ClockFromContext(ctx).Sleep(ctx, delay); err != nil {
+			return err
+		}
+
+		backoff = time.Duration(float64(backoff) * multiplier)
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
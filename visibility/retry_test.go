@@ -0,0 +1,84 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"testing"
+	"time"
+)
+
+func TestRetryInstrumented(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	ctx = MakeMetricContext(ctx, "Outer")
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	calls := 0
+	err := RetryInstrumented(ctx, "flaky", policy, func(c context.Context) error {
+		calls++
+		if calls < 2 {
+			return fmt.Errorf("transient")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 1.0, GetMetricsFromContext(ctx).GetMetricVal(RetriesMetric))
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, 1, spans[0].Tag(AttemptTag))
+	assert.Equal(t, 2, spans[1].Tag(AttemptTag))
+
+	// Non-retryable errors fail immediately
+	calls = 0
+	policy.Retryable = func(err error) bool { return false }
+	err = RetryInstrumented(ctx, "broken", policy, func(c context.Context) error {
+		calls++
+		return fmt.Errorf("permanent")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	// Attempts are exhausted
+	calls = 0
+	policy.Retryable = nil
+	err = RetryInstrumented(ctx, "broken", policy, func(c context.Context) error {
+		calls++
+		return fmt.Errorf("transient")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	assert.True(t, policy.Retryable(awserr.New("ThrottlingException", "slow", nil)))
+	assert.False(t, policy.Retryable(fmt.Errorf("permanent")))
+}
+
+func TestRetryWithFakeClock(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(1000, 0))
+	ctx := utils.WithClock(ImbueContext(context.Background(), zap.NewNop()), clock)
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Hour}
+
+	done := make(chan error)
+	go func() {
+		done <- RetryInstrumented(ctx, "flaky", policy, func(c context.Context) error {
+			return fmt.Errorf("transient")
+		})
+	}()
+	// The hour-long backoff passes instantly
+	for clock.PendingTimers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Hour)
+	assert.Error(t, <-done)
+}
@@ -2,16 +2,33 @@ package visibility
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"go.uber.org/zap"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"runtime"
 )
 
 const ClientTypeTag = "client-type"
 const ClientTypeNormal = "normal"
 const ClientTypeCanary = "canary"
 
+// The count recorded instead of the Error when the caller has cancelled the
+// operation, e.g. the client disconnected mid-request
+const CancelledMetric = "Cancelled"
+
+// The span tag of the cancelled operations, they are not tagged as errors
+const CancelledTag = "cancelled"
+
+// Check whether the operation failed because its caller went away: the error
+// is (or wraps) context.Canceled. The other errors are the real failures even
+// if the context is cancelled by then (e.g. during the shutdown).
+func IsCancellation(ctx context.Context, err error) bool {
+	return err != nil && errors.Is(err, context.Canceled)
+}
+
 func ClientTypeFromSpan(sp tracer.Span) string {
 	item := sp.BaggageItem(ClientTypeTag)
 	if item == "" {
@@ -24,32 +41,92 @@ func ClientTypeFromSpan(sp tracer.Span) string {
 //beginning and closing a new subsegment around its execution.
 //If the parent segment doesn't exist yet then a new top-level segment is created
 func RunInstrumented(ctx context.Context, name string, fn func(context.Context) error) error {
+	return RunInstrumentedWithPolicy(ctx, name, PanicPolicyDefault, fn)
+}
+
+// Run the function like RunInstrumented, with the panic policy override. The
+// PanicCrash re-raises the panic to the caller (the default), the PanicContain
+// returns it as a PanicError.
+func RunInstrumentedWithPolicy(ctx context.Context, name string, policy PanicPolicy,
+	fn func(context.Context) error) (err error) {
+	return RunInstrumentedWithOptions(ctx, name, RunOptions{PanicPolicy: policy}, fn)
+}
+
+type RunOptions struct {
+	// See RunInstrumentedWithPolicy
+	PanicPolicy PanicPolicy
+
+	// Reuse the context's span (e.g. started by a third-party instrumentation)
+	// instead of starting a child span, if there's one. The span gets the
+	// metrics, the error and the panic tags, but it's not finished: its owner
+	// finishes it.
+	ContinueSpan bool
+
+	// Convert the expected panics (e.g. the ones some parsers use for the
+	// control flow) into the errors: if the classifier handles the recovered
+	// value, the panic is not re-raised and the operation fails with the
+	// returned error, counted by InstrumentWithMetrics as the Error instead of
+	// the Fault. The panics it doesn't handle are processed as usual.
+	RecoverClassifier func(recovered interface{}) (error, bool)
+}
+
+type recoverClassifierKey struct{}
+
+var recoverClassifierKeyVal = &recoverClassifierKey{}
+
+// Run the function like RunInstrumented, with the options
+func RunInstrumentedWithOptions(ctx context.Context, name string, opts RunOptions,
+	fn func(context.Context) error) (err error) {
+
 	logger := CL(ctx)
 	statsd := GetStatsdFromContext(ctx)
 	clientType := GetClientTypeFromContext(ctx)
 
-	span, ctx := tracer.StartSpanFromContext(ctx, name,
-		tracer.SpanType("background"))
-	span.SetTag(ext.ResourceName, name)
+	span, continued := tracer.SpanFromContext(ctx)
+	if !opts.ContinueSpan || !continued {
+		continued = false
+		span, ctx = tracer.StartSpanFromContext(ctx, name,
+			tracer.SpanType("background"))
+		span.SetTag(ext.ResourceName, name)
+		span.SetOperationName(name)
+	}
 	span.SetTag(ClientTypeTag, clientType)
-	span.SetOperationName(name)
 
-	var err error
+	finish := func(err error) {
+		if continued {
+			if err != nil {
+				span.SetTag(ext.Error, err)
+			}
+			return
+		}
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+		} else {
+			span.Finish()
+		}
+	}
 
 	defer func() {
 		if p := recover(); p != nil {
 			// Create an error with a nice stack trace
 			stack := NewShortenedStackTrace(3, true,
 				fmt.Sprintf("%v", p))
-			span.SetTag(ext.ErrorStack, stack.StringStack())
-			span.SetTag("panic", fmt.Sprintf("%v", p))
-			span.Finish(tracer.WithError(fmt.Errorf("gopanic: %v", p)))
-			panic(p)
+			TagSpanWithPanic(span, p, stack)
+			EmitPanicEvent(statsd, name, fmt.Sprintf("%v", p), stack)
+			logger.Error("Operation panicked",
+				zap.String("panic", fmt.Sprintf("%v", p)), stack.Field())
+
+			finish(fmt.Errorf("gopanic: %v", p))
+			if ResolvePanicPolicy(opts.PanicPolicy, PanicCrash) == PanicCrash {
+				panic(p)
+			}
+			err = &PanicError{Value: p, Stack: stack}
 		} else {
-			if err != nil {
-				span.Finish(tracer.WithError(err))
+			if IsCancellation(ctx, err) {
+				span.SetTag(CancelledTag, true)
+				finish(nil)
 			} else {
-				span.Finish()
+				finish(err)
 			}
 		}
 	}()
@@ -63,13 +140,44 @@ func RunInstrumented(ctx context.Context, name string, fn func(context.Context)
 
 	met := GetMetricsFromContext(ctx)
 	defer met.CopyToStatsd(statsd, clientType)
-	defer met.CopyToSpan(span)
+	defer met.CopyToSampledSpan(span)
+	defer met.Seal()
 
-	err = fn(ctx)
+	// Always set, so the nested operations don't inherit the classifier
+	ctx = context.WithValue(ctx, recoverClassifierKeyVal, opts.RecoverClassifier)
+	err = runClassifyingPanics(ctx, opts.RecoverClassifier, fn)
 
 	return err
 }
 
+// Run the function, converting the panics handled by the classifier into the
+// errors. The nil classifier handles nothing.
+func runClassifyingPanics(ctx context.Context, classifier func(interface{}) (error, bool),
+	fn func(context.Context) error) (err error) {
+
+	if classifier == nil {
+		return fn(ctx)
+	}
+
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		classified, handled := classifier(p)
+		if !handled {
+			// The stack is not unwound yet, so it still has the original frames
+			panic(p)
+		}
+		if classified == nil {
+			classified = fmt.Errorf("recovered panic: %v", p)
+		}
+		err = classified
+	}()
+
+	return fn(ctx)
+}
+
 func InstrumentWithMetrics(ctx context.Context, fn func(context.Context) error) error {
 	met := GetMetricsFromContext(ctx)
 	met.AddCount("Success", 0)
@@ -79,7 +187,9 @@ func InstrumentWithMetrics(ctx context.Context, fn func(context.Context) error)
 	bench := met.Benchmark("Time")
 	defer bench.Done()
 
-	err := fn(ctx)
+	// The panics handled by the RecoverClassifier of the operation are the errors
+	classifier, _ := ctx.Value(recoverClassifierKeyVal).(func(interface{}) (error, bool))
+	err := runClassifyingPanics(ctx, classifier, fn)
 
 	// We have set Fault to 1 initially. If the function panics then we never reach
 	// this statement and the value of 1 propagates to the caller. However, if we
@@ -89,9 +199,41 @@ func InstrumentWithMetrics(ctx context.Context, fn func(context.Context) error)
 
 	if err == nil {
 		met.AddCount("Success", 1)
+	} else if IsCancellation(ctx, err) {
+		// Client cancellations are not errors of the operation
+		met.AddCount(CancelledMetric, 1)
 	} else {
 		met.AddCount("Error", 1)
 	}
+	if !IsCancellation(ctx, err) {
+		RecordSLO(ctx, met.OpName, bench.Elapsed())
+	}
 
 	return err
 }
+
+const BytesAllocatedMetric = "BytesAllocated"
+const AllocationsMetric = "Allocations"
+
+// InstrumentWithAllocations() records the heap allocations made during fn execution
+// as BytesAllocated and Allocations metrics. This is meant for optimization work
+// and must be opt-in: runtime.ReadMemStats stops the world (twice per call here),
+// and the counters are process-wide, so allocations of concurrently running
+// goroutines are also attributed to this operation.
+func InstrumentWithAllocations(ctx context.Context, fn func(context.Context) error) error {
+	met := GetMetricsFromContext(ctx)
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	defer func() {
+		// Record the allocations even if fn panics
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		met.AddMetric(BytesAllocatedMetric, float64(after.TotalAlloc-before.TotalAlloc),
+			cloudwatch.StandardUnitBytes)
+		met.AddCount(AllocationsMetric, float64(after.Mallocs-before.Mallocs))
+	}()
+
+	return fn(ctx)
+}
@@ -155,3 +155,139 @@ func testWithPanic(t *testing.T, rs *RecordingSink) {
 
 	assert.Fail(t, "expected panic")
 }
+
+var allocSink [][]byte
+
+func TestInstrumentWithAllocations(t *testing.T) {
+	rs := NewRecordingSink()
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	ctx = ContextWithStatsd(ctx, rs)
+
+	err := RunInstrumented(ctx, "test1",
+		func(c context.Context) error {
+			return InstrumentWithAllocations(c, func(ctx context.Context) error {
+				for i := 0; i < 100; i++ {
+					allocSink = append(allocSink, make([]byte, 1024))
+				}
+				return nil
+			})
+		})
+	assert.NoError(t, err)
+	allocSink = nil
+
+	assert.True(t, rs.Distributions["test1.BytesAllocated"] >= 100*1024)
+	assert.True(t, rs.Distributions["test1.Allocations"] >= 100)
+}
+
+func TestInstrumentCancelled(t *testing.T) {
+	rs := NewRecordingSink()
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx, cancel := context.WithCancel(ImbueContext(context.Background(), zap.NewNop()))
+	ctx = ContextWithStatsd(ctx, rs)
+
+	err := RunInstrumented(ctx, "test1",
+		func(c context.Context) error {
+			return InstrumentWithMetrics(c, func(ctx context.Context) error {
+				cancel()
+				<-ctx.Done()
+				return fmt.Errorf("failed to read: %w", ctx.Err())
+			})
+		})
+	assert.True(t, IsCancellation(context.Background(), err))
+	// The real failures are errors even if the context is cancelled by then
+	assert.False(t, IsCancellation(ctx, fmt.Errorf("disk is full")))
+
+	assert.Equal(t, 1.0, rs.Distributions["test1.Cancelled"])
+	assert.Equal(t, 0.0, rs.Distributions["test1.Error"])
+	assert.Equal(t, 0.0, rs.Distributions["test1.Success"])
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, true, spans[0].Tag(CancelledTag))
+	assert.Nil(t, spans[0].Tag("error"))
+}
+
+func TestRunInstrumentedContinueSpan(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	upstream, ctx := tracer.StartSpanFromContext(context.Background(), "upstream")
+	ctx = ImbueContext(ctx, zap.NewNop())
+
+	err := RunInstrumentedWithOptions(ctx, "continued", RunOptions{ContinueSpan: true},
+		func(ctx context.Context) error {
+			span, _ := tracer.SpanFromContext(ctx)
+			assert.Equal(t, upstream, span)
+			GetMetricsFromContext(ctx).AddCount("Items", 2)
+			return fmt.Errorf("failed")
+		})
+	assert.Error(t, err)
+
+	// The upstream span is not finished by the runner
+	assert.Equal(t, 0, len(mt.FinishedSpans()))
+	upstream.Finish()
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "upstream", spans[0].OperationName())
+	assert.Equal(t, 2.0, spans[0].Tag("Items"))
+	assert.NotNil(t, spans[0].Tag("error"))
+
+	// A new span is started if there's none to continue
+	mt.Reset()
+	err = RunInstrumentedWithOptions(ImbueContext(context.Background(), zap.NewNop()),
+		"fresh", RunOptions{ContinueSpan: true}, func(ctx context.Context) error {
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, "fresh", mt.FinishedSpans()[0].OperationName())
+}
+
+type parserPanic struct {
+	pos int
+}
+
+func TestRunInstrumentedRecoverClassifier(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	sink := NewRecordingSink()
+	ctx := ContextWithStatsd(ImbueContext(context.Background(), zap.NewNop()), sink)
+	opts := RunOptions{RecoverClassifier: func(recovered interface{}) (error, bool) {
+		if pp, ok := recovered.(parserPanic); ok {
+			return fmt.Errorf("parse error at %d", pp.pos), true
+		}
+		return nil, false
+	}}
+
+	err := RunInstrumentedWithOptions(ctx, "parse", opts, func(ctx context.Context) error {
+		return InstrumentWithMetrics(ctx, func(ctx context.Context) error {
+			panic(parserPanic{pos: 12})
+		})
+	})
+	assert.Equal(t, "parse error at 12", err.Error())
+	assert.Equal(t, 0.0, sink.Distributions["parse.Fault"])
+	assert.Equal(t, 1.0, sink.Distributions["parse.Error"])
+	assert.Equal(t, 0.0, sink.Distributions["parse.Success"])
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.NotNil(t, spans[0].Tag("error"))
+
+	// Without InstrumentWithMetrics the panic is still converted
+	err = RunInstrumentedWithOptions(ctx, "parse", opts, func(ctx context.Context) error {
+		panic(parserPanic{pos: 13})
+	})
+	assert.Equal(t, "parse error at 13", err.Error())
+
+	// The other panics are re-raised
+	assert.Panics(t, func() {
+		_ = RunInstrumentedWithOptions(ctx, "parse", opts, func(ctx context.Context) error {
+			panic("broken")
+		})
+	})
+}
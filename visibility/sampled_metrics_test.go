@@ -0,0 +1,43 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"testing"
+)
+
+func TestSpanMetricsSampledOnly(t *testing.T) {
+	rs := NewRecordingSink()
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	SetSpanMetricsSampledOnly(true)
+	defer SetSpanMetricsSampledOnly(false)
+
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	ctx = ContextWithStatsd(ctx, rs)
+
+	run := func(priority int) {
+		_ = RunInstrumented(ctx, "test1", func(c context.Context) error {
+			span, _ := tracer.SpanFromContext(c)
+			span.SetTag(ext.SamplingPriority, priority)
+			GetMetricsFromContext(c).AddCount("hellocount", 1)
+			return nil
+		})
+	}
+
+	run(ext.PriorityAutoKeep)
+	assert.Equal(t, float64(1), mt.FinishedSpans()[0].Tag("hellocount"))
+	assert.Equal(t, float64(1), rs.Distributions["test1.hellocount"])
+
+	mt.Reset()
+	rs.Clear()
+	run(ext.PriorityAutoReject)
+	assert.Nil(t, mt.FinishedSpans()[0].Tag("hellocount"))
+	// Statsd still gets everything
+	assert.Equal(t, float64(1), rs.Distributions["test1.hellocount"])
+}
@@ -0,0 +1,35 @@
+package visibility
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"strconv"
+	"time"
+)
+
+// The gauge with the number of the keys owned by the instance in the last
+// iteration of the sharded periodic process, tagged with "process:<name>" and
+// "shard:<index>"
+const ShardSizeMetric = "ShardSize"
+
+// Run the periodic process over the keys owned by this instance (see
+// utils.Sharder). The keys are listed on every iteration, so the newly added
+// keys are picked up by their owners, and proc is called with the owned keys
+// only (possibly none).
+func (pc *ProcessContext) RunShardedPeriodicProcess(period time.Duration,
+	sharder *utils.Sharder, listKeys func(ctx context.Context) ([]string, error),
+	proc func(ctx context.Context, keys []string) error) {
+
+	sink := GetStatsdFromContext(pc.Parent.rootCtx)
+	tags := []string{"process:" + pc.opName(), "shard:" + strconv.Itoa(sharder.Index)}
+
+	pc.RunPeriodicProcess(period, func(ctx context.Context) error {
+		keys, err := listKeys(ctx)
+		if err != nil {
+			return err
+		}
+		owned := sharder.Filter(keys)
+		_ = sink.Gauge(ShardSizeMetric, float64(len(owned)), tags, 1)
+		return proc(ctx, owned)
+	})
+}
@@ -0,0 +1,65 @@
+package visibility
+
+import (
+	"context"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type gaugeSink struct {
+	statsd.NoOpClient
+	mtx    sync.Mutex
+	gauges map[string]float64
+}
+
+func (g *gaugeSink) Gauge(name string, value float64, tags []string, _ float64) error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.gauges[name+"|"+strings.Join(tags, ",")] = value
+	return nil
+}
+
+func (g *gaugeSink) get(name string) float64 {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.gauges[name]
+}
+
+func TestShardedPeriodicProcess(t *testing.T) {
+	sink := &gaugeSink{gauges: make(map[string]float64)}
+	ctx := ContextWithStatsd(ImbueContext(context.Background(), zap.NewNop()), sink)
+	reg := NewProcessRegistry(ctx)
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	sharder := utils.NewSharder(1, 3)
+
+	processed := make(chan []string)
+	pc := reg.CreateProcessContext("sync")
+	pc.RunShardedPeriodicProcess(time.Millisecond, sharder,
+		func(ctx context.Context) ([]string, error) {
+			return keys, nil
+		}, func(ctx context.Context, owned []string) error {
+			select {
+			case <-ctx.Done():
+			case processed <- owned:
+			}
+			return nil
+		})
+
+	owned := <-processed
+	reg.Close()
+	pc.Wait()
+
+	// Only the owned keys are processed
+	assert.Equal(t, sharder.Filter(keys), owned)
+	for _, k := range owned {
+		assert.Equal(t, 1, sharder.Owner(k))
+	}
+	assert.Equal(t, float64(len(owned)), sink.get("ShardSize|process:sync,shard:1"))
+}
@@ -0,0 +1,159 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/DataDog/datadog-go/statsd"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The orders of the steps of the default shutdown sequence, the custom steps
+// can be placed between them
+const (
+	ShutdownOrderProcesses = 100
+	ShutdownOrderTracing   = 200
+	ShutdownOrderStatsd    = 300
+	ShutdownOrderLogger    = 1000
+)
+
+// The timeout of the steps added with the zero timeout
+const DefaultShutdownStepTimeout = 5 * time.Second
+
+type shutdownStep struct {
+	name    string
+	order   int
+	timeout time.Duration
+	fn      func(ctx context.Context) error
+}
+
+// The ordered list of the shutdown steps, so that e.g. the final log lines are
+// written before the logger is synced, and the metrics of the stopped
+// processes are sent before the statsd client is closed. The steps are run in
+// the ascending order (the steps with the same order are run in the order they
+// were added), each with its own timeout. The failed or timed out steps are
+// logged and don't stop the sequence.
+type ShutdownSequence struct {
+	logger *zap.Logger
+
+	mtx   sync.Mutex
+	steps []shutdownStep
+}
+
+func NewShutdownSequence(logger *zap.Logger) *ShutdownSequence {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &ShutdownSequence{logger: logger}
+}
+
+// Create the sequence for the pieces this package creates: close the process
+// registry (if not nil), stop the tracing (see StopTracing), flush and close
+// the statsd client, and finally sync the logger
+func NewDefaultShutdownSequence(logger *zap.Logger, registry *ProcessRegistry,
+	client statsd.ClientInterface) *ShutdownSequence {
+
+	s := NewShutdownSequence(logger)
+	if registry != nil {
+		s.Add("process registry", ShutdownOrderProcesses, 0, CloseRegistryStep(registry))
+	}
+	s.Add("tracing", ShutdownOrderTracing, 0, StopTracing)
+	s.Add("statsd", ShutdownOrderStatsd, 0, CloseStatsdStep(client))
+	s.Add("logger", ShutdownOrderLogger, 0, SyncLoggerStep(logger))
+	return s
+}
+
+// Add the step, DefaultShutdownStepTimeout is used for the zero timeout. The
+// step's function should return once the context is done, but the sequence
+// doesn't wait for it past the timeout.
+func (s *ShutdownSequence) Add(name string, order int, timeout time.Duration,
+	fn func(ctx context.Context) error) {
+
+	if timeout == 0 {
+		timeout = DefaultShutdownStepTimeout
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.steps = append(s.steps, shutdownStep{name: name, order: order,
+		timeout: timeout, fn: fn})
+}
+
+// Run the steps, returning the error of the first failed step
+func (s *ShutdownSequence) Run(ctx context.Context) error {
+	s.mtx.Lock()
+	steps := append([]shutdownStep(nil), s.steps...)
+	s.mtx.Unlock()
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].order < steps[j].order
+	})
+
+	var firstErr error
+	for _, step := range steps {
+		err := s.runStep(ctx, step)
+		if err == nil {
+			continue
+		}
+		s.logger.Error("Shutdown step failed", zap.String("step", step.name),
+			zap.Error(err))
+		if firstErr == nil {
+			firstErr = fmt.Errorf("shutdown step %s: %w", step.name, err)
+		}
+	}
+	return firstErr
+}
+
+func (s *ShutdownSequence) runStep(ctx context.Context, step shutdownStep) error {
+	stepCtx, cancel := context.WithTimeout(ctx, step.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- step.fn(stepCtx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-stepCtx.Done():
+		return stepCtx.Err()
+	}
+}
+
+// Close the registry, waiting for its processes for at most the step's timeout
+func CloseRegistryStep(registry *ProcessRegistry) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		timeout := DefaultShutdownStepTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		if !registry.CloseWithTimeout(timeout) {
+			return fmt.Errorf("the processes haven't finished in %v", timeout)
+		}
+		return nil
+	}
+}
+
+// Flush and close the statsd client
+func CloseStatsdStep(client statsd.ClientInterface) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		err := client.Flush()
+		closeErr := client.Close()
+		if err != nil {
+			return err
+		}
+		return closeErr
+	}
+}
+
+// Sync the logger. The sync errors are ignored since the syncing of the
+// console (stdout or stderr) always fails on some platforms.
+func SyncLoggerStep(logger *zap.Logger) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if logger != nil {
+			_ = logger.Sync()
+		}
+		return nil
+	}
+}
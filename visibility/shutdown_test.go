@@ -0,0 +1,62 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownSequence(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	seq := NewShutdownSequence(logger)
+
+	var ran []string
+	step := func(name string, err error) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			ran = append(ran, name)
+			return err
+		}
+	}
+	seq.Add("last", ShutdownOrderLogger, 0, step("last", nil))
+	seq.Add("statsd", ShutdownOrderStatsd, 0, step("statsd", fmt.Errorf("broken")))
+	seq.Add("first", ShutdownOrderProcesses, 0, step("first", nil))
+	seq.Add("second", ShutdownOrderProcesses, 0, step("second", nil))
+	seq.Add("hung", ShutdownOrderTracing, 10*time.Millisecond,
+		func(ctx context.Context) error {
+			<-ctx.Done()
+			// Outlives the step's timeout
+			time.Sleep(time.Second)
+			return nil
+		})
+
+	err := seq.Run(context.Background())
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "hung"))
+	assert.Equal(t, []string{"first", "second", "statsd", "last"}, ran)
+
+	logged := sink.String()
+	assert.True(t, strings.Contains(logged, `"step":"hung"`))
+	assert.True(t, strings.Contains(logged, `"step":"statsd","error":"broken"`))
+}
+
+func TestDefaultShutdownSequence(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	registry := NewProcessRegistry(ImbueContext(context.Background(), logger))
+	pc := registry.CreateProcessContext("worker")
+	pc.Run(func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	seq := NewDefaultShutdownSequence(logger, registry, NewRecordingSink())
+	seq.Add("breadcrumb", ShutdownOrderStatsd+1, 0, func(ctx context.Context) error {
+		logger.Info("Shutting down cleanly")
+		return nil
+	})
+	assert.NoError(t, seq.Run(context.Background()))
+	assert.True(t, strings.Contains(sink.String(), "Shutting down cleanly"))
+}
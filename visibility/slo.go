@@ -0,0 +1,161 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/ghodss/yaml"
+	"sync"
+	"time"
+)
+
+const (
+	// 1 if the operation took longer than its SLO target, 0 otherwise
+	SLOBreachMetric = "SLO.Breach"
+	// The breach divided by the error budget, so its average is the budget burn
+	// rate (1 burns the budget exactly over the SLO period)
+	SLOBudgetBurnMetric = "SLO.BudgetBurn"
+
+	SLOBreachedTag = "slo.breached"
+)
+
+// The latency objective of an operation: the Objective fraction (e.g. 0.99) of
+// the requests must complete within the Target
+type SLO struct {
+	Target    time.Duration
+	Objective float64
+}
+
+func (s SLO) validate(opName string) error {
+	if s.Target <= 0 {
+		return fmt.Errorf("the SLO target of %s must be positive", opName)
+	}
+	if !(s.Objective > 0 && s.Objective < 1) {
+		return fmt.Errorf("the SLO objective of %s must be between 0 and 1", opName)
+	}
+	return nil
+}
+
+// The SLOs of the operations, consulted by the middlewares and
+// InstrumentWithMetrics once the operations complete (see SetSLORegistry). The
+// targets can be updated at runtime.
+type SLORegistry struct {
+	mtx  sync.RWMutex
+	slos map[string]SLO
+}
+
+func NewSLORegistry() *SLORegistry {
+	return &SLORegistry{slos: make(map[string]SLO)}
+}
+
+// Register (or update) the SLO of the operation (the metrics' OpName)
+func (r *SLORegistry) Register(opName string, target time.Duration, objective float64) {
+	slo := SLO{Target: target, Objective: objective}
+	err := slo.validate(opName)
+	utils.PanicIfF(err != nil, "%v", err)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.slos[opName] = slo
+}
+
+func (r *SLORegistry) Unregister(opName string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.slos, opName)
+}
+
+func (r *SLORegistry) Get(opName string) (SLO, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	slo, ok := r.slos[opName]
+	return slo, ok
+}
+
+// Replace all the SLOs, the operations missing from the map are unregistered
+func (r *SLORegistry) Load(slos map[string]SLO) error {
+	for opName, slo := range slos {
+		if err := slo.validate(opName); err != nil {
+			return err
+		}
+	}
+
+	res := make(map[string]SLO, len(slos))
+	for opName, slo := range slos {
+		res[opName] = slo
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.slos = res
+	return nil
+}
+
+// Replace all the SLOs with the ones from the YAML (or JSON) document, keyed
+// by the operation name:
+//
+//	GetItem:
+//	  target: 250ms
+//	  objective: 0.99
+func (r *SLORegistry) LoadYAML(data []byte) error {
+	var doc map[string]struct {
+		Target    string  `json:"target"`
+		Objective float64 `json:"objective"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("bad SLO config: %w", err)
+	}
+
+	slos := make(map[string]SLO, len(doc))
+	for opName, entry := range doc {
+		target, err := time.ParseDuration(entry.Target)
+		if err != nil {
+			return fmt.Errorf("bad SLO target of %s: %w", opName, err)
+		}
+		slos[opName] = SLO{Target: target, Objective: entry.Objective}
+	}
+	return r.Load(slos)
+}
+
+var sloRegistryMtx sync.RWMutex
+var sloRegistry *SLORegistry
+
+// Install the registry consulted by the middlewares and InstrumentWithMetrics,
+// nil disables the SLO metrics
+func SetSLORegistry(registry *SLORegistry) {
+	sloRegistryMtx.Lock()
+	defer sloRegistryMtx.Unlock()
+	sloRegistry = registry
+}
+
+func getSLORegistry() *SLORegistry {
+	sloRegistryMtx.RLock()
+	defer sloRegistryMtx.RUnlock()
+	return sloRegistry
+}
+
+// Check the duration of the completed operation against its SLO: tag the span
+// of the context, and send the SLO.Breach and SLO.BudgetBurn distributions
+// tagged with the operation to the context's statsd. Nothing is done for the
+// operations without the SLO.
+func RecordSLO(ctx context.Context, opName string, duration time.Duration) {
+	registry := getSLORegistry()
+	if registry == nil {
+		return
+	}
+	slo, ok := registry.Get(opName)
+	if !ok {
+		return
+	}
+
+	breach := 0.0
+	if duration > slo.Target {
+		breach = 1
+	}
+	SpanFromContextOrNoop(ctx).SetTag(SLOBreachedTag, breach == 1)
+
+	statsd := GetStatsdFromContext(ctx)
+	tags := []string{"operation:" + opName,
+		ClientTypeTag + ":" + GetClientTypeFromContext(ctx)}
+	_ = statsd.Distribution(SLOBreachMetric, breach, tags, 1)
+	_ = statsd.Distribution(SLOBudgetBurnMetric, breach/(1-slo.Objective), tags, 1)
+}
@@ -0,0 +1,82 @@
+package visibility
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"testing"
+	"time"
+)
+
+func TestSLORegistry(t *testing.T) {
+	registry := NewSLORegistry()
+	registry.Register("GetItem", 100*time.Millisecond, 0.99)
+	slo, ok := registry.Get("GetItem")
+	assert.True(t, ok)
+	assert.Equal(t, SLO{Target: 100 * time.Millisecond, Objective: 0.99}, slo)
+	assert.Panics(t, func() {
+		registry.Register("Bad", time.Second, 1.5)
+	})
+
+	err := registry.LoadYAML([]byte(`
+PutItem:
+  target: 250ms
+  objective: 0.9
+`))
+	assert.NoError(t, err)
+	_, ok = registry.Get("GetItem")
+	assert.False(t, ok)
+	slo, _ = registry.Get("PutItem")
+	assert.Equal(t, SLO{Target: 250 * time.Millisecond, Objective: 0.9}, slo)
+
+	assert.Error(t, registry.LoadYAML([]byte("PutItem: {target: soon, objective: 0.9}")))
+	assert.Error(t, registry.LoadYAML([]byte("PutItem: {target: 1s, objective: 0}")))
+	// The failed loads keep the existing SLOs
+	_, ok = registry.Get("PutItem")
+	assert.True(t, ok)
+}
+
+func TestInstrumentWithSLO(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	registry := NewSLORegistry()
+	registry.Register("slow", 100*time.Millisecond, 0.9)
+	SetSLORegistry(registry)
+	defer SetSLORegistry(nil)
+
+	rs := NewRecordingSink()
+	clock := utils.NewFakeClock(time.Unix(1000, 0))
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	ctx = ContextWithStatsd(utils.WithClock(ctx, clock), rs)
+
+	run := func(name string, duration time.Duration) {
+		err := RunInstrumented(ctx, name, func(ctx context.Context) error {
+			return InstrumentWithMetrics(ctx, func(ctx context.Context) error {
+				clock.Advance(duration)
+				return nil
+			})
+		})
+		assert.NoError(t, err)
+	}
+
+	run("slow", 200*time.Millisecond)
+	assert.Equal(t, 1.0, rs.Distributions[SLOBreachMetric])
+	assert.InDelta(t, 10.0, rs.Distributions[SLOBudgetBurnMetric], 1e-9)
+	assert.Equal(t, []string{"operation:slow", "client-type:normal"},
+		rs.Tags[SLOBreachMetric])
+	assert.Equal(t, true, mt.FinishedSpans()[0].Tag(SLOBreachedTag))
+
+	run("slow", 50*time.Millisecond)
+	assert.Equal(t, 0.0, rs.Distributions[SLOBreachMetric])
+	assert.Equal(t, false, mt.FinishedSpans()[1].Tag(SLOBreachedTag))
+
+	// The operations without the SLO emit nothing
+	rs.Clear()
+	run("other", 200*time.Millisecond)
+	_, found := rs.Distributions[SLOBreachMetric]
+	assert.False(t, found)
+	assert.Nil(t, mt.FinishedSpans()[2].Tag(SLOBreachedTag))
+}
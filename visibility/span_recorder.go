@@ -0,0 +1,165 @@
+package visibility
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const SpanRecorderDrainInterval = time.Second
+
+// How long a replaced mocktracer is still checked for the spans that were started
+// before it was replaced, the longer spans are not recorded
+const SpanRecorderRetention = time.Minute
+
+// An in-process span recorder for the local development without the DataDog
+// agent. It keeps the last N finished spans, and serves them via Handler().
+// The recorder uses the mocktracer to collect the spans, replacing it periodically
+// so the memory use stays bounded. Don't use it in production.
+type SpanRecorder struct {
+	mtx      sync.Mutex
+	tracer   mocktracer.Tracer
+	retired  []retiredTracer
+	maxSpans int
+	spans    []RecordedSpan
+	stopped  bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// The mocktracer can't atomically take its finished spans and reset, so it's
+// never reset. Instead, the new spans go to a new mocktracer, and the old one is
+// only read from the last seen position for the spans that are still open.
+type retiredTracer struct {
+	tracer    mocktracer.Tracer
+	seen      int
+	retiredAt time.Time
+}
+
+type RecordedSpan struct {
+	TraceId   uint64                 `json:"trace_id"`
+	SpanId    uint64                 `json:"span_id"`
+	ParentId  uint64                 `json:"parent_id"`
+	Operation string                 `json:"operation"`
+	Start     time.Time              `json:"start"`
+	Duration  time.Duration          `json:"duration"`
+	Tags      map[string]interface{} `json:"tags"`
+}
+
+// Start the recorder, it replaces the global tracer
+func StartSpanRecorder(maxSpans int) *SpanRecorder {
+	r := &SpanRecorder{
+		tracer:   mocktracer.Start(),
+		maxSpans: maxSpans,
+		done:     make(chan struct{}),
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(SpanRecorderDrainInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				r.drain()
+			}
+		}
+	}()
+
+	return r
+}
+
+func (r *SpanRecorder) Stop() {
+	close(r.done)
+	r.wg.Wait()
+	r.drain()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.stopped = true
+	r.tracer.Stop()
+}
+
+// Move the finished spans from the tracer into the bounded buffer
+func (r *SpanRecorder) drain() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.stopped {
+		return
+	}
+
+	now := time.Now()
+	r.retired = append(r.retired, retiredTracer{tracer: r.tracer, retiredAt: now})
+	r.tracer = mocktracer.Start()
+
+	active := r.retired[:0]
+	for _, rt := range r.retired {
+		finished := rt.tracer.FinishedSpans()
+		for _, s := range finished[rt.seen:] {
+			r.record(s)
+		}
+		rt.seen = len(finished)
+		if now.Sub(rt.retiredAt) < SpanRecorderRetention {
+			active = append(active, rt)
+		}
+	}
+	r.retired = active
+
+	if len(r.spans) > r.maxSpans {
+		r.spans = append([]RecordedSpan{}, r.spans[len(r.spans)-r.maxSpans:]...)
+	}
+}
+
+func (r *SpanRecorder) record(s mocktracer.Span) {
+	tags := make(map[string]interface{}, len(s.Tags()))
+	for k, v := range s.Tags() {
+		switch val := v.(type) {
+		case error:
+			tags[k] = val.Error()
+		case string, bool, int, int64, uint64, float64:
+			tags[k] = val
+		default:
+			tags[k] = fmt.Sprintf("%v", val)
+		}
+	}
+	r.spans = append(r.spans, RecordedSpan{
+		TraceId:   s.TraceID(),
+		SpanId:    s.SpanID(),
+		ParentId:  s.ParentID(),
+		Operation: s.OperationName(),
+		Start:     s.StartTime(),
+		Duration:  s.FinishTime().Sub(s.StartTime()),
+		Tags:      tags,
+	})
+}
+
+// Get the last recorded spans, the oldest first
+func (r *SpanRecorder) Spans() []RecordedSpan {
+	r.drain()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	res := make([]RecordedSpan, len(r.spans))
+	copy(res, r.spans)
+	return res
+}
+
+// The handler returning the recorded spans as JSON, e.g. for /debug/spans
+func (r *SpanRecorder) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, err := json.Marshal(r.Spans())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	})
+}
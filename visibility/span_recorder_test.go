@@ -0,0 +1,69 @@
+package visibility
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSpanRecorder(t *testing.T) {
+	rec := StartSpanRecorder(3)
+	defer rec.Stop()
+
+	for i := 0; i < 5; i++ {
+		span := tracer.StartSpan("op" + strconv.Itoa(i))
+		span.SetTag("index", i)
+		span.Finish()
+	}
+
+	// Only the last spans are kept
+	spans := rec.Spans()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, "op2", spans[0].Operation)
+	assert.Equal(t, "op4", spans[2].Operation)
+	assert.Equal(t, 4, spans[2].Tags["index"])
+
+	resp := httptest.NewRecorder()
+	rec.Handler().ServeHTTP(resp, httptest.NewRequest("GET", "/debug/spans", nil))
+	var res []RecordedSpan
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+	assert.Equal(t, 3, len(res))
+}
+
+func TestSpanRecorderConcurrentDrain(t *testing.T) {
+	rec := StartSpanRecorder(10000)
+
+	// Start the spans before the drains, and finish them concurrently with them
+	var spans []tracer.Span
+	for i := 0; i < 1000; i++ {
+		spans = append(spans, tracer.StartSpan("op"))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	done := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		for _, s := range spans {
+			s.Finish()
+		}
+		close(done)
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+			rec.drain()
+		}
+	}
+	wg.Wait()
+
+	// None of the spans are lost
+	rec.Stop()
+	assert.Equal(t, 1000, len(rec.Spans()))
+}
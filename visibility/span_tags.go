@@ -0,0 +1,152 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// DataDog drops the span tags longer than ~25k characters
+const DefaultSpanTagLimit = 25000
+
+var spanTagLimit int64 = DefaultSpanTagLimit
+var spanTagTruncations uint64
+var spanTagRejections uint64
+var unboundedTagKeys sync.Map
+
+// Log the truncated and rejected tags at most once in this interval
+const spanTagWarningInterval = 10 * time.Second
+
+var lastSpanTagWarning int64
+
+// Set the maximum length (in bytes) of the string span tags set with
+// SetSpanTagSafe, the longer values are truncated. Zero or a negative value
+// restores the default.
+func SetSpanTagLimit(limit int) {
+	if limit <= 0 {
+		limit = DefaultSpanTagLimit
+	}
+	atomic.StoreInt64(&spanTagLimit, int64(limit))
+}
+
+// Allow the span tag to hold the values of the unbounded types (byte slices,
+// readers, HTTP requests and responses). They are still truncated.
+func AllowUnboundedSpanTag(key string) {
+	unboundedTagKeys.Store(key, true)
+}
+
+// The number of the span tags truncated since the start of the process
+func SpanTagTruncations() uint64 {
+	return atomic.LoadUint64(&spanTagTruncations)
+}
+
+// The number of the span tags rejected since the start of the process
+func SpanTagRejections() uint64 {
+	return atomic.LoadUint64(&spanTagRejections)
+}
+
+// Set the span tag, truncating the long strings to the limit (see
+// SetSpanTagLimit) with a "...[truncated N bytes]" suffix. The values that are
+// likely to be huge (like the request bodies) are replaced with a placeholder,
+// unless the key is allowed with AllowUnboundedSpanTag. Both are only counted,
+// AnnotateSpan also logs them.
+func SetSpanTagSafe(span tracer.Span, key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	safeValue, _ := safeTagValue(key, value)
+	span.SetTag(key, safeValue)
+}
+
+// Get the span from the context, or a no-op span if there's none, so that the
+// call sites can set the tags unconditionally
+func SpanFromContextOrNoop(ctx context.Context) tracer.Span {
+	if span, ok := tracer.SpanFromContext(ctx); ok {
+		return span
+	}
+	return &FakeSpan{}
+}
+
+// Set the tags of the context's span from the key-value pairs, e.g.
+// AnnotateSpan(ctx, "tenant", tenantId, "items", len(items)). The values are
+// set with SetSpanTagSafe, the non-string keys are formatted with fmt.Sprint,
+// and the unpaired last key is ignored. The truncated and rejected values are
+// logged with the context's logger, rate-limited.
+func AnnotateSpan(ctx context.Context, kv ...interface{}) {
+	span := SpanFromContextOrNoop(ctx)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		value, problem := safeTagValue(key, kv[i+1])
+		span.SetTag(key, value)
+		if problem != "" {
+			warnSpanTag(ctx, key, problem)
+		}
+	}
+}
+
+func warnSpanTag(ctx context.Context, key string, problem string) {
+	logger := TryCL(ctx)
+	if logger == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&lastSpanTagWarning)
+	if now-last < int64(spanTagWarningInterval) ||
+		!atomic.CompareAndSwapInt64(&lastSpanTagWarning, last, now) {
+		return
+	}
+	logger.Warn("The span tag value is "+problem, zap.String("key", key),
+		zap.Uint64("truncations", SpanTagTruncations()),
+		zap.Uint64("rejections", SpanTagRejections()))
+}
+
+// Get the value to set as the span tag, and the problem with the original one
+// ("truncated" or "rejected"), if any
+func safeTagValue(key string, value interface{}) (interface{}, string) {
+	switch v := value.(type) {
+	case string:
+		return truncateTagValue(v)
+	case []byte, io.Reader, *http.Request, *http.Response:
+		if _, ok := unboundedTagKeys.Load(key); !ok {
+			atomic.AddUint64(&spanTagRejections, 1)
+			return fmt.Sprintf("[rejected unbounded value of type %T]", value), "rejected"
+		}
+		if data, ok := v.([]byte); ok {
+			return truncateTagValue(string(data))
+		}
+		return truncateTagValue(fmt.Sprintf("%v", v))
+	}
+	return value, ""
+}
+
+// Truncate the string to the span tag limit, cutting it on the UTF-8 character
+// boundary
+func TruncateTagValue(value string) string {
+	res, _ := truncateTagValue(value)
+	return res
+}
+
+func truncateTagValue(value string) (string, string) {
+	limit := int(atomic.LoadInt64(&spanTagLimit))
+	if len(value) <= limit {
+		return value, ""
+	}
+
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	atomic.AddUint64(&spanTagTruncations, 1)
+	return fmt.Sprintf("%s...[truncated %d bytes]", value[:cut], len(value)-cut),
+		"truncated"
+}
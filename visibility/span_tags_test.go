@@ -0,0 +1,144 @@
+package visibility
+
+import (
+	"bytes"
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/twitchtv/twirp/ctxsetters"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTruncateTagBoundaries(t *testing.T) {
+	SetSpanTagLimit(10)
+	defer SetSpanTagLimit(0)
+
+	before := SpanTagTruncations()
+	assert.Equal(t, "", TruncateTagValue(""))
+	assert.Equal(t, "123456789", TruncateTagValue("123456789"))
+	assert.Equal(t, "1234567890", TruncateTagValue("1234567890"))
+	assert.Equal(t, before, SpanTagTruncations())
+
+	assert.Equal(t, "1234567890...[truncated 1 bytes]", TruncateTagValue("12345678901"))
+	assert.Equal(t, "1234567890...[truncated 10 bytes]",
+		TruncateTagValue(strings.Repeat("1234567890", 2)))
+	assert.Equal(t, before+2, SpanTagTruncations())
+
+	// Don't cut the multibyte characters in half ("ж" is 2 bytes)
+	assert.Equal(t, "123456789...[truncated 2 bytes]", TruncateTagValue("123456789ж"))
+}
+
+func TestSpanTagLimitReset(t *testing.T) {
+	SetSpanTagLimit(0)
+	long := strings.Repeat("a", DefaultSpanTagLimit)
+	assert.Equal(t, long, TruncateTagValue(long))
+	assert.True(t, strings.HasSuffix(TruncateTagValue(long+"b"), "...[truncated 1 bytes]"))
+}
+
+func TestSetSpanTagSafe(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	SetSpanTagLimit(5)
+	defer SetSpanTagLimit(0)
+
+	span := tracer.StartSpan("test")
+	SetSpanTagSafe(span, "str", "abcdefgh")
+	SetSpanTagSafe(span, "num", 123.0)
+
+	rejections := SpanTagRejections()
+	SetSpanTagSafe(span, "body", []byte("abcdefgh"))
+	SetSpanTagSafe(span, "reader", bytes.NewReader([]byte("abc")))
+	assert.Equal(t, rejections+2, SpanTagRejections())
+
+	AllowUnboundedSpanTag("allowed-body")
+	SetSpanTagSafe(span, "allowed-body", []byte("abcdefgh"))
+	span.Finish()
+
+	ms := mt.FinishedSpans()[0]
+	assert.Equal(t, "abcde...[truncated 3 bytes]", ms.Tag("str"))
+	assert.Equal(t, 123.0, ms.Tag("num"))
+	assert.Equal(t, "[rejected unbounded value of type []uint8]", ms.Tag("body"))
+	assert.Equal(t, "[rejected unbounded value of type *bytes.Reader]", ms.Tag("reader"))
+	assert.Equal(t, "abcde...[truncated 3 bytes]", ms.Tag("allowed-body"))
+
+	// Nil spans are ignored
+	SetSpanTagSafe(nil, "str", "abc")
+}
+
+func TestPanicStackIsTruncated(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	SetSpanTagLimit(20)
+	defer SetSpanTagLimit(0)
+
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	assert.Panics(t, func() {
+		_ = RunInstrumented(ctx, "Op", func(ctx context.Context) error {
+			panic(strings.Repeat("x", 100))
+		})
+	})
+
+	ms := mt.FinishedSpans()[0]
+	assert.Equal(t, strings.Repeat("x", 20)+"...[truncated 80 bytes]", ms.Tag("panic"))
+	assert.Contains(t, ms.Tag(ext.ErrorStack), "...[truncated ")
+}
+
+func TestSpanFromContextOrNoop(t *testing.T) {
+	// No span in the context, the tags are silently dropped
+	span := SpanFromContextOrNoop(context.Background())
+	span.SetTag("key", "value")
+	assert.Equal(t, uint64(0), span.Context().TraceID())
+	AnnotateSpan(context.Background(), "key", "value")
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	root, ctx := tracer.StartSpanFromContext(context.Background(), "root")
+	assert.Equal(t, root, SpanFromContextOrNoop(ctx))
+	AnnotateSpan(ctx, "tenant", "abc", 42, "answer", "unpaired")
+	root.Finish()
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, "abc", spans[0].Tag("tenant"))
+	assert.Equal(t, "answer", spans[0].Tag("42"))
+	assert.Nil(t, spans[0].Tag("unpaired"))
+}
+
+func TestAnnotateSpanWarnings(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	atomic.StoreInt64(&lastSpanTagWarning, 0)
+
+	sink, logger := utils.NewMemorySinkLogger()
+	root, ctx := tracer.StartSpanFromContext(ImbueContext(context.Background(), logger), "root")
+	AnnotateSpan(ctx, "body", []byte("data"), "text", "fine")
+	// Rate-limited
+	AnnotateSpan(ctx, "other", []byte("data"))
+	root.Finish()
+
+	assert.Equal(t, 1, strings.Count(sink.String(), "The span tag value is"))
+	assert.Contains(t, sink.String(), `"msg":"The span tag value is rejected","key":"body"`)
+	assert.NotContains(t, sink.String(), `"key":"text"`)
+}
+
+func TestTwirpHooksWithoutTracing(t *testing.T) {
+	rs := NewRecordingSink()
+	ctx := ContextWithStatsd(ImbueContext(context.Background(), zap.NewNop()), rs)
+	ctx = ctxsetters.WithPackageName(ctx, "twirp.test")
+	ctx = ctxsetters.WithServiceName(ctx, "Example")
+	ctx = ctxsetters.WithMethodName(ctx, "MakeHat")
+
+	hooks := MakeTraceHooks("test")
+	ctx, err := hooks.RequestRouted(ctx)
+	assert.NoError(t, err)
+	hooks.ResponseSent(ctx)
+
+	// The metrics are sent even without the span
+	assert.Equal(t, 1.0, rs.Distributions["Example.MakeHat.Success"])
+}
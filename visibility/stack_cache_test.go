@@ -0,0 +1,77 @@
+package visibility
+
+import (
+	"github.com/stretchr/testify/assert"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func makeDeepStack(depth int) *ShortenedStackTrace {
+	if depth > 0 {
+		return makeDeepStack(depth - 1)
+	}
+	return NewShortenedStackTrace(1, false, "deep")
+}
+
+// The symbolization without the frame cache, for comparison
+func uncachedStringStack(s *ShortenedStackTrace) string {
+	var res string
+	frames := runtime.CallersFrames(s.stack)
+	for frame, more := frames.Next(); more; frame, more = frames.Next() {
+		path, line, label := s.parseFrame(frame)
+		res += path + ":" + strconv.Itoa(line) + " " + label + "\n"
+	}
+	return res
+}
+
+func TestCachedStackMatches(t *testing.T) {
+	st := makeDeepStack(30)
+	assert.Equal(t, uncachedStringStack(st), st.StringStack())
+	// The second pass comes from the cache
+	assert.Equal(t, uncachedStringStack(st), st.StringStack())
+}
+
+func BenchmarkStackUncached(b *testing.B) {
+	st := makeDeepStack(30)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = uncachedStringStack(st)
+	}
+}
+
+func BenchmarkStackCached(b *testing.B) {
+	st := makeDeepStack(30)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = st.StringStack()
+	}
+}
+
+type nilDerefTarget struct {
+	val int
+}
+
+//go:noinline
+func derefNil(p *nilDerefTarget, line *int) int {
+	_, _, *line, _ = runtime.Caller(0)
+	return p.val
+}
+
+func TestNilDerefStack(t *testing.T) {
+	var line int
+	var st *ShortenedStackTrace
+	func() {
+		defer func() {
+			st = NewShortenedStackTrace(1, false, recover())
+		}()
+		derefNil(nil, &line)
+	}()
+
+	// The faulting frame points to the dereferencing line, not the one before it
+	expected := "stack_cache_test.go:" + strconv.Itoa(line+1) + " derefNil\n"
+	assert.Contains(t, st.StringStack(), expected)
+	// The cached frames are the same
+	assert.Contains(t, st.StringStack(), expected)
+	assert.Equal(t, uncachedStringStack(st), st.StringStack())
+}
@@ -0,0 +1,222 @@
+package visibility
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DataDog/datadog-go/statsd"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TaskPoolQueueDepthGauge = "TaskPool.QueueDepth"
+	TaskPoolWaitTimeMetric  = "TaskPool.WaitTime"
+	TaskPoolSuccessMetric   = "TaskPool.Success"
+	TaskPoolErrorMetric     = "TaskPool.Error"
+	TaskPoolRejectedMetric  = "TaskPool.Rejected"
+	TaskPoolAbandonedMetric = "TaskPool.Abandoned"
+)
+
+var ErrTaskPoolFull = errors.New("the task pool queue is full")
+var ErrTaskPoolClosed = errors.New("the task pool is closed")
+
+type poolTask struct {
+	ctx      context.Context
+	name     string
+	fn       func(ctx context.Context) error
+	enqueued time.Time
+}
+
+// The pool of a fixed number of workers that run the tasks in background, to
+// do the work after the response has been sent. The workers are registered in
+// the ProcessRegistry, and each task is run with RunInstrumented.
+type TaskPool struct {
+	name    string
+	logger  *zap.Logger
+	sink    statsd.ClientInterface
+	tags    []string
+	queue   chan *poolTask
+	depth   int64
+	stop    chan struct{}
+	workers []*ProcessContext
+
+	mtx          sync.RWMutex
+	closed       bool
+	drainOnClose bool
+}
+
+func NewTaskPool(registry *ProcessRegistry, name string, workers int,
+	queueSize int) *TaskPool {
+
+	res := &TaskPool{
+		name:         name,
+		logger:       CL(registry.rootCtx),
+		sink:         GetStatsdFromContext(registry.rootCtx),
+		tags:         []string{"pool:" + name},
+		queue:        make(chan *poolTask, queueSize),
+		stop:         make(chan struct{}),
+		drainOnClose: true,
+	}
+
+	for i := 0; i < workers; i++ {
+		pc := registry.CreateProcessContext(fmt.Sprintf("%s-worker-%d", name, i))
+		res.workers = append(res.workers, &pc)
+		pc.Run(func(ctx context.Context) error {
+			res.work(ctx)
+			return nil
+		})
+	}
+	return res
+}
+
+// Set whether Close() runs the tasks that are still in the queue (the default),
+// or abandons them
+func (t *TaskPool) SetDrainOnClose(drain bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.drainOnClose = drain
+}
+
+// Enqueue the task. The task gets a context detached from ctx (see
+// DetachContext), so it's not cancelled when the request is finished. If the
+// queue is full, ErrTaskPoolFull is returned instead of waiting.
+func (t *TaskPool) Submit(ctx context.Context, taskName string,
+	fn func(ctx context.Context) error) error {
+
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	if t.closed {
+		return ErrTaskPoolClosed
+	}
+
+	task := &poolTask{
+		ctx:      DetachContext(ctx),
+		name:     taskName,
+		fn:       fn,
+		enqueued: time.Now(),
+	}
+
+	select {
+	case t.queue <- task:
+		t.reportDepth(atomic.AddInt64(&t.depth, 1))
+		return nil
+	default:
+		_ = t.sink.Count(TaskPoolRejectedMetric, 1, t.tags, 1)
+		return ErrTaskPoolFull
+	}
+}
+
+func (t *TaskPool) reportDepth(depth int64) {
+	_ = t.sink.Gauge(TaskPoolQueueDepthGauge, float64(depth), t.tags, 1)
+}
+
+func (t *TaskPool) work(ctx context.Context) {
+	for {
+		// Check the abandonment first, select picks the ready channels randomly
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+
+		select {
+		case <-t.stop:
+			return
+		case <-ctx.Done():
+			// The registry is closing
+			return
+		case task, ok := <-t.queue:
+			if !ok {
+				return
+			}
+			t.reportDepth(atomic.AddInt64(&t.depth, -1))
+			t.runTask(task)
+		}
+	}
+}
+
+func (t *TaskPool) runTask(task *poolTask) {
+	wait := time.Now().Sub(task.enqueued)
+	_ = t.sink.Timing(TaskPoolWaitTimeMetric, wait, t.tags, 1)
+
+	var crashWith interface{}
+	err := func() (err error) {
+		// Don't let a panicking task kill the worker, unless the crash policy
+		// is set globally (see SetPanicPolicy)
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("task panicked: %v", p)
+				if ResolvePanicPolicy(PanicPolicyDefault, PanicContain) == PanicCrash {
+					crashWith = p
+				}
+			}
+		}()
+		return RunInstrumented(task.ctx, task.name, func(ctx context.Context) error {
+			GetMetricsFromContext(ctx).AddDuration(TaskPoolWaitTimeMetric, wait)
+			return task.fn(ctx)
+		})
+	}()
+
+	if err != nil {
+		CL(task.ctx).Error("Pooled task failed", zap.String("pool", t.name),
+			zap.String("task", task.name), zap.Error(err))
+		_ = t.sink.Count(TaskPoolErrorMetric, 1, t.tags, 1)
+	} else {
+		_ = t.sink.Count(TaskPoolSuccessMetric, 1, t.tags, 1)
+	}
+	if crashWith != nil {
+		CrashProcess(crashWith)
+	}
+}
+
+// Stop accepting the new tasks, and wait for the workers to finish. The queued
+// tasks are either run or abandoned, depending on SetDrainOnClose.
+func (t *TaskPool) Close() {
+	t.mtx.Lock()
+	if t.closed {
+		t.mtx.Unlock()
+		return
+	}
+	t.closed = true
+	drain := t.drainOnClose
+	close(t.queue)
+	t.mtx.Unlock()
+
+	if !drain {
+		close(t.stop)
+	}
+	for _, w := range t.workers {
+		w.Wait()
+	}
+
+	abandoned := 0
+	for range t.queue {
+		abandoned++
+	}
+	if abandoned != 0 {
+		atomic.AddInt64(&t.depth, -int64(abandoned))
+		_ = t.sink.Count(TaskPoolAbandonedMetric, int64(abandoned), t.tags, 1)
+		t.logger.Warn("Abandoned the queued tasks",
+			zap.String("pool", t.name), zap.Int("count", abandoned))
+	}
+}
+
+// Create a context that is not cancelled along with ctx, but keeps its logger,
+// statsd client, client type, tenant and the current span (so that the work done with
+// the new context is linked to the original trace).
+func DetachContext(ctx context.Context) context.Context {
+	res := ImbueContext(context.Background(), CL(ctx))
+	res = ContextWithStatsd(res, GetStatsdFromContext(ctx))
+	res = ContextWithClientType(res, GetClientTypeFromContext(ctx))
+	if tenant := TenantFromContext(ctx); tenant != "" {
+		res = ContextWithTenant(res, tenant)
+	}
+	if span, ok := tracer.SpanFromContext(ctx); ok {
+		res = tracer.ContextWithSpan(res, span)
+	}
+	return res
+}
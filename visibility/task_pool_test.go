@@ -0,0 +1,145 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTaskPool(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	reg := NewProcessRegistry(ctx)
+	defer reg.Close()
+
+	pool := NewTaskPool(reg, "pool", 1, 2)
+	assert.True(t, reg.HasProcess("pool-worker-0"))
+
+	// The submitting request is finished and its context is cancelled
+	span, reqCtx := tracer.StartSpanFromContext(ctx, "request")
+	reqCtx, cancel := context.WithCancel(reqCtx)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	var ran int64
+	err := pool.Submit(reqCtx, "blocker", func(ctx context.Context) error {
+		started <- true
+		<-release
+		// The detached context is not cancelled
+		assert.NoError(t, ctx.Err())
+		atomic.AddInt64(&ran, 1)
+		return nil
+	})
+	assert.NoError(t, err)
+	<-started
+	cancel()
+	span.Finish()
+
+	counter := func(ctx context.Context) error {
+		atomic.AddInt64(&ran, 1)
+		return nil
+	}
+	assert.NoError(t, pool.Submit(reqCtx, "task", counter))
+	assert.NoError(t, pool.Submit(reqCtx, "task", counter))
+	// The queue is full, the submission doesn't block
+	assert.Equal(t, ErrTaskPoolFull, pool.Submit(reqCtx, "task", counter))
+
+	close(release)
+	pool.Close()
+	assert.Equal(t, int64(3), atomic.LoadInt64(&ran))
+	assert.Equal(t, ErrTaskPoolClosed, pool.Submit(reqCtx, "task", counter))
+	assert.False(t, reg.HasProcess("pool-worker-0"))
+
+	// The tasks are linked to the request's trace
+	var tasks int
+	for _, s := range mt.FinishedSpans() {
+		if s.OperationName() == "task" {
+			tasks++
+			assert.Equal(t, span.Context().TraceID(), s.TraceID())
+			assert.Equal(t, span.Context().SpanID(), s.ParentID())
+		}
+	}
+	assert.Equal(t, 2, tasks)
+}
+
+func TestTaskPoolAbandon(t *testing.T) {
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	reg := NewProcessRegistry(ctx)
+	defer reg.Close()
+
+	pool := NewTaskPool(reg, "pool", 1, 5)
+	pool.SetDrainOnClose(false)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	var ran int64
+	assert.NoError(t, pool.Submit(ctx, "blocker", func(ctx context.Context) error {
+		started <- true
+		<-release
+		return nil
+	}))
+	<-started
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, pool.Submit(ctx, "task", func(ctx context.Context) error {
+			atomic.AddInt64(&ran, 1)
+			return nil
+		}))
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	pool.Close()
+
+	// The queued tasks were abandoned
+	assert.Equal(t, int64(0), atomic.LoadInt64(&ran))
+}
+
+func TestTaskPoolPanic(t *testing.T) {
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	reg := NewProcessRegistry(ctx)
+	defer reg.Close()
+
+	pool := NewTaskPool(reg, "pool", 2, 5)
+	var ran int64
+	assert.NoError(t, pool.Submit(ctx, "panicky", func(ctx context.Context) error {
+		panic("oops")
+	}))
+	assert.NoError(t, pool.Submit(ctx, "task", func(ctx context.Context) error {
+		atomic.AddInt64(&ran, 1)
+		return nil
+	}))
+	pool.Close()
+	assert.Equal(t, int64(1), atomic.LoadInt64(&ran))
+}
+
+func TestTaskPoolPanicCrash(t *testing.T) {
+	SetPanicPolicy(PanicCrash)
+	defer SetPanicPolicy(PanicPolicyDefault)
+	crashed := make(chan interface{}, 1)
+	oldCrash := CrashProcess
+	CrashProcess = func(p interface{}) {
+		crashed <- p
+	}
+	defer func() { CrashProcess = oldCrash }()
+
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	reg := NewProcessRegistry(ctx)
+	defer reg.Close()
+
+	pool := NewTaskPool(reg, "pool", 1, 5)
+	assert.NoError(t, pool.Submit(ctx, "panicky", func(ctx context.Context) error {
+		panic("oops")
+	}))
+	pool.Close()
+	assert.Equal(t, "oops", <-crashed)
+}
@@ -0,0 +1,96 @@
+package visibility
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// The log field, the span tag and the metric tag with the tenant
+const TenantTag = "tenant"
+
+// Extract the tenant of the inbound request, the empty string if it has none.
+// It's set up in the middlewares (see TracingAndMetricsOptions.TenantResolver
+// and TracedGorilla.SetTenantResolver), the tenant is then put into the
+// context, the request's log fields, the span tags and the statsd tags of the
+// metrics.
+type TenantResolver func(r *http.Request) string
+
+type tenantKey struct{}
+
+var tenantKeyVal = &tenantKey{}
+
+// The metrics contexts created with the context are tagged with the tenant
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKeyVal, tenant)
+}
+
+// Get the tenant of the request, or an empty string
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKeyVal).(string)
+	return tenant
+}
+
+// Get the tenant from the request header
+func TenantFromHeader(header string) TenantResolver {
+	return func(r *http.Request) string {
+		return r.Header.Get(header)
+	}
+}
+
+// Get the tenant from the path segment with the index, e.g. 1 for
+// "/tenants/abc/items" yields "abc"
+func TenantFromPathSegment(idx int) TenantResolver {
+	return func(r *http.Request) string {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if idx < 0 || idx >= len(segments) {
+			return ""
+		}
+		return segments[idx]
+	}
+}
+
+// Get the tenant from the string claim of the bearer JWT. The token's
+// signature is NOT verified, so this must be used only for the observability,
+// and the authentication must be done separately.
+func TenantFromJWTClaim(claim string) TenantResolver {
+	return func(r *http.Request) string {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			return ""
+		}
+		parts := strings.Split(auth[7:], ".")
+		if len(parts) != 3 {
+			return ""
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return ""
+		}
+		var claims map[string]interface{}
+		if err = json.Unmarshal(payload, &claims); err != nil {
+			return ""
+		}
+		tenant, _ := claims[claim].(string)
+		return tenant
+	}
+}
+
+// Get the guard for the metric tags, the tenant tag is always guarded
+func getTagGuard(tenant string) *CardinalityGuard {
+	guard := getCardinalityGuard()
+	if guard == nil && tenant != "" {
+		return defaultTagGuard
+	}
+	return guard
+}
+
+// Append the tenant tag if the tenant is set
+func appendTenantTag(tags []string, tenant string) []string {
+	if tenant == "" {
+		return tags
+	}
+	return append(tags, TenantTag+":"+tenant)
+}
@@ -0,0 +1,53 @@
+package visibility
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestTenantResolvers(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/tenants/abc/items", nil)
+	req.Header.Set("X-Tenant", "hdr")
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"tid":"jwt","n":1}`))
+	req.Header.Set("Authorization", "Bearer e30."+payload+".sig")
+
+	assert.Equal(t, "hdr", TenantFromHeader("X-Tenant")(req))
+	assert.Equal(t, "abc", TenantFromPathSegment(1)(req))
+	assert.Equal(t, "", TenantFromPathSegment(5)(req))
+	assert.Equal(t, "jwt", TenantFromJWTClaim("tid")(req))
+	assert.Equal(t, "", TenantFromJWTClaim("n")(req))
+
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+	assert.Equal(t, "", TenantFromJWTClaim("tid")(req))
+}
+
+func TestTenantMetrics(t *testing.T) {
+	ctx := ContextWithTenant(ImbueContext(context.Background(), zap.NewNop()), "acme")
+	assert.Equal(t, "acme", TenantFromContext(ctx))
+	assert.Equal(t, "", TenantFromContext(context.Background()))
+	assert.Equal(t, "acme", TenantFromContext(DetachContext(ctx)))
+
+	mctx := GetMetricsFromContext(MakeMetricContext(ctx, "TenantOp"))
+	mctx.AddCount("Items", 1)
+	sink := NewRecordingSink()
+	mctx.CopyToStatsd(sink, "normal")
+	assert.Equal(t, []string{"unit:count", "client-type:normal", "tenant:acme"},
+		sink.Tags["TenantOp.Items"])
+
+	// The tenant values over the limit are replaced
+	SetCardinalityGuard(NewCardinalityGuard(2, nil))
+	defer SetCardinalityGuard(nil)
+	for i := 0; i < 3; i++ {
+		mctx = GetMetricsFromContext(MakeMetricContext(context.Background(), "TenantOp"))
+		mctx.SetTenant("tenant" + strconv.Itoa(i))
+		mctx.AddCount("Items", 1)
+		sink.Clear()
+		mctx.CopyToStatsd(sink, "normal")
+	}
+	assert.Equal(t, "tenant:"+OverflowTagValue, sink.Tags["TenantOp.Items"][2])
+}
@@ -0,0 +1,36 @@
+package visibility
+
+import (
+	"context"
+	"time"
+)
+
+const TimeoutTag = "timeout"
+const TimeoutMetric = "Timeout"
+
+// Derive the context with the timeout, like context.WithTimeout. If the timeout
+// (and not the parent's deadline or cancellation) expires the context, the
+// context's span is tagged with "timeout":true and the Timeout count is added
+// to the context's metrics. The cancel function waits for the tagging, so
+// defer it before finishing the span to keep the tag.
+func WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parent, d)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		if ctx.Err() != context.DeadlineExceeded || parent.Err() != nil {
+			return
+		}
+		SpanFromContextOrNoop(ctx).SetTag(TimeoutTag, true)
+		if met := TryGetMetricsFromContext(ctx); met != nil {
+			met.AddCount(TimeoutMetric, 1)
+		}
+	}()
+
+	return ctx, func() {
+		cancel()
+		<-done
+	}
+}
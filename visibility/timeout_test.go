@@ -0,0 +1,41 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"testing"
+	"time"
+)
+
+func TestWithTimeout(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "test")
+	ctx = MakeMetricContext(ctx, "Test")
+
+	// The expired timeout is tagged
+	tctx, cancel := WithTimeout(ctx, time.Millisecond)
+	<-tctx.Done()
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, tctx.Err())
+	span.Finish()
+	assert.Equal(t, true, mt.FinishedSpans()[0].Tag(TimeoutTag))
+	assert.Equal(t, 1.0, GetMetricsFromContext(ctx).GetMetricVal(TimeoutMetric))
+
+	// The cancellation isn't a timeout
+	tctx, cancel = WithTimeout(ctx, time.Hour)
+	cancel()
+	assert.Equal(t, context.Canceled, tctx.Err())
+	assert.Equal(t, 1.0, GetMetricsFromContext(ctx).GetMetricVal(TimeoutMetric))
+
+	// Neither is the parent's deadline
+	parent, parentCancel := context.WithTimeout(ctx, time.Millisecond)
+	defer parentCancel()
+	tctx, cancel = WithTimeout(parent, time.Hour)
+	<-tctx.Done()
+	cancel()
+	assert.Equal(t, 1.0, GetMetricsFromContext(ctx).GetMetricVal(TimeoutMetric))
+}
@@ -0,0 +1,56 @@
+package visibility
+
+import (
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net/http"
+	"strings"
+)
+
+// The span tag recording whether the request continued the caller's trace
+const TraceContinuedTag = "trace.continued"
+
+// The predicate matching the requests from the untrusted clients (e.g. coming
+// through the public load balancer). Their trace headers are ignored, so they
+// can't inject the spans into our traces.
+type UntrustedRequestPredicate func(r *http.Request) bool
+
+// The trace context headers of the Datadog, B3 and W3C propagation, and the
+// OpenTracing baggage
+var traceHeaderPrefixes = []string{"x-datadog-", "x-b3-", "ot-baggage-"}
+var traceHeaders = []string{"b3", "traceparent", "tracestate"}
+
+// Get the span options that continue the trace of the inbound request, unless
+// the request is untrusted. A fresh trace is started for the untrusted requests
+// and for the requests without the trace headers. The trace headers of the
+// untrusted requests are removed, so that the handlers (and the outbound calls
+// that copy the headers) don't propagate them either.
+func InboundTraceOptions(r *http.Request,
+	untrusted UntrustedRequestPredicate) []tracer.StartSpanOption {
+
+	if untrusted == nil || !untrusted(r) {
+		spanctx, err := tracer.Extract(tracer.HTTPHeadersCarrier(r.Header))
+		if err == nil {
+			return []tracer.StartSpanOption{tracer.ChildOf(spanctx),
+				tracer.Tag(TraceContinuedTag, true)}
+		}
+	} else {
+		stripTraceHeaders(r.Header)
+	}
+	return []tracer.StartSpanOption{tracer.Tag(TraceContinuedTag, false)}
+}
+
+func stripTraceHeaders(header http.Header) {
+	for name := range header {
+		lower := strings.ToLower(name)
+		for _, h := range traceHeaders {
+			if lower == h {
+				delete(header, name)
+			}
+		}
+		for _, prefix := range traceHeaderPrefixes {
+			if strings.HasPrefix(lower, prefix) {
+				delete(header, name)
+			}
+		}
+	}
+}
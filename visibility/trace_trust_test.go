@@ -0,0 +1,78 @@
+package visibility
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func makeTracedRequest(t *testing.T, parent tracer.Span) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/twirp/twirp.test.Example/MakeHat", nil)
+	err := tracer.Inject(parent.Context(), tracer.HTTPHeadersCarrier(req.Header))
+	assert.NoError(t, err)
+	return req
+}
+
+func TestInboundTraceOptions(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	parent, _ := tracer.StartSpanFromContext(context.Background(), "caller")
+	req := makeTracedRequest(t, parent)
+	fromPublicLb := func(r *http.Request) bool {
+		return r.Header.Get("X-Public") != ""
+	}
+
+	// Internal traffic continues the trace
+	span := tracer.StartSpan("request", InboundTraceOptions(req, fromPublicLb)...)
+	span.Finish()
+	assert.Equal(t, parent.Context().TraceID(), span.Context().TraceID())
+
+	// Untrusted requests start a fresh trace
+	req.Header.Set("X-Public", "true")
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	span = tracer.StartSpan("request", InboundTraceOptions(req, fromPublicLb)...)
+	span.Finish()
+	assert.NotEqual(t, parent.Context().TraceID(), span.Context().TraceID())
+
+	// And their trace headers are removed
+	assert.Equal(t, http.Header{"X-Public": {"true"}}, req.Header)
+
+	// No trace headers at all
+	span = tracer.StartSpan("request", InboundTraceOptions(
+		httptest.NewRequest(http.MethodGet, "/", nil), nil)...)
+	span.Finish()
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, true, spans[0].Tag(TraceContinuedTag))
+	assert.Equal(t, false, spans[1].Tag(TraceContinuedTag))
+	assert.Equal(t, false, spans[2].Tag(TraceContinuedTag))
+}
+
+func TestGorillaUntrustedRequests(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	gorilla := NewTracedGorilla(&panickyTwirpServer{succeed: true}, zap.NewNop(),
+		NewRecordingSink(), nil, nil)
+	gorilla.SetUntrustedRequestPredicate(func(r *http.Request) bool {
+		return true
+	})
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	parent, _ := tracer.StartSpanFromContext(context.Background(), "caller")
+	muxer.ServeHTTP(httptest.NewRecorder(), makeTracedRequest(t, parent))
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.NotEqual(t, parent.Context().TraceID(), spans[0].TraceID())
+	assert.Equal(t, false, spans[0].Tag(TraceContinuedTag))
+}
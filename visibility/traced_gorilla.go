@@ -6,6 +6,7 @@ import (
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 	"net/http"
@@ -15,8 +16,6 @@ import (
 	"time"
 )
 
-const RequestHeaderKey = 11
-
 type GenericTwirpServer interface {
 	http.Handler
 	ServiceDescriptor() ([]byte, int)
@@ -26,8 +25,11 @@ type GenericTwirpServer interface {
 
 type responseCapturer struct {
 	http.ResponseWriter
-	statusCode int
-	bytesOut   int64
+	statusCode  int
+	bytesOut    int64
+	wroteHeader bool
+	// Set only if the response is compressed
+	uncompressedBytes int64
 }
 
 func NewResponseCodeCapturer(writer http.ResponseWriter) *responseCapturer {
@@ -36,10 +38,20 @@ func NewResponseCodeCapturer(writer http.ResponseWriter) *responseCapturer {
 
 func (lrw *responseCapturer) WriteHeader(code int) {
 	lrw.statusCode = code
+	lrw.wroteHeader = true
 	lrw.ResponseWriter.WriteHeader(code)
 }
 
+// The ratio of the uncompressed and compressed sizes, if the response was compressed
+func (lrw *responseCapturer) compressionRatio() (float64, bool) {
+	if lrw.uncompressedBytes == 0 || lrw.bytesOut == 0 {
+		return 0, false
+	}
+	return float64(lrw.uncompressedBytes) / float64(lrw.bytesOut), true
+}
+
 func (lrw *responseCapturer) Write(data []byte) (int, error) {
+	lrw.wroteHeader = true
 	res, err := lrw.ResponseWriter.Write(data)
 	if res > 0 {
 		lrw.bytesOut += int64(res)
@@ -53,6 +65,20 @@ type TracedGorilla struct {
 	sink        statsd.ClientInterface
 
 	sampleRate, errorSampleRate *float64
+	longRunningThreshold        time.Duration
+	longRunningMultiple         float64
+	versionHeader               bool
+	logBufferFactory            func() RequestLogBuffer
+	untrustedRequest            UntrustedRequestPredicate
+	compressionThreshold        int
+	panicPolicy                 PanicPolicy
+	debugMode                   bool
+	clientTypeHeader            *ClientTypeHeaderOptions
+	logFieldNames               LogFieldNames
+	headerLogging               *HeaderLogging
+	tenantResolver              TenantResolver
+	strippedErrorMeta           []string
+	maxResponseSize             int64
 }
 
 func NewTracedGorilla(twirpServer GenericTwirpServer, logger *zap.Logger, sink statsd.ClientInterface,
@@ -66,6 +92,95 @@ func NewTracedGorilla(twirpServer GenericTwirpServer, logger *zap.Logger, sink s
 		errorSampleRate: errorSampleRate}
 }
 
+// Report the requests that are still running after the threshold, zero disables
+// the watchdog
+func (t *TracedGorilla) SetLongRunningThreshold(threshold time.Duration) {
+	t.longRunningThreshold = threshold
+}
+
+// Also report the requests that are still running after the multiple of their
+// operation's SLO target (see SetSLORegistry and SetExpectedDuration), zero
+// disables it
+func (t *TracedGorilla) SetLongRunningMultiple(multiple float64) {
+	t.longRunningMultiple = multiple
+}
+
+// Return the service version in the VersionHeader response header
+func (t *TracedGorilla) SetVersionHeader(enabled bool) {
+	t.versionHeader = enabled
+}
+
+// Buffer the Debug and Info logs of each request, and write them out only if
+// the request fails with a 5xx status or a panic. Nil disables the buffering.
+func (t *TracedGorilla) SetRequestLogBuffer(factory func() RequestLogBuffer) {
+	t.logBufferFactory = factory
+}
+
+// Ignore the trace headers of the requests matching the predicate, starting
+// fresh traces for them instead. Nil trusts all the requests.
+func (t *TracedGorilla) SetUntrustedRequestPredicate(untrusted UntrustedRequestPredicate) {
+	t.untrustedRequest = untrusted
+}
+
+// Gzip the responses of at least the threshold size (see
+// DefaultCompressionThreshold) for the clients that accept it, zero disables
+// the compression. The bytes_out is the compressed size.
+func (t *TracedGorilla) SetResponseCompression(threshold int) {
+	t.compressionThreshold = threshold
+}
+
+// Override the panic policy of the requests. By default the panics are
+// converted into 500 responses, PanicCrash terminates the process once the
+// panic is logged and the span is finished.
+func (t *TracedGorilla) SetPanicPolicy(policy PanicPolicy) {
+	t.panicPolicy = policy
+}
+
+// Read the client type from the request header if it's not in the span
+// baggage (see ClientTypeFromRequest), nil disables the header
+func (t *TracedGorilla) SetClientTypeHeader(opts *ClientTypeHeaderOptions) {
+	t.clientTypeHeader = opts
+}
+
+// Resolve the tenant of the requests, it's added to their contexts (see
+// TenantFromContext), log fields, spans and metrics. Nil disables the tenants.
+func (t *TracedGorilla) SetTenantResolver(resolver TenantResolver) {
+	t.tenantResolver = resolver
+}
+
+// Attach the metrics of the failed requests to their log lines
+func (t *TracedGorilla) SetDebugMode(enabled bool) {
+	t.debugMode = enabled
+}
+
+// Rename the access log fields (e.g. to ECSLogFieldNames), nil keeps the
+// default keys
+func (t *TracedGorilla) SetLogFieldNames(names LogFieldNames) {
+	t.logFieldNames = names
+}
+
+// Log the request and response headers, with the sensitive ones redacted. Nil
+// disables the header logging.
+func (t *TracedGorilla) SetHeaderLogging(logging *HeaderLogging) {
+	t.headerLogging = logging
+}
+
+// Remove the meta keys (e.g. StackTraceKey) from the twirp error responses,
+// so that the internal details don't leak to the external callers. The stacks
+// are still set on the spans and logged by the hooks (see MakeTraceHooks). No
+// keys disable the stripping.
+func (t *TracedGorilla) SetStrippedErrorMeta(keys ...string) {
+	t.strippedErrorMeta = keys
+}
+
+// Stop the responses that are larger than the limit (before the compression),
+// zero disables the limit. The uncommitted responses are replaced with the 500
+// error, the committed ones can only be cut short. Both are logged and counted
+// in ResponseTooLargeMetric.
+func (t *TracedGorilla) SetMaxResponseSize(maxBytes int64) {
+	t.maxResponseSize = maxBytes
+}
+
 func (t *TracedGorilla) AttachGorillaToMuxer(router *mux.Router) {
 	router.Use(t.handleRequest)
 	router.PathPrefix(t.twirpServer.PathPrefix()).Methods("POST").
@@ -80,36 +195,44 @@ func (t *TracedGorilla) handleRequest(next http.Handler) http.Handler {
 			return
 		}
 
+		// Name the resource by the route template rather than the raw path,
+		// to keep the cardinality of the spans bounded
+		template := RouteTemplate(r)
 		opts := []tracer.StartSpanOption{
 			tracer.SpanType(ext.SpanTypeWeb),
 			tracer.Tag(ext.HTTPMethod, r.Method),
 			tracer.Tag(ext.HTTPURL, r.URL.Path),
+			tracer.ResourceName(r.Method + " " + template),
 		}
 		if t.sampleRate != nil {
 			opts = append(opts, tracer.Tag(ext.EventSampleRate, *t.sampleRate))
 		}
-		if spanctx, err := tracer.Extract(tracer.HTTPHeadersCarrier(r.Header)); err == nil {
-			opts = append(opts, tracer.ChildOf(spanctx))
-		}
+		opts = append(opts, InboundTraceOptions(r, t.untrustedRequest)...)
 
 		// We start with an 'unknown' method, it will be overridden in traced_twirp.go
 		// once the method name is known.
-		span, ctx := tracer.StartSpanFromContext(r.Context(),
-			"twirp.unknown", opts...)
-		defer span.Finish()
+		span, ctx := tracer.StartSpanFromContext(
+			ContextWithRequestStart(r.Context(), time.Now()), "twirp.unknown", opts...)
+		var panicErr error
+		var crashWith interface{}
+		defer func() {
+			if panicErr != nil {
+				span.Finish(tracer.WithError(panicErr), tracer.NoDebugStack())
+			} else {
+				span.Finish()
+			}
+			if crashWith != nil {
+				CrashProcess(crashWith)
+			}
+		}()
 
-		// Get the client type from the baggage
-		clientType := ClientTypeFromSpan(span)
+		// Get the client type from the baggage (or the header)
+		clientType := ClientTypeFromRequest(span, r, t.clientTypeHeader)
 
 		// Copy the 'baggage' from other tracers
-		reqId := r.Header.Get("Request-Id")
-		if reqId == "" {
-			reqId = r.Header.Get("X-Request-Id")
-		}
-		if reqId != "" {
-			span.SetBaggageItem("request-id", reqId)
-			span.SetTag("request-id", reqId)
-		}
+		reqId := InboundRequestId(r, span)
+		span.SetBaggageItem(RequestIdBaggage, reqId)
+		span.SetTag(RequestIdBaggage, reqId)
 
 		// Contextualize the logger
 		traceId := fmt.Sprintf("%d", span.Context().TraceID())
@@ -120,9 +243,18 @@ func (t *TracedGorilla) handleRequest(next http.Handler) http.Handler {
 			w.Header().Add(tracer.DefaultTraceIDHeader, traceId)
 			w.Header().Add(tracer.DefaultParentIDHeader, spanId)
 		}
+		if t.versionHeader {
+			if version := GetBuildInfo().Version; version != "" {
+				w.Header().Set(VersionHeader, version)
+			}
+		}
 
 		ctx = ContextWithStatsd(ctx, t.sink)
 		ctx = ContextWithClientType(ctx, clientType)
+		var tenant string
+		if t.tenantResolver != nil {
+			tenant = t.tenantResolver(r)
+		}
 
 		// Set the pprof labels for the thread
 		ctx = pprof.WithLabels(ctx,
@@ -135,16 +267,58 @@ func (t *TracedGorilla) handleRequest(next http.Handler) http.Handler {
 			zap.String("dd.span_id", spanId),
 			zap.String("log.trace_id", traceId),
 			zap.String("log.span_id", spanId),
+			zap.String("request_id", reqId),
 		}
-		if reqId != "" {
-			fields = append(fields, zap.String("request_id", reqId))
+		if tenant != "" {
+			ctx = ContextWithTenant(ctx, tenant)
+			span.SetTag(TenantTag, tenant)
+			fields = append(fields, zap.String(TenantTag, tenant))
 		}
 		logger := t.logger.Named("HTTP").With(fields...)
-		ctx = ImbueContext(ctx, logger) // Add the logger
+		reqLogger := logger
+		var logBuffer RequestLogBuffer
+		if t.logBufferFactory != nil {
+			logBuffer = t.logBufferFactory()
+			reqLogger = logBuffer.Wrap(logger)
+		}
+		finishLogBuffer := func(failed bool) {
+			if logBuffer != nil {
+				logBuffer.Finish(failed)
+			}
+		}
+		ctx = ImbueContext(ctx, reqLogger) // Add the logger
+
+		// Watch for the stuck requests
+		ctx, stopWatchdog := StartWatchdogWithMultiple(ctx, span,
+			t.longRunningThreshold, t.longRunningMultiple, traceId)
+		defer stopWatchdog()
 		// Also set up the headers
-		ctx = context.WithValue(ctx, RequestHeaderKey, r.Header)
+		ctx = ContextWithHttpRequestHeader(ctx, r.Header)
+		// The twirp hook fills in the operation name once it's known
+		routedOp := &routedOperation{}
+		ctx = context.WithValue(ctx, routedOperationKeyVal, routedOp)
 		r = r.WithContext(ctx)
 		capt := NewResponseCodeCapturer(w)
+		var writer http.ResponseWriter = capt
+		var compressor *CompressingWriter
+		if t.compressionThreshold > 0 && AcceptsGzip(r) {
+			compressor = NewCompressingWriter(capt, t.compressionThreshold)
+			writer = compressor
+		}
+		var stripper *metaStrippingWriter
+		if len(t.strippedErrorMeta) > 0 {
+			stripper = newMetaStrippingWriter(writer, t.strippedErrorMeta)
+			writer = stripper
+			for _, key := range t.strippedErrorMeta {
+				routedOp.stackStripped = routedOp.stackStripped || key == StackTraceKey
+			}
+		}
+		var capper *SizeCappedWriter
+		if t.maxResponseSize > 0 {
+			capper = NewSizeCappedWriter(writer, t.maxResponseSize)
+			writer = capper
+			routedOp.capper = capper
+		}
 
 		logger.Info("Starting request")
 		start := time.Now()
@@ -155,35 +329,88 @@ func (t *TracedGorilla) handleRequest(next http.Handler) http.Handler {
 				return
 			}
 
-			// Sample errors at a higher rate
-			if t.errorSampleRate != nil && capt.statusCode >= http.StatusBadRequest {
+			// Sample faults at a higher rate
+			if t.errorSampleRate != nil {
 				span.SetTag(ext.EventSampleRate, *t.errorSampleRate)
 			}
 
-			// We can't do much with the panic at this point, just make
-			// sure panic is logged and we've returned the 500 error.
-			stack := NewShortenedStackTrace(3, true,
-				fmt.Sprintf("%v", p))
-			var fields []zap.Field
+			finishLogBuffer(true)
 
-			// Log the stack trace
-			fields = append(fields, zap.String("stacktrace", stack.StringStack()))
-			fields = append(fields, zap.String("panic", fmt.Sprintf("%v", p)))
-			fields = append(fields, t.prepareCommonLogFields(capt, r, time.Now().Sub(start))...)
-			logger.Info("Request failed", fields...)
+			stack := NewShortenedStackTrace(3, true, p)
+			panicErr = fmt.Errorf("%v", p)
+			TagSpanWithPanic(span, p, stack)
 
-			// Re-panic if the error has not been committed
-			if capt.statusCode < 400 {
-				panic(p)
+			// Make sure that we've returned the 500 error
+			if !capt.wroteHeader {
+				http.Error(capt, http.StatusText(http.StatusInternalServerError),
+					http.StatusInternalServerError)
 			}
 			span.SetTag(ext.HTTPCode, capt.statusCode)
+
+			opName := routedOp.name
+			if opName == "" {
+				opName = "unknown"
+			}
+			_ = t.sink.Count(opName+".Fault", 1,
+				[]string{"unit:count", ClientTypeTag + ":" + clientType}, 1)
+			EmitPanicEvent(t.sink, opName, fmt.Sprintf("%v", p), stack)
+
+			fields := []zap.Field{
+				zap.String("panic", fmt.Sprintf("%v", p)),
+				stack.Field(),
+			}
+			fields = append(fields,
+				t.prepareCommonLogFields(capt, r, time.Now().Sub(start))...)
+			if t.debugMode && routedOp.metrics != nil {
+				fields = append(fields, zap.Object("metrics", routedOp.metrics))
+			}
+			logger.Error("Request fault", fields...)
+
+			if ResolvePanicPolicy(t.panicPolicy, PanicContain) == PanicCrash {
+				// Crash once the span is finished
+				crashWith = p
+				return
+			}
+
+			// A successful response has already been started, so abort it
+			// to let the client know that it's broken. ErrAbortHandler is not
+			// logged by the http.Server.
+			if capt.statusCode < http.StatusBadRequest {
+				panic(http.ErrAbortHandler)
+			}
 		}()
 
 		// Run the next handler
-		next.ServeHTTP(capt, r)
+		next.ServeHTTP(writer, r)
+		if capper != nil {
+			capper.Finish()
+		}
+		if stripper != nil {
+			if err := stripper.Close(); err != nil {
+				logger.Warn("Failed to send the error response", zap.Error(err))
+			}
+		}
+		if compressor != nil {
+			if err := compressor.Close(); err != nil {
+				logger.Warn("Failed to finish the compressed response", zap.Error(err))
+			}
+			if _, compressed := compressor.CompressionRatio(); compressed {
+				capt.uncompressedBytes = compressor.BytesIn()
+			}
+		}
+		if capper != nil && capper.TooLarge() {
+			t.reportTooLarge(span, logger, routedOp, clientType, capper.Rejected())
+		}
+		finishLogBuffer(capt.statusCode >= http.StatusInternalServerError)
 
-		logger.Info("Request finished",
-			t.prepareCommonLogFields(capt, r, time.Now().Sub(start))...)
+		duration := time.Now().Sub(start)
+		logFields := t.prepareCommonLogFields(capt, r, duration)
+		if t.debugMode && routedOp.metrics != nil &&
+			capt.statusCode >= http.StatusBadRequest {
+			logFields = append(logFields, zap.Object("metrics", routedOp.metrics))
+		}
+		logger.Info("Request finished", logFields...)
+		t.emitRequestMetrics(routedOp.name, clientType, tenant, capt, r, duration)
 
 		span.SetTag(ext.HTTPCode, capt.statusCode)
 
@@ -194,27 +421,113 @@ func (t *TracedGorilla) handleRequest(next http.Handler) http.Handler {
 	})
 }
 
-func GetHttpRequestHeader(ctx context.Context) (http.Header, bool) {
-	val, ok := ctx.Value(RequestHeaderKey).(http.Header)
-	return val, ok
+func (t *TracedGorilla) reportTooLarge(span ddtrace.Span, logger *zap.Logger,
+	routedOp *routedOperation, clientType string, rejected bool) {
+
+	span.SetTag(ext.Error, ErrResponseTooLarge)
+	logger.Warn("Response too large", zap.Int64("limit", t.maxResponseSize),
+		zap.Bool("rejected", rejected))
+
+	if routedOp.tooLargeRecorded {
+		// Already in the request's metrics (see MakeTraceHooks)
+		return
+	}
+	opName := routedOp.name
+	if opName == "" {
+		opName = "unknown"
+	}
+	_ = t.sink.Distribution(opName+"."+ResponseTooLargeMetric, 1,
+		[]string{"unit:count", ClientTypeTag + ":" + clientType}, 1)
 }
 
+// The span resource of the requests that didn't match any mux route
+const UnmatchedRouteTemplate = "unmatched"
+
+// Get the path template of the mux route matched by the request (e.g.
+// "/api/run/{res}"), or UnmatchedRouteTemplate. Unlike the raw path, the
+// templates are safe to use in the span and metric names.
+func RouteTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return UnmatchedRouteTemplate
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return UnmatchedRouteTemplate
+	}
+	return template
+}
+
+// The operation name (service.method) of the request, set by the twirp hooks
+type routedOperation struct {
+	name    string
+	metrics *MetricsContext
+	// The error stacks are stripped from the responses
+	stackStripped bool
+	// The size limit of the response (see SetMaxResponseSize), the hooks
+	// record its breach in the metrics
+	capper           *SizeCappedWriter
+	tooLargeRecorded bool
+}
+
+const (
+	BytesInMetric     = "BytesIn"
+	BytesOutMetric    = "BytesOut"
+	RequestTimeMetric = "RequestTime"
+)
+
+// Send the HTTP-level facts of the request into the namespace of its twirp
+// method (e.g. "Haberdasher.MakeHat.BytesOut"). The method's MetricsContext
+// is already sent out by the ResponseSent hook at this point, so the metrics
+// are sent directly.
+func (t *TracedGorilla) emitRequestMetrics(opName string, clientType string,
+	tenant string, res *responseCapturer, req *http.Request, duration time.Duration) {
+
+	if opName == "" {
+		// The request was not routed to a twirp method
+		return
+	}
+
+	guard := getTagGuard(tenant)
+	send := func(name string, val float64, unit string) {
+		tags := appendTenantTag([]string{"unit:" + unit, ClientTypeTag + ":" + clientType}, tenant)
+		if guard != nil {
+			tags = guard.Filter(opName+"."+name, tags)
+		}
+		_ = t.sink.Distribution(opName+"."+name, val, tags, 1)
+	}
+	send(BytesInMetric, float64(requestBytesIn(req)), "bytes")
+	send(BytesOutMetric, float64(res.bytesOut), "bytes")
+	send(RequestTimeMetric, float64(duration.Microseconds()), "microseconds")
+	if ratio, ok := res.compressionRatio(); ok {
+		send(CompressionRatioMetric, ratio, "none")
+	}
+}
+
+func requestBytesIn(req *http.Request) int64 {
+	bytesIn, err := strconv.ParseInt(req.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return bytesIn
+}
+
+type routedOperationKey struct{}
+
+var routedOperationKeyVal = &routedOperationKey{}
+
 func (t *TracedGorilla) prepareCommonLogFields(res *responseCapturer, req *http.Request,
 	reqDuration time.Duration) []zap.Field {
 
 	// Now log whatever happened
-	bytesIn, err := strconv.ParseInt(req.Header.Get("Content-Length"),
-		10, 64)
-	if err != nil {
-		bytesIn = 0
-	}
+	bytesIn := requestBytesIn(req)
 	p := req.URL.Path
 	if p == "" {
 		p = "/"
 	}
 
 	host := req.Host
-	return []zap.Field{
+	fields := []zap.Field{
 		zap.String("path", p),
 		//zap.String("remote_ip", req.RealIP()), //TODO
 		zap.String("host", host),
@@ -228,4 +541,9 @@ func (t *TracedGorilla) prepareCommonLogFields(res *responseCapturer, req *http.
 		zap.Int64("bytes_in", bytesIn),
 		zap.Int64("bytes_out", res.bytesOut),
 	}
+	if ratio, ok := res.compressionRatio(); ok {
+		fields = append(fields, zap.Float64("compression_ratio", ratio))
+	}
+	fields = append(fields, t.headerLogging.Fields(req.Header, res.Header())...)
+	return t.logFieldNames.Apply(fields)
 }
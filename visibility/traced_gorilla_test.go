@@ -0,0 +1,166 @@
+package visibility
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/twitchtv/twirp/ctxsetters"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The fake twirp server that gets routed and then panics
+type panickyTwirpServer struct {
+	commitOk bool
+	succeed  bool
+}
+
+func (p *panickyTwirpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := ctxsetters.WithPackageName(r.Context(), "twirp.test")
+	ctx = ctxsetters.WithServiceName(ctx, "Example")
+	ctx = ctxsetters.WithMethodName(ctx, "MakeHat")
+	_, _ = MakeTraceHooks("test").RequestRouted(ctx)
+
+	if p.succeed {
+		_, _ = w.Write([]byte("hello"))
+		return
+	}
+	if p.commitOk {
+		w.WriteHeader(http.StatusOK)
+	}
+	panic("A very bad idea")
+}
+
+func (p *panickyTwirpServer) ServiceDescriptor() ([]byte, int) {
+	return nil, 0
+}
+
+func (p *panickyTwirpServer) ProtocGenTwirpVersion() string {
+	return "v5.12.1"
+}
+
+func (p *panickyTwirpServer) PathPrefix() string {
+	return "/twirp/twirp.test.Example/"
+}
+
+func TestGorillaPanic(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	rs := NewRecordingSink()
+	server := &panickyTwirpServer{}
+	gorilla := NewTracedGorilla(server, logger, rs, aws.Float64(1), aws.Float64(1))
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	rec := httptest.NewRecorder()
+	assert.NotPanics(t, func() {
+		muxer.ServeHTTP(rec, httptest.NewRequest(http.MethodPost,
+			"/twirp/twirp.test.Example/MakeHat", nil))
+	})
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	// The span is finished with the error
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "A very bad idea", spans[0].Tag(ext.Error).(error).Error())
+	assert.Equal(t, http.StatusInternalServerError, spans[0].Tag(ext.HTTPCode))
+
+	// The fault is counted under the routed operation name
+	assert.Equal(t, int64(1), rs.Counts["Example.MakeHat.Fault"])
+
+	// The panic is logged once, at the Error level
+	logs := sink.String()
+	assert.Equal(t, 1, strings.Count(logs, "A very bad idea\""))
+	assert.True(t, strings.Contains(logs,
+		"{\"level\":\"error\",\"logger\":\"HTTP\",\"msg\":\"Request fault\""))
+	assert.True(t, strings.Contains(logs, "\"stacktrace\":[{\"Fl\":"))
+	assert.False(t, strings.Contains(logs, "Request finished"))
+}
+
+func TestGorillaPanicAfterCommit(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	rs := NewRecordingSink()
+	server := &panickyTwirpServer{commitOk: true}
+	gorilla := NewTracedGorilla(server, zap.NewNop(), rs, nil, nil)
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	// The successful response can't be turned into a 500, so it's aborted
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		muxer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost,
+			"/twirp/twirp.test.Example/MakeHat", nil))
+	})
+	assert.Equal(t, 1, len(mt.FinishedSpans()))
+	assert.Equal(t, int64(1), rs.Counts["Example.MakeHat.Fault"])
+}
+
+func TestGorillaRequestMetrics(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	rs := NewRecordingSink()
+	server := &panickyTwirpServer{succeed: true}
+	gorilla := NewTracedGorilla(server, zap.NewNop(), rs, nil, nil)
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	req := httptest.NewRequest(http.MethodPost, "/twirp/twirp.test.Example/MakeHat",
+		strings.NewReader("{}"))
+	req.Header.Set("Content-Length", "2")
+	muxer.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The HTTP-level metrics are in the twirp method namespace
+	assert.Equal(t, 2.0, rs.Distributions["Example.MakeHat.BytesIn"])
+	assert.Equal(t, 5.0, rs.Distributions["Example.MakeHat.BytesOut"])
+	assert.Equal(t, []string{"unit:bytes", "client-type:normal"},
+		rs.Tags["Example.MakeHat.BytesOut"])
+	_, hasTime := rs.Distributions["Example.MakeHat.RequestTime"]
+	assert.True(t, hasTime)
+}
+
+func TestGorillaRouteTemplate(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	server := &panickyTwirpServer{succeed: true}
+	gorilla := NewTracedGorilla(server, zap.NewNop(), NewRecordingSink(), nil, nil)
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+	muxer.Path("/twirp/twirp.test.Example/run/{res}").Methods("GET").
+		HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+
+	for _, res := range []string{"ok", "other"} {
+		muxer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet,
+			"/twirp/twirp.test.Example/run/"+res, nil))
+	}
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 2, len(spans))
+	for i, res := range []string{"ok", "other"} {
+		// Only the resource is templated
+		assert.Equal(t, "/twirp/twirp.test.Example/run/"+res, spans[i].Tag(ext.HTTPURL))
+		assert.Equal(t, "GET /twirp/twirp.test.Example/run/{res}",
+			spans[i].Tag(ext.ResourceName))
+	}
+	mt.Reset()
+
+	// The twirp methods are still named by the hooks
+	muxer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost,
+		"/twirp/twirp.test.Example/MakeHat", nil))
+	spans = mt.FinishedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "Example.MakeHat", spans[0].Tag(ext.ResourceName))
+	assert.Equal(t, "/twirp/twirp.test.Example/MakeHat", spans[0].Tag(ext.HTTPURL))
+}
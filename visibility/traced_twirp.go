@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"github.com/cyberax/go-dd-service-base/utils"
 	"github.com/twitchtv/twirp"
+	"go.uber.org/zap"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net/http"
 	"runtime/pprof"
+	"strings"
 )
 
 type contextKey int
@@ -36,8 +39,7 @@ func MakeTraceHooks(serviceName string) *twirp.ServerHooks {
 }
 
 func (t *TracedTwirp) requestRoutedHook(ctx context.Context) (context.Context, error) {
-	span, ok := tracer.SpanFromContext(ctx)
-	utils.PanicIfF(!ok, "no tracing context")
+	span := SpanFromContextOrNoop(ctx)
 
 	pkg, ok := twirp.PackageName(ctx)
 	utils.PanicIfF(!ok, "no package in request")
@@ -52,9 +54,15 @@ func (t *TracedTwirp) requestRoutedHook(ctx context.Context) (context.Context, e
 	span.SetTag(ext.ResourceName, svc+"."+method)
 	span.SetOperationName(svc+"."+method)
 
+	ExpectOperation(ctx, svc+"."+method)
 	metCtx := MakeMetricContext(ctx, svc+"."+method)
+	if op, ok := ctx.Value(routedOperationKeyVal).(*routedOperation); ok {
+		op.name = svc + "." + method
+		op.metrics = GetMetricsFromContext(metCtx)
+	}
 	bench := GetMetricsFromContext(metCtx).Benchmark("Time")
 	metCtx = context.WithValue(metCtx, RequestTimingKey, bench)
+	recordSerialization(metCtx, span)
 
 	// Set the pprof labels for the thread
 	traceId := fmt.Sprintf("%d", span.Context().TraceID())
@@ -65,17 +73,75 @@ func (t *TracedTwirp) requestRoutedHook(ctx context.Context) (context.Context, e
 	return metCtx, nil
 }
 
-func (t *TracedTwirp) responseSentHook(ctx context.Context) {
-	span, ok := tracer.SpanFromContext(ctx)
+const SerializationTag = "twirp.serialization"
+const SerializationMetric = "Serialization"
+
+const (
+	SerializationJson     = "json"
+	SerializationProtobuf = "protobuf"
+)
+
+// Get the serialization ("json" or "protobuf") of the twirp request from its
+// Content-Type. The request headers are available only if the request came
+// through the TracedGorilla, false is returned otherwise.
+func GetRequestSerialization(ctx context.Context) (string, bool) {
+	header, ok := GetHttpRequestHeader(ctx)
+	if !ok {
+		return "", false
+	}
+	contentType := header.Get("Content-Type")
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	switch strings.ToLower(strings.TrimSpace(contentType)) {
+	case "application/json":
+		return SerializationJson, true
+	case "application/protobuf":
+		return SerializationProtobuf, true
+	}
+	return "", false
+}
+
+// Tag the span with the request serialization, and count the requests of each
+// serialization. Both counts are always set, so the average of the
+// "<op>.Serialization.json" distribution is the fraction of the JSON requests.
+func recordSerialization(ctx context.Context, span tracer.Span) {
+	serialization, ok := GetRequestSerialization(ctx)
 	if !ok {
 		return
 	}
+	span.SetTag(SerializationTag, serialization)
+
+	met := GetMetricsFromContext(ctx)
+	for _, s := range []string{SerializationJson, SerializationProtobuf} {
+		val := 0.0
+		if s == serialization {
+			val = 1
+		}
+		met.SetCount(SerializationMetric+"."+s, val)
+	}
+}
+
+func (t *TracedTwirp) responseSentHook(ctx context.Context) {
+	span := SpanFromContextOrNoop(ctx)
 	if sc, ok := twirp.StatusCode(ctx); ok {
 		span.SetTag(ext.HTTPCode, sc)
 	}
 
 	err, _ := ctx.Value(twirpErrorKey).(twirp.Error)
 	isPanic := err != nil && err.Msg() == "Internal service panic"
+	isCancelled := err != nil && !isPanic &&
+		(err.Code() == twirp.Canceled || IsCancellation(ctx, err))
+	// The response might be over the size limit (see SetMaxResponseSize)
+	op, _ := ctx.Value(routedOperationKeyVal).(*routedOperation)
+	tooLarge := op != nil && op.capper != nil && op.capper.TooLarge()
+	rejected := tooLarge && op.capper.Rejected()
+	if tooLarge {
+		span.SetTag(ext.Error, ErrResponseTooLarge)
+	}
+	if rejected {
+		span.SetTag(ext.HTTPCode, http.StatusInternalServerError)
+	}
 
 	// Collect and send metrics
 	met := TryGetMetricsFromContext(ctx)
@@ -86,6 +152,16 @@ func (t *TracedTwirp) responseSentHook(ctx context.Context) {
 			met.SetCount("Fault", 1)
 			met.SetCount("Error", 0)
 			met.SetCount("Success", 0)
+		} else if isCancelled {
+			met.SetCount("Fault", 0)
+			met.SetCount("Error", 0)
+			met.SetCount("Success", 0)
+			met.SetCount(CancelledMetric, 1)
+		} else if rejected {
+			// The 500 error was sent instead of the response
+			met.SetCount("Fault", 1)
+			met.SetCount("Error", 0)
+			met.SetCount("Success", 0)
 		} else if err != nil {
 			met.SetCount("Fault", 0)
 			met.SetCount("Error", 1)
@@ -95,23 +171,34 @@ func (t *TracedTwirp) responseSentHook(ctx context.Context) {
 			met.SetCount("Error", 0)
 			met.SetCount("Success", 1)
 		}
+		if tooLarge {
+			met.AddCount(ResponseTooLargeMetric, 1)
+			op.tooLargeRecorded = true
+		}
 		bench, ok := ctx.Value(RequestTimingKey).(*TimeMeasurement)
 		if ok && bench != nil {
+			if !isPanic && !isCancelled {
+				RecordSLO(ctx, met.OpName, bench.Elapsed())
+			}
 			bench.Done()
 		}
-		met.CopyToSpan(span)
+		met.Seal()
+		met.CopyToSampledSpan(span)
 		met.CopyToStatsd(statsd, clientType)
 	} else {
 		// TODO: check for BadRouteError?
 	}
 
-	if err != nil {
+	if isCancelled {
+		span.SetTag(CancelledTag, true)
+		span.Finish()
+	} else if err != nil {
 		if err.Meta(StackTraceKey) != "" {
-			span.SetTag(ext.ErrorStack, err.Meta(StackTraceKey))
+			SetSpanTagSafe(span, ext.ErrorStack, err.Meta(StackTraceKey))
 			span.Finish(tracer.WithError(err))
 		} else if isPanic {
 			stack := NewShortenedStackTrace(0, true, err.Msg())
-			span.SetTag(ext.ErrorStack, stack.StringStack())
+			SetSpanTagSafe(span, ext.ErrorStack, stack.StringStack())
 			span.Finish(tracer.WithError(err))
 		} else {
 			span.Finish(tracer.WithError(err))
@@ -122,10 +209,29 @@ func (t *TracedTwirp) responseSentHook(ctx context.Context) {
 }
 
 func (t *TracedTwirp) errorHook(ctx context.Context, err twirp.Error) context.Context {
+	// The stack is logged only if it's stripped from the response (see
+	// SetStrippedErrorMeta), otherwise the caller gets it anyway
+	op, ok := ctx.Value(routedOperationKeyVal).(*routedOperation)
+	if stack := err.Meta(StackTraceKey); stack != "" && ok && op.stackStripped {
+		if logger := TryCL(ctx); logger != nil {
+			fields := []zap.Field{zap.String("code", string(err.Code())),
+				zap.String("msg", err.Msg()), zap.String("stack", stack)}
+			if isInternalErrorCode(err.Code()) {
+				logger.Error("Request error", fields...)
+			} else {
+				logger.Info("Request error", fields...)
+			}
+		}
+	}
 	return context.WithValue(ctx, twirpErrorKey, err)
 }
 
+// Check whether the error code means a server-side failure
+func isInternalErrorCode(code twirp.ErrorCode) bool {
+	return code == twirp.Internal || code == twirp.Unknown || code == twirp.DataLoss
+}
+
 func WithStack(err twirp.Error) twirp.Error {
 	trace := NewShortenedStackTrace(3, false, "")
-	return err.WithMeta(StackTraceKey, trace.StringStack())
+	return err.WithMeta(StackTraceKey, TruncateTagValue(trace.StringStack()))
 }
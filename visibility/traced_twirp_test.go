@@ -190,6 +190,9 @@ func TestHaberdash(t *testing.T) {
 	ass.Equal(float64(1), rs.Distributions["Haberdasher.MakeHat.Success"])
 	ass.Equal(float64(0), rs.Distributions["Haberdasher.MakeHat.Fault"])
 	ass.Equal(float64(0), rs.Distributions["Haberdasher.MakeHat.Error"])
+	ass.Equal(SerializationJson, spans[0].Tag(SerializationTag))
+	ass.Equal(float64(1), rs.Distributions["Haberdasher.MakeHat.Serialization.json"])
+	ass.Equal(float64(0), rs.Distributions["Haberdasher.MakeHat.Serialization.protobuf"])
 
 	// Regular error
 	mt.Reset()
@@ -220,4 +223,36 @@ func TestHaberdash(t *testing.T) {
 	ass.Equal(float64(0), rs.Distributions["Haberdasher.MakeHat.Success"])
 	ass.Equal(float64(1), rs.Distributions["Haberdasher.MakeHat.Fault"])
 	ass.Equal(float64(0), rs.Distributions["Haberdasher.MakeHat.Error"])
+
+	// Protobuf
+	mt.Reset()
+	rs.Clear()
+	pbClient := example.NewHaberdasherProtobufClient("http://"+nl.Addr().String(),
+		WrapTwirpClient(&http.Client{}, "tester", DefAnalyticsRate,
+			"myClient"))
+	_, err = pbClient.MakeHat(context.Background(), &example.Size{Inches: 6})
+	ass.NoError(err)
+	ass.Equal(SerializationProtobuf, mt.FinishedSpans()[0].Tag(SerializationTag))
+	ass.Equal(float64(0), rs.Distributions["Haberdasher.MakeHat.Serialization.json"])
+	ass.Equal(float64(1), rs.Distributions["Haberdasher.MakeHat.Serialization.protobuf"])
+}
+
+func TestRequestSerialization(t *testing.T) {
+	_, ok := GetRequestSerialization(context.Background())
+	assert.False(t, ok)
+
+	check := func(contentType string) (string, bool) {
+		header := http.Header{}
+		header.Set("Content-Type", contentType)
+		return GetRequestSerialization(
+			ContextWithHttpRequestHeader(context.Background(), header))
+	}
+	s, ok := check("application/json; charset=utf-8")
+	assert.True(t, ok)
+	assert.Equal(t, SerializationJson, s)
+	s, ok = check("Application/Protobuf")
+	assert.True(t, ok)
+	assert.Equal(t, SerializationProtobuf, s)
+	_, ok = check("text/plain")
+	assert.False(t, ok)
 }
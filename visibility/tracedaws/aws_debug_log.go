@@ -0,0 +1,114 @@
+package tracedaws
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+const redactedValue = "<redacted>"
+
+// The parameter name fragments (lowercase) that mark the sensitive values
+var sensitiveParamNames = []string{
+	"password", "secret", "token", "credential", "plaintext",
+	"privatekey", "accesskey", "customerkey", "sessionkey",
+}
+
+const (
+	maxSummaryDepth     = 4
+	maxSummarySliceSize = 10
+)
+
+func isSensitiveParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range sensitiveParamNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Summarize the input parameters of an AWS call for the debug logs. The
+// sensitive fields are redacted, the binary data and the streams are replaced
+// with their sizes, and the long lists are shortened.
+func summarizeParams(params interface{}) interface{} {
+	if params == nil {
+		return nil
+	}
+	return summarizeValue(reflect.ValueOf(params), 0)
+}
+
+func summarizeValue(v reflect.Value, depth int) interface{} {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Implements(readerType) {
+			return "<stream>"
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if depth >= maxSummaryDepth {
+			return "<...>"
+		}
+		res := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue // Unexported
+			}
+			fv := v.Field(i)
+			if (fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Slice ||
+				fv.Kind() == reflect.Map || fv.Kind() == reflect.Interface) && fv.IsNil() {
+				continue
+			}
+			// The SDK marks some of the sensitive fields with a tag
+			if field.Tag.Get("sensitive") == "true" || isSensitiveParam(field.Name) {
+				res[field.Name] = redactedValue
+				continue
+			}
+			res[field.Name] = summarizeValue(fv, depth+1)
+		}
+		return res
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return fmt.Sprintf("<%d bytes>", v.Len())
+		}
+		if depth >= maxSummaryDepth || v.Len() > maxSummarySliceSize {
+			return fmt.Sprintf("<%d items>", v.Len())
+		}
+		res := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			res = append(res, summarizeValue(v.Index(i), depth+1))
+		}
+		return res
+	case reflect.Map:
+		if depth >= maxSummaryDepth || v.Len() > maxSummarySliceSize ||
+			v.Type().Key().Kind() != reflect.String {
+			return fmt.Sprintf("<%d entries>", v.Len())
+		}
+		res := make(map[string]interface{})
+		iter := v.MapRange()
+		for iter.Next() {
+			key := iter.Key().String()
+			if isSensitiveParam(key) {
+				res[key] = redactedValue
+				continue
+			}
+			res[key] = summarizeValue(iter.Value(), depth+1)
+		}
+		return res
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil
+	default:
+		return v.Interface()
+	}
+}
+
+var readerType = reflect.TypeOf((*io.Reader)(nil)).Elem()
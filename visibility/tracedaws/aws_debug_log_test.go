@@ -0,0 +1,97 @@
+package tracedaws
+
+import (
+	"bytes"
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"strings"
+	"testing"
+)
+
+type nestedParams struct {
+	Name        *string
+	Credentials map[string]string
+	Tags        map[string]string
+	Items       []int
+	Inner       *nestedParams
+	hidden      string
+}
+
+func TestSummarizeParams(t *testing.T) {
+	summary := summarizeParams(&kms.EncryptInput{
+		KeyId:     aws.String("alias/key"),
+		Plaintext: []byte("the secret"),
+	}).(map[string]interface{})
+	assert.Equal(t, "alias/key", summary["KeyId"])
+	assert.Equal(t, redactedValue, summary["Plaintext"])
+	_, hasContext := summary["EncryptionContext"]
+	assert.False(t, hasContext)
+
+	summary = summarizeParams(&s3.PutObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("key"),
+		Body:   bytes.NewReader([]byte("data")),
+	}).(map[string]interface{})
+	assert.Equal(t, "bucket", summary["Bucket"])
+	assert.Equal(t, "key", summary["Key"])
+	assert.Equal(t, "<stream>", summary["Body"])
+
+	summary = summarizeParams(&nestedParams{
+		Name:        aws.String("outer"),
+		Credentials: map[string]string{"user": "pass"},
+		Tags:        map[string]string{"env": "prod", "api_token": "tok"},
+		Items:       []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		Inner:       &nestedParams{Items: []int{1, 2}},
+		hidden:      "hidden",
+	}).(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"Name":        "outer",
+		"Credentials": redactedValue,
+		"Tags":        map[string]interface{}{"env": "prod", "api_token": redactedValue},
+		"Items":       "<11 items>",
+		"Inner": map[string]interface{}{
+			"Items": []interface{}{1, 2},
+		},
+	}, summary)
+}
+
+func TestDebugLogging(t *testing.T) {
+	am := utils.NewAwsMockHandler()
+	am.AddHandler(func(ctx context.Context, arg *ec2.TerminateInstancesInput) (
+		*ec2.TerminateInstancesOutput, error) {
+		return &ec2.TerminateInstancesOutput{}, nil
+	})
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	ctx := visibility.ImbueContext(context.Background(), logger)
+
+	send := func(opts ...Option) {
+		ec := ec2.New(am.AwsConfig())
+		InstrumentHandlers(&ec.Handlers, opts...)
+		_, err := ec.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
+			InstanceIds: []string{"i-123"},
+		}).Send(ctx)
+		assert.NoError(t, err)
+	}
+
+	// Disabled by default
+	send()
+	assert.Equal(t, "", sink.String())
+
+	send(WithDebugLogging(true))
+	logs := sink.String()
+	assert.Contains(t, logs, "Sending AWS request")
+	assert.Contains(t, logs, `"aws_operation":"ec2.TerminateInstances"`)
+	assert.Contains(t, logs, `"InstanceIds":["i-123"]`)
+	assert.Contains(t, logs, "AWS request finished")
+	assert.Equal(t, 2, strings.Count(logs, "\n"))
+}
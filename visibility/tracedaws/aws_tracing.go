@@ -5,36 +5,37 @@
 package tracedaws
 
 import (
+	"errors"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"math"
-	"strconv"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/cyberax/go-dd-service-base/visibility/tracedaws/internal/awscall"
+	"go.uber.org/zap"
+	"time"
 
-	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
-	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
 const (
-	tagAWSAgent     = "aws.agent"
-	tagAWSOperation = "aws.operation"
-	tagAWSRegion    = "aws.region"
+	tagAWSAgent     = awscall.TagAWSAgent
+	tagAWSOperation = awscall.TagAWSOperation
+	tagAWSRegion    = awscall.TagAWSRegion
+	tagAWSRequestID = awscall.TagAWSRequestID
 )
 
 type instrumenter struct {
-	cfg *config
+	cfg *awscall.Config
 }
 
 func InstrumentHandlers(handlers *aws.Handlers, opts ...Option) {
-	cfg := new(config)
-	defaults(cfg)
-	for _, opt := range opts {
-		opt(cfg)
-	}
-	h := &instrumenter{cfg: cfg}
+	h := &instrumenter{cfg: awscall.NewConfig(opts...)}
 	handlers.Send.PushFrontNamed(aws.NamedHandler{
 		Name: "visibility/aws/handlers.Send",
 		Fn:   h.Send,
 	})
+	handlers.ShouldRetry.PushFrontNamed(aws.NamedHandler{
+		Name: "visibility/aws/handlers.Throttling",
+		Fn:   h.detectThrottling,
+	})
 	handlers.Complete.PushFrontNamed(aws.NamedHandler{
 		Name: "visibility/aws/handlers.Complete",
 		Fn:   h.Complete,
@@ -42,49 +43,80 @@ func InstrumentHandlers(handlers *aws.Handlers, opts ...Option) {
 }
 
 func (h *instrumenter) Send(req *aws.Request) {
-	opts := []ddtrace.StartSpanOption{
-		tracer.SpanType(ext.SpanTypeHTTP),
-		tracer.ServiceName(h.serviceName(req)),
-		tracer.ResourceName(h.resourceName(req)),
-		tracer.Tag(tagAWSAgent, h.awsAgent(req)),
-		tracer.Tag(tagAWSOperation, h.awsOperation(req)),
-		tracer.Tag(tagAWSRegion, h.awsRegion(req)),
-		tracer.Tag(ext.HTTPMethod, req.Operation.HTTPMethod),
-		tracer.Tag(ext.HTTPURL, req.HTTPRequest.URL.String()),
+	_, ctx := awscall.StartCallSpan(req.Context(), h.cfg, awscall.CallInfo{
+		Service:   h.awsService(req),
+		Operation: h.awsOperation(req),
+		Region:    h.awsRegion(req),
+		Agent:     h.awsAgent(req),
+		Method:    req.Operation.HTTPMethod,
+		URL:       req.HTTPRequest.URL.String(),
+	})
+	req.SetContext(ctx)
+
+	if logger := h.debugLogger(req); logger != nil {
+		logger.Debug("Sending AWS request",
+			zap.String("aws_operation", h.resourceName(req)),
+			zap.Any("aws_params", summarizeParams(req.Params)))
 	}
-	if !math.IsNaN(h.cfg.analyticsRate) {
-		opts = append(opts, tracer.Tag(ext.EventSampleRate, h.cfg.analyticsRate))
+}
+
+func (h *instrumenter) debugLogger(req *aws.Request) *zap.Logger {
+	if !h.cfg.DebugLogging {
+		return nil
 	}
-	_, ctx := tracer.StartSpanFromContext(req.Context(), h.operationName(req), opts...)
-	req.SetContext(ctx)
+	return visibility.TryCL(req.Context())
 }
 
 func (h *instrumenter) Complete(req *aws.Request) {
+	// Retries are a part of the same call
+	visibility.RecordDependencyCall(req.Context(), h.awsService(req),
+		time.Since(req.Time))
+
 	span, ok := tracer.SpanFromContext(req.Context())
 	if !ok {
 		return
 	}
+	statusCode := 0
 	if req.HTTPResponse != nil {
-		span.SetTag(ext.HTTPCode, strconv.Itoa(req.HTTPResponse.StatusCode))
+		statusCode = req.HTTPResponse.StatusCode
+	}
+	requestId := h.awsRequestId(req)
+	awscall.TagResult(span, statusCode, requestId)
+
+	var throttled *ThrottledError
+	if errors.As(req.Error, &throttled) {
+		span.SetTag(tagAWSThrottled, true)
 	}
-	span.Finish(tracer.WithError(req.Error))
-}
 
-func (h *instrumenter) operationName(req *aws.Request) string {
-	return h.awsService(req) + ".command"
+	// Log the failed calls with the request ID, AWS support always asks for it
+	if req.Error != nil {
+		if logger := visibility.TryCL(req.Context()); logger != nil {
+			logger.Error("AWS request failed",
+				zap.String("aws_operation", h.resourceName(req)),
+				zap.String("aws_request_id", requestId), zap.Error(req.Error))
+		}
+	}
+	if logger := h.debugLogger(req); logger != nil {
+		fields := []zap.Field{
+			zap.String("aws_operation", h.resourceName(req)),
+			zap.String("aws_request_id", requestId),
+			zap.Int("aws_retries", req.RetryCount),
+		}
+		if req.HTTPResponse != nil {
+			fields = append(fields, zap.Int("status", req.HTTPResponse.StatusCode))
+		}
+		if req.Error != nil {
+			fields = append(fields, zap.Error(req.Error))
+		}
+		logger.Debug("AWS request finished", fields...)
+	}
+	span.Finish(tracer.WithError(req.Error))
 }
 
 func (h *instrumenter) resourceName(req *aws.Request) string {
 	return h.awsService(req) + "." + req.Operation.Name
 }
 
-func (h *instrumenter) serviceName(req *aws.Request) string {
-	if h.cfg.serviceName != "" {
-		return h.cfg.serviceName
-	}
-	return "aws." + h.awsService(req)
-}
-
 func (h *instrumenter) awsAgent(req *aws.Request) string {
 	if agent := req.HTTPRequest.Header.Get("User-Agent"); agent != "" {
 		return agent
@@ -103,3 +135,16 @@ func (h *instrumenter) awsRegion(req *aws.Request) string {
 func (h *instrumenter) awsService(req *aws.Request) string {
 	return req.Metadata.SigningName
 }
+
+func (h *instrumenter) awsRequestId(req *aws.Request) string {
+	if req.RequestID != "" {
+		return req.RequestID
+	}
+	if req.HTTPResponse == nil {
+		return ""
+	}
+	if id := req.HTTPResponse.Header.Get("X-Amzn-Requestid"); id != "" {
+		return id
+	}
+	return req.HTTPResponse.Header.Get("X-Amz-Request-Id")
+}
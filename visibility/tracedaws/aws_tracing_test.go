@@ -7,9 +7,18 @@ package tracedaws
 
 import (
 	"context"
-	"github.com/cyberax/go-dd-service-base/utils"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/cyberax/go-dd-service-base/visibility/oapi"
+	"github.com/labstack/echo/v4"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
@@ -119,5 +128,172 @@ func TestAnalyticsSettings(t *testing.T) {
 
 		assertRate(t, mt, 0.23, WithAnalyticsRate(0.23))
 	})
+
+	t.Run("runtime", func(t *testing.T) {
+		holder := NewAnalyticsRate(0.1)
+		ec := ec2.New(awsConfig)
+		InstrumentHandlers(&ec.Handlers, WithAnalyticsRateHolder(holder))
+
+		sendAndCheck := func(rate interface{}) {
+			mt := mocktracer.Start()
+			defer mt.Stop()
+
+			_, _ = ec.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
+				InstanceIds: []string{"i-123"},
+			}).Send(context.Background())
+
+			spans := mt.FinishedSpans()
+			assert.Len(t, spans, 1)
+			assert.Equal(t, rate, spans[0].Tag(ext.EventSampleRate))
+		}
+
+		sendAndCheck(0.1)
+		// Crank it up without re-instrumenting
+		holder.Set(1.0)
+		sendAndCheck(1.0)
+		holder.Set(-1)
+		sendAndCheck(nil)
+	})
+}
+
+func TestRequestId(t *testing.T) {
+	am := utils.NewAwsMockHandler()
+	am.AddHandler(func(ctx context.Context, arg *ec2.TerminateInstancesInput) (
+		*ec2.TerminateInstancesOutput, error) {
+		return &ec2.TerminateInstancesOutput{}, nil
+	})
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ec := ec2.New(am.AwsConfig())
+	InstrumentHandlers(&ec.Handlers)
+	// Simulate the AWS response headers
+	ec.Handlers.Send.PushFrontNamed(aws.NamedHandler{
+		Name: "test/fakeResponse", Fn: func(req *aws.Request) {
+			req.HTTPResponse = &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+			}
+			req.HTTPResponse.Header.Set("X-Amzn-RequestId", "req-1234")
+		}})
+
+	_, _ = ec.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
+		InstanceIds: []string{"i-123"},
+	}).Send(context.Background())
+
+	spans := mt.FinishedSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "req-1234", spans[0].Tag(tagAWSRequestID))
 }
 
+func TestThrottling(t *testing.T) {
+	am := utils.NewAwsMockHandler()
+	am.AddHandler(func(ctx context.Context, arg *ec2.TerminateInstancesInput) (
+		*ec2.TerminateInstancesOutput, error) {
+		return nil, awserr.New("RequestLimitExceeded", "Request limit exceeded", nil)
+	})
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	rs := visibility.NewRecordingSink()
+
+	ec := ec2.New(am.AwsConfig())
+	InstrumentHandlers(&ec.Handlers)
+	// Simulate the throttled response
+	ec.Handlers.Send.PushFrontNamed(aws.NamedHandler{
+		Name: "test/fakeResponse", Fn: func(req *aws.Request) {
+			req.HTTPResponse = &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     http.Header{},
+			}
+			req.HTTPResponse.Header.Set("Retry-After", "3")
+		}})
+
+	ctx := visibility.ContextWithStatsd(context.Background(), rs)
+	_, err := ec.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
+		InstanceIds: []string{"i-123"},
+	}).Send(ctx)
+
+	var throttled *ThrottledError
+	assert.True(t, errors.As(err, &throttled))
+	assert.Equal(t, 3*time.Second, throttled.RetryAfter)
+	assert.Equal(t, "ec2", throttled.Service)
+	// The original error is still accessible
+	var aerr awserr.Error
+	assert.True(t, errors.As(err, &aerr))
+	assert.Equal(t, "RequestLimitExceeded", aerr.Code())
+
+	assert.Equal(t, int64(1), rs.Counts["AwsThrottled"])
+	assert.Equal(t, true, mt.FinishedSpans()[0].Tag(tagAWSThrottled))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	resp := &http.Response{Header: http.Header{}}
+	assert.Equal(t, time.Duration(0), parseRetryAfter(resp, now))
+
+	resp.Header.Set("Retry-After", "120")
+	assert.Equal(t, 2*time.Minute, parseRetryAfter(resp, now))
+
+	resp.Header.Set("Retry-After", now.Add(time.Minute).Format(http.TimeFormat))
+	assert.Equal(t, time.Minute, parseRetryAfter(resp, now))
+
+	resp.Header.Set("Retry-After", "garbage")
+	assert.Equal(t, time.Duration(0), parseRetryAfter(resp, now))
+}
+
+const depsSpec = `
+{
+  "openapi": "3.0.0",
+  "info": {"version": "1.0.0", "title": "Deps API"},
+  "paths": {
+    "/items/{id}": {
+      "get": {
+        "operationId": "getItem",
+        "parameters": [{"name": "id", "in": "path", "required": true,
+          "schema": {"type": "string"}}],
+        "responses": {"200": {"description": "OK"}}
+      }
+    }
+  }
+}
+`
+
+func TestDependencyMetrics(t *testing.T) {
+	am := utils.NewAwsMockHandler()
+	am.AddHandler(func(ctx context.Context, arg *dynamodb.GetItemInput) (
+		*dynamodb.GetItemOutput, error) {
+		return &dynamodb.GetItemOutput{}, nil
+	})
+	awsConfig := am.AwsConfig()
+	InstrumentHandlers(&awsConfig.Handlers)
+	ddb := dynamodb.New(awsConfig)
+
+	srv := oapi.NewTestServer(t, oapi.MustLoadSpec([]byte(depsSpec)),
+		oapi.TracingAndMetricsOptions{}, func(e *echo.Echo) {
+			e.GET("/items/:id", func(c echo.Context) error {
+				for i := 0; i < 2; i++ {
+					_, err := ddb.GetItemRequest(&dynamodb.GetItemInput{
+						TableName: aws.String("items"),
+					}).Send(c.Request().Context())
+					if err != nil {
+						return err
+					}
+				}
+				return c.String(http.StatusOK, "ok")
+			})
+		})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.BaseUrl + "/items/123")
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	srv.Close()
+
+	assert.Equal(t, 2.0, srv.Metrics.Distributions["GetItem.Deps.dynamodb.Calls"])
+	assert.Equal(t, []string{"unit:count", "client-type:normal"},
+		srv.Metrics.Tags["GetItem.Deps.dynamodb.Calls"])
+	_, hasTime := srv.Metrics.Distributions["GetItem.Deps.dynamodb.Time"]
+	assert.True(t, hasTime)
+}
@@ -0,0 +1,132 @@
+// The tracing of the middleware-based (v1.x) aws-sdk-go-v2 clients, with the same
+// spans as tracedaws.InstrumentHandlers. It's a separate module, as the main one
+// is pinned to the handler-based aws-sdk-go-v2 v0.21 that shares the module path
+// with the v1.x SDK.
+//
+// The dependency call metrics (visibility.RecordDependencyCall) are not recorded
+// here, the visibility package depends on the v0.21 SDK.
+package awsv2
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/cyberax/go-dd-service-base/visibility/tracedaws/internal/awscall"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"strings"
+)
+
+// The analytics rate that can be changed at runtime, see tracedaws.AnalyticsRate
+type AnalyticsRate = awscall.AnalyticsRate
+
+func NewAnalyticsRate(rate float64) *AnalyticsRate {
+	return awscall.NewAnalyticsRate(rate)
+}
+
+// The same options as for tracedaws.InstrumentHandlers
+type Option = awscall.Option
+
+// WithServiceName sets the span service name instead of "aws.<service>"
+func WithServiceName(name string) Option {
+	return awscall.WithServiceName(name)
+}
+
+// WithAnalytics enables Trace Analytics for all started spans.
+func WithAnalytics(on bool) Option {
+	return awscall.WithAnalytics(on)
+}
+
+// WithAnalyticsRate sets the sampling rate for Trace Analytics events
+// correlated to started spans.
+func WithAnalyticsRate(rate float64) Option {
+	return awscall.WithAnalyticsRate(rate)
+}
+
+// WithAnalyticsRateHolder uses the holder for the sampling rate of Trace
+// Analytics events, so that it can be adjusted after the instrumentation.
+func WithAnalyticsRateHolder(holder *AnalyticsRate) Option {
+	return awscall.WithAnalyticsRateHolder(holder)
+}
+
+type instrumenter struct {
+	cfg *awscall.Config
+}
+
+// Add the tracing middleware to the config, the clients created from it
+// (e.g. ec2.NewFromConfig) trace all their calls
+func AppendMiddleware(cfg *aws.Config, opts ...Option) {
+	h := &instrumenter{cfg: awscall.NewConfig(opts...)}
+	cfg.APIOptions = append(cfg.APIOptions, h.addMiddleware)
+}
+
+func (h *instrumenter) addMiddleware(stack *middleware.Stack) error {
+	// The span is started right after the service metadata is known, so that it
+	// wraps the input validation and the mocks (utils/awsv2mock)
+	start := middleware.InitializeMiddlewareFunc("visibility/aws/StartSpan",
+		h.startSpan)
+	err := stack.Initialize.Insert(start, (&awsmiddleware.RegisterServiceMetadata{}).ID(),
+		middleware.After)
+	if err != nil {
+		err = stack.Initialize.Add(start, middleware.Before)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Each attempt is deserialized separately, the last one tags the span
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc(
+		"visibility/aws/TagSpan", h.tagSpan), middleware.Before)
+}
+
+func (h *instrumenter) startSpan(ctx context.Context, in middleware.InitializeInput,
+	next middleware.InitializeHandler) (middleware.InitializeOutput,
+	middleware.Metadata, error) {
+
+	span, ctx := awscall.StartCallSpan(ctx, h.cfg, awscall.CallInfo{
+		Service:   awsService(ctx),
+		Operation: awsmiddleware.GetOperationName(ctx),
+		Region:    awsmiddleware.GetRegion(ctx),
+	})
+	out, metadata, err := next.HandleInitialize(ctx, in)
+	span.Finish(tracer.WithError(err))
+	return out, metadata, err
+}
+
+func (h *instrumenter) tagSpan(ctx context.Context, in middleware.DeserializeInput,
+	next middleware.DeserializeHandler) (middleware.DeserializeOutput,
+	middleware.Metadata, error) {
+
+	span, ok := tracer.SpanFromContext(ctx)
+	if !ok {
+		return next.HandleDeserialize(ctx, in)
+	}
+
+	if req, ok := in.Request.(*smithyhttp.Request); ok {
+		awscall.TagRequest(span, awsAgent(req), req.Method, req.URL.String())
+	}
+
+	out, metadata, err := next.HandleDeserialize(ctx, in)
+
+	statusCode := 0
+	if resp, ok := out.RawResponse.(*smithyhttp.Response); ok {
+		statusCode = resp.StatusCode
+	}
+	requestId, _ := awsmiddleware.GetRequestIDMetadata(metadata)
+	awscall.TagResult(span, statusCode, requestId)
+	return out, metadata, err
+}
+
+// The handler-based SDK names the spans after the signing name (e.g. "ec2" or
+// "dynamodb"), the v1.x SDK only has the service ID ("EC2", "DynamoDB")
+func awsService(ctx context.Context) string {
+	return strings.ToLower(strings.ReplaceAll(awsmiddleware.GetServiceID(ctx), " ", ""))
+}
+
+func awsAgent(req *smithyhttp.Request) string {
+	if agent := req.Header.Get("User-Agent"); agent != "" {
+		return agent
+	}
+	return "aws-sdk-go-v2"
+}
@@ -0,0 +1,141 @@
+package awsv2
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/cyberax/go-dd-service-base/visibility/tracedaws/internal/awscall"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const identityResponse = `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<GetCallerIdentityResult><Arn>arn:aws:iam::123456:user/test</Arn><UserId>test</UserId>
+<Account>123456</Account></GetCallerIdentityResult>
+<ResponseMetadata><RequestId>req-1234</RequestId></ResponseMetadata>
+</GetCallerIdentityResponse>`
+
+const deniedResponse = `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<Error><Type>Sender</Type><Code>AccessDenied</Code><Message>Denied</Message></Error>
+<RequestId>req-5678</RequestId></ErrorResponse>`
+
+func newTestConfig(url string) aws.Config {
+	return aws.Config{
+		Region:       "us-mars-1",
+		BaseEndpoint: aws.String(url),
+		Credentials: aws.CredentialsProviderFunc(
+			func(ctx context.Context) (aws.Credentials, error) {
+				return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET"}, nil
+			}),
+	}
+}
+
+func TestAWS(t *testing.T) {
+	deny := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		if deny {
+			w.Header().Set("X-Amzn-Requestid", "req-5678")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(deniedResponse))
+			return
+		}
+		w.Header().Set("X-Amzn-Requestid", "req-1234")
+		_, _ = w.Write([]byte(identityResponse))
+	}))
+	defer srv.Close()
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	config := newTestConfig(srv.URL)
+	AppendMiddleware(&config)
+	client := sts.NewFromConfig(config)
+
+	root, ctx := tracer.StartSpanFromContext(context.Background(), "test")
+	identity, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	assert.NoError(t, err)
+	assert.Equal(t, "123456", *identity.Account)
+	root.Finish()
+
+	spans := mt.FinishedSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, spans[1].TraceID(), spans[0].TraceID())
+
+	s := spans[0]
+	assert.Equal(t, "sts.command", s.OperationName())
+	assert.Contains(t, s.Tag(awscall.TagAWSAgent), "aws-sdk-go-v2")
+	assert.Equal(t, "GetCallerIdentity", s.Tag(awscall.TagAWSOperation))
+	assert.Equal(t, "us-mars-1", s.Tag(awscall.TagAWSRegion))
+	assert.Equal(t, "sts.GetCallerIdentity", s.Tag(ext.ResourceName))
+	assert.Equal(t, "aws.sts", s.Tag(ext.ServiceName))
+	assert.Equal(t, "POST", s.Tag(ext.HTTPMethod))
+	assert.Equal(t, srv.URL+"/", s.Tag(ext.HTTPURL))
+	assert.Equal(t, "200", s.Tag(ext.HTTPCode))
+	assert.Equal(t, "req-1234", s.Tag(awscall.TagAWSRequestID))
+	assert.Nil(t, s.Tag(ext.Error))
+
+	// The failed calls are marked as errors
+	mt.Reset()
+	deny = true
+	_, err = client.GetCallerIdentity(context.Background(), &sts.GetCallerIdentityInput{})
+	assert.Error(t, err)
+
+	spans = mt.FinishedSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "403", spans[0].Tag(ext.HTTPCode))
+	assert.Equal(t, "req-5678", spans[0].Tag(awscall.TagAWSRequestID))
+	assert.NotNil(t, spans[0].Tag(ext.Error))
+}
+
+func TestAnalyticsSettings(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = w.Write([]byte(identityResponse))
+	}))
+	defer srv.Close()
+
+	assertRate := func(t *testing.T, rate interface{}, opts ...Option) {
+		mt := mocktracer.Start()
+		defer mt.Stop()
+
+		config := newTestConfig(srv.URL)
+		AppendMiddleware(&config, opts...)
+		_, err := sts.NewFromConfig(config).GetCallerIdentity(context.Background(),
+			&sts.GetCallerIdentityInput{})
+		assert.NoError(t, err)
+
+		spans := mt.FinishedSpans()
+		assert.Len(t, spans, 1)
+		assert.Equal(t, rate, spans[0].Tag(ext.EventSampleRate))
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		assertRate(t, nil)
+	})
+	t.Run("enabled", func(t *testing.T) {
+		assertRate(t, 1.0, WithAnalytics(true))
+	})
+	t.Run("override", func(t *testing.T) {
+		assertRate(t, 0.23, WithAnalyticsRate(0.23))
+	})
+	t.Run("holder", func(t *testing.T) {
+		assertRate(t, 0.1, WithAnalyticsRateHolder(NewAnalyticsRate(0.1)))
+	})
+	t.Run("service", func(t *testing.T) {
+		mt := mocktracer.Start()
+		defer mt.Stop()
+
+		config := newTestConfig(srv.URL)
+		AppendMiddleware(&config, WithServiceName("identity"))
+		_, err := sts.NewFromConfig(config).GetCallerIdentity(context.Background(),
+			&sts.GetCallerIdentityInput{})
+		assert.NoError(t, err)
+		assert.Equal(t, "identity", mt.FinishedSpans()[0].Tag(ext.ServiceName))
+	})
+}
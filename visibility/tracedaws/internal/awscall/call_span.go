@@ -0,0 +1,88 @@
+package awscall
+
+import (
+	"context"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"math"
+	"strconv"
+)
+
+const (
+	TagAWSAgent     = "aws.agent"
+	TagAWSOperation = "aws.operation"
+	TagAWSRegion    = "aws.region"
+	TagAWSRequestID = "aws.request_id"
+)
+
+// The SDK-independent description of an AWS call. The span naming and tags
+// are kept here, so that the handler-based instrumentation (tracedaws) and
+// the middleware-based one for the GA SDK (awsv2) produce the same spans.
+type CallInfo struct {
+	Service   string
+	Operation string
+	Region    string
+	Agent     string
+	Method    string
+	URL       string
+}
+
+func (c CallInfo) operationName() string {
+	return c.Service + ".command"
+}
+
+func (c CallInfo) resourceName() string {
+	return c.Service + "." + c.Operation
+}
+
+func (c CallInfo) serviceName(cfg *Config) string {
+	if cfg.ServiceName != "" {
+		return cfg.ServiceName
+	}
+	return "aws." + c.Service
+}
+
+// Start the call span, the HTTP request tags can be omitted if the request
+// is not built yet, and set later with TagRequest
+func StartCallSpan(ctx context.Context, cfg *Config,
+	info CallInfo) (tracer.Span, context.Context) {
+
+	opts := []ddtrace.StartSpanOption{
+		tracer.SpanType(ext.SpanTypeHTTP),
+		tracer.ServiceName(info.serviceName(cfg)),
+		tracer.ResourceName(info.resourceName()),
+		tracer.Tag(TagAWSOperation, info.Operation),
+		tracer.Tag(TagAWSRegion, info.Region),
+	}
+	if info.Agent != "" {
+		opts = append(opts, tracer.Tag(TagAWSAgent, info.Agent))
+	}
+	if info.Method != "" {
+		opts = append(opts, tracer.Tag(ext.HTTPMethod, info.Method))
+	}
+	if info.URL != "" {
+		opts = append(opts, tracer.Tag(ext.HTTPURL, info.URL))
+	}
+	if rate := cfg.AnalyticsRate.Get(); !math.IsNaN(rate) {
+		opts = append(opts, tracer.Tag(ext.EventSampleRate, rate))
+	}
+	return tracer.StartSpanFromContext(ctx, info.operationName(), opts...)
+}
+
+func TagRequest(span tracer.Span, agent, method, url string) {
+	span.SetTag(TagAWSAgent, agent)
+	span.SetTag(ext.HTTPMethod, method)
+	span.SetTag(ext.HTTPURL, url)
+}
+
+// Tag the outcome of the call, the zero status code and the empty request ID
+// (e.g. if there was no response) are skipped
+func TagResult(span tracer.Span, statusCode int, requestId string) {
+	if statusCode != 0 {
+		span.SetTag(ext.HTTPCode, strconv.Itoa(statusCode))
+	}
+	if requestId != "" {
+		span.SetTag(TagAWSRequestID, requestId)
+	}
+}
@@ -0,0 +1,89 @@
+// Licensed under Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+// The SDK-independent part of the AWS call tracing, shared by the instrumentation
+// of the handler-based SDK (tracedaws) and of the middleware-based v1.x SDK
+// (the visibility/tracedaws/awsv2 module). It must not import the AWS SDK.
+package awscall
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+type Config struct {
+	ServiceName   string
+	AnalyticsRate *AnalyticsRate
+	DebugLogging  bool
+}
+
+// Create the config with the options applied over the defaults
+func NewConfig(opts ...Option) *Config {
+	cfg := &Config{
+		// cfg.analyticsRate = globalconfig.AnalyticsRate()
+		AnalyticsRate: NewAnalyticsRate(math.NaN()),
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+type AnalyticsRate struct {
+	bits uint64
+}
+
+func NewAnalyticsRate(rate float64) *AnalyticsRate {
+	res := &AnalyticsRate{}
+	res.Set(rate)
+	return res
+}
+
+// Set the new rate, the rates outside of [0, 1] disable the Trace Analytics
+func (a *AnalyticsRate) Set(rate float64) {
+	if !(rate >= 0.0 && rate <= 1.0) {
+		rate = math.NaN()
+	}
+	atomic.StoreUint64(&a.bits, math.Float64bits(rate))
+}
+
+func (a *AnalyticsRate) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&a.bits))
+}
+
+type Option func(*Config)
+
+func WithServiceName(name string) Option {
+	return func(cfg *Config) {
+		cfg.ServiceName = name
+	}
+}
+
+func WithAnalytics(on bool) Option {
+	return func(cfg *Config) {
+		if on {
+			cfg.AnalyticsRate.Set(1.0)
+		} else {
+			cfg.AnalyticsRate.Set(math.NaN())
+		}
+	}
+}
+
+func WithAnalyticsRate(rate float64) Option {
+	return func(cfg *Config) {
+		cfg.AnalyticsRate.Set(rate)
+	}
+}
+
+func WithAnalyticsRateHolder(holder *AnalyticsRate) Option {
+	return func(cfg *Config) {
+		cfg.AnalyticsRate = holder
+	}
+}
+
+func WithDebugLogging(enabled bool) Option {
+	return func(cfg *Config) {
+		cfg.DebugLogging = enabled
+	}
+}
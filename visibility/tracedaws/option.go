@@ -4,50 +4,51 @@
 package tracedaws
 
 import (
-	"math"
+	"github.com/cyberax/go-dd-service-base/visibility/tracedaws/internal/awscall"
 )
 
-type config struct {
-	serviceName   string
-	analyticsRate float64
-}
-
-// Option represents an option that can be passed to Dial.
-type Option func(*config)
+// The analytics rate that can be changed at runtime (e.g. from an admin endpoint
+// during an incident), the new rate is used for the next AWS call. NaN disables
+// the Trace Analytics.
+type AnalyticsRate = awscall.AnalyticsRate
 
-func defaults(cfg *config) {
-	// cfg.analyticsRate = globalconfig.AnalyticsRate()
-	cfg.analyticsRate = math.NaN()
+func NewAnalyticsRate(rate float64) *AnalyticsRate {
+	return awscall.NewAnalyticsRate(rate)
 }
 
+// Option represents an option that can be passed to Dial. The options are
+// shared with the instrumentation of the v1.x SDK clients (the
+// visibility/tracedaws/awsv2 module).
+type Option = awscall.Option
+
 // WithServiceName sets the given service name for the dialled connection.
 // When the service name is not explicitly set it will be inferred based on the
 // request to AWS.
 func WithServiceName(name string) Option {
-	return func(cfg *config) {
-		cfg.serviceName = name
-	}
+	return awscall.WithServiceName(name)
 }
 
 // WithAnalytics enables Trace Analytics for all started spans.
 func WithAnalytics(on bool) Option {
-	return func(cfg *config) {
-		if on {
-			cfg.analyticsRate = 1.0
-		} else {
-			cfg.analyticsRate = math.NaN()
-		}
-	}
+	return awscall.WithAnalytics(on)
 }
 
 // WithAnalyticsRate sets the sampling rate for Trace Analytics events
 // correlated to started spans.
 func WithAnalyticsRate(rate float64) Option {
-	return func(cfg *config) {
-		if rate >= 0.0 && rate <= 1.0 {
-			cfg.analyticsRate = rate
-		} else {
-			cfg.analyticsRate = math.NaN()
-		}
-	}
+	return awscall.WithAnalyticsRate(rate)
+}
+
+// WithAnalyticsRateHolder uses the holder for the sampling rate of Trace
+// Analytics events, so that it can be adjusted after the instrumentation.
+// The options applied after this one update the holder's rate.
+func WithAnalyticsRateHolder(holder *AnalyticsRate) Option {
+	return awscall.WithAnalyticsRateHolder(holder)
+}
+
+// WithDebugLogging logs the AWS calls (with the redacted summary of their
+// parameters) and their outcomes at the debug level, if the request context
+// has a logger.
+func WithDebugLogging(enabled bool) Option {
+	return awscall.WithDebugLogging(enabled)
 }
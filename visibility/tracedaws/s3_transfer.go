@@ -0,0 +1,237 @@
+package tracedaws
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"io"
+	"time"
+)
+
+const (
+	S3BytesUploadedMetric   = "S3.BytesUploaded"
+	S3PartsMetric           = "S3.Parts"
+	S3UploadTimeMetric      = "S3.UploadTime"
+	S3BytesDownloadedMetric = "S3.BytesDownloaded"
+	S3DownloadTimeMetric    = "S3.DownloadTime"
+)
+
+// S3 doesn't accept multipart parts smaller than 5Mb (except the last one)
+const MinS3PartSize = 5 * 1024 * 1024
+
+const (
+	tagS3Bucket = "aws.s3.bucket"
+	tagS3Key    = "aws.s3.key"
+	tagS3Part   = "aws.s3.part"
+	tagS3Size   = "aws.s3.size"
+)
+
+// Upload the data from the reader into the S3 object, splitting it into parts
+// of partSize bytes. The upload gets a parent "s3.upload" span with a child
+// span for each part, and the statistics are recorded in the context's
+// MetricsContext (if it exists).
+//
+// The data that fits into one part is uploaded with a simple PutObject. Larger
+// data is uploaded with a multipart upload, which is aborted if any part fails
+// or if the context is cancelled, so that no orphaned parts are left behind.
+//
+// This doesn't use the s3manager, as it doesn't allow to observe the parts.
+func UploadTraced(ctx context.Context, client *s3.Client, bucket, key string,
+	reader io.Reader, partSize int64) (err error) {
+
+	if partSize < MinS3PartSize {
+		partSize = MinS3PartSize
+	}
+
+	span, ctx := tracer.StartSpanFromContext(ctx, "s3.upload",
+		tracer.ResourceName("s3.upload"),
+		tracer.Tag(tagS3Bucket, bucket),
+		tracer.Tag(tagS3Key, key))
+	start := time.Now()
+	var uploaded, parts int64
+	defer func() {
+		span.SetTag(tagS3Size, uploaded)
+		span.Finish(tracer.WithError(err))
+
+		met := visibility.TryGetMetricsFromContext(ctx)
+		if met != nil {
+			met.AddCount(S3PartsMetric, float64(parts))
+			met.AddMetric(S3BytesUploadedMetric, float64(uploaded),
+				cloudwatch.StandardUnitBytes)
+			met.AddDuration(S3UploadTimeMetric, time.Now().Sub(start))
+		}
+	}()
+
+	buf := make([]byte, partSize)
+	n, err := readPart(reader, buf)
+	if err != nil {
+		return err
+	}
+
+	// Short data, no need for the multipart upload
+	if int64(n) < partSize {
+		err = uploadPart(ctx, 1, n, func() error {
+			_, err := client.PutObjectRequest(&s3.PutObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+				Body:   bytes.NewReader(buf[:n]),
+			}).Send(ctx)
+			return err
+		})
+		if err == nil {
+			uploaded, parts = int64(n), 1
+		}
+		return err
+	}
+
+	created, err := client.CreateMultipartUploadRequest(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}).Send(ctx)
+	if err != nil {
+		return err
+	}
+	uploadId := created.UploadId
+
+	defer func() {
+		if err != nil {
+			abortUpload(ctx, client, bucket, key, uploadId)
+		}
+	}()
+
+	var completed []s3.CompletedPart
+	for partNum := int64(1); n > 0; partNum++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var etag *string
+		err = uploadPart(ctx, partNum, n, func() error {
+			res, err := client.UploadPartRequest(&s3.UploadPartInput{
+				Bucket:     aws.String(bucket),
+				Key:        aws.String(key),
+				UploadId:   uploadId,
+				PartNumber: aws.Int64(partNum),
+				Body:       bytes.NewReader(buf[:n]),
+			}).Send(ctx)
+			if err != nil {
+				return err
+			}
+			etag = res.ETag
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		completed = append(completed, s3.CompletedPart{
+			ETag: etag, PartNumber: aws.Int64(partNum)})
+		uploaded += int64(n)
+		parts++
+
+		n, err = readPart(reader, buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = client.CompleteMultipartUploadRequest(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	}).Send(ctx)
+	return err
+}
+
+func uploadPart(ctx context.Context, partNum int64, size int, fn func() error) error {
+	span, _ := tracer.StartSpanFromContext(ctx, "s3.upload_part",
+		tracer.ResourceName("s3.upload_part"),
+		tracer.Tag(tagS3Part, partNum),
+		tracer.Tag(tagS3Size, size))
+	err := fn()
+	span.Finish(tracer.WithError(err))
+	return err
+}
+
+// Read the full part, a short read means that the data has ended
+func readPart(reader io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(reader, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, nil
+	}
+	return n, err
+}
+
+func abortUpload(ctx context.Context, client *s3.Client, bucket, key string,
+	uploadId *string) {
+
+	// The original context might be already cancelled, so use a new one that
+	// keeps the trace and the logger
+	abortCtx := context.Background()
+	logger := visibility.TryCL(ctx)
+	if logger != nil {
+		abortCtx = visibility.ImbueContext(abortCtx, logger)
+	}
+	if span, ok := tracer.SpanFromContext(ctx); ok {
+		abortCtx = tracer.ContextWithSpan(abortCtx, span)
+	}
+	abortCtx, cancel := context.WithTimeout(abortCtx, 30*time.Second)
+	defer cancel()
+
+	_, err := client.AbortMultipartUploadRequest(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: uploadId,
+	}).Send(abortCtx)
+	if err != nil && logger != nil {
+		logger.Warn("Failed to abort the multipart upload",
+			zap.String("bucket", bucket), zap.String("key", key),
+			zap.String("uploadId", aws.StringValue(uploadId)), zap.Error(err))
+	}
+}
+
+// Download the S3 object into the writer within an "s3.download" span,
+// recording the statistics in the context's MetricsContext (if it exists).
+// Returns the number of bytes downloaded.
+func DownloadTraced(ctx context.Context, client *s3.Client, bucket, key string,
+	writer io.Writer) (downloaded int64, err error) {
+
+	span, ctx := tracer.StartSpanFromContext(ctx, "s3.download",
+		tracer.ResourceName("s3.download"),
+		tracer.Tag(tagS3Bucket, bucket),
+		tracer.Tag(tagS3Key, key))
+	start := time.Now()
+	defer func() {
+		span.SetTag(tagS3Size, downloaded)
+		span.Finish(tracer.WithError(err))
+
+		met := visibility.TryGetMetricsFromContext(ctx)
+		if met != nil {
+			met.AddMetric(S3BytesDownloadedMetric, float64(downloaded),
+				cloudwatch.StandardUnitBytes)
+			met.AddDuration(S3DownloadTimeMetric, time.Now().Sub(start))
+		}
+	}()
+
+	res, err := client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}).Send(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if res.Body == nil {
+		return 0, fmt.Errorf("no body for s3://%s/%s", bucket, key)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer res.Body.Close()
+
+	return io.Copy(writer, res.Body)
+}
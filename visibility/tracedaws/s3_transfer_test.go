@@ -0,0 +1,139 @@
+package tracedaws
+
+import (
+	"bytes"
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+type s3Recorder struct {
+	cancel    context.CancelFunc
+	cancelAt  int64
+	parts     []int
+	completed []s3.CompletedPart
+	aborted   bool
+}
+
+// noinspection GoUnusedParameter
+func (r *s3Recorder) CreateMultipartUpload(ctx context.Context,
+	input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+}
+
+// noinspection GoUnusedParameter
+func (r *s3Recorder) UploadPart(ctx context.Context,
+	input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	data, _ := ioutil.ReadAll(input.Body)
+	r.parts = append(r.parts, len(data))
+	if r.cancel != nil && *input.PartNumber == r.cancelAt {
+		r.cancel()
+	}
+	return &s3.UploadPartOutput{
+		ETag: aws.String("etag-" + strconv.FormatInt(*input.PartNumber, 10))}, nil
+}
+
+// noinspection GoUnusedParameter
+func (r *s3Recorder) CompleteMultipartUpload(ctx context.Context,
+	input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	r.completed = input.MultipartUpload.Parts
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+// noinspection GoUnusedParameter
+func (r *s3Recorder) AbortMultipartUpload(ctx context.Context,
+	input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	r.aborted = true
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// noinspection GoUnusedParameter
+func (r *s3Recorder) PutObject(ctx context.Context,
+	input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, _ := ioutil.ReadAll(input.Body)
+	r.parts = append(r.parts, len(data))
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestUploadTraced(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	rec := &s3Recorder{}
+	am := utils.NewAwsMockHandler()
+	am.AddHandler(rec)
+	client := s3.New(am.AwsConfig())
+
+	ctx := visibility.MakeMetricContext(context.Background(), "Upload")
+	data := make([]byte, MinS3PartSize*2+100)
+	err := UploadTraced(ctx, client, "bucket", "key", bytes.NewReader(data), 100)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []int{MinS3PartSize, MinS3PartSize, 100}, rec.parts)
+	assert.Equal(t, 3, len(rec.completed))
+	assert.Equal(t, "etag-3", *rec.completed[2].ETag)
+	assert.False(t, rec.aborted)
+
+	met := visibility.GetMetricsFromContext(ctx)
+	assert.Equal(t, 3.0, met.GetMetricVal(S3PartsMetric))
+	assert.Equal(t, float64(len(data)), met.GetMetricVal(S3BytesUploadedMetric))
+
+	var partSpans int
+	for _, s := range mt.FinishedSpans() {
+		if s.OperationName() == "s3.upload_part" {
+			partSpans++
+		}
+	}
+	assert.Equal(t, 3, partSpans)
+
+	// Small uploads don't need the multipart upload
+	rec.parts = nil
+	err = UploadTraced(ctx, client, "bucket", "key", bytes.NewReader([]byte("hello")), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{5}, rec.parts)
+}
+
+func TestUploadTracedCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rec := &s3Recorder{cancel: cancel, cancelAt: 1}
+	am := utils.NewAwsMockHandler()
+	am.AddHandler(rec)
+	client := s3.New(am.AwsConfig())
+
+	data := make([]byte, MinS3PartSize*3)
+	err := UploadTraced(ctx, client, "bucket", "key", bytes.NewReader(data), 0)
+	assert.Equal(t, context.Canceled, err)
+
+	// The upload is aborted after the first part
+	assert.Equal(t, 1, len(rec.parts))
+	assert.True(t, rec.aborted)
+	assert.Nil(t, rec.completed)
+}
+
+func TestDownloadTraced(t *testing.T) {
+	am := utils.NewAwsMockHandler()
+	am.AddHandler(func(ctx context.Context, input *s3.GetObjectInput) (
+		*s3.GetObjectOutput, error) {
+		return &s3.GetObjectOutput{
+			Body: ioutil.NopCloser(bytes.NewReader([]byte("hello world")))}, nil
+	})
+	client := s3.New(am.AwsConfig())
+
+	ctx := visibility.MakeMetricContext(context.Background(), "Download")
+	buf := bytes.Buffer{}
+	n, err := DownloadTraced(ctx, client, "bucket", "key", &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	assert.Equal(t, "hello world", buf.String())
+	assert.Equal(t, 11.0, visibility.GetMetricsFromContext(ctx).GetMetricVal(
+		S3BytesDownloadedMetric))
+}
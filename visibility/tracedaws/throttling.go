@@ -0,0 +1,128 @@
+package tracedaws
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const AwsThrottledMetric = "AwsThrottled"
+
+const tagAWSThrottled = "aws.throttled"
+
+// ThrottledError wraps the AWS throttling errors, use errors.As to detect it.
+// RetryAfter is the delay suggested by AWS, or zero if it's unknown.
+type ThrottledError struct {
+	Service    string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (t *ThrottledError) Error() string {
+	if t.RetryAfter != 0 {
+		return fmt.Sprintf("AWS %s call is throttled (retry after %s): %s",
+			t.Service, t.RetryAfter, t.Err.Error())
+	}
+	return fmt.Sprintf("AWS %s call is throttled: %s", t.Service, t.Err.Error())
+}
+
+// The suggested delay for utils.SuggestedBackoff, also makes the throttled
+// calls retryable for utils.IsRetryable
+func (t *ThrottledError) SuggestedBackoff() time.Duration {
+	return t.RetryAfter
+}
+
+func (t *ThrottledError) Unwrap() error {
+	return t.Err
+}
+
+// ThrottledError is an awserr.Error with the code of the original error, the
+// SDK retryers use the type assertions to classify the throttling errors and
+// to choose the longer throttling delays.
+func (t *ThrottledError) Code() string {
+	if aerr, ok := t.Err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return "Throttling"
+}
+
+func (t *ThrottledError) Message() string {
+	if aerr, ok := t.Err.(awserr.Error); ok {
+		return aerr.Message()
+	}
+	return t.Err.Error()
+}
+
+// The error wrapped by the original AWS error, or the original error itself
+func (t *ThrottledError) OrigErr() error {
+	if aerr, ok := t.Err.(awserr.Error); ok {
+		if orig := errors.Unwrap(aerr); orig != nil {
+			return orig
+		}
+	}
+	return t.Err
+}
+
+var _ awserr.Error = &ThrottledError{}
+
+// Wrap the throttling errors into ThrottledError. This runs as the first
+// ShouldRetry handler, so the final error returned by Send() is wrapped as well.
+// The retryer still sees the original error code (see ThrottledError.Code).
+func (h *instrumenter) detectThrottling(req *aws.Request) {
+	if req.Error == nil {
+		return
+	}
+	if _, ok := req.Error.(*ThrottledError); ok {
+		return
+	}
+	if !isThrottlingError(req) {
+		return
+	}
+
+	service := h.awsService(req)
+	req.Error = &ThrottledError{
+		Service:    service,
+		RetryAfter: parseRetryAfter(req.HTTPResponse, time.Now()),
+		Err:        req.Error,
+	}
+
+	_ = visibility.GetStatsdFromContext(req.Context()).Count(AwsThrottledMetric, 1,
+		[]string{"service:" + service}, 1)
+}
+
+func isThrottlingError(req *aws.Request) bool {
+	if req.HTTPResponse != nil && req.HTTPResponse.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if aerr, ok := req.Error.(awserr.Error); ok {
+		return utils.IsAwsThrottlingCode(aerr.Code())
+	}
+	return false
+}
+
+// Parse the Retry-After header, it's either the number of seconds or an HTTP date
+func parseRetryAfter(resp *http.Response, now time.Time) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	val := resp.Header.Get("Retry-After")
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(val); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
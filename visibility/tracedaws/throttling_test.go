@@ -0,0 +1,84 @@
+package tracedaws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const throttledResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response><Errors><Error><Code>RequestLimitExceeded</Code>` +
+	`<Message>Request limit exceeded.</Message></Error></Errors>` +
+	`<RequestID>req-1</RequestID></Response>`
+
+const terminatedResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<TerminateInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+<requestId>req-2</requestId><instancesSet/></TerminateInstancesResponse>`
+
+func TestThrottledCallsAreRetried(t *testing.T) {
+	// Throttle the first call only
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(throttledResponse))
+			return
+		}
+		_, _ = w.Write([]byte(terminatedResponse))
+	}))
+	defer srv.Close()
+
+	// The default config has the default retryer
+	config := defaults.Config()
+	config.Region = "mock-region"
+	config.EndpointResolver = aws.ResolveWithEndpointURL(srv.URL)
+	config.Credentials = aws.StaticCredentialsProvider{
+		Value: aws.Credentials{
+			AccessKeyID: "AKID", SecretAccessKey: "SECRET", SessionToken: "SESSION",
+			Source: "unit test credentials",
+		},
+	}
+
+	ec := ec2.New(config)
+	InstrumentHandlers(&ec.Handlers)
+	rs := visibility.NewRecordingSink()
+	ctx := visibility.ContextWithStatsd(context.Background(), rs)
+
+	req := ec.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
+		InstanceIds: []string{"i-123"},
+	})
+	_, err := req.Send(ctx)
+	assert.NoError(t, err)
+
+	// The throttled call is detected, and still retried by the SDK
+	assert.True(t, req.RetryCount > 0)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, int64(1), rs.Counts[AwsThrottledMetric])
+}
+
+func TestThrottledErrorCode(t *testing.T) {
+	err := &ThrottledError{Service: "ec2",
+		Err: awserr.New("RequestLimitExceeded", "Request limit exceeded", nil)}
+	assert.Equal(t, "RequestLimitExceeded", err.Code())
+	assert.Equal(t, "Request limit exceeded", err.Message())
+	assert.Equal(t, err.Err, err.OrigErr())
+
+	orig := fmt.Errorf("connection reset")
+	err = &ThrottledError{Service: "ec2",
+		Err: awserr.New("RequestLimitExceeded", "Request limit exceeded", orig)}
+	assert.Equal(t, orig, err.OrigErr())
+
+	err = &ThrottledError{Service: "ec2", Err: fmt.Errorf("too many requests")}
+	assert.Equal(t, "Throttling", err.Code())
+	assert.Equal(t, err.Err, err.OrigErr())
+}
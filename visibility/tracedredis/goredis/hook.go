@@ -0,0 +1,66 @@
+// The go-redis (v9) hook tracing the commands with tracedredis. It's a separate
+// module, as go-redis requires a newer Go version than the main one.
+package goredis
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/visibility/tracedredis"
+	"github.com/redis/go-redis/v9"
+)
+
+const pipelineCommand = "pipeline"
+
+// The hook for redis.Client.AddHook, the commands are traced and counted by
+// tracedredis.Tracer. The pipelines are traced as one "redis.pipeline" call.
+type Hook struct {
+	tracer *tracedredis.Tracer
+}
+
+var _ redis.Hook = (*Hook)(nil)
+
+// Create the hook with the tracedredis options, the redis.Nil errors are
+// always counted as misses.
+func NewHook(opts ...tracedredis.Option) *Hook {
+	opts = append([]tracedredis.Option{tracedredis.WithMissError(redis.Nil)}, opts...)
+	return &Hook{tracer: tracedredis.NewTracer(opts...)}
+}
+
+func (h *Hook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *Hook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		// The first argument is the command name itself
+		var args []interface{}
+		if cmdArgs := cmd.Args(); len(cmdArgs) > 1 {
+			args = cmdArgs[1:]
+		}
+		sent := false
+		err := h.tracer.Do(ctx, cmd.Name(), args, func(ctx context.Context) error {
+			sent = true
+			return next(ctx, cmd)
+		})
+		if !sent {
+			// The context is already done
+			cmd.SetErr(err)
+		}
+		return err
+	}
+}
+
+func (h *Hook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		sent := false
+		err := h.tracer.Do(ctx, pipelineCommand, nil, func(ctx context.Context) error {
+			sent = true
+			return next(ctx, cmds)
+		})
+		if !sent {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+		}
+		return err
+	}
+}
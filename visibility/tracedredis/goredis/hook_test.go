@@ -0,0 +1,105 @@
+package goredis
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/cyberax/go-dd-service-base/visibility/tracedredis"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"testing"
+)
+
+func newTestClient(t *testing.T, opts ...tracedredis.Option) *redis.Client {
+	srv := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	client.AddHook(NewHook(opts...))
+	return client
+}
+
+func TestHook(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	client := newTestClient(t, tracedredis.WithServiceName("cache"),
+		tracedredis.WithAnalyticsRate(0.5))
+	ctx := visibility.MakeMetricContext(context.Background(), "Test")
+
+	assert.NoError(t, client.Set(ctx, "user:42", "v", 0).Err())
+	val, err := client.Get(ctx, "user:42").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, "v", val)
+	_, err = client.Get(ctx, "user:43").Result()
+	assert.Equal(t, redis.Nil, err)
+	assert.Error(t, client.Incr(ctx, "user:42").Err())
+
+	met := visibility.GetMetricsFromContext(ctx)
+	assert.Equal(t, 4.0, met.GetMetricVal(tracedredis.CallsMetric))
+	assert.Equal(t, 1.0, met.GetMetricVal(tracedredis.MissesMetric))
+	assert.Equal(t, 1.0, met.GetMetricVal(tracedredis.ErrorsMetric))
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 4, len(spans))
+	assert.Equal(t, "redis.set", spans[0].OperationName())
+	assert.Equal(t, "SET user:?", spans[0].Tag(ext.ResourceName))
+	assert.Equal(t, "cache", spans[0].Tag(ext.ServiceName))
+	assert.Equal(t, 0.5, spans[0].Tag(ext.EventSampleRate))
+	assert.Nil(t, spans[0].Tag(ext.Error))
+
+	assert.Equal(t, "redis.get", spans[1].OperationName())
+	assert.Nil(t, spans[1].Tag(ext.Error))
+	// The miss is not an error
+	assert.Equal(t, "GET user:?", spans[2].Tag(ext.ResourceName))
+	assert.Equal(t, true, spans[2].Tag("redis.miss"))
+	assert.Nil(t, spans[2].Tag(ext.Error))
+	assert.Equal(t, "redis.incr", spans[3].OperationName())
+	assert.NotNil(t, spans[3].Tag(ext.Error))
+}
+
+func TestHookPipeline(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	client := newTestClient(t)
+	ctx := visibility.MakeMetricContext(context.Background(), "Test")
+
+	pipe := client.Pipeline()
+	pipe.Set(ctx, "key", "v", 0)
+	get := pipe.Get(ctx, "key")
+	_, err := pipe.Exec(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v", get.Val())
+
+	met := visibility.GetMetricsFromContext(ctx)
+	assert.Equal(t, 1.0, met.GetMetricVal(tracedredis.CallsMetric))
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "redis.pipeline", spans[0].OperationName())
+	assert.Equal(t, "redis", spans[0].Tag(ext.ServiceName))
+}
+
+func TestHookCancellation(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	client := newTestClient(t)
+	ctx, cancel := context.WithCancel(
+		visibility.MakeMetricContext(context.Background(), "Test"))
+	cancel()
+
+	get := client.Get(ctx, "key")
+	assert.Equal(t, context.Canceled, get.Err())
+
+	met := visibility.GetMetricsFromContext(ctx)
+	assert.Equal(t, 1.0, met.GetMetricVal(tracedredis.CallsMetric))
+	assert.Equal(t, 0.0, met.GetMetricVal(tracedredis.ErrorsMetric))
+	span := mt.FinishedSpans()[0]
+	assert.Equal(t, true, span.Tag(visibility.CancelledTag))
+	assert.Nil(t, span.Tag(ext.Error))
+}
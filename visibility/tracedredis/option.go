@@ -0,0 +1,58 @@
+package tracedredis
+
+import (
+	"math"
+)
+
+type config struct {
+	serviceName   string
+	analyticsRate float64
+	missErrors    []error
+}
+
+// Option represents an option that can be passed to NewTracer.
+type Option func(*config)
+
+func defaults(cfg *config) {
+	cfg.serviceName = "redis"
+	cfg.analyticsRate = math.NaN()
+}
+
+// WithServiceName sets the given service name for the Redis spans.
+func WithServiceName(name string) Option {
+	return func(cfg *config) {
+		cfg.serviceName = name
+	}
+}
+
+// WithAnalytics enables Trace Analytics for all started spans.
+func WithAnalytics(on bool) Option {
+	return func(cfg *config) {
+		if on {
+			cfg.analyticsRate = 1.0
+		} else {
+			cfg.analyticsRate = math.NaN()
+		}
+	}
+}
+
+// WithAnalyticsRate sets the sampling rate for Trace Analytics events
+// correlated to started spans.
+func WithAnalyticsRate(rate float64) Option {
+	return func(cfg *config) {
+		if rate >= 0.0 && rate <= 1.0 {
+			cfg.analyticsRate = rate
+		} else {
+			cfg.analyticsRate = math.NaN()
+		}
+	}
+}
+
+// WithMissError sets the error that means a missing key (goredis.NewHook adds
+// redis.Nil), the commands failing with it are counted as misses and not
+// as errors.
+func WithMissError(err error) Option {
+	return func(cfg *config) {
+		cfg.missErrors = append(cfg.missErrors, err)
+	}
+}
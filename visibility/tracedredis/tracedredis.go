@@ -0,0 +1,198 @@
+// Package tracedredis traces the Redis commands and records their metrics,
+// independently of the client library. For the go-redis (v9) client, add the
+// hook from the visibility/tracedredis/goredis module:
+//
+//	client.AddHook(goredis.NewHook(tracedredis.WithServiceName("cache")))
+//
+// The other clients can wrap their calls with Tracer.Do, or with
+// Tracer.StartCommand and Command.Finish.
+package tracedredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	CallsMetric  = "Redis.Calls"
+	TimeMetric   = "Redis.Time"
+	ErrorsMetric = "Redis.Errors"
+	MissesMetric = "Redis.Misses"
+
+	tagRedisCommand    = "redis.command"
+	tagRedisKeyPattern = "redis.key_pattern"
+	tagRedisMiss       = "redis.miss"
+)
+
+var uuidSegment = regexp.MustCompile(
+	`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+var hexSegment = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+var numericSegment = regexp.MustCompile(`^[0-9]+$`)
+
+type Tracer struct {
+	cfg *config
+}
+
+func NewTracer(opts ...Option) *Tracer {
+	cfg := new(config)
+	defaults(cfg)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return &Tracer{cfg: cfg}
+}
+
+// The in-flight Redis command, started with Tracer.StartCommand
+type Command struct {
+	tracer *Tracer
+	ctx    context.Context
+	span   tracer.Span
+	start  time.Time
+}
+
+// Start the span of the command, named "redis.<command>", with the pattern of
+// its key (see KeyPattern) in the resource name. The args are the command's
+// arguments, the first one is taken as the key. The scripts of EVAL are never
+// put into the resource, EVALSHA is identified by the SHA and the first key. The
+// returned context has the command's span.
+func (t *Tracer) StartCommand(ctx context.Context, command string,
+	args ...interface{}) (*Command, context.Context) {
+
+	command = strings.ToLower(command)
+	resource := strings.ToUpper(command)
+	var key interface{}
+	switch command {
+	case "eval", "eval_ro", "evalsha", "evalsha_ro":
+		// The script (or its SHA) is followed by the number of keys and the keys
+		if sha, ok := firstArg(args).(string); ok && strings.HasPrefix(command, "evalsha") {
+			resource += " " + sha
+		}
+		if len(args) > 2 && fmt.Sprint(args[1]) != "0" {
+			key = args[2]
+		}
+	default:
+		key = firstArg(args)
+	}
+	var pattern string
+	if key, ok := key.(string); ok {
+		pattern = KeyPattern(key)
+		resource += " " + pattern
+	}
+
+	opts := []ddtrace.StartSpanOption{
+		tracer.SpanType(ext.SpanTypeRedis),
+		tracer.ServiceName(t.cfg.serviceName),
+		tracer.ResourceName(resource),
+		tracer.Tag(tagRedisCommand, command),
+	}
+	if pattern != "" {
+		opts = append(opts, tracer.Tag(tagRedisKeyPattern, pattern))
+	}
+	if !math.IsNaN(t.cfg.analyticsRate) {
+		opts = append(opts, tracer.Tag(ext.EventSampleRate, t.cfg.analyticsRate))
+	}
+	span, ctx := tracer.StartSpanFromContext(ctx, "redis."+command, opts...)
+
+	return &Command{
+		tracer: t,
+		ctx:    ctx,
+		span:   span,
+		start:  utils.ClockFromContext(ctx).Now(),
+	}, ctx
+}
+
+// Finish the command's span and record its metrics into the MetricsContext of
+// the context: the calls, the time, and the errors or the misses. The cancelled
+// commands are tagged as such, and are not counted as errors.
+func (c *Command) Finish(err error) {
+	duration := utils.ClockFromContext(c.ctx).Now().Sub(c.start)
+	met := visibility.TryGetMetricsFromContext(c.ctx)
+	if met != nil {
+		met.AddCount(CallsMetric, 1)
+		met.AddDuration(TimeMetric, duration)
+	}
+
+	switch {
+	case err == nil:
+		c.span.Finish()
+	case c.tracer.isMiss(err):
+		if met != nil {
+			met.AddCount(MissesMetric, 1)
+		}
+		c.span.SetTag(tagRedisMiss, true)
+		c.span.Finish()
+	case visibility.IsCancellation(c.ctx, err):
+		c.span.SetTag(visibility.CancelledTag, true)
+		c.span.Finish()
+	default:
+		if met != nil {
+			met.AddCount(ErrorsMetric, 1)
+		}
+		c.span.Finish(tracer.WithError(err))
+	}
+}
+
+// Run the command with the function doing the actual call, tracing it like
+// StartCommand and Finish. The function is not called if the context is
+// already done.
+func (t *Tracer) Do(ctx context.Context, command string, args []interface{},
+	fn func(ctx context.Context) error) error {
+
+	cmd, ctx := t.StartCommand(ctx, command, args...)
+	err := ctx.Err()
+	if err == nil {
+		err = fn(ctx)
+	}
+	cmd.Finish(err)
+	return err
+}
+
+func (t *Tracer) isMiss(err error) bool {
+	for _, e := range t.cfg.missErrors {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func firstArg(args []interface{}) interface{} {
+	if len(args) == 0 {
+		return nil
+	}
+	return args[0]
+}
+
+// Get the pattern of the key for the span resources, replacing its variable
+// segments (separated by ':', '/' or '.') with '?': the numbers, the UUIDs and
+// the long hex strings. E.g. "user:1234:profile" becomes "user:?:profile".
+func KeyPattern(key string) string {
+	var res strings.Builder
+	segStart := 0
+	for i := 0; i <= len(key); i++ {
+		if i < len(key) && !strings.ContainsRune(":/.", rune(key[i])) {
+			continue
+		}
+		seg := key[segStart:i]
+		if numericSegment.MatchString(seg) || uuidSegment.MatchString(seg) ||
+			hexSegment.MatchString(seg) {
+			seg = "?"
+		}
+		res.WriteString(seg)
+		if i < len(key) {
+			res.WriteByte(key[i])
+		}
+		segStart = i + 1
+	}
+	return res.String()
+}
@@ -0,0 +1,110 @@
+package tracedredis
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"testing"
+)
+
+var errNil = fmt.Errorf("redis: nil")
+
+func TestKeyPattern(t *testing.T) {
+	assert.Equal(t, "user:?:profile", KeyPattern("user:1234:profile"))
+	assert.Equal(t, "session:?", KeyPattern("session:0f8c6e3a-1b2c-4d5e-8f90-123456789abc"))
+	assert.Equal(t, "blob/?.json", KeyPattern("blob/0123456789abcdef0123.json"))
+	assert.Equal(t, "config:v2", KeyPattern("config:v2"))
+	assert.Equal(t, "", KeyPattern(""))
+}
+
+func TestTracer(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx := visibility.MakeMetricContext(context.Background(), "Test")
+	tr := NewTracer(WithServiceName("cache"), WithAnalyticsRate(0.5),
+		WithMissError(errNil))
+
+	err := tr.Do(ctx, "GET", []interface{}{"user:42"}, func(ctx context.Context) error {
+		return nil
+	})
+	assert.NoError(t, err)
+
+	err = tr.Do(ctx, "GET", []interface{}{"user:43"}, func(ctx context.Context) error {
+		return fmt.Errorf("wrapped: %w", errNil)
+	})
+	assert.Error(t, err)
+
+	err = tr.Do(ctx, "SET", []interface{}{"user:44", "v"}, func(ctx context.Context) error {
+		return fmt.Errorf("connection refused")
+	})
+	assert.Error(t, err)
+
+	met := visibility.GetMetricsFromContext(ctx)
+	assert.Equal(t, 3.0, met.GetMetricVal(CallsMetric))
+	assert.Equal(t, 1.0, met.GetMetricVal(MissesMetric))
+	assert.Equal(t, 1.0, met.GetMetricVal(ErrorsMetric))
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, "redis.get", spans[0].OperationName())
+	assert.Equal(t, "GET user:?", spans[0].Tag(ext.ResourceName))
+	assert.Equal(t, "cache", spans[0].Tag(ext.ServiceName))
+	assert.Equal(t, 0.5, spans[0].Tag(ext.EventSampleRate))
+	assert.Nil(t, spans[0].Tag(ext.Error))
+
+	// The miss is not an error
+	assert.Equal(t, true, spans[1].Tag(tagRedisMiss))
+	assert.Nil(t, spans[1].Tag(ext.Error))
+	assert.Equal(t, "SET user:?", spans[2].Tag(ext.ResourceName))
+	assert.NotNil(t, spans[2].Tag(ext.Error))
+}
+
+func TestTracerScripts(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx := visibility.MakeMetricContext(context.Background(), "Test")
+	tr := NewTracer()
+	noop := func(ctx context.Context) error {
+		return nil
+	}
+	script := "return redis.call('GET', KEYS[1])"
+	sha := "e0e1f9fabfc9d4800c877a703b823ac0578ff8db"
+	assert.NoError(t, tr.Do(ctx, "EVAL", []interface{}{script, 1, "user:42"}, noop))
+	assert.NoError(t, tr.Do(ctx, "evalsha", []interface{}{sha, "1", "user:43"}, noop))
+	assert.NoError(t, tr.Do(ctx, "EVAL", []interface{}{script, 0}, noop))
+
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, "redis.eval", spans[0].OperationName())
+	assert.Equal(t, "EVAL user:?", spans[0].Tag(ext.ResourceName))
+	assert.Equal(t, "EVALSHA "+sha+" user:?", spans[1].Tag(ext.ResourceName))
+	assert.Equal(t, "EVAL", spans[2].Tag(ext.ResourceName))
+}
+
+func TestTracerCancellation(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	ctx, cancel := context.WithCancel(
+		visibility.MakeMetricContext(context.Background(), "Test"))
+	cancel()
+
+	called := false
+	err := NewTracer().Do(ctx, "GET", []interface{}{"key"}, func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, called)
+
+	met := visibility.GetMetricsFromContext(ctx)
+	assert.Equal(t, 0.0, met.GetMetricVal(ErrorsMetric))
+	span := mt.FinishedSpans()[0]
+	assert.Equal(t, true, span.Tag(visibility.CancelledTag))
+	assert.Nil(t, span.Tag(ext.Error))
+}
@@ -3,11 +3,14 @@ package tracedsql
 import (
 	"context"
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/rds"
-	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/cyberax/go-dd-service-base/utils"
 	"github.com/lib/pq"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,6 +19,9 @@ import (
 
 const MaxRdsRetriesSec = 5
 
+// The default DataDog service of the database spans
+const DefaultServiceName = "postgres"
+
 type PgConnectorWithRds struct {
 	config aws.Config
 	isRds  bool
@@ -28,6 +34,13 @@ type PgConnectorWithRds struct {
 	sslMode   string
 	sslCaPath string
 
+	serviceName        string
+	resourceNormalizer func(query string) string
+
+	// The result limits of the queries (see WithMaxRows)
+	maxRows        int
+	maxResultBytes int64
+
 	mtx        sync.Mutex
 	connString string
 	delegate   driver.Connector
@@ -37,7 +50,7 @@ type PgConnectorWithRds struct {
 // resolving RDS endpoints and AWS secrets-based authentication.
 // Example conn string: "rdsDb=terra-rds dbName=terra secretName=terra-rds-admin"
 func MakePgConnector(ctx context.Context, connStr string, sslCaPath string,
-	config aws.Config) (*PgConnectorWithRds, error) {
+	config aws.Config, opts ...Option) (*PgConnectorWithRds, error) {
 
 	// Not an RDS-format connection string?
 	if strings.HasPrefix(connStr, "postgres://") {
@@ -51,6 +64,9 @@ func MakePgConnector(ctx context.Context, connStr string, sslCaPath string,
 			connString: connStr,
 			delegate:   connector,
 		}
+		for _, opt := range opts {
+			opt(res)
+		}
 		return res, nil
 	}
 
@@ -99,17 +115,20 @@ func MakePgConnector(ctx context.Context, connStr string, sslCaPath string,
 	}
 
 	res := &PgConnectorWithRds{
-		isRds:            true,
-		config:           config,
-		connString:       connStr,
-		rdsDb:            rdsDb,
-		postgresDbName:   dbName,
-		sslMode:          sslMode,
-		sslCaPath:        sslCaPath,
-		user:             user,
-		secretName:       secretName,
-		host:             host,
-		port:             int32(port),
+		isRds:          true,
+		config:         config,
+		connString:     connStr,
+		rdsDb:          rdsDb,
+		postgresDbName: dbName,
+		sslMode:        sslMode,
+		sslCaPath:      sslCaPath,
+		user:           user,
+		secretName:     secretName,
+		host:           host,
+		port:           int32(port),
+	}
+	for _, opt := range opts {
+		opt(res)
 	}
 
 	err := res.Ping(ctx)
@@ -141,24 +160,7 @@ func resolveHost(ctx context.Context, config aws.Config, db string) (string, int
 }
 
 func (pc *PgConnectorWithRds) getCurrentPassword(ctx context.Context) (string, error) {
-	sm := secretsmanager.New(pc.config)
-
-	//Create a Secrets Manager client
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(pc.secretName),
-		// VersionStage defaults to AWSCURRENT if unspecified
-		VersionStage: aws.String("AWSCURRENT"),
-	}
-
-	result, err := sm.GetSecretValueRequest(input).Send(ctx)
-	if err != nil {
-		return "", err
-	}
-
-	if aws.StringValue(result.SecretString) == "" {
-		return "", fmt.Errorf("no string secret")
-	}
-	return *result.SecretString, nil
+	return utils.GetSecretString(ctx, pc.config, pc.secretName)
 }
 
 func (pc *PgConnectorWithRds) getConnString(pass string) string {
@@ -209,32 +211,61 @@ func (pc *PgConnectorWithRds) tryConnection(ctx context.Context) (driver.Conn, e
 }
 
 func (pc *PgConnectorWithRds) Connect(ctx context.Context) (driver.Conn, error) {
+	span, ctx := tracer.StartSpanFromContext(ctx, "postgres.connect",
+		tracer.ServiceName(pc.getServiceName()),
+		tracer.SpanType(ext.SpanTypeSQL),
+		tracer.ResourceName("connect"),
+		tracer.Tag(ext.DBType, "postgres"),
+		tracer.Tag(ext.DBInstance, pc.postgresDbName))
+
+	conn, err := pc.connect(ctx)
+	span.Finish(tracer.WithError(err))
+	if err != nil {
+		return nil, err
+	}
+	// Always wrapped, the limits can be set per query and the queries are
+	// counted. The optional interfaces of the connection are forwarded.
+	return &limitedConn{Conn: conn, limits: resultLimits{
+		maxRows: pc.maxRows, maxBytes: pc.maxResultBytes}}, nil
+}
+
+func (pc *PgConnectorWithRds) connect(ctx context.Context) (driver.Conn, error) {
 	if !pc.isRds {
 		return pc.delegate.Connect(ctx)
 	}
 
 	// A small retry loop to compensate for the possibility of secret rotation
-	start := time.Now().Unix()
-	for ; ; {
+	// and for the transient failures
+	clock := utils.ClockFromContext(ctx)
+	start := clock.Now().Unix()
+	for {
 		conn, err := pc.tryConnection(ctx)
 		if err == nil {
 			return conn, err
 		}
 
-		if time.Now().Unix()-start > MaxRdsRetriesSec {
+		if clock.Now().Unix()-start > MaxRdsRetriesSec ||
+			!(utils.IsRetryable(err) || isAuthFailure(err)) {
 			return nil, err
 		}
 
-		timer := time.NewTimer(200 * time.Millisecond)
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-timer.C:
-		default:
+		delay := 200 * time.Millisecond
+		if suggested := utils.SuggestedBackoff(err); suggested > delay {
+			delay = suggested
+		}
+		if err := clock.Sleep(ctx, delay); err != nil {
+			return nil, err
 		}
 	}
 }
 
+// The password may have just been rotated (invalid_authorization_specification
+// or invalid_password), it's re-read on the next attempt
+func isAuthFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "28000" || pqErr.Code == "28P01")
+}
+
 func (pc *PgConnectorWithRds) Ping(ctx context.Context) error {
 	conn, err := pc.Connect(ctx)
 	if err != nil {
@@ -245,3 +276,50 @@ func (pc *PgConnectorWithRds) Ping(ctx context.Context) error {
 
 	return conn.(driver.Pinger).Ping(ctx)
 }
+
+// Set the DataDog service name of the database spans, so that they are shown
+// as a separate service in the service map (DefaultServiceName by default)
+func (pc *PgConnectorWithRds) SetServiceName(name string) {
+	pc.serviceName = name
+}
+
+// Set the function used to turn the queries into the span resource names,
+// NormalizeSQL by default
+func (pc *PgConnectorWithRds) SetResourceNormalizer(normalizer func(query string) string) {
+	pc.resourceNormalizer = normalizer
+}
+
+// Start a span for the SQL query, with the normalized query as its resource
+func (pc *PgConnectorWithRds) StartQuerySpan(ctx context.Context,
+	query string) (tracer.Span, context.Context) {
+
+	normalizer := pc.resourceNormalizer
+	if normalizer == nil {
+		normalizer = NormalizeSQL
+	}
+	return tracer.StartSpanFromContext(ctx, "postgres.query",
+		tracer.ServiceName(pc.getServiceName()),
+		tracer.SpanType(ext.SpanTypeSQL),
+		tracer.ResourceName(normalizer(query)),
+		tracer.Tag(ext.DBType, "postgres"),
+		tracer.Tag(ext.DBInstance, pc.postgresDbName))
+}
+
+// Run the query function in the query span (see StartQuerySpan). The queries
+// of the connector's connections are counted in the "Deps.postgres.*" metrics
+// by the connections themselves.
+func (pc *PgConnectorWithRds) TraceQuery(ctx context.Context, query string,
+	fn func(ctx context.Context) error) error {
+
+	span, ctx := pc.StartQuerySpan(ctx, query)
+	err := fn(ctx)
+	span.Finish(tracer.WithError(err))
+	return err
+}
+
+func (pc *PgConnectorWithRds) getServiceName() string {
+	if pc.serviceName == "" {
+		return DefaultServiceName
+	}
+	return pc.serviceName
+}
@@ -0,0 +1,395 @@
+package tracedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"reflect"
+	"time"
+)
+
+const (
+	// The number of the query results cut short by the limits
+	TruncatedMetric = "DB.Truncated"
+	// Set on the span of the query whose result was cut short
+	TruncatedTag = "db.truncated"
+
+	// The dependency of the queries, counted in "Deps.postgres.*"
+	PostgresDependency = "postgres"
+)
+
+// Returned by the rows' Next (so it's the sql.Rows.Err) once the result of the
+// query is over the row or the byte limit. The error is wrapped with the
+// details, check it with errors.Is.
+var ErrResultTruncated = errors.New("the query result is over the limit")
+
+// Option represents an option that can be passed to MakePgConnector.
+type Option func(pc *PgConnectorWithRds)
+
+// WithMaxRows limits the number of the rows each query can return, zero
+// disables the limit. It can be overridden per query with WithRowLimit.
+func WithMaxRows(n int) Option {
+	return func(pc *PgConnectorWithRds) {
+		pc.maxRows = n
+	}
+}
+
+// WithMaxResultBytes limits the total size of the values each query can
+// return, zero disables the limit. It can be overridden per query with
+// WithResultBytesLimit.
+func WithMaxResultBytes(n int64) Option {
+	return func(pc *PgConnectorWithRds) {
+		pc.maxResultBytes = n
+	}
+}
+
+type rowLimitKey struct{}
+
+var rowLimitKeyVal = &rowLimitKey{}
+
+type bytesLimitKey struct{}
+
+var bytesLimitKeyVal = &bytesLimitKey{}
+
+// Override the connector's row limit for the queries run with the context,
+// zero (or a negative value) disables the limit, e.g. for the known large
+// exports
+func WithRowLimit(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, rowLimitKeyVal, n)
+}
+
+// Override the connector's result size limit for the queries run with the
+// context, zero (or a negative value) disables the limit
+func WithResultBytesLimit(ctx context.Context, n int64) context.Context {
+	return context.WithValue(ctx, bytesLimitKeyVal, n)
+}
+
+type resultLimits struct {
+	maxRows  int
+	maxBytes int64
+}
+
+func (l resultLimits) forContext(ctx context.Context) resultLimits {
+	if n, ok := ctx.Value(rowLimitKeyVal).(int); ok {
+		l.maxRows = n
+	}
+	if n, ok := ctx.Value(bytesLimitKeyVal).(int64); ok {
+		l.maxBytes = n
+	}
+	return l
+}
+
+// The connection enforcing the limits on the rows of its queries, and counting
+// the queries in the Deps.postgres.* metrics (see visibility.RecordDependencyCall).
+// The optional driver interfaces of the wrapped connection are forwarded, or
+// skipped with driver.ErrSkip so that database/sql falls back.
+type limitedConn struct {
+	driver.Conn
+	limits resultLimits
+}
+
+var (
+	_ driver.QueryerContext     = &limitedConn{}
+	_ driver.ExecerContext      = &limitedConn{}
+	_ driver.ConnBeginTx        = &limitedConn{}
+	_ driver.ConnPrepareContext = &limitedConn{}
+	_ driver.Pinger             = &limitedConn{}
+	_ driver.NamedValueChecker  = &limitedConn{}
+	_ driver.SessionResetter    = &limitedConn{}
+	_ driver.Validator          = &limitedConn{}
+)
+
+func (c *limitedConn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := utils.ClockFromContext(ctx).Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	recordQuery(ctx, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return newLimitedRows(ctx, rows, c.limits.forContext(ctx)), nil
+}
+
+func (c *limitedConn) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Result, error) {
+
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := utils.ClockFromContext(ctx).Now()
+	res, err := execer.ExecContext(ctx, query, args)
+	recordQuery(ctx, start, err)
+	return res, err
+}
+
+// Count the query in the Deps.postgres.* metrics of the context. The queries
+// skipped with driver.ErrSkip are retried by database/sql (as the prepared
+// statements), and counted then.
+func recordQuery(ctx context.Context, start time.Time, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	visibility.RecordDependencyCall(ctx, PostgresDependency,
+		utils.ClockFromContext(ctx).Now().Sub(start))
+}
+
+func (c *limitedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	//noinspection GoDeprecation
+	return c.Conn.Begin()
+}
+
+func (c *limitedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *limitedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *limitedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *limitedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *limitedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *limitedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &limitedStmt{Stmt: stmt, ctx: ctx, limits: c.limits}, nil
+}
+
+// The statement enforcing the limits, its Query (without a context) uses the
+// context it was prepared with
+type limitedStmt struct {
+	driver.Stmt
+	ctx    context.Context
+	limits resultLimits
+}
+
+var (
+	_ driver.StmtQueryContext  = &limitedStmt{}
+	_ driver.StmtExecContext   = &limitedStmt{}
+	_ driver.NamedValueChecker = &limitedStmt{}
+	_ driver.ColumnConverter   = &limitedStmt{}
+)
+
+func (s *limitedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	start := utils.ClockFromContext(s.ctx).Now()
+	//noinspection GoDeprecation
+	rows, err := s.Stmt.Query(args)
+	recordQuery(s.ctx, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return newLimitedRows(s.ctx, rows, s.limits.forContext(s.ctx)), nil
+}
+
+func (s *limitedStmt) ExecContext(ctx context.Context,
+	args []driver.NamedValue) (driver.Result, error) {
+
+	start := utils.ClockFromContext(ctx).Now()
+	var res driver.Result
+	var err error
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = execer.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedToValues(args); err != nil {
+			return nil, err
+		}
+		//noinspection GoDeprecation
+		res, err = s.Stmt.Exec(values)
+	}
+	recordQuery(ctx, start, err)
+	return res, err
+}
+
+func (s *limitedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (s *limitedStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if converter, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return converter.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+func (s *limitedStmt) QueryContext(ctx context.Context,
+	args []driver.NamedValue) (driver.Rows, error) {
+
+	start := utils.ClockFromContext(ctx).Now()
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedToValues(args); err != nil {
+			return nil, err
+		}
+		//noinspection GoDeprecation
+		rows, err = s.Stmt.Query(values)
+	}
+	recordQuery(ctx, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return newLimitedRows(ctx, rows, s.limits.forContext(ctx)), nil
+}
+
+func namedToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("the driver does not support the named parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+// The rows counting the returned rows and their sizes
+type limitedRows struct {
+	driver.Rows
+	ctx    context.Context
+	limits resultLimits
+
+	rows      int
+	bytes     int64
+	truncated error
+}
+
+func newLimitedRows(ctx context.Context, rows driver.Rows, limits resultLimits) driver.Rows {
+	if limits.maxRows <= 0 && limits.maxBytes <= 0 {
+		return rows
+	}
+	return &limitedRows{Rows: rows, ctx: ctx, limits: limits}
+}
+
+func (r *limitedRows) Next(dest []driver.Value) error {
+	if r.truncated != nil {
+		return r.truncated
+	}
+	if err := r.Rows.Next(dest); err != nil {
+		return err
+	}
+
+	r.rows++
+	for _, v := range dest {
+		r.bytes += valueSize(v)
+	}
+	if r.limits.maxRows > 0 && r.rows > r.limits.maxRows {
+		r.truncate(fmt.Errorf("%w: more than %d rows", ErrResultTruncated,
+			r.limits.maxRows))
+	} else if r.limits.maxBytes > 0 && r.bytes > r.limits.maxBytes {
+		r.truncate(fmt.Errorf("%w: more than %d bytes", ErrResultTruncated,
+			r.limits.maxBytes))
+	}
+	return r.truncated
+}
+
+func (r *limitedRows) truncate(err error) {
+	r.truncated = err
+	visibility.SpanFromContextOrNoop(r.ctx).SetTag(TruncatedTag, true)
+	if met := visibility.TryGetMetricsFromContext(r.ctx); met != nil {
+		met.AddCount(TruncatedMetric, 1)
+	}
+}
+
+// The approximate size of the value, the fixed-size values count as 8 bytes
+func valueSize(v driver.Value) int64 {
+	switch val := v.(type) {
+	case []byte:
+		return int64(len(val))
+	case string:
+		return int64(len(val))
+	case nil:
+		return 0
+	default:
+		return 8
+	}
+}
+
+func (r *limitedRows) HasNextResultSet() bool {
+	if next, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return next.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *limitedRows) NextResultSet() error {
+	if next, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return next.NextResultSet()
+	}
+	return fmt.Errorf("the driver does not support multiple result sets")
+}
+
+func (r *limitedRows) ColumnTypeScanType(index int) reflect.Type {
+	if ct, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return ct.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *limitedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if ct, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return ct.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *limitedRows) ColumnTypeLength(index int) (int64, bool) {
+	if ct, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return ct.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *limitedRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if ct, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return ct.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
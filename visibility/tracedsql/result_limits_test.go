@@ -0,0 +1,234 @@
+package tracedsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"io"
+	"testing"
+)
+
+// The connection returning the rows "row-0", "row-1"... of the count from the
+// query "rows <count>"
+type fakeConn struct{}
+
+func (f *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{query: query}, nil
+}
+
+func (f *fakeConn) Close() error {
+	return nil
+}
+
+func (f *fakeConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (f *fakeConn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+	return makeFakeRows(query)
+}
+
+type fakeStmt struct {
+	query string
+}
+
+func (f *fakeStmt) Close() error {
+	return nil
+}
+
+func (f *fakeStmt) NumInput() int {
+	return 0
+}
+
+func (f *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (f *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return makeFakeRows(f.query)
+}
+
+type fakeRows struct {
+	count, cur int
+}
+
+func makeFakeRows(query string) (driver.Rows, error) {
+	rows := &fakeRows{}
+	_, err := fmt.Sscanf(query, "rows %d", &rows.count)
+	return rows, err
+}
+
+func (f *fakeRows) Columns() []string {
+	return []string{"value"}
+}
+
+func (f *fakeRows) Close() error {
+	return nil
+}
+
+func (f *fakeRows) Next(dest []driver.Value) error {
+	if f.cur == f.count {
+		return io.EOF
+	}
+	dest[0] = fmt.Sprintf("row-%d", f.cur)
+	f.cur++
+	return nil
+}
+
+type fakeConnector struct {
+	limits resultLimits
+}
+
+func (f *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &limitedConn{Conn: &fakeConn{}, limits: f.limits}, nil
+}
+
+func (f *fakeConnector) Driver() driver.Driver {
+	return nil
+}
+
+func readAll(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer rows.Close()
+
+	var res []string
+	for rows.Next() {
+		var val string
+		if err = rows.Scan(&val); err != nil {
+			return nil, err
+		}
+		res = append(res, val)
+	}
+	return res, rows.Err()
+}
+
+func TestResultLimits(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	db := sql.OpenDB(&fakeConnector{limits: resultLimits{maxRows: 3}})
+	//noinspection GoUnhandledErrorResult
+	defer db.Close()
+	ctx := visibility.MakeMetricContext(context.Background(), "TestOp")
+
+	res, err := readAll(ctx, db, "rows 3")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(res))
+
+	span, spanCtx := tracer.StartSpanFromContext(ctx, "query")
+	res, err = readAll(spanCtx, db, "rows 5")
+	span.Finish()
+	assert.True(t, errors.Is(err, ErrResultTruncated))
+	assert.Equal(t, []string{"row-0", "row-1", "row-2"}, res)
+	assert.Equal(t, true, mt.FinishedSpans()[0].Tag(TruncatedTag))
+	assert.Equal(t, 1.0, visibility.GetMetricsFromContext(ctx).GetMetricVal(TruncatedMetric))
+
+	// The exports can opt out
+	res, err = readAll(WithRowLimit(ctx, 0), db, "rows 5")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(res))
+
+	// The byte limit, each row is 5 bytes
+	res, err = readAll(WithResultBytesLimit(ctx, 12), db, "rows 3")
+	assert.True(t, errors.Is(err, ErrResultTruncated))
+	assert.Equal(t, 2, len(res))
+
+	// The prepared statements are limited too
+	stmt, err := db.PrepareContext(ctx, "rows 5")
+	assert.NoError(t, err)
+	rows, err := stmt.QueryContext(ctx)
+	assert.NoError(t, err)
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	assert.True(t, errors.Is(rows.Err(), ErrResultTruncated))
+	assert.Equal(t, 3, count)
+	_ = stmt.Close()
+}
+
+// The connection implementing the optional driver interfaces
+type optionalConn struct {
+	fakeConn
+	prepareCtx context.Context
+}
+
+func (f *optionalConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return driver.ErrRemoveArgument
+}
+
+func (f *optionalConn) ResetSession(ctx context.Context) error {
+	return driver.ErrBadConn
+}
+
+func (f *optionalConn) IsValid() bool {
+	return false
+}
+
+func (f *optionalConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	f.prepareCtx = ctx
+	return f.Prepare(query)
+}
+
+func TestLimitedConnForwarding(t *testing.T) {
+	conn := &optionalConn{}
+	limited := &limitedConn{Conn: conn, limits: resultLimits{maxRows: 1}}
+	assert.Equal(t, driver.ErrRemoveArgument, limited.CheckNamedValue(&driver.NamedValue{}))
+	assert.Equal(t, driver.ErrBadConn, limited.ResetSession(context.Background()))
+	assert.False(t, limited.IsValid())
+
+	// The connection without them gets the defaults
+	plain := &limitedConn{Conn: &fakeConn{}}
+	assert.Equal(t, driver.ErrSkip, plain.CheckNamedValue(&driver.NamedValue{}))
+	assert.NoError(t, plain.ResetSession(context.Background()))
+	assert.True(t, plain.IsValid())
+
+	// The Query without a context uses the context of the PrepareContext
+	ctx := visibility.MakeMetricContext(context.Background(), "TestOp")
+	stmt, err := limited.PrepareContext(ctx, "rows 2")
+	assert.NoError(t, err)
+	assert.Equal(t, ctx, conn.prepareCtx)
+	//noinspection GoDeprecation
+	rows, err := stmt.Query(nil)
+	assert.NoError(t, err)
+	dest := make([]driver.Value, 1)
+	assert.NoError(t, rows.Next(dest))
+	assert.True(t, errors.Is(rows.Next(dest), ErrResultTruncated))
+	assert.Equal(t, 1.0, visibility.GetMetricsFromContext(ctx).GetMetricVal(TruncatedMetric))
+}
+
+func TestQueriesAreCounted(t *testing.T) {
+	db := sql.OpenDB(&fakeConnector{})
+	//noinspection GoUnhandledErrorResult
+	defer db.Close()
+	ctx := visibility.MakeMetricContext(context.Background(), "TestOp")
+
+	_, err := readAll(ctx, db, "rows 2")
+	assert.NoError(t, err)
+
+	// The fake connection has no ExecerContext, the exec is retried as the
+	// prepared statement and counted once
+	_, err = db.ExecContext(ctx, "rows 1")
+	assert.Error(t, err)
+
+	stmt, err := db.PrepareContext(ctx, "rows 1")
+	assert.NoError(t, err)
+	rows, err := stmt.QueryContext(ctx)
+	assert.NoError(t, err)
+	_ = rows.Close()
+	_ = stmt.Close()
+
+	met := visibility.GetMetricsFromContext(ctx)
+	assert.Equal(t, 3.0, met.GetMetricVal("Deps.postgres.Calls"))
+}
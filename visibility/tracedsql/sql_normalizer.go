@@ -0,0 +1,120 @@
+package tracedsql
+
+import (
+	"regexp"
+	"strings"
+)
+
+var placeholderListRe = regexp.MustCompile(`\(\?(?:, ?\?)+\)`)
+
+// Normalize the SQL query for use as the span resource name: the string and
+// numeric literals and the positional parameters are replaced with "?", the
+// lists of them are collapsed into a single "(?)", comments are removed and
+// whitespace is collapsed. This keeps the cardinality of resources low.
+// E.g.: "SELECT * FROM t WHERE id = 12 AND name IN ('a', 'b')" becomes
+// "SELECT * FROM t WHERE id = ? AND name IN (?)"
+func NormalizeSQL(query string) string {
+	var res strings.Builder
+	res.Grow(len(query))
+
+	pendingSpace := false
+	emit := func(s string) {
+		if pendingSpace && res.Len() > 0 {
+			res.WriteByte(' ')
+		}
+		pendingSpace = false
+		res.WriteString(s)
+	}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pendingSpace = true
+			i++
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			// Line comment
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			pendingSpace = true
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+			pendingSpace = true
+		case c == '\'':
+			// String literal, the quotes are escaped by doubling them
+			i++
+			for i < len(query) {
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i += 2
+						continue
+					}
+					break
+				}
+				i++
+			}
+			i++
+			emit("?")
+		case c == '"':
+			// Quoted identifier, keep it as is
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				emit(query[i:])
+				i = len(query)
+			} else {
+				emit(query[i : i+end+2])
+				i += end + 2
+			}
+		case c == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			i++
+			for i < len(query) && isDigit(query[i]) {
+				i++
+			}
+			emit("?")
+		case isDigit(c) && !precededByIdent(query, i):
+			for i < len(query) && (isDigit(query[i]) || query[i] == '.') {
+				i++
+			}
+			if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+				i++
+				if i < len(query) && (query[i] == '+' || query[i] == '-') {
+					i++
+				}
+				for i < len(query) && isDigit(query[i]) {
+					i++
+				}
+			}
+			emit("?")
+		default:
+			start := i
+			for i < len(query) && isIdentChar(query[i]) {
+				i++
+			}
+			if i == start {
+				i++
+			}
+			emit(query[start:i])
+		}
+	}
+
+	return placeholderListRe.ReplaceAllString(res.String(), "(?)")
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		c >= 0x80
+}
+
+func precededByIdent(query string, pos int) bool {
+	return pos > 0 && isIdentChar(query[pos-1])
+}
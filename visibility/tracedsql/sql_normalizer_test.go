@@ -0,0 +1,22 @@
+package tracedsql
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNormalizeSQL(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM t WHERE id = 12":                     "SELECT * FROM t WHERE id = ?",
+		"SELECT * FROM t WHERE name = 'it''s' AND x=1.5e-3": "SELECT * FROM t WHERE name = ? AND x=?",
+		"SELECT a FROM t1 WHERE id IN (1, 2, 3)":            "SELECT a FROM t1 WHERE id IN (?)",
+		"UPDATE t SET a = $1\n\t WHERE id = $2":             "UPDATE t SET a = ? WHERE id = ?",
+		`SELECT "Col1" FROM t -- comment
+			WHERE /* block */ b = 'x'`: `SELECT "Col1" FROM t WHERE b = ?`,
+		"INSERT INTO t (a, b) VALUES ('a', 2)": "INSERT INTO t (a, b) VALUES (?)",
+		"  SELECT 1  ":                         "SELECT ?",
+	}
+	for query, expected := range cases {
+		assert.Equal(t, expected, NormalizeSQL(query), query)
+	}
+}
@@ -0,0 +1,157 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The interval of the self-traces, the check fails if the agent wasn't
+	// confirmed for two intervals
+	SelfTraceInterval = time.Minute
+	SelfTraceOpName   = "tracer-self-trace"
+	// The tag set on the self-trace spans, to find (or exclude) them
+	SelfTraceTag = "self_trace"
+
+	// The counts of the confirmed and the failed self-trace round-trips
+	TracerSelfTraceMetric  = "Tracer.SelfTrace"
+	TracerAgentErrorMetric = "Tracer.AgentError"
+
+	agentInfoTimeout = 5 * time.Second
+)
+
+type tracerLogger struct {
+	logger *zap.Logger
+}
+
+// Get the logger for tracer.WithLogger, the tracer's messages are logged with
+// their levels (e.g. the dropped traces are logged as errors)
+func NewTracerLogger(logger *zap.Logger) ddtrace.Logger {
+	return &tracerLogger{logger: logger.Named("dd-tracer")}
+}
+
+// The messages are formatted like "Datadog Tracer v1.26.0 ERROR: <msg>"
+func (l *tracerLogger) Log(msg string) {
+	levels := []struct {
+		prefix string
+		log    func(msg string, fields ...zap.Field)
+	}{
+		{"ERROR: ", l.logger.Error},
+		{"WARN: ", l.logger.Warn},
+		{"INFO: ", l.logger.Info},
+		{"DEBUG: ", l.logger.Debug},
+	}
+	for _, lvl := range levels {
+		if idx := strings.Index(msg, lvl.prefix); idx >= 0 {
+			lvl.log(strings.TrimSpace(msg[idx+len(lvl.prefix):]))
+			return
+		}
+	}
+	l.logger.Warn(strings.TrimSpace(msg))
+}
+
+// Get the trace agent's URL from DD_AGENT_HOST and DD_TRACE_AGENT_PORT (8126
+// by default), empty if there's no agent
+func AgentURLFromEnv() string {
+	host := os.Getenv("DD_AGENT_HOST")
+	if host == "" {
+		return ""
+	}
+	port := os.Getenv("DD_TRACE_AGENT_PORT")
+	if port == "" {
+		port = "8126"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// The periodic self-trace confirming that the trace agent is reachable. The
+// Trace should be run periodically (e.g. with RunPeriodicProcess every
+// SelfTraceInterval), and the Check reports the failed round-trips to the
+// health checks.
+type TracerSelfCheck struct {
+	AgentURL string
+	Client   *http.Client
+
+	mtx           sync.Mutex
+	lastConfirmed time.Time
+	lastErr       error
+}
+
+func NewTracerSelfCheck(agentURL string) *TracerSelfCheck {
+	return &TracerSelfCheck{
+		AgentURL: strings.TrimSuffix(agentURL, "/"),
+		Client:   &http.Client{Timeout: agentInfoTimeout},
+	}
+}
+
+// Emit the self-trace span, and confirm the agent is up with its /info endpoint
+func (c *TracerSelfCheck) Trace(ctx context.Context) error {
+	span := tracer.StartSpan(SelfTraceOpName, tracer.Tag(SelfTraceTag, true))
+	span.Finish()
+
+	err := c.queryAgent(ctx)
+
+	sink := GetStatsdFromContext(ctx)
+	tags := []string{"unit:count", ClientTypeTag + ":" + GetClientTypeFromContext(ctx)}
+	if err != nil {
+		_ = sink.Count(TracerAgentErrorMetric, 1, tags, 1)
+	} else {
+		_ = sink.Count(TracerSelfTraceMetric, 1, tags, 1)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.lastErr = err
+	if err == nil {
+		c.lastConfirmed = utils.ClockFromContext(ctx).Now()
+	}
+	return err
+}
+
+func (c *TracerSelfCheck) queryAgent(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, c.AgentURL+"/info", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("the trace agent is unreachable: %w", err)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the trace agent's /info returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Fail if the last self-trace has failed, or if there was no confirmed one for
+// two SelfTraceIntervals
+func (c *TracerSelfCheck) Check(ctx context.Context) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.lastErr != nil {
+		return c.lastErr
+	}
+	if c.lastConfirmed.IsZero() {
+		return fmt.Errorf("the trace agent is not confirmed yet")
+	}
+	since := utils.ClockFromContext(ctx).Now().Sub(c.lastConfirmed)
+	if since > 2*SelfTraceInterval {
+		return fmt.Errorf("the trace agent is not confirmed for %v", since)
+	}
+	return nil
+}
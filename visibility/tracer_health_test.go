@@ -0,0 +1,70 @@
+package visibility
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTracerLogger(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	tl := NewTracerLogger(logger)
+
+	tl.Log("Datadog Tracer v1.26.0 ERROR: lost 3 traces")
+	tl.Log("Datadog Tracer v1.26.0 WARN: agent is slow")
+	tl.Log("something odd")
+
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.True(t, strings.Contains(lines[0], `"level":"error"`))
+	assert.True(t, strings.Contains(lines[0], `"msg":"lost 3 traces"`))
+	assert.True(t, strings.Contains(lines[1], `"level":"warn"`))
+	assert.True(t, strings.Contains(lines[2], `"msg":"something odd"`))
+}
+
+func TestTracerSelfCheck(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	agentUp := int32(1)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/info", r.URL.Path)
+		if atomic.LoadInt32(&agentUp) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer agent.Close()
+
+	clock := utils.NewFakeClock(time.Unix(1000, 0))
+	metrics := NewRecordingSink()
+	ctx := ContextWithStatsd(utils.WithClock(context.Background(), clock), metrics)
+
+	check := NewTracerSelfCheck(agent.URL)
+	assert.Error(t, check.Check(ctx))
+
+	assert.NoError(t, check.Trace(ctx))
+	assert.NoError(t, check.Check(ctx))
+	assert.Equal(t, int64(1), metrics.Counts[TracerSelfTraceMetric])
+	assert.Equal(t, []string{"unit:count", ClientTypeTag + ":" + ClientTypeNormal},
+		metrics.Tags[TracerSelfTraceMetric])
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, true, spans[0].Tag(SelfTraceTag))
+
+	// The confirmation expires
+	clock.Advance(3 * SelfTraceInterval)
+	assert.Error(t, check.Check(ctx))
+
+	// The agent's failure is reported at once
+	atomic.StoreInt32(&agentUp, 0)
+	assert.Error(t, check.Trace(ctx))
+	assert.Error(t, check.Check(ctx))
+	assert.Equal(t, int64(1), metrics.Counts[TracerAgentErrorMetric])
+}
@@ -0,0 +1,90 @@
+package visibility
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The twirp hooks can't change the error that is sent (the generated code
+// serializes its own copy), so the meta is removed from the serialized error
+// instead. The twirp error responses are always JSON, whatever the request's
+// serialization is.
+
+// The writer that buffers the JSON error responses and removes the meta keys
+// from them, the other responses are passed through
+type metaStrippingWriter struct {
+	http.ResponseWriter
+	keys []string
+
+	statusCode int
+	buf        *bytes.Buffer
+}
+
+func newMetaStrippingWriter(w http.ResponseWriter, keys []string) *metaStrippingWriter {
+	return &metaStrippingWriter{ResponseWriter: w, keys: keys}
+}
+
+func (m *metaStrippingWriter) WriteHeader(code int) {
+	contentType := m.Header().Get("Content-Type")
+	if code >= http.StatusBadRequest && strings.HasPrefix(contentType, "application/json") {
+		m.statusCode = code
+		m.buf = &bytes.Buffer{}
+		return
+	}
+	m.ResponseWriter.WriteHeader(code)
+}
+
+func (m *metaStrippingWriter) Write(data []byte) (int, error) {
+	if m.buf != nil {
+		return m.buf.Write(data)
+	}
+	return m.ResponseWriter.Write(data)
+}
+
+// Send the buffered error response, if there's one
+func (m *metaStrippingWriter) Close() error {
+	if m.buf == nil {
+		return nil
+	}
+	body := stripErrorMeta(m.buf.Bytes(), m.keys)
+	m.buf = nil
+
+	m.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	m.ResponseWriter.WriteHeader(m.statusCode)
+	_, err := m.ResponseWriter.Write(body)
+	return err
+}
+
+// Remove the meta keys from the serialized twirp error, the body is returned
+// unchanged if it's not a twirp error
+func stripErrorMeta(body []byte, keys []string) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	rawMeta, ok := fields["meta"]
+	if !ok {
+		return body
+	}
+	var meta map[string]string
+	if err := json.Unmarshal(rawMeta, &meta); err != nil {
+		return body
+	}
+
+	for _, k := range keys {
+		delete(meta, k)
+	}
+	if len(meta) == 0 {
+		delete(fields, "meta")
+	} else {
+		fields["meta"], _ = json.Marshal(meta)
+	}
+	res, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return res
+}
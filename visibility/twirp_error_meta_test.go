@@ -0,0 +1,100 @@
+package visibility
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/twitchtv/twirp"
+	"github.com/twitchtv/twirp/ctxsetters"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The fake twirp server that fails the way the generated code does
+type erroringTwirpServer struct {
+	panickyTwirpServer
+	hooks *twirp.ServerHooks
+}
+
+func (e *erroringTwirpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := ctxsetters.WithPackageName(r.Context(), "twirp.test")
+	ctx = ctxsetters.WithServiceName(ctx, "Example")
+	ctx = ctxsetters.WithMethodName(ctx, "MakeHat")
+	ctx, _ = e.hooks.RequestRouted(ctx)
+
+	twerr := WithStack(twirp.InternalError("broken")).WithMeta("retryable", "no")
+	ctx = ctxsetters.WithStatusCode(ctx, http.StatusInternalServerError)
+	ctx = e.hooks.Error(ctx, twerr)
+	_ = twirp.WriteError(w, twerr)
+	e.hooks.ResponseSent(ctx)
+}
+
+func TestStrippedErrorMeta(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	gorilla := NewTracedGorilla(&erroringTwirpServer{hooks: MakeTraceHooks("test")},
+		logger, NewRecordingSink(), aws.Float64(1), aws.Float64(1))
+	muxer := mux.NewRouter()
+	gorilla.AttachGorillaToMuxer(muxer)
+
+	call := func() (*httptest.ResponseRecorder, map[string]string) {
+		rec := httptest.NewRecorder()
+		muxer.ServeHTTP(rec, httptest.NewRequest(http.MethodPost,
+			"/twirp/twirp.test.Example/MakeHat", nil))
+		var body struct {
+			Code string            `json:"code"`
+			Msg  string            `json:"msg"`
+			Meta map[string]string `json:"meta"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Equal(t, "internal", body.Code)
+		assert.Equal(t, "broken", body.Msg)
+		return rec, body.Meta
+	}
+
+	// The stack is sent by default, and not logged
+	_, meta := call()
+	assert.NotEmpty(t, meta[StackTraceKey])
+	assert.NotContains(t, sink.String(), `"msg":"Request error"`)
+
+	gorilla.SetStrippedErrorMeta(StackTraceKey)
+	mt.Reset()
+	sink.Reset()
+	rec, meta := call()
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, map[string]string{"retryable": "no"}, meta)
+	assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"))
+
+	// The stack is still on the span and in the logs
+	spans := mt.FinishedSpans()
+	assert.Equal(t, 1, len(spans))
+	assert.NotEmpty(t, spans[0].Tag(ext.ErrorStack))
+	assert.True(t, strings.Contains(sink.String(),
+		`"level":"error","logger":"HTTP","msg":"Request error"`))
+	assert.True(t, strings.Contains(sink.String(), `"stack":"`))
+
+	// The meta is dropped if nothing is left
+	gorilla.SetStrippedErrorMeta(StackTraceKey, "retryable")
+	rec, meta = call()
+	assert.Nil(t, meta)
+	assert.NotContains(t, rec.Body.String(), "meta")
+}
+
+func TestStripErrorMeta(t *testing.T) {
+	// The non-twirp bodies are left alone
+	for _, body := range []string{`not json`, `{"code":"internal"}`, `{"meta":[1]}`} {
+		assert.Equal(t, body, string(stripErrorMeta([]byte(body), []string{StackTraceKey})))
+	}
+	assert.Equal(t, `{"code":"internal","meta":{"a":"b"}}`, string(stripErrorMeta(
+		[]byte(`{"code":"internal","meta":{"a":"b","StackTrace":"x"}}`),
+		[]string{StackTraceKey})))
+}
@@ -0,0 +1,82 @@
+package visibility
+
+import (
+	"encoding/json"
+	"github.com/DataDog/datadog-go/statsd"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const UnmatchedRequestsMetric = "http.unmatched"
+
+type unmatchedHandler struct {
+	logger *zap.Logger
+	sink   statsd.ClientInterface
+	traced bool
+
+	status int
+	code   string
+	msg    string
+}
+
+// Create a handler for the requests that don't match any route, to be used as
+// mux.Router.NotFoundHandler. The requests are logged and counted, the span is
+// started only if traced is set.
+func InstrumentedNotFoundHandler(logger *zap.Logger, sink statsd.ClientInterface,
+	traced bool) http.Handler {
+	return &unmatchedHandler{logger: logger.Named("HTTP"), sink: sink, traced: traced,
+		status: http.StatusNotFound, code: "bad_route", msg: "no handler for the path"}
+}
+
+// Create a handler for the requests with a wrong method, to be used as
+// mux.Router.MethodNotAllowedHandler. The requests are logged and counted, the span
+// is started only if traced is set.
+func InstrumentedMethodNotAllowedHandler(logger *zap.Logger, sink statsd.ClientInterface,
+	traced bool) http.Handler {
+	return &unmatchedHandler{logger: logger.Named("HTTP"), sink: sink, traced: traced,
+		status: http.StatusMethodNotAllowed, code: "bad_route", msg: "method is not allowed"}
+}
+
+func (u *unmatchedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if u.traced {
+		span, _ := tracer.StartSpanFromContext(r.Context(), "http.unmatched",
+			tracer.SpanType(ext.SpanTypeWeb),
+			tracer.Tag(ext.HTTPMethod, r.Method),
+			tracer.Tag(ext.HTTPURL, r.URL.Path),
+			tracer.Tag(ext.HTTPCode, strconv.Itoa(u.status)))
+		defer span.Finish()
+	}
+
+	u.logger.Warn("Unmatched request",
+		zap.String("path", r.URL.Path),
+		zap.String("method", r.Method),
+		zap.String("remote_ip", realIP(r)),
+		zap.Int("status", u.status))
+	_ = u.sink.Count(UnmatchedRequestsMetric, 1,
+		[]string{"status:" + strconv.Itoa(u.status)}, 1)
+
+	// The same error envelope as Twirp uses
+	body, _ := json.Marshal(map[string]string{
+		"code": u.code,
+		"msg":  u.msg + ": " + r.Method + " " + r.URL.Path,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(u.status)
+	_, _ = w.Write(body)
+}
+
+func realIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
+		return strings.TrimSpace(strings.Split(ip, ",")[0])
+	}
+	if ip := r.Header.Get("X-Real-Ip"); ip != "" {
+		return ip
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return ip
+}
@@ -0,0 +1,41 @@
+package visibility
+
+import (
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUnmatchedHandlers(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	rs := NewRecordingSink()
+
+	router := mux.NewRouter()
+	router.NotFoundHandler = InstrumentedNotFoundHandler(logger, rs, false)
+	router.MethodNotAllowedHandler = InstrumentedMethodNotAllowedHandler(logger, rs, true)
+	router.Path("/api").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/wp-admin", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, `{"code":"bad_route","msg":"no handler for the path: GET /wp-admin"}`,
+		rec.Body.String())
+	assert.Equal(t, int64(1), rs.Counts[UnmatchedRequestsMetric])
+	assert.Equal(t, []string{"status:404"}, rs.Tags[UnmatchedRequestsMetric])
+	assert.True(t, strings.Contains(sink.String(), `"path":"/wp-admin"`))
+	assert.Equal(t, 0, len(mt.FinishedSpans()))
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, []string{"status:405"}, rs.Tags[UnmatchedRequestsMetric])
+	assert.Equal(t, 1, len(mt.FinishedSpans()))
+}
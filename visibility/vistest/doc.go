@@ -0,0 +1,8 @@
+// The test doubles for the code instrumented with the visibility package: the
+// recording statsd sink, the fake spans and the builder of the request
+// contexts. The logger writing into memory is in the utils/testutil package.
+//
+// The API of the package is stable: the existing types, functions and fields
+// are not changed or removed, only new ones are added. The package is meant
+// for the tests only, the production code must not import it.
+package vistest
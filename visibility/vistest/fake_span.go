@@ -0,0 +1,86 @@
+package vistest
+
+import "gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+
+// The span context with the settable IDs and baggage
+type FakeSpanContext struct {
+	TraceId uint64
+	SpanId  uint64
+	Baggage map[string]string
+}
+
+var _ ddtrace.SpanContext = &FakeSpanContext{}
+
+func (f *FakeSpanContext) SpanID() uint64 {
+	return f.SpanId
+}
+
+func (f *FakeSpanContext) TraceID() uint64 {
+	return f.TraceId
+}
+
+func (f *FakeSpanContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for k, v := range f.Baggage {
+		if !handler(k, v) {
+			return
+		}
+	}
+}
+
+// The span recording everything done to it, put it into the context with
+// tracer.ContextWithSpan (or RequestContextOptions.Span). It's not
+// thread-safe.
+type FakeSpan struct {
+	OperationName string
+	Tags          map[string]interface{}
+	// The options of the last Finish call
+	FinishOptions []ddtrace.FinishOption
+	Finished      bool
+
+	SpanContext FakeSpanContext
+}
+
+var _ ddtrace.Span = &FakeSpan{}
+
+// Create the span with the IDs
+func NewFakeSpan(traceId, spanId uint64) *FakeSpan {
+	return &FakeSpan{
+		Tags: make(map[string]interface{}),
+		SpanContext: FakeSpanContext{
+			TraceId: traceId,
+			SpanId:  spanId,
+			Baggage: make(map[string]string),
+		},
+	}
+}
+
+func (f *FakeSpan) SetTag(key string, value interface{}) {
+	if f.Tags == nil {
+		f.Tags = make(map[string]interface{})
+	}
+	f.Tags[key] = value
+}
+
+func (f *FakeSpan) SetOperationName(operationName string) {
+	f.OperationName = operationName
+}
+
+func (f *FakeSpan) BaggageItem(key string) string {
+	return f.SpanContext.Baggage[key]
+}
+
+func (f *FakeSpan) SetBaggageItem(key, val string) {
+	if f.SpanContext.Baggage == nil {
+		f.SpanContext.Baggage = make(map[string]string)
+	}
+	f.SpanContext.Baggage[key] = val
+}
+
+func (f *FakeSpan) Finish(opts ...ddtrace.FinishOption) {
+	f.Finished = true
+	f.FinishOptions = opts
+}
+
+func (f *FakeSpan) Context() ddtrace.SpanContext {
+	return &f.SpanContext
+}
@@ -0,0 +1,69 @@
+package vistest
+
+import (
+	"context"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// The operation name of the metrics context if none is set
+const DefaultOpName = "TestOp"
+
+// The parts of the request context, the zero values are replaced with the
+// defaults
+type RequestContextOptions struct {
+	// The base context, context.Background() by default
+	Parent context.Context
+	// The logger, zap.NewNop() by default (see testutil.NewMemorySinkLogger)
+	Logger *zap.Logger
+	// The statsd client, the no-op one by default (see NewRecordingSink)
+	Statsd statsd.ClientInterface
+	// The client type, visibility.ClientTypeNormal by default
+	ClientType string
+	// The operation name of the metrics context, DefaultOpName by default
+	OpName string
+	// The active span (e.g. NewFakeSpan), none by default
+	Span ddtrace.Span
+	// The tenant, none by default
+	Tenant string
+}
+
+// Create the context the way the middlewares do for the requests: with the
+// logger, the statsd client, the client type and the metrics context (get it
+// with visibility.GetMetricsFromContext)
+func NewRequestContext(opts RequestContextOptions) context.Context {
+	ctx := opts.Parent
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	var sink statsd.ClientInterface = &statsd.NoOpClient{}
+	if opts.Statsd != nil {
+		sink = opts.Statsd
+	}
+	clientType := opts.ClientType
+	if clientType == "" {
+		clientType = visibility.ClientTypeNormal
+	}
+	opName := opts.OpName
+	if opName == "" {
+		opName = DefaultOpName
+	}
+
+	if opts.Span != nil {
+		ctx = tracer.ContextWithSpan(ctx, opts.Span)
+	}
+	ctx = visibility.ImbueContext(ctx, logger)
+	ctx = visibility.ContextWithStatsd(ctx, sink)
+	ctx = visibility.ContextWithClientType(ctx, clientType)
+	if opts.Tenant != "" {
+		ctx = visibility.ContextWithTenant(ctx, opts.Tenant)
+	}
+	return visibility.MakeMetricContext(ctx, opName)
+}
@@ -0,0 +1,13 @@
+package vistest
+
+import "github.com/cyberax/go-dd-service-base/visibility/internal/testdoubles"
+
+// The statsd client recording the last value and the tags of each metric: the
+// Counts, Distributions, Gauges and Timings (in milliseconds). It's not
+// thread-safe, read it once the code under test is done. Clear forgets
+// everything recorded so far.
+type RecordingSink = testdoubles.RecordingSink
+
+func NewRecordingSink() *RecordingSink {
+	return testdoubles.NewRecordingSink()
+}
@@ -0,0 +1,81 @@
+package vistest
+
+import (
+	"github.com/cyberax/go-dd-service-base/utils/testutil"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestContext(t *testing.T) {
+	logs, logger := testutil.NewMemorySinkLogger()
+	sink := NewRecordingSink()
+	span := NewFakeSpan(123, 456)
+	ctx := NewRequestContext(RequestContextOptions{
+		Logger:     logger,
+		Statsd:     sink,
+		ClientType: visibility.ClientTypeCanary,
+		Span:       span,
+		Tenant:     "acme",
+	})
+
+	visibility.CL(ctx).Info("Hello")
+	assert.True(t, strings.Contains(logs.String(), `"msg":"Hello"`))
+	assert.Equal(t, visibility.ClientTypeCanary, visibility.GetClientTypeFromContext(ctx))
+	assert.Equal(t, "acme", visibility.TenantFromContext(ctx))
+	assert.Equal(t, span, visibility.SpanFromContextOrNoop(ctx))
+
+	met := visibility.GetMetricsFromContext(ctx)
+	assert.Equal(t, DefaultOpName, met.OpName)
+	met.AddCount("Items", 2)
+	met.CopyToStatsd(visibility.GetStatsdFromContext(ctx), visibility.ClientTypeCanary)
+	assert.Equal(t, 2.0, sink.Distributions["TestOp.Items"])
+	assert.Equal(t, []string{"unit:count", "client-type:canary", "tenant:acme"},
+		sink.Tags["TestOp.Items"])
+
+	// The defaults
+	ctx = NewRequestContext(RequestContextOptions{})
+	assert.Equal(t, visibility.ClientTypeNormal, visibility.GetClientTypeFromContext(ctx))
+	assert.NotNil(t, visibility.TryGetMetricsFromContext(ctx))
+	visibility.CL(ctx).Info("Discarded")
+}
+
+func TestFakeSpan(t *testing.T) {
+	span := NewFakeSpan(1, 2)
+	span.SetOperationName("op")
+	span.SetTag("key", "value")
+	span.SetBaggageItem("request_id", "abc")
+	span.Finish()
+
+	assert.Equal(t, "op", span.OperationName)
+	assert.Equal(t, "value", span.Tags["key"])
+	assert.Equal(t, "abc", span.BaggageItem("request_id"))
+	assert.True(t, span.Finished)
+	assert.Equal(t, uint64(1), span.Context().TraceID())
+	assert.Equal(t, uint64(2), span.Context().SpanID())
+
+	baggage := map[string]string{}
+	span.Context().ForeachBaggageItem(func(k, v string) bool {
+		baggage[k] = v
+		return true
+	})
+	assert.Equal(t, map[string]string{"request_id": "abc"}, baggage)
+}
+
+func TestRecordingSinkGaugesAndTimings(t *testing.T) {
+	sink := NewRecordingSink()
+	_ = sink.Gauge("Depth", 3, []string{"pool:a"}, 1)
+	_ = sink.Timing("Latency", 1500*time.Microsecond, nil, 1)
+	_ = sink.TimeInMilliseconds("Other", 7, nil, 1)
+
+	assert.Equal(t, 3.0, sink.Gauges["Depth"])
+	assert.Equal(t, []string{"pool:a"}, sink.Tags["Depth"])
+	assert.Equal(t, 1.5, sink.Timings["Latency"])
+	assert.Equal(t, 7.0, sink.Timings["Other"])
+
+	sink.Clear()
+	assert.Empty(t, sink.Gauges)
+	assert.Empty(t, sink.Timings)
+}
@@ -0,0 +1,180 @@
+package visibility
+
+import (
+	"bytes"
+	"context"
+	"go.uber.org/zap"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const LongRunningTag = "long_running"
+const LongRunningMetric = "LongRunningRequests"
+
+// Start a watchdog for an in-flight request. If the request is still running after
+// the threshold, the watchdog logs a warning with the request's goroutine stack
+// (found by the "dd" pprof label), tags the still-open span and emits the
+// LongRunningRequests count. The returned function must be called once the request
+// is complete. A non-positive threshold disables the watchdog.
+func StartWatchdog(ctx context.Context, span tracer.Span, threshold time.Duration,
+	traceId string) func() {
+
+	_, stop := StartWatchdogWithMultiple(ctx, span, threshold, 0, traceId)
+	return stop
+}
+
+// Start the watchdog (see StartWatchdog) that also triggers at the multiple of
+// the request's expected duration, once it's known (see SetExpectedDuration),
+// whichever comes first. The returned context carries the watchdog for
+// SetExpectedDuration. A non-positive multiple only uses the threshold.
+func StartWatchdogWithMultiple(ctx context.Context, span tracer.Span,
+	threshold time.Duration, multiple float64, traceId string) (context.Context, func()) {
+
+	if threshold <= 0 && multiple <= 0 {
+		return ctx, func() {}
+	}
+
+	w := &watchdog{
+		ctx:       ctx,
+		span:      span,
+		traceId:   traceId,
+		threshold: threshold,
+		multiple:  multiple,
+		start:     time.Now(),
+	}
+	if threshold > 0 {
+		w.armLocked(threshold)
+	}
+	return context.WithValue(ctx, watchdogKeyVal, w), w.stop
+}
+
+type watchdogKey struct{}
+
+var watchdogKeyVal = &watchdogKey{}
+
+// Set the expected duration of the request, its watchdog started with a multiple
+// (see StartWatchdogWithMultiple) is re-armed at that multiple of it, counted
+// from the start of the request. Nothing is done without such a watchdog.
+func SetExpectedDuration(ctx context.Context, expected time.Duration) {
+	w, ok := ctx.Value(watchdogKeyVal).(*watchdog)
+	if !ok || w.multiple <= 0 || expected <= 0 {
+		return
+	}
+	limit := time.Duration(w.multiple * float64(expected))
+	if w.threshold > 0 && w.threshold <= limit {
+		// The absolute threshold comes first anyway
+		return
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.done || w.fired {
+		return
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.armLocked(limit)
+}
+
+// Expect the request to take about the SLO target of the operation (see
+// SetSLORegistry), if there's one. The middlewares call it once the operation
+// is known.
+func ExpectOperation(ctx context.Context, opName string) {
+	registry := getSLORegistry()
+	if registry == nil {
+		return
+	}
+	if slo, ok := registry.Get(opName); ok {
+		SetExpectedDuration(ctx, slo.Target)
+	}
+}
+
+type watchdog struct {
+	ctx       context.Context
+	span      tracer.Span
+	traceId   string
+	threshold time.Duration
+	multiple  float64
+	start     time.Time
+
+	// The timer callback might be already running when the watchdog is stopped,
+	// so the report holds the lock to make sure the finished span is never tagged
+	mtx   sync.Mutex
+	timer *time.Timer
+	done  bool
+	fired bool
+}
+
+// Report the request once it runs for longer than the limit
+func (w *watchdog) armLocked(limit time.Duration) {
+	w.timer = time.AfterFunc(limit-time.Since(w.start), func() {
+		w.mtx.Lock()
+		defer w.mtx.Unlock()
+		if !w.done && !w.fired {
+			w.fired = true
+			reportLongRunning(w.ctx, w.span, limit, w.traceId)
+		}
+	})
+}
+
+func (w *watchdog) stop() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.done = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+func reportLongRunning(ctx context.Context, span tracer.Span, threshold time.Duration,
+	traceId string) {
+
+	span.SetTag(LongRunningTag, true)
+	_ = GetStatsdFromContext(ctx).Count(LongRunningMetric, 1,
+		[]string{ClientTypeTag + ":" + GetClientTypeFromContext(ctx)}, 1)
+
+	logger := TryCL(ctx)
+	if logger == nil {
+		return
+	}
+
+	labels := make(map[string]string)
+	pprof.ForLabels(ctx, func(key, value string) bool {
+		labels[key] = value
+		return true
+	})
+
+	logger.Warn("Long-running request",
+		zap.Duration("threshold", threshold),
+		zap.Any("labels", labels),
+		zap.String("stacktrace", FindLabeledGoroutines("dd", traceId)))
+}
+
+// Find the stacks of the goroutines marked with the given pprof label. The goroutine
+// profile in the debug=1 format has records separated by blank lines, with labels
+// listed in the "# labels: {...}" line.
+func FindLabeledGoroutines(key, value string) string {
+	if value == "" {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	err := pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	if err != nil {
+		return ""
+	}
+
+	label := strconv.Quote(key) + ":" + strconv.Quote(value)
+	var res []string
+	for _, record := range strings.Split(buf.String(), "\n\n") {
+		if strings.Contains(record, label) {
+			res = append(res, strings.TrimSpace(record))
+		}
+	}
+	return strings.Join(res, "\n\n")
+}
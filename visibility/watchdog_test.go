@@ -0,0 +1,90 @@
+package visibility
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	rs := NewRecordingSink()
+
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "test")
+	ctx = ImbueContext(ctx, logger)
+	ctx = ContextWithStatsd(ctx, rs)
+	ctx = pprof.WithLabels(ctx, pprof.Labels("dd", "123456"))
+	pprof.SetGoroutineLabels(ctx)
+	defer pprof.SetGoroutineLabels(context.Background())
+
+	stop := StartWatchdog(ctx, span, 10*time.Millisecond, "123456")
+	time.Sleep(200 * time.Millisecond)
+	stop()
+	span.Finish()
+
+	assert.Equal(t, true, mt.FinishedSpans()[0].Tag(LongRunningTag))
+	assert.Equal(t, int64(1), rs.Counts[LongRunningMetric])
+	assert.True(t, strings.Contains(sink.String(), "Long-running request"))
+	assert.True(t, strings.Contains(sink.String(), "TestWatchdog"))
+
+	// Fast requests are not reported
+	mt.Reset()
+	rs.Clear()
+	span, ctx = tracer.StartSpanFromContext(ctx, "test2")
+	stop = StartWatchdog(ctx, span, time.Second, "123456")
+	stop()
+	span.Finish()
+
+	assert.Nil(t, mt.FinishedSpans()[0].Tag(LongRunningTag))
+	assert.Equal(t, 0, len(rs.Counts))
+}
+
+func TestWatchdogExpectedDuration(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	registry := NewSLORegistry()
+	registry.Register("Slow", 5*time.Millisecond, 0.99)
+	SetSLORegistry(registry)
+	defer SetSLORegistry(nil)
+
+	sink, logger := utils.NewMemorySinkLogger()
+	rs := NewRecordingSink()
+	span, ctx := tracer.StartSpanFromContext(context.Background(), "test")
+	ctx = ImbueContext(ContextWithStatsd(ctx, rs), logger)
+
+	// Triggers at the multiple of the SLO target, long before the threshold
+	ctx, stop := StartWatchdogWithMultiple(ctx, span, time.Hour, 2, "123456")
+	ExpectOperation(ctx, "Slow")
+	time.Sleep(200 * time.Millisecond)
+	stop()
+	span.Finish()
+
+	assert.Equal(t, true, mt.FinishedSpans()[0].Tag(LongRunningTag))
+	assert.Equal(t, int64(1), rs.Counts[LongRunningMetric])
+	assert.True(t, strings.Contains(sink.String(), `"threshold":0.01`))
+
+	// The operations without the SLO only have the threshold
+	mt.Reset()
+	rs.Clear()
+	span, ctx = tracer.StartSpanFromContext(ctx, "test2")
+	ctx, stop = StartWatchdogWithMultiple(ctx, span, time.Hour, 2, "123456")
+	ExpectOperation(ctx, "Unknown")
+	// The threshold comes before the multiple of the expected duration
+	SetExpectedDuration(ctx, time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	span.Finish()
+
+	assert.Nil(t, mt.FinishedSpans()[0].Tag(LongRunningTag))
+	assert.Equal(t, 0, len(rs.Counts))
+}
@@ -0,0 +1,172 @@
+package zaputils
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits for the logged fields, to keep the oversized structured fields from
+// bloating the log storage.
+type FieldLimits struct {
+	// The maximum size of string and reflected field values (in their JSON form),
+	// the longer values are truncated. Zero means no limit.
+	MaxValueSize int
+
+	// The allowed field keys for the loggers with the given name (or its
+	// sub-loggers, e.g. "HTTP" also applies to "HTTP.twirp"). The other fields
+	// passed at the logging call site are dropped. The fields added via
+	// Logger.With() are not filtered.
+	Allowlists map[string][]string
+}
+
+func (l FieldLimits) isEmpty() bool {
+	return l.MaxValueSize <= 0 && len(l.Allowlists) == 0
+}
+
+type fieldLimitingCore struct {
+	next       zapcore.Core
+	maxSize    int
+	allowlists map[string]map[string]struct{}
+}
+
+func LimitFields(limits FieldLimits) zap.Option {
+	allowlists := make(map[string]map[string]struct{})
+	for name, keys := range limits.Allowlists {
+		set := make(map[string]struct{})
+		for _, k := range keys {
+			set[k] = struct{}{}
+		}
+		allowlists[name] = set
+	}
+
+	return zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &fieldLimitingCore{
+			next:       core,
+			maxSize:    limits.MaxValueSize,
+			allowlists: allowlists,
+		}
+	})
+}
+
+func (c *fieldLimitingCore) Enabled(level zapcore.Level) bool {
+	return c.next.Enabled(level)
+}
+
+func (c *fieldLimitingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &fieldLimitingCore{
+		next:       c.next.With(c.truncate(fields)),
+		maxSize:    c.maxSize,
+		allowlists: c.allowlists,
+	}
+}
+
+func (c *fieldLimitingCore) Check(entry zapcore.Entry,
+	checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+
+	if c.next.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *fieldLimitingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return c.next.Write(entry, c.truncate(c.filter(entry.LoggerName, fields)))
+}
+
+func (c *fieldLimitingCore) Sync() error {
+	return c.next.Sync()
+}
+
+// Find the allowlist for the logger or its closest parent
+func (c *fieldLimitingCore) findAllowlist(name string) map[string]struct{} {
+	for {
+		if list, ok := c.allowlists[name]; ok {
+			return list
+		}
+		idx := strings.LastIndexByte(name, '.')
+		if idx < 0 {
+			return nil
+		}
+		name = name[:idx]
+	}
+}
+
+func (c *fieldLimitingCore) filter(name string, fields []zapcore.Field) []zapcore.Field {
+	allowed := c.findAllowlist(name)
+	if allowed == nil {
+		return fields
+	}
+
+	res := make([]zapcore.Field, 0, len(fields))
+	for _, f := range fields {
+		if _, ok := allowed[f.Key]; ok {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+func (c *fieldLimitingCore) truncate(fields []zapcore.Field) []zapcore.Field {
+	if c.maxSize <= 0 {
+		return fields
+	}
+
+	var res []zapcore.Field
+	for i, f := range fields {
+		val, truncated := c.truncateField(f)
+		if !truncated {
+			continue
+		}
+		// Copy on the first change, the caller owns the slice
+		if res == nil {
+			res = make([]zapcore.Field, len(fields))
+			copy(res, fields)
+		}
+		res[i] = val
+	}
+
+	if res == nil {
+		return fields
+	}
+	return res
+}
+
+func (c *fieldLimitingCore) truncateField(f zapcore.Field) (zapcore.Field, bool) {
+	var str string
+	switch f.Type {
+	case zapcore.StringType:
+		str = f.String
+	case zapcore.ByteStringType, zapcore.BinaryType:
+		data, ok := f.Interface.([]byte)
+		if !ok || len(data) <= c.maxSize {
+			return f, false
+		}
+		str = string(data)
+	case zapcore.ReflectType:
+		data, err := json.Marshal(f.Interface)
+		if err != nil {
+			return f, false
+		}
+		str = string(data)
+	default:
+		return f, false
+	}
+
+	if len(str) <= c.maxSize {
+		return f, false
+	}
+	return zap.String(f.Key, truncateString(str, c.maxSize)), true
+}
+
+func truncateString(str string, maxSize int) string {
+	cut := maxSize
+	// Don't cut in the middle of a UTF-8 sequence
+	for cut > 0 && !utf8.RuneStart(str[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s...(truncated from %d bytes)", str[:cut], len(str))
+}
@@ -0,0 +1,53 @@
+package zaputils
+
+import (
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+)
+
+type bigObject struct {
+	Name string
+	Data []int
+}
+
+func TestFieldTruncation(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	logger = logger.WithOptions(LimitFields(FieldLimits{MaxValueSize: 20}))
+
+	logger.Info("Test", zap.String("short", "hello"),
+		zap.String("long", strings.Repeat("a", 30)),
+		zap.Reflect("obj", bigObject{Name: "test", Data: []int{1, 2, 3, 4, 5, 6, 7, 8}}),
+		zap.Int("num", 123))
+
+	assert.Equal(t, `{"level":"info","msg":"Test","short":"hello",`+
+		`"long":"aaaaaaaaaaaaaaaaaaaa...(truncated from 30 bytes)",`+
+		`"obj":"{\"Name\":\"test\",\"Data...(truncated from 40 bytes)","num":123}`+"\n",
+		sink.String())
+
+	// Fields added via With are truncated as well
+	sink.Reset()
+	logger.With(zap.String("ctx", strings.Repeat("b", 21))).Info("Test")
+	assert.True(t, strings.Contains(sink.String(), "truncated from 21 bytes"))
+
+	// UTF-8 sequences are not split
+	assert.Equal(t, "...(truncated from 4 bytes)", truncateString("éé", 1))
+}
+
+func TestFieldAllowlist(t *testing.T) {
+	sink, logger := utils.NewMemorySinkLogger()
+	logger = logger.WithOptions(LimitFields(FieldLimits{
+		Allowlists: map[string][]string{"HTTP": {"status"}},
+	}))
+
+	logger.Named("HTTP").Named("twirp").Info("Test",
+		zap.Int("status", 200), zap.Reflect("request", bigObject{}))
+	logger.Named("Other").Info("Test", zap.Int("status", 200), zap.String("extra", "x"))
+
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	assert.Equal(t, `{"level":"info","logger":"HTTP.twirp","msg":"Test","status":200}`, lines[0])
+	assert.Equal(t, `{"level":"info","logger":"Other","msg":"Test","status":200,"extra":"x"}`,
+		lines[1])
+}
@@ -0,0 +1,287 @@
+package zaputils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const FileSinkScheme = "rotfile"
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// The file sink that writes the log lines into a file, rotating it when it
+// exceeds the size or gets too old. The rotated files are renamed to
+// <name>-<timestamp><ext>, and they are optionally gzipped.
+type rotatingFileSink struct {
+	mtx sync.Mutex
+
+	path        string
+	maxSize     int64         // Rotate the file when it's larger than that, 0 to disable
+	rotateEvery time.Duration // Rotate the file when it's older than that, 0 to disable
+	maxBackups  int           // Keep at most this many rotated files, 0 to keep all
+	maxAge      time.Duration // Delete the rotated files older than that, 0 to keep all
+	compress    bool
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	wg       sync.WaitGroup // Pending compressions
+	// The compression of a backup and the cleanup after another rotation must
+	// not overlap, the cleanup would see both the backup and its partial .gz
+	cleanupMtx sync.Mutex
+}
+
+// Create the sink from the URL: rotfile:///path/to/file.log?maxSize=100&
+// rotateEvery=24h&maxBackups=10&maxAge=168h&compress=true (maxSize is in MB)
+func newRotatingFileSink(u *url.URL) (*rotatingFileSink, error) {
+	if u.Path == "" {
+		return nil, fmt.Errorf("no file path in %s", u.String())
+	}
+	query := u.Query()
+	res := &rotatingFileSink{path: u.Path}
+
+	var err error
+	if val := query.Get("maxSize"); val != "" {
+		var mb int64
+		if mb, err = strconv.ParseInt(val, 10, 64); err != nil {
+			return nil, fmt.Errorf("bad maxSize: %w", err)
+		}
+		res.maxSize = mb * 1024 * 1024
+	}
+	if val := query.Get("rotateEvery"); val != "" {
+		if res.rotateEvery, err = time.ParseDuration(val); err != nil {
+			return nil, fmt.Errorf("bad rotateEvery: %w", err)
+		}
+	}
+	if val := query.Get("maxBackups"); val != "" {
+		if res.maxBackups, err = strconv.Atoi(val); err != nil {
+			return nil, fmt.Errorf("bad maxBackups: %w", err)
+		}
+	}
+	if val := query.Get("maxAge"); val != "" {
+		if res.maxAge, err = time.ParseDuration(val); err != nil {
+			return nil, fmt.Errorf("bad maxAge: %w", err)
+		}
+	}
+	if val := query.Get("compress"); val != "" {
+		if res.compress, err = strconv.ParseBool(val); err != nil {
+			return nil, fmt.Errorf("bad compress: %w", err)
+		}
+	}
+
+	res.mtx.Lock()
+	defer res.mtx.Unlock()
+	if err = res.open(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Make the sink URL for the zap.Config output paths
+func FileSinkURL(path string, maxSizeMb int, rotateEvery time.Duration, maxBackups int,
+	maxAge time.Duration, compress bool) string {
+
+	query := url.Values{}
+	if maxSizeMb != 0 {
+		query.Set("maxSize", strconv.Itoa(maxSizeMb))
+	}
+	if rotateEvery != 0 {
+		query.Set("rotateEvery", rotateEvery.String())
+	}
+	if maxBackups != 0 {
+		query.Set("maxBackups", strconv.Itoa(maxBackups))
+	}
+	if maxAge != 0 {
+		query.Set("maxAge", maxAge.String())
+	}
+	if compress {
+		query.Set("compress", "true")
+	}
+	// A relative path would be parsed as the host (rotfile://logs/app.log)
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	u := url.URL{Scheme: FileSinkScheme, Path: path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+func (r *rotatingFileSink) open() error {
+	err := os.MkdirAll(filepath.Dir(r.path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = info.Size()
+	r.openedAt = time.Now()
+	return nil
+}
+
+func (r *rotatingFileSink) Write(p []byte) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	needsRotation := r.size > 0 &&
+		((r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize) ||
+			(r.rotateEvery > 0 && time.Now().Sub(r.openedAt) >= r.rotateEvery))
+	if needsRotation {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFileSink) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+
+	ext := filepath.Ext(r.path)
+	backup := strings.TrimSuffix(r.path, ext) + "-" +
+		time.Now().Format(backupTimeFormat) + ext
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	// Compression and cleanup might be slow, don't block the logging
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.cleanupMtx.Lock()
+		defer r.cleanupMtx.Unlock()
+		if r.compress {
+			_ = compressFile(backup)
+		}
+		r.removeOldBackups()
+	}()
+	return nil
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (r *rotatingFileSink) removeOldBackups() {
+	if r.maxBackups <= 0 && r.maxAge <= 0 {
+		return
+	}
+
+	ext := filepath.Ext(r.path)
+	prefix := filepath.Base(strings.TrimSuffix(r.path, ext)) + "-"
+	entries, err := ioutil.ReadDir(filepath.Dir(r.path))
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		path string
+		time time.Time
+	}
+	var backups []backup
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimSuffix(name[len(prefix):], ".gz"), ext)
+		tm, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{filepath.Join(filepath.Dir(r.path), name), tm})
+	}
+	// Newest first
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+
+	for i, b := range backups {
+		if (r.maxBackups > 0 && i >= r.maxBackups) ||
+			(r.maxAge > 0 && time.Now().Sub(b.time) > r.maxAge) {
+			_ = os.Remove(b.path)
+		}
+	}
+}
+
+func (r *rotatingFileSink) Sync() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+func (r *rotatingFileSink) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.wg.Wait()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func registerFileSink() error {
+	return zap.RegisterSink(FileSinkScheme, func(u *url.URL) (zap.Sink, error) {
+		return newRotatingFileSink(u)
+	})
+}
@@ -0,0 +1,147 @@
+package zaputils
+
+import (
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeSink(t *testing.T, path string, maxSizeMb int, maxBackups int,
+	compress bool) *rotatingFileSink {
+
+	u, err := url.Parse(FileSinkURL(path, maxSizeMb, 0, maxBackups, 0, compress))
+	assert.NoError(t, err)
+	sink, err := newRotatingFileSink(u)
+	assert.NoError(t, err)
+	return sink
+}
+
+func listBackups(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	var res []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "app-") {
+			res = append(res, f.Name())
+		}
+	}
+	return res
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "logs", "app.log")
+	sink := makeSink(t, path, 1, 2, true)
+
+	line := strings.Repeat("a", 1023) + "\n"
+	for i := 0; i < 1024; i++ {
+		_, err = sink.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	// The file is full, the next write rotates it
+	assert.Empty(t, listBackups(t, filepath.Join(dir, "logs")))
+	_, err = sink.Write([]byte("next\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Close())
+
+	backups := listBackups(t, filepath.Join(dir, "logs"))
+	assert.Equal(t, 1, len(backups))
+	assert.True(t, strings.HasSuffix(backups[0], ".log.gz"))
+
+	cur, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "next\n", string(cur))
+
+	gzFile, err := os.Open(filepath.Join(dir, "logs", backups[0]))
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer gzFile.Close()
+	reader, err := gzip.NewReader(gzFile)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, 1024*1024, len(data))
+}
+
+func TestFileSinkMaxBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	sink := makeSink(t, path, 0, 2, false)
+	for i := 0; i < 4; i++ {
+		_, err = sink.Write([]byte("line\n"))
+		assert.NoError(t, err)
+		sink.mtx.Lock()
+		assert.NoError(t, sink.rotate())
+		sink.mtx.Unlock()
+		sink.wg.Wait()
+		// Make sure the backup names are distinct
+		time.Sleep(2 * time.Millisecond)
+	}
+	assert.NoError(t, sink.Close())
+
+	assert.Equal(t, 2, len(listBackups(t, dir)))
+}
+
+func TestFileSinkURL(t *testing.T) {
+	u, err := url.Parse(FileSinkURL("/var/log/app.log", 100, time.Hour,
+		5, 24*time.Hour, true))
+	assert.NoError(t, err)
+	assert.Equal(t, FileSinkScheme, u.Scheme)
+	assert.Equal(t, "/var/log/app.log", u.Path)
+	assert.Equal(t, "100", u.Query().Get("maxSize"))
+	assert.Equal(t, "1h0m0s", u.Query().Get("rotateEvery"))
+	assert.Equal(t, "true", u.Query().Get("compress"))
+
+	_, err = newRotatingFileSink(&url.URL{Scheme: FileSinkScheme,
+		Path: "/tmp/x.log", RawQuery: "maxSize=abc"})
+	assert.Error(t, err)
+
+	// The relative paths are resolved, and not parsed as the host
+	u, err = url.Parse(FileSinkURL("logs/app.log", 0, 0, 0, 0, false))
+	assert.NoError(t, err)
+	assert.Equal(t, "", u.Host)
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(wd, "logs/app.log"), u.Path)
+}
+
+func TestFileSinkCompressedBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer os.RemoveAll(dir)
+
+	// Rotate without waiting for the previous compressions
+	path := filepath.Join(dir, "app.log")
+	sink := makeSink(t, path, 0, 2, true)
+	for i := 0; i < 10; i++ {
+		_, err = sink.Write([]byte(strings.Repeat("line\n", 500000)))
+		assert.NoError(t, err)
+		sink.mtx.Lock()
+		assert.NoError(t, sink.rotate())
+		sink.mtx.Unlock()
+		// Make sure the backup names are distinct
+		time.Sleep(2 * time.Millisecond)
+	}
+	assert.NoError(t, sink.Close())
+
+	backups := listBackups(t, dir)
+	assert.Equal(t, 2, len(backups))
+	for _, b := range backups {
+		assert.True(t, strings.HasSuffix(b, ".gz"), b)
+	}
+}
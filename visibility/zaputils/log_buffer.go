@@ -0,0 +1,214 @@
+package zaputils
+
+import (
+	"encoding/json"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"sort"
+	"sync"
+)
+
+const DefaultLogBufferEntries = 1000
+const DefaultLogBufferBytes = 1024 * 1024
+
+type bufferedEntry struct {
+	core   zapcore.Core
+	entry  zapcore.Entry
+	fields []zapcore.Field
+	size   int
+}
+
+// The request-scoped log buffer. The Debug and Info entries written through the
+// wrapped logger are kept in memory, and they are either written to the real
+// core with their original timestamps if the request fails, or dropped otherwise.
+// The buffer is shared by all the loggers derived from the wrapped one, so it's
+// safe to use it from the goroutines spawned by the request handler.
+type RequestLogBuffer struct {
+	mtx        sync.Mutex
+	maxEntries int
+	maxBytes   int
+
+	entries []bufferedEntry
+	bytes   int
+	dropped int
+	done    bool
+}
+
+var _ visibility.RequestLogBuffer = &RequestLogBuffer{}
+
+// Create a new buffer, keeping at most maxEntries entries with the total
+// approximate size of maxBytes. The oldest entries are evicted first.
+func NewRequestLogBuffer(maxEntries, maxBytes int) *RequestLogBuffer {
+	if maxEntries <= 0 {
+		maxEntries = DefaultLogBufferEntries
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultLogBufferBytes
+	}
+	return &RequestLogBuffer{maxEntries: maxEntries, maxBytes: maxBytes}
+}
+
+// Make a factory for the middlewares (TracedGorilla and the Echo middleware)
+func RequestLogBufferFactory(maxEntries, maxBytes int) func() visibility.RequestLogBuffer {
+	return func() visibility.RequestLogBuffer {
+		return NewRequestLogBuffer(maxEntries, maxBytes)
+	}
+}
+
+// Buffer the entries below the Warn level
+func BufferLogs(buf *RequestLogBuffer) zap.Option {
+	return zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &bufferingCore{buf: buf, next: core}
+	})
+}
+
+func (b *RequestLogBuffer) Wrap(logger *zap.Logger) *zap.Logger {
+	return logger.WithOptions(BufferLogs(b))
+}
+
+// Flush the buffered entries if the request has failed, drop them otherwise.
+// The entries logged after this call are passed through to the real core.
+func (b *RequestLogBuffer) Finish(failed bool) {
+	b.mtx.Lock()
+	entries, dropped := b.entries, b.dropped
+	wasDone := b.done
+	b.entries = nil
+	b.bytes = 0
+	b.dropped = 0
+	b.done = true
+	b.mtx.Unlock()
+
+	if wasDone || !failed || len(entries) == 0 {
+		return
+	}
+
+	if dropped != 0 {
+		first := entries[0]
+		_ = first.core.Write(zapcore.Entry{
+			Level:      zapcore.WarnLevel,
+			Time:       first.entry.Time,
+			LoggerName: first.entry.LoggerName,
+			Message:    "Log buffer overflowed, the oldest entries were dropped",
+		}, []zapcore.Field{zap.Int("dropped_entries", dropped)})
+	}
+	for _, e := range entries {
+		_ = e.core.Write(e.entry, e.fields)
+	}
+}
+
+// Returns false if the entry was not buffered because the buffer is finished
+func (b *RequestLogBuffer) add(e bufferedEntry) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.done {
+		return false
+	}
+
+	b.entries = append(b.entries, e)
+	b.bytes += e.size
+	for len(b.entries) > 1 && (len(b.entries) > b.maxEntries || b.bytes > b.maxBytes) {
+		b.bytes -= b.entries[0].size
+		b.entries[0] = bufferedEntry{}
+		b.entries = b.entries[1:]
+		b.dropped++
+	}
+	return true
+}
+
+func (b *RequestLogBuffer) isDone() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.done
+}
+
+type bufferingCore struct {
+	buf  *RequestLogBuffer
+	next zapcore.Core
+}
+
+func isBuffered(level zapcore.Level) bool {
+	return level < zapcore.WarnLevel
+}
+
+func (c *bufferingCore) Enabled(level zapcore.Level) bool {
+	if isBuffered(level) && !c.buf.isDone() {
+		return true
+	}
+	return c.next.Enabled(level)
+}
+
+func (c *bufferingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &bufferingCore{buf: c.buf, next: c.next.With(fields)}
+}
+
+func (c *bufferingCore) Check(entry zapcore.Entry,
+	checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+
+	if isBuffered(entry.Level) && !c.buf.isDone() {
+		return checked.AddCore(entry, c)
+	}
+	return c.next.Check(entry, checked)
+}
+
+func (c *bufferingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	// The fields slice can be reused by the caller after Write returns, and the
+	// referenced objects can change before the flush, so snapshot them now
+	copied, size := snapshotFields(fields)
+	size += len(entry.Message) + len(entry.LoggerName)
+
+	if c.buf.add(bufferedEntry{core: c.next, entry: entry, fields: copied, size: size}) {
+		return nil
+	}
+
+	// The buffer is already finished, pass the entry through
+	if !c.next.Enabled(entry.Level) {
+		return nil
+	}
+	return c.next.Write(entry, fields)
+}
+
+func (c *bufferingCore) Sync() error {
+	return c.next.Sync()
+}
+
+// Copy the fields, encoding the ones referencing the objects (reflected values,
+// marshalers, errors) into JSON, and estimate the total size of the fields
+func snapshotFields(fields []zapcore.Field) ([]zapcore.Field, int) {
+	res := make([]zapcore.Field, 0, len(fields))
+	size := 0
+	for _, f := range fields {
+		switch f.Type {
+		case zapcore.ArrayMarshalerType, zapcore.ObjectMarshalerType, zapcore.ReflectType,
+			zapcore.StringerType, zapcore.ErrorType:
+			// Errors can expand into several keys (e.g. "errorVerbose")
+			enc := zapcore.NewMapObjectEncoder()
+			f.AddTo(enc)
+			keys := make([]string, 0, len(enc.Fields))
+			for k := range enc.Fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				data, err := json.Marshal(enc.Fields[k])
+				if err != nil {
+					res = append(res, zap.String(k+"Error", err.Error()))
+					size += len(k) + len(err.Error()) + 8
+					continue
+				}
+				res = append(res, zap.Reflect(k, json.RawMessage(data)))
+				size += len(k) + len(data) + 8
+			}
+		case zapcore.BinaryType, zapcore.ByteStringType:
+			data, _ := f.Interface.([]byte)
+			f.Interface = append([]byte(nil), data...)
+			res = append(res, f)
+			size += len(f.Key) + len(data) + 8
+		default:
+			res = append(res, f)
+			size += len(f.Key) + len(f.String) + 8
+		}
+	}
+	return res, size
+}
@@ -0,0 +1,112 @@
+package zaputils
+
+import (
+	"errors"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newInfoLogger() (*utils.MemorySink, *zap.Logger) {
+	sink := &utils.MemorySink{}
+	config := zap.NewProductionEncoderConfig()
+	config.TimeKey = ""
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(config), zapcore.Lock(sink), zap.InfoLevel)
+	return sink, zap.New(core)
+}
+
+func TestLogBufferDropsOnSuccess(t *testing.T) {
+	sink, logger := newInfoLogger()
+	buf := NewRequestLogBuffer(10, 0)
+	reqLogger := buf.Wrap(logger).With(zap.String("req", "1"))
+
+	reqLogger.Debug("Debug message")
+	reqLogger.Info("Info message")
+	reqLogger.Warn("Warn message")
+	assert.Equal(t, `{"level":"warn","msg":"Warn message","req":"1"}`+"\n", sink.String())
+
+	buf.Finish(false)
+	assert.Equal(t, 1, strings.Count(sink.String(), "\n"))
+
+	// Pass-through after the buffer is finished, respecting the real level
+	reqLogger.Debug("Late debug")
+	reqLogger.Info("Late info")
+	assert.False(t, strings.Contains(sink.String(), "Late debug"))
+	assert.True(t, strings.Contains(sink.String(), "Late info"))
+}
+
+func TestLogBufferFlushesOnFailure(t *testing.T) {
+	sink, logger := newInfoLogger()
+	buf := NewRequestLogBuffer(3, 0)
+	reqLogger := buf.Wrap(logger)
+
+	for i := 0; i < 5; i++ {
+		reqLogger.Debug("Debug message", zap.Int("i", i))
+	}
+	assert.Equal(t, "", sink.String())
+
+	buf.Finish(true)
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	assert.Equal(t, 4, len(lines))
+	assert.True(t, strings.Contains(lines[0], `"dropped_entries":2`))
+	assert.Equal(t, `{"level":"debug","msg":"Debug message","i":2}`, lines[1])
+	assert.Equal(t, `{"level":"debug","msg":"Debug message","i":4}`, lines[3])
+
+	// Finishing twice is a no-op
+	buf.Finish(true)
+	assert.Equal(t, 4, len(strings.Split(strings.TrimSpace(sink.String()), "\n")))
+}
+
+func TestLogBufferConcurrent(t *testing.T) {
+	sink, logger := newInfoLogger()
+	buf := NewRequestLogBuffer(0, 0)
+	reqLogger := buf.Wrap(logger)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				reqLogger.Info("Message", zap.Int("i", i), zap.Int("j", j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	buf.Finish(true)
+	assert.Equal(t, 100, strings.Count(sink.String(), "Message"))
+}
+
+func TestLogBufferSnapshotsObjects(t *testing.T) {
+	sink, logger := newInfoLogger()
+	buf := NewRequestLogBuffer(10, 200)
+	reqLogger := buf.Wrap(logger)
+
+	// The reflected values are encoded when buffered
+	data := map[string]string{"key": "before"}
+	reqLogger.Info("Reflected", zap.Reflect("data", data))
+	data["key"] = "after"
+
+	// The large reflected values count towards the size limit
+	reqLogger.Info("Large", zap.Reflect("big", []string{strings.Repeat("a", 150)}))
+
+	buf.Finish(true)
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.True(t, strings.Contains(lines[0], `"dropped_entries":1`))
+	assert.True(t, strings.Contains(lines[1], `"msg":"Large"`))
+
+	sink, logger = newInfoLogger()
+	buf = NewRequestLogBuffer(10, 0)
+	buf.Wrap(logger).Info("Reflected", zap.Reflect("data", data),
+		zap.Error(errors.New("failed")))
+	data["key"] = "changed"
+	buf.Finish(true)
+	assert.Equal(t, `{"level":"info","msg":"Reflected","data":{"key":"after"},`+
+		`"error":"failed"}`+"\n", sink.String())
+}
@@ -0,0 +1,54 @@
+package zaputils
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/kami-zh/go-capturer"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+)
+
+func TestPrettyErrorChain(t *testing.T) {
+	inner := visibility.WithStackErr(errors.New("disk is full"))
+	outer := visibility.WithStackErr(fmt.Errorf("failed to save: %w", inner))
+
+	out := capturer.CaptureStderr(func() {
+		devLogger := ConfigureDevLogger()
+		devLogger.Error("this is bad", visibility.ErrorChainField(outer),
+			zap.Int64("haha", 123))
+	})
+
+	// Both stacks are rendered, the outer one first. The line numbers are the
+	// lines of WithStackErr calls, might change during refactoring.
+	outerPos := strings.Index(out, "\nError: failed to save: disk is full\n")
+	outerStackPos := strings.Index(out,
+		"zaputils/pretty_error_chain_test.go:16 TestPrettyErrorChain\n")
+	innerPos := strings.Index(out, "\n--- Caused by: disk is full\n")
+	innerStackPos := strings.Index(out,
+		"zaputils/pretty_error_chain_test.go:15 TestPrettyErrorChain\n")
+	assert.True(t, outerPos > 0)
+	assert.True(t, outerStackPos > outerPos)
+	assert.True(t, innerPos > outerStackPos)
+	assert.True(t, innerStackPos > innerPos)
+
+	// The other fields are still printed
+	assert.True(t, strings.Contains(out, "\"haha\":123"))
+	assert.False(t, strings.Contains(out, "errorchain"))
+}
+
+func TestPrettyMultipleStacks(t *testing.T) {
+	out := capturer.CaptureStderr(func() {
+		devLogger := ConfigureDevLogger()
+		stack := visibility.NewShortenedStackTrace(2, false, "")
+		devLogger.Error("this is bad", stack.Field(),
+			zap.String("creation_stacktrace", "main.go:10 main\nfoo.go:20 foo"))
+	})
+
+	assert.True(t, strings.Contains(out,
+		"pretty_error_chain_test.go:45 TestPrettyMultipleStacks"))
+	assert.True(t, strings.Contains(out,
+		"\n--- creation_stacktrace:\n\tmain.go:10 main\n\tfoo.go:20 foo\n"))
+}
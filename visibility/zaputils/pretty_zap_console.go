@@ -7,6 +7,7 @@ import (
 	"github.com/cyberax/go-dd-service-base/visibility"
 	"go.uber.org/zap/buffer"
 	"go.uber.org/zap/zapcore"
+	"sort"
 	"strings"
 	"time"
 )
@@ -136,12 +137,19 @@ func (c *prettyConsoleEncoder) writeContext(line *buffer.Buffer, extra []zapcore
 	}
 
 	stack, hasStack := c.tryGetStack(fieldsData)
-	if !hasStack {
+	extraStacks, hasExtraStacks := c.tryGetExtraStacks(fieldsData)
+	if !hasStack && !hasExtraStacks {
 		return
 	}
 
 	// Remove the stack trace data
 	delete(fieldsData, "stacktrace")
+	delete(fieldsData, "errorchain")
+	for k := range fieldsData {
+		if strings.HasSuffix(k, "_stacktrace") {
+			delete(fieldsData, k)
+		}
+	}
 	// Format the rest of the fields
 	withoutStack, err := json.Marshal(fieldsData)
 	if err != nil {
@@ -153,6 +161,79 @@ func (c *prettyConsoleEncoder) writeContext(line *buffer.Buffer, extra []zapcore
 	if hasStack {
 		_, _ = line.Write([]byte(stack))
 	}
+	if hasExtraStacks {
+		_, _ = line.Write([]byte(extraStacks))
+	}
+}
+
+// Render the additional stacks: the fields named "<something>_stacktrace" and
+// the error chain (see visibility.ErrorChainField), each one as a separate
+// group of frames
+func (c *prettyConsoleEncoder) tryGetExtraStacks(
+	fieldsData map[string]interface{}) (string, bool) {
+
+	var keys []string
+	for k := range fieldsData {
+		if strings.HasSuffix(k, "_stacktrace") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	res := ""
+	for _, k := range keys {
+		frames, ok := formatFrames(fieldsData[k])
+		if ok {
+			res += fmt.Sprintf("\n--- %s:\n%s", k, frames)
+		}
+	}
+
+	chain, ok := fieldsData["errorchain"]
+	if ok {
+		var links []visibility.ErrorChainLink
+		data, err := json.Marshal(chain)
+		if err == nil {
+			err = json.Unmarshal(data, &links)
+		}
+		if err == nil {
+			for i, l := range links {
+				header := "Error"
+				if i > 0 {
+					header = "--- Caused by"
+				}
+				res += fmt.Sprintf("\n%s: %s\n", header, l.Msg)
+				for _, s := range l.Stack {
+					res += fmt.Sprintf("\t%s %s\n", s.Fl, s.Fn)
+				}
+			}
+		}
+	}
+
+	return res, res != ""
+}
+
+// Format the stack (a string or a list of StackElements) as tab-indented lines
+func formatFrames(stack interface{}) (string, bool) {
+	if stackStr, ok := stack.(string); ok {
+		stackStr = strings.TrimSpace(stackStr)
+		return "\t" + strings.Join(strings.Split(stackStr, "\n"), "\n\t") + "\n", true
+	}
+
+	data, err := json.Marshal(stack)
+	if err != nil {
+		return "", false
+	}
+	var elements []visibility.StackElement
+	err = json.Unmarshal(data, &elements)
+	if err != nil {
+		return "", false
+	}
+
+	res := ""
+	for _, s := range elements {
+		res += fmt.Sprintf("\t%s %s\n", s.Fl, s.Fn)
+	}
+	return res, true
 }
 
 func (c *prettyConsoleEncoder) tryGetStack(fieldsData map[string]interface{}) (string, bool) {
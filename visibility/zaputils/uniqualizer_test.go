@@ -0,0 +1,25 @@
+package zaputils
+
+import (
+	"context"
+	"github.com/cyberax/go-dd-service-base/visibility"
+	"github.com/kami-zh/go-capturer"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+)
+
+func TestImbueContextWithOverride(t *testing.T) {
+	out := capturer.CaptureStderr(func() {
+		ctx := visibility.ImbueContext(context.Background(), ConfigureDevLogger())
+		ctx = visibility.ImbueContextWith(ctx, zap.String("field1", "hello"),
+			zap.String("field2", "world"))
+		ctx = visibility.ImbueContextWith(ctx, zap.String("field1", "goodbye"))
+		visibility.CL(ctx).Info("Everything is OK")
+	})
+
+	// The repeated keys are deduplicated
+	assert.True(t, strings.Contains(out,
+		"Everything is OK\t{\"field2\":\"world\",\"field1\":\"goodbye\"}"))
+}
@@ -1,11 +1,14 @@
 package zaputils
 
 import (
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/cyberax/go-dd-service-base/visibility"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"net"
 	"net/url"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -22,6 +25,20 @@ type zapTcpSink struct {
 	conn            net.Conn
 	lastTimeChecked time.Time
 	discard         []byte
+
+	// The clock for the reconnect backoff, utils.RealClock if nil
+	clock utils.Clock
+}
+
+// Create the sink sending the log lines to the TCP address (like DD_TCP_SINK
+// does), the lines written without the connection are dropped. The reconnects
+// are tried at most every TcpSinkCheckSec by the clock, utils.RealClock if nil.
+func NewTcpSink(addr string, clock utils.Clock) zap.Sink {
+	sink := &zapTcpSink{addr: addr, clock: clock, discard: make([]byte, 1024)}
+	sink.mtx.Lock()
+	defer sink.mtx.Unlock()
+	sink.connect()
+	return sink
 }
 
 func (t *zapTcpSink) Write(p []byte) (int, error) {
@@ -55,8 +72,15 @@ func (t *zapTcpSink) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+func (t *zapTcpSink) now() time.Time {
+	if t.clock == nil {
+		return utils.RealClock.Now()
+	}
+	return t.clock.Now()
+}
+
 func (t *zapTcpSink) connect() {
-	if time.Now().Sub(t.lastTimeChecked).Seconds() < TcpSinkCheckSec {
+	if t.now().Sub(t.lastTimeChecked).Seconds() < TcpSinkCheckSec {
 		return
 	}
 
@@ -66,7 +90,7 @@ func (t *zapTcpSink) connect() {
 		t.conn = conn
 		return
 	} else {
-		t.lastTimeChecked = time.Now()
+		t.lastTimeChecked = t.now()
 	}
 }
 
@@ -102,6 +126,11 @@ func ConfigureZapGlobals() {
 		panic(err.Error())
 	}
 
+	err = registerFileSink()
+	if err != nil {
+		panic(err.Error())
+	}
+
 	err = zap.RegisterEncoder("prettyconsole",
 		func(config zapcore.EncoderConfig) (zapcore.Encoder, error) {
 			ce := NewPrettyConsoleEncoder(config)
@@ -131,11 +160,24 @@ func ConfigureDevLogger() *zap.Logger {
 }
 
 func ConfigureProdLogger() *zap.Logger {
+	return ConfigureProdLoggerWithLimits(FieldLimits{})
+}
+
+// Configure the production logger, truncating or dropping the fields according
+// to the limits
+func ConfigureProdLoggerWithLimits(limits FieldLimits) *zap.Logger {
 	ConfigureZapGlobals()
 
 	config := zap.NewProductionConfig()
+	config.InitialFields = visibility.GetBuildInfo().Map()
 	checkTcpSink(&config)
-	logger, err := config.Build(MakeFieldsUnique())
+	checkFileSink(&config)
+
+	opts := []zap.Option{MakeFieldsUnique()}
+	if !limits.isEmpty() {
+		opts = append(opts, LimitFields(limits))
+	}
+	logger, err := config.Build(opts...)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -149,3 +191,30 @@ func checkTcpSink(config *zap.Config) {
 		config.ErrorOutputPaths = []string{"tcp://" + tcpSink, "stderr"}
 	}
 }
+
+// Write the JSON log lines into the rotated file instead of stderr, if
+// DD_LOG_FILE is set. The rotation is configured by the optional variables:
+// DD_LOG_FILE_MAX_SIZE_MB, DD_LOG_FILE_ROTATE_EVERY (e.g. "24h"),
+// DD_LOG_FILE_MAX_BACKUPS, DD_LOG_FILE_MAX_AGE and DD_LOG_FILE_COMPRESS.
+func checkFileSink(config *zap.Config) {
+	path := os.Getenv("DD_LOG_FILE")
+	if path == "" {
+		return
+	}
+
+	maxSize, _ := strconv.Atoi(os.Getenv("DD_LOG_FILE_MAX_SIZE_MB"))
+	rotateEvery, _ := time.ParseDuration(os.Getenv("DD_LOG_FILE_ROTATE_EVERY"))
+	maxBackups, _ := strconv.Atoi(os.Getenv("DD_LOG_FILE_MAX_BACKUPS"))
+	maxAge, _ := time.ParseDuration(os.Getenv("DD_LOG_FILE_MAX_AGE"))
+	compress, _ := strconv.ParseBool(os.Getenv("DD_LOG_FILE_COMPRESS"))
+	sink := FileSinkURL(path, maxSize, rotateEvery, maxBackups, maxAge, compress)
+
+	// Replace stderr with the file, keeping the TCP sink if it's present
+	var outputs []string
+	for _, p := range config.OutputPaths {
+		if p != "stderr" {
+			outputs = append(outputs, p)
+		}
+	}
+	config.OutputPaths = append(outputs, sink)
+}
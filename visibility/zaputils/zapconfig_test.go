@@ -0,0 +1,44 @@
+package zaputils
+
+import (
+	"bufio"
+	"github.com/cyberax/go-dd-service-base/utils"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTcpSinkReconnectBackoff(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	clock := utils.NewFakeClock(time.Unix(1000, 0))
+	sink := NewTcpSink(addr, clock)
+	//noinspection GoUnhandledErrorResult
+	defer sink.Close()
+	_, err = sink.Write([]byte("lost\n"))
+	assert.NoError(t, err)
+
+	listener, err = net.Listen("tcp", addr)
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer listener.Close()
+
+	// Not reconnected until the check interval passes
+	_, _ = sink.Write([]byte("lost\n"))
+	assert.Nil(t, sink.(*zapTcpSink).conn)
+	clock.Advance(TcpSinkCheckSec * time.Second)
+	_, _ = sink.Write([]byte("sent\n"))
+	assert.NotNil(t, sink.(*zapTcpSink).conn)
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer conn.Close()
+	line, _, err := bufio.NewReader(conn).ReadLine()
+	assert.NoError(t, err)
+	assert.Equal(t, "sent", string(line))
+}